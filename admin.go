@@ -0,0 +1,419 @@
+package traefikgothauth
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gorilla/sessions"
+	"github.com/markbates/goth"
+	"github.com/markbates/goth/gothic"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	adminPath = "/__goth/admin/"
+	// sessionSeenInterval is how often the last activity of a session is written to the registry.
+	sessionSeenInterval = time.Minute
+)
+
+// AdminConfig keeps a server-side registry of the sessions, that the admins list and revoke at /__goth/admin/. Only
+// the registered sessions are valid, so enabling it logs out the users once.
+//
+// The page returns JSON with ?format=json, including a CSRF token for the POST requests (action=revoke with an id,
+// action=revoke-user with a provider and user, action=impersonate with an id, or action=stop-impersonation).
+//
+// While impersonating, the next handlers also receive the Impersonation-Stop claim: a link that stops the
+// impersonation with a GET request, for the banner that the apps must show to the admin.
+//
+// Revoking all the sessions of a user also deletes their API keys and rejects the device tokens issued to them until
+// then, so that a compromised account is locked out everywhere (until it logs in again).
+type AdminConfig struct {
+	// SessionsFile is the JSON file where the sessions are registered. It must be writable and persistent.
+	SessionsFile string
+	// Admins (optional) are the users allowed to manage the sessions, as "provider:userID" (e.g. "github:1234567").
+	Admins []string
+	// AdminClaims (optional) also makes admins the users whose claims match all these regular expressions, e.g.
+	// {"groups": "(^|,)support(,|$)"}. Lists are matched as comma-separated values.
+	AdminClaims map[string]string
+	// Impersonation (optional) lets the admins see the apps as the user of a registered session. The next handlers
+	// receive the claims of that user, and the admin in the Impersonator claim.
+	Impersonation bool
+	// ImpersonationTTL (optional) ends the impersonations after this long, e.g. "1h" (default).
+	ImpersonationTTL string
+	adminClaims      map[string]*regexp.Regexp
+	impersonationTTL time.Duration
+	registry         *sessionRegistry
+	apiKeys          *APIKeysConfig
+	csrfKey          []byte
+}
+
+// registeredSession is a login known to the registry.
+type registeredSession struct {
+	ID        string
+	Provider  string
+	UserID    string
+	User      string
+	Host      string
+	IP        string
+	UserAgent string
+	Claims    map[string]interface{}
+	Created   time.Time
+	LastSeen  time.Time
+}
+
+// sessionsData is the content of the sessions file.
+type sessionsData struct {
+	Sessions []*registeredSession
+	// RevokedUsers are the times when all the sessions of the users ("provider:userID") were revoked, to reject
+	// the device tokens issued before.
+	RevokedUsers map[string]time.Time `json:",omitempty"`
+}
+
+// sessionRegistry links the session cookies to the registered sessions, by the key of their login (the provider, or
+// the SSO key of the provider).
+type sessionRegistry struct {
+	store *fileStore
+	// retention is how long inactive sessions are kept, as their cookies should have expired.
+	retention time.Duration
+}
+
+func (c *AdminConfig) setup(cookieSecret string, cookieOptions *sessions.Options, apiKeys *APIKeysConfig) error {
+	var errs []error
+	if c.SessionsFile == "" {
+		errs = append(errs, errors.New("admin: SessionsFile is required"))
+	}
+	if len(c.Admins) == 0 && len(c.AdminClaims) == 0 {
+		errs = append(errs, errors.New("admin: Admins or AdminClaims is required"))
+	}
+	for _, admin := range c.Admins {
+		if provider, userID, ok := strings.Cut(admin, ":"); !ok || provider == "" || userID == "" {
+			errs = append(errs, fmt.Errorf("admin: admins must be provider:userID, got %q", admin))
+		}
+	}
+	c.adminClaims = make(map[string]*regexp.Regexp, len(c.AdminClaims))
+	for claim, expr := range c.AdminClaims {
+		regex, err := regexp.Compile(expr)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("admin: invalid regular expression for claim %s: %w", claim, err))
+			continue
+		}
+		c.adminClaims[claim] = regex
+	}
+	var err error
+	if c.impersonationTTL, err = parseDurationDefault(c.ImpersonationTTL, time.Hour); err != nil {
+		errs = append(errs, fmt.Errorf("admin: failed to parse ImpersonationTTL: %w", err))
+	}
+	if cookieSecret == "" {
+		errs = append(errs, errors.New("admin: CookieSecret is required, as it signs the admin forms"))
+	}
+	c.registry = &sessionRegistry{store: newFileStore(c.SessionsFile), retention: 30 * 24 * time.Hour}
+	if cookieOptions.MaxAge > 0 {
+		c.registry.retention = time.Duration(cookieOptions.MaxAge) * time.Second
+	}
+	c.apiKeys = apiKeys
+	c.csrfKey = signingKey(cookieSecret, "admin")
+	return errors.Join(errs...)
+}
+
+// register creates the session of a new login, and links the session cookie of the request to it. The cookie is
+// saved with the login time, by recordAuthTime.
+func (r *sessionRegistry) register(req *http.Request, key, providerName string, auth *goth.User) error {
+	now := time.Now().UTC()
+	registered := &registeredSession{
+		ID:        randomString(16),
+		Provider:  providerName,
+		UserID:    auth.UserID,
+		User:      auth.Email,
+		Host:      req.Host,
+		IP:        clientIP(req),
+		UserAgent: req.UserAgent(),
+		Claims:    auth.RawData,
+		Created:   now,
+		LastSeen:  now,
+	}
+	if registered.User == "" {
+		registered.User = auth.Name
+	}
+	data := &sessionsData{}
+	err := r.store.update(data, func() error {
+		kept := data.Sessions[:0]
+		for _, other := range data.Sessions {
+			if now.Sub(other.LastSeen) <= r.retention {
+				kept = append(kept, other)
+			}
+		}
+		data.Sessions = append(kept, registered)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	session, _ := gothic.Store.Get(req, authTimeSessionName)
+	session.Values["session:"+key] = auth.UserID + "\x00" + registered.ID
+	return nil
+}
+
+// sessionID returns the ID of the registered session of the user in the request, if any.
+func (r *sessionRegistry) sessionID(req *http.Request, key, userID string) string {
+	session, _ := gothic.Store.Get(req, authTimeSessionName)
+	value, _ := session.Values["session:"+key].(string)
+	recordedUserID, id, ok := strings.Cut(value, "\x00")
+	if !ok || recordedUserID != userID {
+		return ""
+	}
+	return id
+}
+
+// active returns true if the session of the request is registered and was not revoked, recording the activity.
+func (r *sessionRegistry) active(req *http.Request, key, userID string) bool {
+	id := r.sessionID(req, key, userID)
+	if id == "" {
+		logi("Session not registered", "request", requestID(req), "session", key, "user", userID)
+		audit(req, auditSessionExpired, key, userID, "not registered")
+		return false
+	}
+	snapshot, err := r.store.snapshot(func() interface{} { return &sessionsData{} })
+	if err != nil {
+		loge("Failed to read the sessions", "request", requestID(req), "error", err)
+		return false
+	}
+	for _, registered := range snapshot.(*sessionsData).Sessions {
+		if registered.ID != id || registered.UserID != userID {
+			continue
+		}
+		if time.Since(registered.LastSeen) > sessionSeenInterval {
+			data := &sessionsData{}
+			err := r.store.update(data, func() error {
+				for _, other := range data.Sessions {
+					if other.ID == id {
+						other.LastSeen = time.Now().UTC()
+						other.IP = clientIP(req)
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				logw("Could not record the session activity", "request", requestID(req), "error", err)
+			}
+		}
+		return true
+	}
+	logi("Session revoked", "request", requestID(req), "session", key, "user", userID)
+	audit(req, auditSessionExpired, key, userID, "revoked")
+	return false
+}
+
+// end removes the session of the request from the registry, when the user logs out.
+func (r *sessionRegistry) end(req *http.Request, key string) {
+	session, _ := gothic.Store.Get(req, authTimeSessionName)
+	value, _ := session.Values["session:"+key].(string)
+	_, id, ok := strings.Cut(value, "\x00")
+	if !ok {
+		return
+	}
+	if _, err := r.revoke(func(registered *registeredSession) bool { return registered.ID == id }); err != nil {
+		logw("Could not remove the session", "request", requestID(req), "error", err)
+	}
+}
+
+// revokedSince returns true if all the sessions of the user were revoked after the given time.
+func (r *sessionRegistry) revokedSince(providerName, userID string, since time.Time) (bool, error) {
+	snapshot, err := r.store.snapshot(func() interface{} { return &sessionsData{} })
+	if err != nil {
+		return false, err
+	}
+	revoked, ok := snapshot.(*sessionsData).RevokedUsers[providerName+":"+userID]
+	return ok && revoked.After(since), nil
+}
+
+// revokeUser removes all the sessions of the user and records the revocation, returning how many were removed.
+func (r *sessionRegistry) revokeUser(providerName, userID string) (int, error) {
+	data := &sessionsData{}
+	revoked := 0
+	err := r.store.update(data, func() error {
+		kept := data.Sessions[:0]
+		for _, registered := range data.Sessions {
+			if registered.Provider == providerName && registered.UserID == userID {
+				revoked++
+			} else {
+				kept = append(kept, registered)
+			}
+		}
+		data.Sessions = kept
+		if data.RevokedUsers == nil {
+			data.RevokedUsers = map[string]time.Time{}
+		}
+		data.RevokedUsers[providerName+":"+userID] = time.Now().UTC()
+		return nil
+	})
+	return revoked, err
+}
+
+// revoke removes the matching sessions, returning how many were removed.
+func (r *sessionRegistry) revoke(matches func(*registeredSession) bool) (int, error) {
+	data := &sessionsData{}
+	revoked := 0
+	err := r.store.update(data, func() error {
+		kept := data.Sessions[:0]
+		for _, registered := range data.Sessions {
+			if matches(registered) {
+				revoked++
+			} else {
+				kept = append(kept, registered)
+			}
+		}
+		data.Sessions = kept
+		return nil
+	})
+	return revoked, err
+}
+
+// isAdmin returns true if the user may manage the sessions.
+func (c *AdminConfig) isAdmin(providerName string, auth *goth.User) bool {
+	for _, admin := range c.Admins {
+		if admin == providerName+":"+auth.UserID {
+			return true
+		}
+	}
+	if len(c.adminClaims) == 0 {
+		return false
+	}
+	for claim, regex := range c.adminClaims {
+		value, ok := auth.RawData[claim]
+		if !ok || !regex.MatchString(claimString(value)) {
+			return false
+		}
+	}
+	return true
+}
+
+// claimString formats a claim as a string, with lists as comma-separated values.
+func claimString(value interface{}) string {
+	if list, ok := value.([]interface{}); ok {
+		values := make([]string, 0, len(list))
+		for _, item := range list {
+			values = append(values, fmt.Sprint(item))
+		}
+		return strings.Join(values, ",")
+	}
+	if list, ok := value.([]string); ok {
+		return strings.Join(list, ",")
+	}
+	return fmt.Sprint(value)
+}
+
+// serveAdmin serves the sessions page to the admins, returning true if it handled the request.
+func (c *AdminConfig) serveAdmin(rw http.ResponseWriter, req *http.Request, providerName string, auth *goth.User) bool {
+	if req.URL.Path != adminPath {
+		return false
+	}
+	if !c.isAdmin(providerName, auth) {
+		logw("Admin access denied", "request", requestID(req), "provider", providerName, "user", auth.UserID, "remote", req.RemoteAddr)
+		audit(req, auditDenied, providerName, auth.UserID, "not an admin")
+		http.Error(rw, "Forbidden", http.StatusForbidden)
+		return true
+	}
+	admin := providerName + ":" + auth.UserID
+	page := &adminPage{Title: "Sessions", Impersonation: c.Impersonation, Impersonating: c.impersonating(req, admin)}
+	status := http.StatusOK
+	if req.Method == http.MethodPost {
+		var expected string
+		_ = req.ParseForm()
+		if err := verifyToken(c.csrfKey, "admin", req.PostForm.Get("csrf"), &expected); err != nil || expected != admin {
+			page.Error, status = "Your session expired, please try again", http.StatusBadRequest
+		} else if page.Message, page.Error = c.handleAction(rw, req, admin, page); page.Error != "" {
+			status = http.StatusBadRequest
+		}
+	} else if req.URL.Query().Get("action") == "stop-impersonation" {
+		var expected string
+		if err := verifyToken(c.csrfKey, "stop-impersonation", req.URL.Query().Get("csrf"), &expected); err != nil || expected != admin {
+			page.Error, status = "Your session expired, please try again", http.StatusBadRequest
+		} else if page.Message, page.Error = c.stopImpersonation(rw, req, admin, page); page.Error != "" {
+			status = http.StatusBadRequest
+		}
+	}
+	data := &sessionsData{}
+	if err := c.registry.store.read(data); err != nil {
+		loge("Failed to read the sessions", "request", requestID(req), "error", err)
+		http.Error(rw, "Failed to read the sessions", http.StatusInternalServerError)
+		return true
+	}
+	for _, registered := range data.Sessions {
+		if time.Since(registered.LastSeen) <= c.registry.retention {
+			page.Sessions = append(page.Sessions, registered)
+		}
+	}
+	sort.Slice(page.Sessions, func(i, j int) bool { return page.Sessions[i].LastSeen.After(page.Sessions[j].LastSeen) })
+	csrf, err := signToken(c.csrfKey, "admin", time.Hour, admin)
+	if err != nil {
+		loge("Failed to sign admin form", "request", requestID(req), "error", err)
+		http.Error(rw, "Failed to serve the page", http.StatusInternalServerError)
+		return true
+	}
+	page.CSRF = csrf
+	if req.URL.Query().Get("format") == "json" {
+		serveJSON(rw, status, page)
+		return true
+	}
+	servePage(rw, status, adminHtml, page)
+	return true
+}
+
+// handleAction revokes sessions or impersonates users, returning the message or the error to show to the admin.
+func (c *AdminConfig) handleAction(rw http.ResponseWriter, req *http.Request, admin string, page *adminPage) (string, string) {
+	switch req.PostForm.Get("action") {
+	case "impersonate":
+		return c.startImpersonation(rw, req, admin, page)
+	case "stop-impersonation":
+		return c.stopImpersonation(rw, req, admin, page)
+	case "revoke":
+		id := req.PostForm.Get("id")
+		revoked, err := c.registry.revoke(func(registered *registeredSession) bool { return registered.ID == id })
+		if err != nil {
+			loge("Failed to revoke sessions", "request", requestID(req), "error", err)
+			return "", "Failed to revoke the sessions"
+		}
+		if revoked == 0 {
+			return "", "Session not found"
+		}
+		logi("Session revoked by admin", "request", requestID(req), "admin", admin, "id", id)
+		return "1 session revoked.", ""
+	case "revoke-user":
+		provider, userID := req.PostForm.Get("provider"), req.PostForm.Get("user")
+		if provider == "" || userID == "" {
+			return "", "Invalid user"
+		}
+		revoked, err := c.registry.revokeUser(provider, userID)
+		if err != nil {
+			loge("Failed to revoke sessions", "request", requestID(req), "error", err)
+			return "", "Failed to revoke the sessions"
+		}
+		keys := 0
+		if c.apiKeys != nil {
+			if keys, err = c.apiKeys.revokeUser(provider, userID); err != nil {
+				loge("Failed to revoke API keys", "request", requestID(req), "error", err)
+				return "", "Failed to revoke the API keys"
+			}
+		}
+		logi("User revoked by admin", "request", requestID(req), "admin", admin, "provider", provider, "user", userID, "sessions", revoked, "keys", keys)
+		return fmt.Sprintf("%d session(s) and %d API key(s) revoked, device tokens rejected.", revoked, keys), ""
+	default:
+		return "", "Invalid action"
+	}
+}
+
+// adminPage is the data of adminHtml, also served as JSON.
+type adminPage struct {
+	Title         string               `json:"-"`
+	Error         string               `json:"error,omitempty"`
+	Message       string               `json:"message,omitempty"`
+	CSRF          string               `json:"csrf"`
+	Impersonation bool                 `json:"-"`
+	Impersonating *impersonation       `json:"impersonating,omitempty"`
+	Sessions      []*registeredSession `json:"sessions"`
+}
+
+var adminHtml = newPageTemplate("adminTemplate", `{{if .Error}}<div class="login-box-error">{{.Error}}</div>{{end}} {{if .Message}}<div class="login-box-message">{{.Message}}</div>{{end}} {{with .Impersonating}}<form class="login-box-message" method="post" action="`+adminPath+`">Impersonating <b>{{.User}} ({{.UserID}})</b> until {{.Expires.Format "15:04"}} <input type="hidden" name="csrf" value="{{$.CSRF}}"><button class="btn" type="submit" name="action" value="stop-impersonation">Stop impersonating</button></form>{{end}} {{if .Sessions}}<table class="login-box-table"><tr><th>User</th><th>Provider</th><th>Host</th><th>IP</th><th>User agent</th><th>Created</th><th>Last seen</th><th></th></tr>{{range .Sessions}}<tr><td>{{.User}} ({{.UserID}})</td><td>{{.Provider}}</td><td>{{.Host}}</td><td>{{.IP}}</td><td>{{.UserAgent}}</td><td>{{.Created.Format "2006-01-02 15:04"}}</td><td>{{.LastSeen.Format "2006-01-02 15:04"}}</td><td><form method="post" action="`+adminPath+`"><input type="hidden" name="csrf" value="{{$.CSRF}}"><input type="hidden" name="id" value="{{.ID}}"><input type="hidden" name="provider" value="{{.Provider}}"><input type="hidden" name="user" value="{{.UserID}}"><button class="btn" type="submit" name="action" value="revoke">Revoke</button><button class="btn" type="submit" name="action" value="revoke-user">Revoke all of the user</button>{{if $.Impersonation}}<button class="btn" type="submit" name="action" value="impersonate">Impersonate</button>{{end}}</form></td></tr>{{end}}</table>{{else}}<div class="login-box-message">No active sessions</div>{{end}}`)
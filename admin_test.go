@@ -0,0 +1,272 @@
+package traefikgothauth
+
+import (
+	"context"
+	"encoding/json"
+	"golang.org/x/crypto/bcrypt"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAdminSessions(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var handler http.Handler
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		handler.ServeHTTP(rw, req)
+	}))
+	defer server.Close()
+	cfg := CreateConfig()
+	cfg.CookieSecret = "secret-for-testing-only"
+	cfg.Admin = &AdminConfig{SessionsFile: filepath.Join(t.TempDir(), "sessions.json"), Admins: []string{"local:alice"}}
+	cfg.APIKeys = &APIKeysConfig{StoreFile: filepath.Join(t.TempDir(), "keys.json")}
+	cfg.DeviceFlow = &DeviceFlowConfig{}
+	cfg.Providers = []*ProviderConfig{{
+		Name:        "local",
+		RedirectURI: server.URL + "/__goth/local/",
+		Custom:      map[string]interface{}{"users": map[string]interface{}{"alice": string(hash), "bob": string(hash)}},
+	}}
+	handler, err = New(context.Background(), http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_, _ = rw.Write([]byte("hello " + req.Header.Get("X-Auth-User-Id")))
+	}), cfg, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	read := func(res *http.Response, err error) (*http.Response, string) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(res.Body)
+		_ = res.Body.Close()
+		return res, string(body)
+	}
+	login := func(user string) *http.Client {
+		jar, _ := cookiejar.New(nil)
+		browser := &http.Client{Jar: jar}
+		res, _ := read(browser.Get(server.URL + "/?provider=local"))
+		if _, body := read(browser.PostForm(res.Request.URL.String(), url.Values{
+			"state": {res.Request.URL.Query().Get("state")}, "username": {user}, "password": {"hunter2"},
+		})); body != "hello "+user {
+			t.Fatalf("expected %s to log in, got %s", user, body)
+		}
+		return browser
+	}
+	admin, bobLaptop, bobPhone := login("alice"), login("bob"), login("bob")
+
+	// Only admins can see the sessions
+	if res, _ := read(bobLaptop.Get(server.URL + adminPath)); res.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected other users to be forbidden, got %d", res.StatusCode)
+	}
+	listing := &adminPage{}
+	if _, body := read(admin.Get(server.URL + adminPath + "?format=json")); json.Unmarshal([]byte(body), listing) != nil || len(listing.Sessions) != 3 {
+		t.Fatalf("expected the three sessions, got %s", body)
+	}
+	var bobSession *registeredSession
+	for _, registered := range listing.Sessions {
+		if registered.UserID == "bob" {
+			bobSession = registered
+		}
+	}
+	if bobSession.Provider != "local" || bobSession.IP != "127.0.0.1" || !strings.HasPrefix(bobSession.UserAgent, "Go-http-client") {
+		t.Fatalf("expected the details of the session, got %+v", bobSession)
+	}
+
+	// Revoke a session, then all the sessions of the user
+	revoke := func(form url.Values) {
+		form.Set("csrf", listing.CSRF)
+		if res, body := read(admin.PostForm(server.URL+adminPath, form)); res.StatusCode != http.StatusOK {
+			t.Fatalf("expected the sessions to be revoked, got %d: %s", res.StatusCode, body)
+		}
+	}
+	revoke(url.Values{"action": {"revoke"}, "id": {bobSession.ID}})
+	laptop, _ := read(bobLaptop.Get(server.URL + "/"))
+	phone, _ := read(bobPhone.Get(server.URL + "/"))
+	if (laptop.Request.URL.Path == "/") == (phone.Request.URL.Path == "/") {
+		t.Fatalf("expected only one session of the user to be revoked, got %s and %s", laptop.Request.URL, phone.Request.URL)
+	}
+	bobKey := &apiKey{ID: "bobkey", Hash: hashAPIKeySecret("secret"), Provider: "local", UserID: "bob", Claims: map[string]interface{}{"user-id": "bob"}}
+	keys := &apiKeysData{}
+	if err = cfg.APIKeys.store.update(keys, func() error { keys.Keys = append(keys.Keys, bobKey); return nil }); err != nil {
+		t.Fatal(err)
+	}
+	bobToken, err := signToken(cfg.DeviceFlow.tokenKey, "device-token", time.Hour, &deviceGrant{
+		Provider: "local", Claims: map[string]interface{}{"user-id": "bob"}, Issued: time.Now().Add(-time.Second),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bearer := func(header, value string) *http.Response {
+		req, _ := http.NewRequest(http.MethodGet, server.URL+"/", nil)
+		req.Header.Set(header, value)
+		res, _ := read(http.DefaultClient.Do(req))
+		return res
+	}
+	if bearer("X-Api-Key", apiKeysPrefix+"bobkey_secret").StatusCode != http.StatusOK || bearer("Authorization", "Bearer "+deviceTokenPrefix+bobToken).StatusCode != http.StatusOK {
+		t.Fatalf("expected the API key and the device token of the user to be accepted")
+	}
+	revoke(url.Values{"action": {"revoke-user"}, "provider": {"local"}, "user": {"bob"}})
+	if res, _ := read(bobPhone.Get(server.URL + "/")); res.Request.URL.Path == "/" {
+		t.Fatalf("expected every session of the user to be revoked")
+	}
+	if res := bearer("X-Api-Key", apiKeysPrefix+"bobkey_secret"); res.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected the API keys of the user to be revoked, got %d", res.StatusCode)
+	}
+	if res := bearer("Authorization", "Bearer "+deviceTokenPrefix+bobToken); res.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected the device tokens of the user to be revoked, got %d", res.StatusCode)
+	}
+	if _, body := read(admin.Get(server.URL + "/")); body != "hello alice" {
+		t.Fatalf("expected other users to keep their sessions, got %s", body)
+	}
+	if res, _ := read(admin.PostForm(server.URL+adminPath, url.Values{"action": {"revoke-user"}, "provider": {"local"}, "user": {"alice"}})); res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected a request without CSRF token to be rejected, got %d", res.StatusCode)
+	}
+}
+
+func TestAdminImpersonation(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var handler http.Handler
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		handler.ServeHTTP(rw, req)
+	}))
+	defer server.Close()
+	cfg := CreateConfig()
+	cfg.CookieSecret = "secret-for-testing-only"
+	cfg.Admin = &AdminConfig{
+		SessionsFile:  filepath.Join(t.TempDir(), "sessions.json"),
+		AdminClaims:   map[string]string{"user-id": "^alice$"},
+		Impersonation: true,
+	}
+	auditFile := filepath.Join(t.TempDir(), "audit.log")
+	cfg.Audit = &AuditConfig{File: auditFile}
+	cfg.Routes = []*RouteRule{{PathPrefixes: []string{"/local-only/"}, Providers: []string{"local"}}}
+	cfg.Providers = []*ProviderConfig{{
+		Name:        "local",
+		RedirectURI: server.URL + "/__goth/local/",
+		Custom:      map[string]interface{}{"users": map[string]interface{}{"alice": string(hash), "bob": string(hash)}},
+	}, {Name: "github", ClientKey: "key", Secret: "secret", RedirectURI: server.URL + "/__goth/github/"}}
+	var stopURL string
+	handler, err = New(context.Background(), http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		stopURL = req.Header.Get("X-Auth-Impersonation-Stop")
+		_, _ = rw.Write([]byte("hello " + req.Header.Get("X-Auth-User-Id") + " " + req.Header.Get("X-Auth-Impersonator")))
+	}), cfg, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { auditCurrent = nil }()
+	read := func(res *http.Response, err error) (*http.Response, string) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(res.Body)
+		_ = res.Body.Close()
+		return res, string(body)
+	}
+	login := func(user string) *http.Client {
+		jar, _ := cookiejar.New(nil)
+		browser := &http.Client{Jar: jar}
+		res, _ := read(browser.Get(server.URL + "/?provider=local"))
+		if _, body := read(browser.PostForm(res.Request.URL.String(), url.Values{
+			"state": {res.Request.URL.Query().Get("state")}, "username": {user}, "password": {"hunter2"},
+		})); body != "hello "+user+" " {
+			t.Fatalf("expected %s to log in, got %s", user, body)
+		}
+		return browser
+	}
+	admin, bob := login("alice"), login("bob")
+
+	// Clients cannot claim to be impersonated
+	req, _ := http.NewRequest(http.MethodGet, server.URL+"/", nil)
+	req.Header.Set("X-Auth-Impersonator", "local:alice")
+	if _, body := read(bob.Do(req)); body != "hello bob " {
+		t.Fatalf("expected the impersonator header of the client to be removed, got %s", body)
+	}
+
+	// The admin sees the apps as the user until they stop
+	listing := &adminPage{}
+	if _, body := read(admin.Get(server.URL + adminPath + "?format=json")); json.Unmarshal([]byte(body), listing) != nil {
+		t.Fatalf("expected the sessions, got %s", body)
+	}
+	var bobSessionID string
+	for _, registered := range listing.Sessions {
+		if registered.UserID == "bob" {
+			bobSessionID = registered.ID
+		}
+	}
+	action := func(form url.Values) (*http.Response, string) {
+		form.Set("csrf", listing.CSRF)
+		return read(admin.PostForm(server.URL+adminPath, form))
+	}
+	if res, body := action(url.Values{"action": {"impersonate"}, "id": {bobSessionID}}); res.StatusCode != http.StatusOK || !strings.Contains(body, "Stop impersonating") {
+		t.Fatalf("expected the impersonation to start, got %d: %s", res.StatusCode, body)
+	}
+	if _, body := read(admin.Get(server.URL + "/")); body != "hello bob local:alice" {
+		t.Fatalf("expected the claims of the user and the impersonator, got %s", body)
+	}
+	if _, body := read(admin.Get(server.URL + adminPath)); !strings.Contains(body, "Stop impersonating") {
+		t.Fatalf("expected the admin page to remain available while impersonating: %s", body)
+	}
+	if res, _ := action(url.Values{"action": {"stop-impersonation"}}); res.StatusCode != http.StatusOK {
+		t.Fatalf("expected the impersonation to stop, got %d", res.StatusCode)
+	}
+	if _, body := read(admin.Get(server.URL + "/")); body != "hello alice " || stopURL != "" {
+		t.Fatalf("expected the admin to be themselves again, got %s", body)
+	}
+	events, _ := os.ReadFile(auditFile)
+	for _, event := range []string{auditImpersonationStart, auditImpersonationStop} {
+		if !strings.Contains(string(events), `"event":"`+event+`","provider":"local","user":"bob","admin":"local:alice","reason":"`) {
+			t.Fatalf("expected the %s event for the impersonated user by the admin: %s", event, events)
+		}
+	}
+
+	// The apps can link to the stop URL from their banner
+	action(url.Values{"action": {"impersonate"}, "id": {bobSessionID}})
+	read(admin.Get(server.URL + "/"))
+	if !strings.HasPrefix(stopURL, adminPath+"?") {
+		t.Fatalf("expected the stop link, got %q", stopURL)
+	}
+	if res, _ := read(admin.Get(server.URL + adminPath + "?action=stop-impersonation&csrf=" + listing.CSRF)); res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected the stop link to require its own token, got %d", res.StatusCode)
+	}
+	if res, body := read(admin.Get(server.URL + stopURL)); res.StatusCode != http.StatusOK || !strings.Contains(body, "You stopped impersonating") {
+		t.Fatalf("expected the stop link to end the impersonation, got %d: %s", res.StatusCode, body)
+	}
+	if _, body := read(admin.Get(server.URL + "/")); body != "hello alice " {
+		t.Fatalf("expected the admin to be themselves again, got %s", body)
+	}
+
+	// Impersonated users are only accepted by the routes of their provider
+	data := &sessionsData{}
+	if err = cfg.Admin.registry.store.update(data, func() error {
+		for _, registered := range data.Sessions {
+			if registered.ID == bobSessionID {
+				registered.Provider = "github"
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	action(url.Values{"action": {"impersonate"}, "id": {bobSessionID}})
+	if res, _ := read(admin.Get(server.URL + "/local-only/")); res.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected the route to reject the impersonated provider, got %d", res.StatusCode)
+	}
+	if _, body := read(admin.Get(server.URL + "/")); body != "hello bob local:alice" {
+		t.Fatalf("expected the other routes to accept the impersonated user, got %s", body)
+	}
+	if res, _ := read(bob.Get(server.URL + adminPath)); res.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected users that do not match the admin claims to be forbidden, got %d", res.StatusCode)
+	}
+}
@@ -0,0 +1,316 @@
+package traefikgothauth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/markbates/goth"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	apiKeysPath   = "/__goth/keys/"
+	apiKeysPrefix = "gothkey_"
+)
+
+// APIKeysConfig lets the authenticated users create personal API keys at /__goth/keys/, for scripts and CI jobs. A
+// request that presents a key is authenticated with the claims of its owner at creation time, without any redirect.
+//
+// Keys are sent as "Authorization: Bearer gothkey_..." or in the configured Header.
+type APIKeysConfig struct {
+	// StoreFile is the JSON file where the (hashed) keys are kept. It must be writable and persistent.
+	StoreFile string
+	// Header (optional) is an alternative header that contains the key. Defaults to "X-Api-Key".
+	Header string
+	// MaxTTL (optional) is the longest lifetime of a key, e.g. "2160h". Defaults to keys that may never expire.
+	MaxTTL string
+	// Scopes (optional) are the scopes that users may assign to their keys, published as the comma-separated
+	// api-key-scopes claim so that the next handlers can restrict what each key is allowed to do.
+	Scopes []string
+	// MaxKeys (optional) is the maximum number of keys per user. Defaults to 20.
+	MaxKeys int
+	maxTTL  time.Duration
+	store   *fileStore
+	csrfKey []byte
+}
+
+// apiKey is a stored key. Only the hash of its secret is stored.
+type apiKey struct {
+	ID       string
+	Hash     string
+	Name     string
+	Provider string
+	UserID   string
+	Scopes   []string
+	Claims   map[string]interface{}
+	Created  time.Time
+	Expires  time.Time
+}
+
+// apiKeysData is the content of the store file.
+type apiKeysData struct {
+	Keys []*apiKey
+}
+
+// apiKeyTTLs are the lifetimes offered when creating a key.
+var apiKeyTTLs = []struct {
+	Label string
+	TTL   time.Duration
+}{
+	{"7 days", 7 * 24 * time.Hour},
+	{"30 days", 30 * 24 * time.Hour},
+	{"90 days", 90 * 24 * time.Hour},
+	{"1 year", 365 * 24 * time.Hour},
+	{"Never", 0},
+}
+
+func (c *APIKeysConfig) setup(cookieSecret string) error {
+	var errs []error
+	if c.StoreFile == "" {
+		errs = append(errs, errors.New("apiKeys: StoreFile is required"))
+	}
+	if c.Header == "" {
+		c.Header = "X-Api-Key"
+	}
+	if c.MaxKeys <= 0 {
+		c.MaxKeys = 20
+	}
+	var err error
+	if c.maxTTL, err = parseDurationDefault(c.MaxTTL, 0); err != nil {
+		errs = append(errs, fmt.Errorf("apiKeys: failed to parse MaxTTL: %w", err))
+	}
+	c.store = newFileStore(c.StoreFile)
+	c.csrfKey = signingKey(cookieSecret, "api-keys")
+	return errors.Join(errs...)
+}
+
+// authenticate returns the user that owns the API key of the request, if any. Other bearer tokens and header values
+// without the key prefix are ignored, as they may be meant for the next handler.
+func (c *APIKeysConfig) authenticate(req *http.Request) (*goth.User, error) {
+	key, found := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer "+apiKeysPrefix)
+	if !found {
+		key, found = strings.CutPrefix(req.Header.Get(c.Header), apiKeysPrefix)
+	}
+	if !found {
+		return nil, nil
+	}
+	id, secret, ok := strings.Cut(key, "_")
+	if !ok {
+		return nil, errors.New("malformed API key")
+	}
+	data, err := c.store.snapshot(func() interface{} { return &apiKeysData{} })
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the API keys: %w", err)
+	}
+	for _, stored := range data.(*apiKeysData).Keys {
+		if stored.ID != id {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(stored.Hash), []byte(hashAPIKeySecret(secret))) != 1 {
+			return nil, errors.New("invalid API key")
+		}
+		if !stored.Expires.IsZero() && time.Now().After(stored.Expires) {
+			return nil, errors.New("expired API key")
+		}
+		claims := make(map[string]interface{}, len(stored.Claims)+2)
+		for claim, value := range stored.Claims {
+			claims[claim] = value
+		}
+		claims["api-key-name"] = stored.Name
+		claims["api-key-scopes"] = strings.Join(stored.Scopes, ",")
+		if stored.Expires.IsZero() {
+			delete(claims, "expires-at")
+		} else {
+			claims["expires-at"] = stored.Expires
+		}
+		return &goth.User{Provider: stored.Provider, UserID: stored.UserID, RawData: claims}, nil
+	}
+	return nil, errors.New("unknown API key")
+}
+
+// serveManagement serves the page where the authenticated user manages their keys, returning true if it handled the
+// request.
+func (c *APIKeysConfig) serveManagement(rw http.ResponseWriter, req *http.Request, providerName string, auth *goth.User) bool {
+	if req.URL.Path != apiKeysPath {
+		return false
+	}
+	owner := providerName + ":" + auth.UserID
+	page := &apiKeysPage{Title: "API keys", User: auth.Email, Scopes: c.Scopes}
+	if page.User == "" {
+		page.User = auth.Name
+	}
+	for _, option := range apiKeyTTLs {
+		if c.offersTTL(option.TTL) {
+			page.TTLs = append(page.TTLs, option.Label)
+		}
+	}
+	status := http.StatusOK
+	if req.Method == http.MethodPost {
+		var expected string
+		_ = req.ParseForm()
+		if err := verifyToken(c.csrfKey, "api-keys", req.PostForm.Get("csrf"), &expected); err != nil || expected != owner {
+			page.Error, status = "Your session expired, please try again", http.StatusBadRequest
+		} else if page.Error = c.handleAction(req, providerName, auth, page); page.Error != "" {
+			status = http.StatusBadRequest
+		}
+	}
+	data := &apiKeysData{}
+	if err := c.store.read(data); err != nil {
+		loge("Failed to read the API keys", "request", requestID(req), "error", err)
+		http.Error(rw, "Failed to read the API keys", http.StatusInternalServerError)
+		return true
+	}
+	for _, stored := range data.Keys {
+		if stored.Provider+":"+stored.UserID == owner {
+			page.Keys = append(page.Keys, stored)
+		}
+	}
+	sort.Slice(page.Keys, func(i, j int) bool { return page.Keys[i].Created.After(page.Keys[j].Created) })
+	csrf, err := signToken(c.csrfKey, "api-keys", time.Hour, owner)
+	if err != nil {
+		loge("Failed to sign API keys form", "request", requestID(req), "error", err)
+		http.Error(rw, "Failed to serve the page", http.StatusInternalServerError)
+		return true
+	}
+	page.CSRF = csrf
+	servePage(rw, status, apiKeysHtml, page)
+	return true
+}
+
+// handleAction creates or revokes a key of the user, returning the error to show to the user, if any.
+func (c *APIKeysConfig) handleAction(req *http.Request, providerName string, auth *goth.User, page *apiKeysPage) string {
+	data := &apiKeysData{}
+	switch req.PostForm.Get("action") {
+	case "create":
+		name := strings.TrimSpace(req.PostForm.Get("name"))
+		if name == "" || len(name) > 100 {
+			return "The name must have between 1 and 100 characters"
+		}
+		var ttl time.Duration
+		ok := false
+		for _, option := range apiKeyTTLs {
+			if option.Label == req.PostForm.Get("ttl") && c.offersTTL(option.TTL) {
+				ttl, ok = option.TTL, true
+			}
+		}
+		if !ok {
+			return "Invalid expiration"
+		}
+		var scopes []string
+		for _, scope := range req.PostForm["scope"] {
+			allowed := false
+			for _, allowedScope := range c.Scopes {
+				allowed = allowed || scope == allowedScope
+			}
+			if !allowed {
+				return fmt.Sprintf("Invalid scope %q", scope)
+			}
+			scopes = append(scopes, scope)
+		}
+		id, secret := randomString(6), randomString(32)
+		stored := &apiKey{
+			ID:       strings.NewReplacer("-", "0", "_", "1").Replace(id), // "_" separates the ID from the secret
+			Hash:     hashAPIKeySecret(secret),
+			Name:     name,
+			Provider: providerName,
+			UserID:   auth.UserID,
+			Scopes:   scopes,
+			Claims:   auth.RawData,
+			Created:  time.Now().UTC().Truncate(time.Second),
+		}
+		if ttl > 0 {
+			stored.Expires = stored.Created.Add(ttl)
+		}
+		err := c.store.update(data, func() error {
+			count := 0
+			for _, other := range data.Keys {
+				if other.Provider == providerName && other.UserID == auth.UserID {
+					count++
+				}
+			}
+			if count >= c.MaxKeys {
+				return errAPIKeysLimit
+			}
+			data.Keys = append(data.Keys, stored)
+			return nil
+		})
+		if errors.Is(err, errAPIKeysLimit) {
+			return "Too many keys, revoke some of them first"
+		}
+		if err != nil {
+			loge("Failed to store API key", "request", requestID(req), "error", err)
+			return "Failed to store the key"
+		}
+		logi("API key created", "request", requestID(req), "provider", providerName, "user", auth.UserID, "key", stored.ID, "name", name, "scopes", scopes)
+		page.NewKey = apiKeysPrefix + stored.ID + "_" + secret
+	case "revoke":
+		id := req.PostForm.Get("id")
+		found := false
+		err := c.store.update(data, func() error {
+			for i, stored := range data.Keys {
+				if stored.ID == id && stored.Provider == providerName && stored.UserID == auth.UserID {
+					data.Keys, found = append(data.Keys[:i], data.Keys[i+1:]...), true
+					break
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			loge("Failed to revoke API key", "request", requestID(req), "error", err)
+			return "Failed to revoke the key"
+		}
+		if !found {
+			return "Key not found"
+		}
+		logi("API key revoked", "request", requestID(req), "provider", providerName, "user", auth.UserID, "key", id)
+		page.Message = "The key was revoked."
+	default:
+		return "Invalid action"
+	}
+	return ""
+}
+
+// revokeUser deletes all the keys of the user, returning how many were deleted.
+func (c *APIKeysConfig) revokeUser(providerName, userID string) (int, error) {
+	data := &apiKeysData{}
+	revoked := 0
+	err := c.store.update(data, func() error {
+		kept := data.Keys[:0]
+		for _, stored := range data.Keys {
+			if stored.Provider == providerName && stored.UserID == userID {
+				revoked++
+			} else {
+				kept = append(kept, stored)
+			}
+		}
+		data.Keys = kept
+		return nil
+	})
+	return revoked, err
+}
+
+// offersTTL returns true if keys with the given lifetime (0 for never expiring) may be created.
+func (c *APIKeysConfig) offersTTL(ttl time.Duration) bool {
+	return c.maxTTL == 0 || (ttl != 0 && ttl <= c.maxTTL)
+}
+
+var errAPIKeysLimit = errors.New("too many API keys")
+
+func hashAPIKeySecret(secret string) string {
+	hash := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(hash[:])
+}
+
+// apiKeysPage is the data of apiKeysHtml.
+type apiKeysPage struct {
+	Title, Error, Message, User, NewKey, CSRF string
+	Scopes, TTLs                              []string
+	Keys                                      []*apiKey
+}
+
+var apiKeysHtml = newPageTemplate("apiKeysTemplate", `{{if .Error}}<div class="login-box-error">{{.Error}}</div>{{end}} {{if .Message}}<div class="login-box-message">{{.Message}}</div>{{end}} {{if .NewKey}}<div class="login-box-message">Copy your new key now, it will not be shown again:<br><code>{{.NewKey}}</code></div>{{end}} <div class="login-box-message">Keys of <b>{{.User}}</b></div> {{if .Keys}}<table class="login-box-table"><tr><th>Name</th><th>Scopes</th><th>Created</th><th>Expires</th><th></th></tr>{{range .Keys}}<tr><td>{{.Name}}</td><td>{{range $i,$scope:=.Scopes}}{{if $i}}, {{end}}{{$scope}}{{end}}</td><td>{{.Created.Format "2006-01-02"}}</td><td>{{if .Expires.IsZero}}Never{{else}}{{.Expires.Format "2006-01-02"}}{{end}}</td><td><form method="post" action="`+apiKeysPath+`"><input type="hidden" name="csrf" value="{{$.CSRF}}"><input type="hidden" name="id" value="{{.ID}}"><button class="btn" type="submit" name="action" value="revoke">Revoke</button></form></td></tr>{{end}}</table>{{end}} <form class="login-box-form" method="post" action="`+apiKeysPath+`"> <input type="hidden" name="csrf" value="{{.CSRF}}"> <label>Name <input name="name" type="text" maxlength="100" autocomplete="off" required></label> <label>Expires after <select name="ttl">{{range .TTLs}}<option>{{.}}</option>{{end}}</select></label> {{range .Scopes}}<label><span><input name="scope" type="checkbox" value="{{.}}"> {{.}}</span></label> {{end}}<button class="btn" type="submit" name="action" value="create">Create key</button> </form>`)
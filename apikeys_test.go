@@ -0,0 +1,101 @@
+package traefikgothauth
+
+import (
+	"context"
+	"golang.org/x/crypto/bcrypt"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestAPIKeys(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var handler http.Handler
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		handler.ServeHTTP(rw, req)
+	}))
+	defer server.Close()
+	cfg := CreateConfig()
+	cfg.CookieSecret = "secret-for-testing-only"
+	cfg.APIKeys = &APIKeysConfig{StoreFile: filepath.Join(t.TempDir(), "keys.json"), Scopes: []string{"read", "write"}, MaxTTL: "2160h"}
+	cfg.Providers = []*ProviderConfig{{
+		Name:        "local",
+		RedirectURI: server.URL + "/__goth/local/",
+		Custom:      map[string]interface{}{"users": map[string]interface{}{"alice": string(hash)}},
+	}}
+	handler, err = New(context.Background(), http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_, _ = rw.Write([]byte("hello " + req.Header.Get("X-Auth-User-Id") + " " + req.Header.Get("X-Auth-Api-Key-Scopes")))
+	}), cfg, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	read := func(res *http.Response, err error) (*http.Response, string) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(res.Body)
+		_ = res.Body.Close()
+		return res, string(body)
+	}
+	callWithKey := func(header, value string) (*http.Response, string) {
+		req, _ := http.NewRequest(http.MethodGet, server.URL+"/api", nil)
+		req.Header.Set(header, value)
+		return read(http.DefaultClient.Do(req))
+	}
+
+	// Log in and create a key
+	jar, _ := cookiejar.New(nil)
+	browser := &http.Client{Jar: jar}
+	res, _ := read(browser.Get(server.URL + apiKeysPath))
+	res, body := read(browser.PostForm(res.Request.URL.String(), url.Values{
+		"state": {res.Request.URL.Query().Get("state")}, "username": {"alice"}, "password": {"hunter2"},
+	}))
+	csrf := regexp.MustCompile(`name="csrf" value="([^"]+)"`).FindStringSubmatch(body)
+	if res.Request.URL.Path != apiKeysPath || csrf == nil {
+		t.Fatalf("expected the API keys page, got %d at %s: %s", res.StatusCode, res.Request.URL, body)
+	}
+	if strings.Contains(body, "Never") {
+		t.Fatalf("expected never expiring keys not to be offered with MaxTTL")
+	}
+	create := url.Values{"csrf": {csrf[1]}, "action": {"create"}, "name": {"ci"}, "ttl": {"30 days"}, "scope": {"read"}}
+	if res, _ = read(browser.PostForm(server.URL+apiKeysPath, url.Values{"csrf": {csrf[1]}, "action": {"create"}, "name": {"ci"}, "ttl": {"Never"}})); res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected a key longer than MaxTTL to be rejected, got %d", res.StatusCode)
+	}
+	_, page := read(browser.PostForm(server.URL+apiKeysPath, create))
+	key := regexp.MustCompile(apiKeysPrefix + `[A-Za-z0-9]+_[A-Za-z0-9_-]+`).FindString(page)
+	id := regexp.MustCompile(`name="id" value="([^"]+)"`).FindStringSubmatch(page)
+	if key == "" || id == nil || !strings.HasPrefix(key, apiKeysPrefix+id[1]+"_") {
+		t.Fatalf("expected the new key to be shown and listed: %s", page)
+	}
+
+	// Use it without the browser
+	if _, body = callWithKey("Authorization", "Bearer "+key); body != "hello alice read" {
+		t.Fatalf("expected the bearer key to be accepted, got %s", body)
+	}
+	if _, body = callWithKey("X-Api-Key", key); body != "hello alice read" {
+		t.Fatalf("expected the header key to be accepted, got %s", body)
+	}
+	if res, _ = callWithKey("X-Api-Key", key+"x"); res.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected the tampered key to be rejected, got %d", res.StatusCode)
+	}
+	if res, _ = callWithKey("Authorization", "Bearer something-else"); res.StatusCode == http.StatusUnauthorized {
+		t.Fatalf("expected other bearer tokens to be ignored")
+	}
+
+	// Revoke it
+	if res, _ = read(browser.PostForm(server.URL+apiKeysPath, url.Values{"csrf": {csrf[1]}, "action": {"revoke"}, "id": {id[1]}})); res.StatusCode != http.StatusOK {
+		t.Fatalf("expected the key to be revoked, got %d", res.StatusCode)
+	}
+	if res, _ = callWithKey("Authorization", "Bearer "+key); res.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected the revoked key to be rejected, got %d", res.StatusCode)
+	}
+}
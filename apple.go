@@ -0,0 +1,312 @@
+package traefikgothauth
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/markbates/goth"
+	"golang.org/x/oauth2"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	appleIssuer   = "https://appleid.apple.com"
+	appleAuthURL  = "https://appleid.apple.com/auth/authorize"
+	appleTokenURL = "https://appleid.apple.com/auth/token"
+	// appleClientSecretLifetime is the lifetime of each generated client secret (Apple allows up to 6 months).
+	appleClientSecretLifetime = 30 * 24 * time.Hour
+)
+
+// appleProvider is a goth.Provider for Sign in with Apple.
+//
+// Apple does not use a static client secret: it is a JWT signed with the private key (.p8) of the developer account,
+// which this provider generates and rotates automatically.
+type appleProvider struct {
+	providerName string
+	clientID     string
+	teamID       string
+	keyID        string
+	key          *ecdsa.PrivateKey
+	config       *oauth2.Config
+	HTTPClient   *http.Client
+
+	secretMu      sync.Mutex
+	secret        string
+	secretExpires time.Time
+}
+
+var _ goth.Provider = &appleProvider{}
+
+// newAppleProvider creates the provider from its custom configuration.
+func newAppleProvider(clientID, callback string, custom map[string]interface{}, scopes ...string) (*appleProvider, error) {
+	keyPEM, _ := custom["privateKey"].(string)
+	if keyFile, ok := custom["privateKeyFile"].(string); ok {
+		keyBytes, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the private key: %w", err)
+		}
+		keyPEM = string(keyBytes)
+	}
+	key, err := parseApplePrivateKey(keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	if len(scopes) == 0 {
+		scopes = []string{"name", "email"}
+	}
+	p := &appleProvider{
+		providerName: "apple",
+		clientID:     clientID,
+		key:          key,
+		config: &oauth2.Config{
+			ClientID:    clientID,
+			RedirectURL: callback,
+			Endpoint:    oauth2.Endpoint{AuthURL: appleAuthURL, TokenURL: appleTokenURL, AuthStyle: oauth2.AuthStyleInParams},
+			Scopes:      scopes,
+		},
+	}
+	p.teamID, _ = custom["teamID"].(string)
+	p.keyID, _ = custom["keyID"].(string)
+	if _, err = p.clientSecret(); err != nil { // Fail early on invalid keys
+		return nil, err
+	}
+	return p, nil
+}
+
+func parseApplePrivateKey(keyPEM string) (*ecdsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(keyPEM))
+	if block == nil {
+		return nil, errors.New("the private key is not PEM encoded")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the private key: %w", err)
+	}
+	key, ok := parsed.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("the private key must be an ECDSA (P-256) key, found %T", parsed)
+	}
+	return key, nil
+}
+
+// clientSecret returns a valid client secret, generating a new one when the current one is about to expire.
+func (p *appleProvider) clientSecret() (string, error) {
+	p.secretMu.Lock()
+	defer p.secretMu.Unlock()
+	now := time.Now()
+	if p.secret != "" && now.Add(24*time.Hour).Before(p.secretExpires) {
+		return p.secret, nil
+	}
+	expires := now.Add(appleClientSecretLifetime)
+	secret, err := signES256JWT(p.key, p.keyID, map[string]interface{}{
+		"iss": p.teamID,
+		"iat": now.Unix(),
+		"exp": expires.Unix(),
+		"aud": appleIssuer,
+		"sub": p.clientID,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to sign the client secret: %w", err)
+	}
+	logd("Generated a new client secret", "provider", p.providerName, "expires", expires)
+	p.secret, p.secretExpires = secret, expires
+	return secret, nil
+}
+
+// signES256JWT signs the claims as a compact JWT using ES256.
+func signES256JWT(key *ecdsa.PrivateKey, keyID string, claims map[string]interface{}) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "ES256", "kid": keyID, "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	hash := sha256.Sum256([]byte(signingInput))
+	r, s, err := ecdsa.Sign(rand.Reader, key, hash[:])
+	if err != nil {
+		return "", err
+	}
+	// JWS uses the fixed-size concatenation of R and S instead of ASN.1
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// Name is the name used to retrieve this provider later.
+func (p *appleProvider) Name() string {
+	return p.providerName
+}
+
+// SetName is to update the name of the provider (needed in case of multiple providers of 1 type).
+func (p *appleProvider) SetName(name string) {
+	p.providerName = name
+}
+
+// Client is the HTTP client to be used in all fetch operations.
+func (p *appleProvider) Client() *http.Client {
+	return goth.HTTPClientWithFallBack(p.HTTPClient)
+}
+
+// Debug is a no-op.
+func (p *appleProvider) Debug(bool) {}
+
+// BeginAuth asks Apple for an authentication end-point.
+//
+// Apple requires the form_post response mode when requesting scopes, which is handled by ServeHTTP.
+func (p *appleProvider) BeginAuth(state string) (goth.Session, error) {
+	return &appleSession{AuthURL: p.config.AuthCodeURL(state, oauth2.SetAuthURLParam("response_mode", "form_post"))}, nil
+}
+
+// UnmarshalSession will unmarshal a JSON string into a session.
+func (p *appleProvider) UnmarshalSession(data string) (goth.Session, error) {
+	s := &appleSession{}
+	err := json.NewDecoder(strings.NewReader(data)).Decode(s)
+	return s, err
+}
+
+// FetchUser reads the user from the ID token, as Apple does not provide a userinfo endpoint.
+func (p *appleProvider) FetchUser(session goth.Session) (goth.User, error) {
+	sess := session.(*appleSession)
+	user := goth.User{
+		AccessToken:  sess.AccessToken,
+		RefreshToken: sess.RefreshToken,
+		IDToken:      sess.IDToken,
+		ExpiresAt:    sess.ExpiresAt,
+		Provider:     p.Name(),
+		FirstName:    sess.FirstName,
+		LastName:     sess.LastName,
+	}
+	if sess.IDToken == "" {
+		return user, fmt.Errorf("%s cannot get user information without an ID token", p.providerName)
+	}
+	// The ID token was received directly from Apple's token endpoint over TLS, so its signature does not need to be
+	// verified (OpenID Connect Core 1.0, section 3.1.3.7).
+	claims, err := decodeJWTClaims(sess.IDToken)
+	if err != nil {
+		return user, err
+	}
+	if claims["iss"] != appleIssuer || claims["aud"] != p.clientID {
+		return user, errors.New("the ID token was not issued by Apple for this client")
+	}
+	user.RawData = claims
+	user.UserID, _ = claims["sub"].(string)
+	user.Email, _ = claims["email"].(string)
+	user.Name = strings.TrimSpace(user.FirstName + " " + user.LastName)
+	return user, nil
+}
+
+// RefreshTokenAvailable refresh token is provided by auth provider or not.
+func (p *appleProvider) RefreshTokenAvailable() bool {
+	return true
+}
+
+// RefreshToken get new access token based on the refresh token.
+func (p *appleProvider) RefreshToken(refreshToken string) (*oauth2.Token, error) {
+	config, err := p.configWithSecret()
+	if err != nil {
+		return nil, err
+	}
+	ts := config.TokenSource(goth.ContextForClient(p.Client()), &oauth2.Token{RefreshToken: refreshToken})
+	return ts.Token()
+}
+
+func (p *appleProvider) configWithSecret() (*oauth2.Config, error) {
+	secret, err := p.clientSecret()
+	if err != nil {
+		return nil, err
+	}
+	config := *p.config
+	config.ClientSecret = secret
+	return &config, nil
+}
+
+// decodeJWTClaims returns the claims of a JWT, without verifying its signature.
+func decodeJWTClaims(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed JWT")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("malformed JWT payload: %w", err)
+	}
+	claims := map[string]interface{}{}
+	if err = json.Unmarshal(payload, &claims); err != nil {
+		return nil, fmt.Errorf("malformed JWT claims: %w", err)
+	}
+	return claims, nil
+}
+
+// appleSession stores data during the auth process with Apple.
+type appleSession struct {
+	AuthURL      string
+	AccessToken  string
+	RefreshToken string
+	IDToken      string
+	ExpiresAt    time.Time
+	// FirstName and LastName are only sent by Apple on the first login of each user.
+	FirstName, LastName string
+}
+
+var _ goth.Session = &appleSession{}
+
+// GetAuthURL will return the URL set by calling the `BeginAuth` function on the provider.
+func (s *appleSession) GetAuthURL() (string, error) {
+	if s.AuthURL == "" {
+		return "", errors.New(goth.NoAuthUrlErrorMessage)
+	}
+	return s.AuthURL, nil
+}
+
+// Authorize the session with Apple and return the access token to be stored for future use.
+func (s *appleSession) Authorize(provider goth.Provider, params goth.Params) (string, error) {
+	p := provider.(*appleProvider)
+	config, err := p.configWithSecret()
+	if err != nil {
+		return "", err
+	}
+	token, err := config.Exchange(goth.ContextForClient(p.Client()), params.Get("code"))
+	if err != nil {
+		return "", err
+	}
+	if !token.Valid() {
+		return "", errors.New("invalid token received from provider")
+	}
+	s.AccessToken = token.AccessToken
+	s.RefreshToken = token.RefreshToken
+	s.ExpiresAt = token.Expiry
+	s.IDToken, _ = token.Extra("id_token").(string)
+	if rawUser := params.Get("user"); rawUser != "" {
+		var appleUser struct {
+			Name struct {
+				FirstName string `json:"firstName"`
+				LastName  string `json:"lastName"`
+			} `json:"name"`
+		}
+		if err = json.Unmarshal([]byte(rawUser), &appleUser); err != nil {
+			logw("Could not parse the user sent by Apple", "error", err)
+		}
+		s.FirstName, s.LastName = appleUser.Name.FirstName, appleUser.Name.LastName
+	}
+	return token.AccessToken, nil
+}
+
+// Marshal the session into a string.
+func (s *appleSession) Marshal() string {
+	b, _ := json.Marshal(s)
+	return string(b)
+}
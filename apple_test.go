@@ -0,0 +1,195 @@
+package traefikgothauth
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"github.com/markbates/goth"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestAppleKey(t *testing.T) (*ecdsa.PrivateKey, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+}
+
+// newTestJWT creates a JWT with the claims, with an invalid signature.
+func newTestJWT(t *testing.T, claims map[string]interface{}) string {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return "eyJhbGciOiJFUzI1NiJ9." + base64.RawURLEncoding.EncodeToString(payload) + ".c2lnbmF0dXJl"
+}
+
+func TestAppleClientSecret(t *testing.T) {
+	key, keyPEM := newTestAppleKey(t)
+	p, err := newAppleProvider("com.example.app", "https://example.com/__goth/apple/", map[string]interface{}{
+		"privateKey": keyPEM, "teamID": "TEAM123", "keyID": "KEY123",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, err := p.clientSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The secret is an ES256 JWT signed by the key of the developer account
+	parts := strings.Split(secret, ".")
+	if len(parts) != 3 {
+		t.Fatalf("expected a JWT, got %s", secret)
+	}
+	header, payload := map[string]interface{}{}, map[string]interface{}{}
+	headerJSON, _ := base64.RawURLEncoding.DecodeString(parts[0])
+	payloadJSON, _ := base64.RawURLEncoding.DecodeString(parts[1])
+	if json.Unmarshal(headerJSON, &header) != nil || json.Unmarshal(payloadJSON, &payload) != nil {
+		t.Fatalf("expected JSON header and claims, got %s", secret)
+	}
+	if header["alg"] != "ES256" || header["kid"] != "KEY123" {
+		t.Fatalf("unexpected header: %v", header)
+	}
+	signature, _ := base64.RawURLEncoding.DecodeString(parts[2])
+	hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	r, s := new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])
+	if len(signature) != 64 || !ecdsa.Verify(&key.PublicKey, hash[:], r, s) {
+		t.Fatal("expected a valid ES256 signature")
+	}
+	exp, _ := payload["exp"].(float64)
+	if payload["iss"] != "TEAM123" || payload["sub"] != "com.example.app" || payload["aud"] != appleIssuer ||
+		time.Until(time.Unix(int64(exp), 0)) < appleClientSecretLifetime-time.Minute {
+		t.Fatalf("unexpected claims: %v", payload)
+	}
+
+	// The secret is reused until it is about to expire
+	if again, _ := p.clientSecret(); again != secret {
+		t.Fatal("expected the secret to be reused")
+	}
+	p.secretExpires = time.Now().Add(time.Hour)
+	if rotated, _ := p.clientSecret(); rotated == secret || !p.secretExpires.After(time.Now().Add(appleClientSecretLifetime-time.Minute)) {
+		t.Fatal("expected the secret to be generated again before it expires")
+	}
+}
+
+func TestAppleFetchUser(t *testing.T) {
+	_, keyPEM := newTestAppleKey(t)
+	p, err := newAppleProvider("com.example.app", "https://example.com/__goth/apple/", map[string]interface{}{
+		"privateKey": keyPEM, "teamID": "TEAM123", "keyID": "KEY123",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fetch := func(claims map[string]interface{}) (goth.User, error) {
+		return p.FetchUser(&appleSession{IDToken: newTestJWT(t, claims), FirstName: "Ada", LastName: "Lovelace"})
+	}
+	user, err := fetch(map[string]interface{}{"iss": appleIssuer, "aud": "com.example.app", "sub": "001", "email": "ada@example.com"})
+	if err != nil || user.UserID != "001" || user.Email != "ada@example.com" || user.Name != "Ada Lovelace" {
+		t.Fatalf("unexpected user: %+v, %v", user, err)
+	}
+	if _, err = fetch(map[string]interface{}{"iss": "https://evil.example.com", "aud": "com.example.app", "sub": "001"}); err == nil {
+		t.Fatal("expected an ID token of another issuer to be rejected")
+	}
+	if _, err = fetch(map[string]interface{}{"iss": appleIssuer, "aud": "com.example.other", "sub": "001"}); err == nil {
+		t.Fatal("expected an ID token for another client to be rejected")
+	}
+}
+
+func TestAppleFormPostCallback(t *testing.T) {
+	_, keyPEM := newTestAppleKey(t)
+	apple := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/auth/token" || req.PostFormValue("code") != "code" {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(rw).Encode(map[string]interface{}{
+			"access_token": "token", "token_type": "bearer", "expires_in": 3600,
+			"id_token": newTestJWT(t, map[string]interface{}{"iss": appleIssuer, "aud": "com.example.app", "sub": "001"}),
+		})
+	}))
+	defer apple.Close()
+	var handler http.Handler
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		handler.ServeHTTP(rw, req)
+	}))
+	defer server.Close()
+	cfg := CreateConfig()
+	cfg.CookieSecret = "secret-for-testing-only"
+	cfg.Providers = []*ProviderConfig{{
+		Name:        "apple",
+		ClientKey:   "com.example.app",
+		RedirectURI: server.URL + "/__goth/apple/",
+		Custom:      map[string]interface{}{"privateKey": keyPEM, "teamID": "TEAM123", "keyID": "KEY123"},
+	}}
+	handler, err := New(context.Background(), http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_, _ = rw.Write([]byte("hello " + req.Header.Get("X-Auth-User-Id") + " " + req.Header.Get("X-Auth-Name")))
+	}), cfg, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider, err := goth.GetProvider("apple")
+	if err != nil {
+		t.Fatal(err)
+	}
+	target, _ := url.Parse(apple.URL)
+	provider.(*appleProvider).HTTPClient = &http.Client{Transport: &rewriteTransport{target: target}}
+	jar, _ := cookiejar.New(nil)
+	client := &http.Client{Jar: jar, CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	read := func(res *http.Response, err error) (*http.Response, string) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(res.Body)
+		_ = res.Body.Close()
+		return res, string(body)
+	}
+
+	res, _ := read(client.Get(server.URL + "/"))
+	authURL, err := url.Parse(res.Header.Get("Location"))
+	if err != nil || authURL.Host != "appleid.apple.com" || authURL.Query().Get("response_mode") != "form_post" {
+		t.Fatalf("expected a redirect to Apple with form_post, got %s", res.Header.Get("Location"))
+	}
+
+	// Apple posts the callback, which is turned into a GET with only the state and the code
+	res, _ = read(client.PostForm(server.URL+"/__goth/apple/", url.Values{
+		"state": {authURL.Query().Get("state")}, "code": {"code"}, "id_token": {"id-token"},
+		"user": {`{"name":{"firstName":"Ada","lastName":"Lovelace"},"email":"ada@example.com"}`},
+	}))
+	callbackURL, err := url.Parse(res.Header.Get("Location"))
+	if res.StatusCode != http.StatusSeeOther || err != nil || callbackURL.Path != "/__goth/apple/" {
+		t.Fatalf("expected a redirect to the callback, got %d to %s", res.StatusCode, res.Header.Get("Location"))
+	}
+	if query := callbackURL.Query(); len(query) != 2 || query.Get("state") != authURL.Query().Get("state") || query.Get("code") != "code" {
+		t.Fatalf("expected only the state and the code in the callback URL, got %s", callbackURL)
+	}
+
+	// The user sent by Apple is still used to complete the login
+	res, _ = read(client.Get(server.URL + callbackURL.RequestURI()))
+	if res.StatusCode != http.StatusTemporaryRedirect {
+		t.Fatalf("expected the login to complete, got %d", res.StatusCode)
+	}
+	if _, body := read(client.Get(server.URL + res.Header.Get("Location"))); body != "hello 001 Ada Lovelace" {
+		t.Fatalf("expected the user with their name, got %s", body)
+	}
+}
@@ -0,0 +1,185 @@
+package traefikgothauth
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Audit event types.
+const (
+	auditLogin          = "login"
+	auditLoginFailure   = "login_failure"
+	auditLogout         = "logout"
+	auditDenied         = "denied"
+	auditSessionExpired = "session_expired"
+	// auditImpersonationStart and auditImpersonationStop are for the impersonated user, with the acting admin.
+	auditImpersonationStart = "impersonation_start"
+	auditImpersonationStop  = "impersonation_stop"
+)
+
+// auditMaxPendingWebhooks limits the webhook requests in flight, dropping the events of a burst if the webhook is slow.
+const auditMaxPendingWebhooks = 100
+
+// AuditConfig writes the authentication events (logins, failed logins, logouts, denied requests, expired sessions and
+// impersonations) as JSON lines, separately from the logs. They can also be sent to a webhook, e.g. the collector of a SIEM.
+type AuditConfig struct {
+	// File (optional) is the file where the events are appended. Defaults to stdout.
+	File string
+	// WebhookURL (optional) receives each event as a JSON POST request.
+	WebhookURL string
+	// WebhookHeaders (optional) are added to the webhook requests, e.g. {"Authorization": "Bearer ..."}.
+	WebhookHeaders map[string]string
+	// HTTPClient (optional) configures the HTTP client of the webhook.
+	HTTPClient *HTTPClientConfig
+	httpClient *http.Client
+	file       *auditFile
+	pending    chan struct{}
+}
+
+// auditEvent is the fixed schema of the audit events. Fields that do not apply to an event are empty.
+type auditEvent struct {
+	Timestamp time.Time `json:"timestamp"`
+	Event     string    `json:"event"`
+	Provider  string    `json:"provider"`
+	User      string    `json:"user"`
+	Admin     string    `json:"admin"`
+	Reason    string    `json:"reason"`
+	RequestID string    `json:"requestId"`
+	Remote    string    `json:"remote"`
+	Host      string    `json:"host"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	UserAgent string    `json:"userAgent"`
+}
+
+// auditCurrent receives the audit events of the process, if configured. Like the logs, it is shared by all the plugin
+// instances.
+var auditCurrent *AuditConfig
+
+// auditFiles are the open audit files, by path, shared by all the plugin instances of this process.
+var auditFiles = struct {
+	sync.Mutex
+	byPath map[string]*auditFile
+}{byPath: map[string]*auditFile{}}
+
+// auditFile serializes the writes to an audit file, so that the lines of concurrent events never interleave.
+type auditFile struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+func (c *AuditConfig) setup() error {
+	var errs []error
+	var err error
+	if c.file, err = openAuditFile(c.File); err != nil {
+		errs = append(errs, fmt.Errorf("audit: failed to open File: %w", err))
+	}
+	if c.WebhookURL != "" {
+		if webhookURL, err := url.Parse(c.WebhookURL); err != nil || (webhookURL.Scheme != "http" && webhookURL.Scheme != "https") {
+			errs = append(errs, fmt.Errorf("audit: WebhookURL must be an absolute http(s) URL: %s", c.WebhookURL))
+		}
+	}
+	if c.httpClient, err = c.HTTPClient.newHTTPClient(); err != nil {
+		errs = append(errs, fmt.Errorf("audit: invalid HTTP client configuration: %w", err))
+	}
+	c.pending = make(chan struct{}, auditMaxPendingWebhooks)
+	return errors.Join(errs...)
+}
+
+func openAuditFile(path string) (*auditFile, error) {
+	if path == "" {
+		return &auditFile{f: os.Stdout}, nil
+	}
+	path = filepath.Clean(path)
+	auditFiles.Lock()
+	defer auditFiles.Unlock()
+	if file, ok := auditFiles.byPath[path]; ok {
+		return file, nil
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	file := &auditFile{f: f}
+	auditFiles.byPath[path] = file
+	return file, nil
+}
+
+// audit records an authentication event about the request, if the audit log is enabled.
+func audit(req *http.Request, event, providerName, userID, reason string) {
+	auditAdmin(req, event, providerName, userID, "", reason)
+}
+
+// auditAdmin records an event done by an admin ("provider:userID") to the user.
+func auditAdmin(req *http.Request, event, providerName, userID, admin, reason string) {
+	c := auditCurrent
+	if c == nil {
+		return
+	}
+	line, err := json.Marshal(&auditEvent{
+		Timestamp: time.Now().UTC(),
+		Event:     event,
+		Provider:  providerName,
+		User:      userID,
+		Admin:     admin,
+		Reason:    reason,
+		RequestID: requestID(req),
+		Remote:    clientIP(req),
+		Host:      req.Host,
+		Method:    req.Method,
+		Path:      req.URL.Path,
+		UserAgent: req.UserAgent(),
+	})
+	if err != nil {
+		loge("Failed to encode the audit event", "event", event, "error", err)
+		return
+	}
+	c.file.mu.Lock()
+	_, err = c.file.f.Write(append(line, '\n'))
+	c.file.mu.Unlock()
+	if err != nil {
+		loge("Failed to write the audit event", "event", event, "error", err)
+	}
+	if c.WebhookURL == "" {
+		return
+	}
+	select {
+	case c.pending <- struct{}{}:
+		go func() {
+			defer func() { <-c.pending }()
+			c.sendWebhook(line)
+		}()
+	default:
+		logw("Too many pending audit webhook requests, dropping the event", "event", event, "provider", providerName, "user", userID)
+	}
+}
+
+// sendWebhook delivers an event to the webhook.
+func (c *AuditConfig) sendWebhook(line []byte) {
+	req, err := http.NewRequest(http.MethodPost, c.WebhookURL, bytes.NewReader(line))
+	if err != nil {
+		loge("Failed to create the audit webhook request", "error", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for header, value := range c.WebhookHeaders {
+		req.Header.Set(header, value)
+	}
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		logw("Failed to send the audit event to the webhook", "error", err)
+		return
+	}
+	_ = res.Body.Close()
+	if res.StatusCode >= 300 {
+		logw("The audit webhook rejected the event", "status", res.StatusCode)
+	}
+}
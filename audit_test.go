@@ -0,0 +1,112 @@
+package traefikgothauth
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"golang.org/x/crypto/bcrypt"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAudit(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	webhookEvents := make(chan *auditEvent, 10)
+	webhook := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		event := &auditEvent{}
+		if req.Header.Get("Authorization") == "Bearer siem" && json.NewDecoder(req.Body).Decode(event) == nil {
+			webhookEvents <- event
+		}
+	}))
+	defer webhook.Close()
+	var handler http.Handler
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		handler.ServeHTTP(rw, req)
+	}))
+	defer server.Close()
+	auditFile := filepath.Join(t.TempDir(), "audit.log")
+	cfg := CreateConfig()
+	cfg.CookieSecret = "secret-for-testing-only"
+	cfg.Audit = &AuditConfig{File: auditFile, WebhookURL: webhook.URL, WebhookHeaders: map[string]string{"Authorization": "Bearer siem"}}
+	cfg.Providers = []*ProviderConfig{{
+		Name:        "local",
+		RedirectURI: server.URL + "/__goth/local/",
+		Custom:      map[string]interface{}{"users": map[string]interface{}{"alice": string(hash)}},
+	}}
+	handler, err = New(context.Background(), http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_, _ = rw.Write([]byte("hello " + req.Header.Get("X-Auth-User-Id")))
+	}), cfg, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { auditCurrent = nil }()
+	read := func(res *http.Response, err error) (*http.Response, string) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(res.Body)
+		_ = res.Body.Close()
+		return res, string(body)
+	}
+
+	// Fail, log in and log out
+	jar, _ := cookiejar.New(nil)
+	browser := &http.Client{Jar: jar}
+	res, _ := read(browser.Get(server.URL + "/"))
+	form := url.Values{"state": {res.Request.URL.Query().Get("state")}, "username": {"alice"}, "password": {"wrong"}}
+	read(browser.PostForm(res.Request.URL.String(), form))
+	form.Set("password", "hunter2")
+	if _, body := read(browser.PostForm(res.Request.URL.String(), form)); body != "hello alice" {
+		t.Fatalf("expected to log in, got %s", body)
+	}
+	read(browser.Get(server.URL + "/__goth/local/logout/"))
+
+	// The events are in the file, with a fixed schema, and at the webhook
+	f, err := os.Open(auditFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = f.Close() }()
+	var events []map[string]interface{}
+	for scanner := bufio.NewScanner(f); scanner.Scan(); {
+		event := map[string]interface{}{}
+		if err = json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatalf("expected JSON lines, got %s", scanner.Text())
+		}
+		events = append(events, event)
+	}
+	expected := []struct{ event, reason string }{{auditLoginFailure, "invalid credentials"}, {auditLogin, ""}, {auditLogout, ""}}
+	if len(events) != len(expected) {
+		t.Fatalf("expected %d events, got %v", len(expected), events)
+	}
+	for i, event := range events {
+		if len(event) != 12 || event["event"] != expected[i].event || event["provider"] != "local" || event["user"] != "alice" || event["requestId"] == "" || event["remote"] != "127.0.0.1" {
+			t.Fatalf("unexpected event %d: %v", i, event)
+		}
+		if expected[i].reason != "" && event["reason"] == "" {
+			t.Fatalf("expected the reason of event %d: %v", i, event)
+		}
+	}
+	received := map[string]bool{}
+	for range expected {
+		select {
+		case event := <-webhookEvents:
+			received[event.Event] = true
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected the events at the webhook, got %v", received)
+		}
+	}
+	if !received[auditLoginFailure] || !received[auditLogin] || !received[auditLogout] {
+		t.Fatalf("expected every event at the webhook, got %v", received)
+	}
+}
@@ -0,0 +1,304 @@
+package traefikgothauth
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Minimal BER encoding (the subset used by LDAPv3, RFC 4511), as Traefik plugins can not use cgo or large libraries.
+
+const (
+	berTagBoolean     = 0x01
+	berTagInteger     = 0x02
+	berTagOctetString = 0x04
+	berTagEnumerated  = 0x0a
+	berTagSequence    = 0x30
+	berTagSet         = 0x31
+
+	berClassApplication = 0x40
+	berClassContext     = 0x80
+	berConstructed      = 0x20
+
+	berMaxLength = 16 << 20 // Refuse absurdly large packets
+)
+
+// berPacket is a decoded BER element. Constructed elements have children, primitive elements have a value.
+type berPacket struct {
+	tag      byte
+	value    []byte
+	children []*berPacket
+}
+
+func berPrimitive(tag byte, value []byte) *berPacket {
+	return &berPacket{tag: tag, value: value}
+}
+
+func berString(tag byte, value string) *berPacket {
+	return berPrimitive(tag, []byte(value))
+}
+
+func berInt(tag byte, value int64) *berPacket {
+	// Two's complement, big-endian, minimal length
+	b := []byte{byte(value)}
+	for value >= 0x80 || value < -0x80 {
+		value >>= 8
+		b = append([]byte{byte(value)}, b...)
+	}
+	return berPrimitive(tag, b)
+}
+
+func berBool(value bool) *berPacket {
+	if value {
+		return berPrimitive(berTagBoolean, []byte{0xff})
+	}
+	return berPrimitive(berTagBoolean, []byte{0x00})
+}
+
+func berConstruct(tag byte, children ...*berPacket) *berPacket {
+	return &berPacket{tag: tag | berConstructed, children: children}
+}
+
+func (p *berPacket) constructed() bool {
+	return p.tag&berConstructed != 0
+}
+
+// encode returns the BER encoding of the packet.
+func (p *berPacket) encode() []byte {
+	content := p.value
+	if p.constructed() {
+		content = nil
+		for _, child := range p.children {
+			content = append(content, child.encode()...)
+		}
+	}
+	out := []byte{p.tag}
+	if len(content) < 0x80 {
+		out = append(out, byte(len(content)))
+	} else {
+		var lengthBytes []byte
+		for l := len(content); l > 0; l >>= 8 {
+			lengthBytes = append([]byte{byte(l)}, lengthBytes...)
+		}
+		out = append(out, 0x80|byte(len(lengthBytes)))
+		out = append(out, lengthBytes...)
+	}
+	return append(out, content...)
+}
+
+// readBERPacket reads and decodes the next packet.
+func readBERPacket(r *bufio.Reader) (*berPacket, error) {
+	tag, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	if tag&0x1f == 0x1f {
+		return nil, errors.New("ber: multi-byte tags are not supported")
+	}
+	length, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	contentLength := int(length)
+	if length&0x80 != 0 {
+		n := int(length & 0x7f)
+		if n == 0 || n > 4 {
+			return nil, errors.New("ber: unsupported length encoding")
+		}
+		contentLength = 0
+		for i := 0; i < n; i++ {
+			b, err := r.ReadByte()
+			if err != nil {
+				return nil, err
+			}
+			contentLength = contentLength<<8 | int(b)
+		}
+	}
+	if contentLength > berMaxLength {
+		return nil, fmt.Errorf("ber: packet too large (%d bytes)", contentLength)
+	}
+	content := make([]byte, contentLength)
+	if _, err = io.ReadFull(r, content); err != nil {
+		return nil, err
+	}
+	return decodeBERContent(tag, content)
+}
+
+func decodeBERContent(tag byte, content []byte) (*berPacket, error) {
+	p := &berPacket{tag: tag}
+	if !p.constructed() {
+		p.value = content
+		return p, nil
+	}
+	r := bufio.NewReader(bytes.NewReader(content))
+	for {
+		child, err := readBERPacket(r)
+		if err == io.EOF {
+			return p, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		p.children = append(p.children, child)
+	}
+}
+
+func (p *berPacket) child(i int) *berPacket {
+	if i < 0 || i >= len(p.children) {
+		return &berPacket{} // Empty values instead of panicking on malformed packets
+	}
+	return p.children[i]
+}
+
+func (p *berPacket) int() int64 {
+	var value int64
+	for i, b := range p.value {
+		if i == 0 && b&0x80 != 0 {
+			value = -1
+		}
+		value = value<<8 | int64(b)
+	}
+	return value
+}
+
+func (p *berPacket) string() string {
+	return string(p.value)
+}
+
+// parseLDAPFilter encodes a string filter (RFC 4515), e.g. "(&(objectClass=person)(uid=john))".
+func parseLDAPFilter(filter string) (*berPacket, error) {
+	packet, rest, err := parseLDAPFilterItem(strings.TrimSpace(filter))
+	if err != nil {
+		return nil, err
+	}
+	if rest != "" {
+		return nil, fmt.Errorf("ldap filter: unexpected trailing characters %q", rest)
+	}
+	return packet, nil
+}
+
+func parseLDAPFilterItem(filter string) (*berPacket, string, error) {
+	if !strings.HasPrefix(filter, "(") {
+		return nil, "", fmt.Errorf("ldap filter: expected ( at %q", filter)
+	}
+	filter = filter[1:]
+	if filter == "" {
+		return nil, "", errors.New("ldap filter: unexpected end")
+	}
+	switch filter[0] {
+	case '&', '|':
+		tag := byte(berClassContext | 0)
+		if filter[0] == '|' {
+			tag = berClassContext | 1
+		}
+		set := berConstruct(tag)
+		rest := filter[1:]
+		for strings.HasPrefix(rest, "(") {
+			item, next, err := parseLDAPFilterItem(rest)
+			if err != nil {
+				return nil, "", err
+			}
+			set.children = append(set.children, item)
+			rest = next
+		}
+		if !strings.HasPrefix(rest, ")") {
+			return nil, "", fmt.Errorf("ldap filter: expected ) at %q", rest)
+		}
+		return set, rest[1:], nil
+	case '!':
+		item, rest, err := parseLDAPFilterItem(filter[1:])
+		if err != nil {
+			return nil, "", err
+		}
+		if !strings.HasPrefix(rest, ")") {
+			return nil, "", fmt.Errorf("ldap filter: expected ) at %q", rest)
+		}
+		return berConstruct(berClassContext|2, item), rest[1:], nil
+	}
+	end := strings.IndexByte(filter, ')')
+	if end < 0 {
+		return nil, "", errors.New("ldap filter: missing )")
+	}
+	item, rest := filter[:end], filter[end+1:]
+	eq := strings.IndexByte(item, '=')
+	if eq <= 0 {
+		return nil, "", fmt.Errorf("ldap filter: invalid item %q", item)
+	}
+	attr, value := item[:eq], item[eq+1:]
+	tag := byte(berClassContext | 3) // equalityMatch
+	switch attr[len(attr)-1] {
+	case '>':
+		tag, attr = berClassContext|5, attr[:len(attr)-1]
+	case '<':
+		tag, attr = berClassContext|6, attr[:len(attr)-1]
+	case '~':
+		tag, attr = berClassContext|8, attr[:len(attr)-1]
+	}
+	if tag == berClassContext|3 && value == "*" {
+		return berString(berClassContext|7, attr), rest, nil // present
+	}
+	if tag == berClassContext|3 && strings.Contains(value, "*") {
+		parts := strings.Split(value, "*")
+		substrings := berConstruct(berTagSequence)
+		for i, part := range parts {
+			if part == "" {
+				continue
+			}
+			unescaped, err := unescapeLDAPFilterValue(part)
+			if err != nil {
+				return nil, "", err
+			}
+			partTag := byte(berClassContext | 1) // any
+			if i == 0 {
+				partTag = berClassContext | 0 // initial
+			} else if i == len(parts)-1 {
+				partTag = berClassContext | 2 // final
+			}
+			substrings.children = append(substrings.children, berString(partTag, unescaped))
+		}
+		return berConstruct(berClassContext|4, berString(berTagOctetString, attr), substrings), rest, nil
+	}
+	unescaped, err := unescapeLDAPFilterValue(value)
+	if err != nil {
+		return nil, "", err
+	}
+	return berConstruct(tag, berString(berTagOctetString, attr), berString(berTagOctetString, unescaped)), rest, nil
+}
+
+func unescapeLDAPFilterValue(value string) (string, error) {
+	var sb strings.Builder
+	for i := 0; i < len(value); i++ {
+		if value[i] != '\\' {
+			sb.WriteByte(value[i])
+			continue
+		}
+		if i+3 > len(value) {
+			return "", fmt.Errorf("ldap filter: invalid escape in %q", value)
+		}
+		b, err := hex.DecodeString(value[i+1 : i+3])
+		if err != nil {
+			return "", fmt.Errorf("ldap filter: invalid escape in %q", value)
+		}
+		sb.Write(b)
+		i += 2
+	}
+	return sb.String(), nil
+}
+
+// escapeLDAPFilterValue escapes user input to be used as a value in a filter.
+func escapeLDAPFilterValue(value string) string {
+	var sb strings.Builder
+	for i := 0; i < len(value); i++ {
+		switch c := value[i]; c {
+		case '*', '(', ')', '\\', 0:
+			sb.WriteString(fmt.Sprintf("\\%02x", c))
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	return sb.String()
+}
@@ -0,0 +1,193 @@
+package traefikgothauth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+)
+
+// Minimal CBOR decoding (RFC 8949) and COSE keys (RFC 9053), the subset used by WebAuthn.
+
+const cborMaxDepth = 16
+
+// cborDecode decodes the first item of data, returning the remaining bytes. Maps are decoded as
+// map[interface{}]interface{}, integers as int64, byte strings as []byte and text strings as string.
+func cborDecode(data []byte) (interface{}, []byte, error) {
+	return cborDecodeDepth(data, 0)
+}
+
+func cborDecodeDepth(data []byte, depth int) (interface{}, []byte, error) {
+	if depth > cborMaxDepth {
+		return nil, nil, errors.New("cbor: nested too deeply")
+	}
+	if len(data) == 0 {
+		return nil, nil, errors.New("cbor: unexpected end")
+	}
+	major, info := data[0]>>5, data[0]&0x1f
+	data = data[1:]
+	var arg uint64
+	switch {
+	case info < 24:
+		arg = uint64(info)
+	case info <= 27:
+		n := 1 << (info - 24)
+		if len(data) < n {
+			return nil, nil, errors.New("cbor: unexpected end")
+		}
+		for _, b := range data[:n] {
+			arg = arg<<8 | uint64(b)
+		}
+		data = data[n:]
+	default:
+		return nil, nil, errors.New("cbor: indefinite lengths are not supported")
+	}
+	switch major {
+	case 0, 1:
+		if arg > math.MaxInt64 {
+			return nil, nil, errors.New("cbor: integer overflow")
+		}
+		if major == 1 {
+			return -1 - int64(arg), data, nil
+		}
+		return int64(arg), data, nil
+	case 2, 3:
+		if uint64(len(data)) < arg {
+			return nil, nil, errors.New("cbor: unexpected end")
+		}
+		if major == 3 {
+			return string(data[:arg]), data[arg:], nil
+		}
+		return data[:arg:arg], data[arg:], nil
+	case 4:
+		if uint64(len(data)) < arg { // Each item takes at least one byte
+			return nil, nil, errors.New("cbor: unexpected end")
+		}
+		items := make([]interface{}, 0, arg)
+		for i := uint64(0); i < arg; i++ {
+			item, rest, err := cborDecodeDepth(data, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			items, data = append(items, item), rest
+		}
+		return items, data, nil
+	case 5:
+		if uint64(len(data)) < 2*arg {
+			return nil, nil, errors.New("cbor: unexpected end")
+		}
+		items := make(map[interface{}]interface{}, arg)
+		for i := uint64(0); i < arg; i++ {
+			key, rest, err := cborDecodeDepth(data, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			switch key.(type) {
+			case int64, string:
+			default:
+				return nil, nil, fmt.Errorf("cbor: unsupported map key type %T", key)
+			}
+			value, rest, err := cborDecodeDepth(rest, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			items[key], data = value, rest
+		}
+		return items, data, nil
+	case 6: // Tags are ignored
+		return cborDecodeDepth(data, depth+1)
+	default:
+		switch {
+		case info == 20 || info == 21:
+			return info == 21, data, nil
+		case info == 22 || info == 23:
+			return nil, data, nil
+		case info == 26:
+			return float64(math.Float32frombits(uint32(arg))), data, nil
+		case info == 27:
+			return math.Float64frombits(arg), data, nil
+		}
+		return nil, nil, fmt.Errorf("cbor: unsupported simple value %d", info)
+	}
+}
+
+// COSE algorithms supported for WebAuthn credentials.
+const (
+	coseAlgES256 = -7
+	coseAlgEdDSA = -8
+	coseAlgRS256 = -257
+)
+
+// parseCOSEKey decodes a COSE_Key, returning its algorithm and public key.
+func parseCOSEKey(data []byte) (int64, crypto.PublicKey, error) {
+	decoded, _, err := cborDecode(data)
+	if err != nil {
+		return 0, nil, err
+	}
+	m, ok := decoded.(map[interface{}]interface{})
+	if !ok {
+		return 0, nil, errors.New("cose: key is not a map")
+	}
+	param := func(label int64) []byte {
+		b, _ := m[label].([]byte)
+		return b
+	}
+	kty, _ := m[int64(1)].(int64)
+	alg, _ := m[int64(3)].(int64)
+	crv, _ := m[int64(-1)].(int64)
+	switch {
+	case alg == coseAlgES256 && kty == 2 && crv == 1:
+		x, y := param(-2), param(-3)
+		if len(x) != 32 || len(y) != 32 {
+			return 0, nil, errors.New("cose: invalid P-256 coordinates")
+		}
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !key.Curve.IsOnCurve(key.X, key.Y) {
+			return 0, nil, errors.New("cose: point is not on the P-256 curve")
+		}
+		return alg, key, nil
+	case alg == coseAlgEdDSA && kty == 1 && crv == 6:
+		x := param(-2)
+		if len(x) != ed25519.PublicKeySize {
+			return 0, nil, errors.New("cose: invalid Ed25519 key")
+		}
+		return alg, ed25519.PublicKey(x), nil
+	case alg == coseAlgRS256 && kty == 3:
+		n, e := param(-1), param(-2)
+		if len(n) < 256 || len(e) == 0 || len(e) > 4 {
+			return 0, nil, errors.New("cose: invalid RSA key")
+		}
+		exponent := make([]byte, 4)
+		copy(exponent[4-len(e):], e)
+		return alg, &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(binary.BigEndian.Uint32(exponent))}, nil
+	}
+	return 0, nil, fmt.Errorf("cose: unsupported key (kty %d, alg %d, crv %d)", kty, alg, crv)
+}
+
+// verifyCOSESignature checks the signature of the message with a key returned by parseCOSEKey.
+func verifyCOSESignature(alg int64, key crypto.PublicKey, message, signature []byte) error {
+	switch alg {
+	case coseAlgES256:
+		digest := sha256.Sum256(message)
+		if !ecdsa.VerifyASN1(key.(*ecdsa.PublicKey), digest[:], signature) {
+			return errors.New("invalid signature")
+		}
+		return nil
+	case coseAlgEdDSA:
+		if !ed25519.Verify(key.(ed25519.PublicKey), message, signature) {
+			return errors.New("invalid signature")
+		}
+		return nil
+	case coseAlgRS256:
+		digest := sha256.Sum256(message)
+		return rsa.VerifyPKCS1v15(key.(*rsa.PublicKey), crypto.SHA256, digest[:], signature)
+	}
+	return fmt.Errorf("unsupported algorithm %d", alg)
+}
@@ -0,0 +1,197 @@
+package traefikgothauth
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/markbates/goth"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	clientCertProviderName = "client-cert"
+	// clientCertHeader is set by Traefik's passTLSClientCert middleware (with pem: true).
+	clientCertHeader = "X-Forwarded-Tls-Client-Cert"
+)
+
+// ClientCertConfig authenticates the requests that present a TLS client certificate (mTLS), without any redirect.
+// Requests without a valid certificate fall back to the providers.
+type ClientCertConfig struct {
+	// ForwardedHeader (optional) also reads the certificate from the X-Forwarded-Tls-Client-Cert header, set by Traefik's
+	// passTLSClientCert middleware with pem: true. Requires CAFile, as the middleware also forwards unverified
+	// certificates, and TrustedProxies.
+	//
+	// The header is a bearer credential: a certificate is public, and the CA check does not prove that the client holds
+	// its private key. Only the TLS handshake of the proxy does, so the header must only be accepted from that proxy.
+	ForwardedHeader bool
+	// TrustedProxies are the addresses (CIDRs, e.g. "10.0.0.0/8", or IPs) of the proxies that verify the client
+	// certificates and set the ForwardedHeader. The header of any other client is rejected.
+	TrustedProxies []string
+	// CAFile (optional) is a PEM bundle of the certificate authorities that issue client certificates. Without it, only
+	// the certificates of connections terminated by this plugin and verified by their TLS handshake are accepted.
+	CAFile string
+	// Required (optional) rejects the requests without a valid certificate instead of falling back to the providers.
+	Required       bool
+	roots          *x509.CertPool
+	trustedProxies []*net.IPNet
+}
+
+func (c *ClientCertConfig) setup() error {
+	var errs []error
+	if c.ForwardedHeader && c.CAFile == "" {
+		errs = append(errs, errors.New("clientCert: ForwardedHeader requires CAFile, as the forwarded certificates may not be verified"))
+	}
+	if c.ForwardedHeader && len(c.TrustedProxies) == 0 {
+		errs = append(errs, errors.New("clientCert: ForwardedHeader requires TrustedProxies, as any client could send the header"))
+	}
+	for _, proxy := range c.TrustedProxies {
+		cidr := proxy
+		if ip := net.ParseIP(proxy); ip != nil && ip.To4() != nil {
+			cidr += "/32"
+		} else if ip != nil {
+			cidr += "/128"
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("clientCert: invalid trusted proxy %q: %w", proxy, err))
+			continue
+		}
+		c.trustedProxies = append(c.trustedProxies, network)
+	}
+	if c.CAFile != "" {
+		pem, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("clientCert: failed to read CA file: %w", err))
+		} else if c.roots = x509.NewCertPool(); !c.roots.AppendCertsFromPEM(pem) {
+			errs = append(errs, fmt.Errorf("clientCert: no certificates found in CA file %s", c.CAFile))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// trustedProxy returns true if the request comes directly from one of the TrustedProxies.
+func (c *ClientCertConfig) trustedProxy(req *http.Request) bool {
+	ip := net.ParseIP(clientIP(req))
+	for _, network := range c.trustedProxies {
+		if ip != nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// authenticate returns the user identified by the verified client certificate of the request, if any.
+func (c *ClientCertConfig) authenticate(req *http.Request) (*goth.User, error) {
+	var chain []*x509.Certificate
+	verified := false
+	if req.TLS != nil && len(req.TLS.PeerCertificates) > 0 {
+		chain, verified = req.TLS.PeerCertificates, len(req.TLS.VerifiedChains) > 0
+	} else if c.ForwardedHeader && req.Header.Get(clientCertHeader) != "" {
+		if !c.trustedProxy(req) {
+			return nil, fmt.Errorf("forwarded client certificate from an untrusted address %s", req.RemoteAddr)
+		}
+		var err error
+		if chain, err = parseForwardedClientCert(req.Header.Get(clientCertHeader)); err != nil {
+			return nil, err
+		}
+	}
+	if len(chain) == 0 {
+		return nil, nil
+	}
+	if c.roots != nil {
+		intermediates := x509.NewCertPool()
+		for _, cert := range chain[1:] {
+			intermediates.AddCert(cert)
+		}
+		if _, err := chain[0].Verify(x509.VerifyOptions{
+			Roots:         c.roots,
+			Intermediates: intermediates,
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}); err != nil {
+			return nil, err
+		}
+	} else if !verified {
+		return nil, errors.New("the certificate was not verified and no CAFile is configured")
+	}
+	return clientCertUser(chain[0]), nil
+}
+
+// parseForwardedClientCert decodes the certificates of the X-Forwarded-Tls-Client-Cert header: URL-escaped and
+// comma-separated PEM blocks, without their BEGIN/END lines.
+func parseForwardedClientCert(header string) ([]*x509.Certificate, error) {
+	unescaped, err := url.QueryUnescape(header)
+	if err != nil {
+		return nil, err
+	}
+	var chain []*x509.Certificate
+	for _, block := range strings.Split(unescaped, ",") {
+		block = strings.TrimPrefix(strings.TrimSpace(block), "-----BEGIN CERTIFICATE-----")
+		block = strings.TrimSuffix(block, "-----END CERTIFICATE-----")
+		der, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(block), ""))
+		if err != nil {
+			return nil, fmt.Errorf("invalid forwarded client certificate: %w", err)
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, fmt.Errorf("invalid forwarded client certificate: %w", err)
+		}
+		chain = append(chain, cert)
+	}
+	return chain, nil
+}
+
+// clientCertUser maps the subject and SANs of the certificate to claims.
+func clientCertUser(cert *x509.Certificate) *goth.User {
+	fingerprint := sha256.Sum256(cert.Raw)
+	var ips []string
+	for _, ip := range cert.IPAddresses {
+		ips = append(ips, ip.String())
+	}
+	var uris []string
+	for _, uri := range cert.URIs {
+		uris = append(uris, uri.String())
+	}
+	user := &goth.User{
+		Provider: clientCertProviderName,
+		UserID:   cert.Subject.CommonName,
+		Name:     cert.Subject.CommonName,
+		NickName: cert.Subject.CommonName,
+		RawData: map[string]interface{}{
+			"subject":             cert.Subject.String(),
+			"issuer":              cert.Issuer.String(),
+			"serial-number":       cert.SerialNumber.Text(16),
+			"fingerprint":         hex.EncodeToString(fingerprint[:]),
+			"organization":        strings.Join(cert.Subject.Organization, ","),
+			"organizational-unit": strings.Join(cert.Subject.OrganizationalUnit, ","),
+			"dns-names":           strings.Join(cert.DNSNames, ","),
+			"email-addresses":     strings.Join(cert.EmailAddresses, ","),
+			"ip-addresses":        strings.Join(ips, ","),
+			"uris":                strings.Join(uris, ","),
+		},
+		ExpiresAt: cert.NotAfter.UTC().Truncate(time.Second),
+	}
+	if len(cert.EmailAddresses) > 0 {
+		user.Email = cert.EmailAddresses[0]
+	}
+	if user.UserID == "" { // Machines are often only identified by their SANs
+		switch {
+		case len(cert.DNSNames) > 0:
+			user.UserID = cert.DNSNames[0]
+		case len(uris) > 0:
+			user.UserID = uris[0]
+		case user.Email != "":
+			user.UserID = user.Email
+		default:
+			user.UserID = hex.EncodeToString(fingerprint[:])
+		}
+	}
+	return user
+}
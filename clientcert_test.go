@@ -0,0 +1,113 @@
+package traefikgothauth
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestCertificate creates a certificate signed by parent (self-signed if nil).
+func newTestCertificate(t *testing.T, template *x509.Certificate, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.NotBefore, template.NotAfter = time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func TestClientCertificate(t *testing.T) {
+	ca, caKey := newTestCertificate(t, &x509.Certificate{Subject: pkix.Name{CommonName: "Test CA"}, IsCA: true, BasicConstraintsValid: true, KeyUsage: x509.KeyUsageCertSign}, nil, nil)
+	client, _ := newTestCertificate(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "build-agent-1", Organization: []string{"Example"}},
+		DNSNames:    []string{"agent1.internal.example.com"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca, caKey)
+	otherCA, otherCAKey := newTestCertificate(t, &x509.Certificate{Subject: pkix.Name{CommonName: "Other CA"}, IsCA: true, BasicConstraintsValid: true, KeyUsage: x509.KeyUsageCertSign}, nil, nil)
+	forged, _ := newTestCertificate(t, &x509.Certificate{Subject: pkix.Name{CommonName: "build-agent-1"}, ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}, otherCA, otherCAKey)
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	forwarded := func(cert *x509.Certificate) string {
+		return url.QueryEscape(base64.StdEncoding.EncodeToString(cert.Raw))
+	}
+
+	cfg := CreateConfig()
+	cfg.ClientCert = &ClientCertConfig{ForwardedHeader: true, CAFile: caFile, TrustedProxies: []string{"192.0.2.0/24", "2001:db8::1"}, Required: true}
+	cfg.Identities = &IdentitiesConfig{StoreFile: filepath.Join(t.TempDir(), "identities.json")}
+	subjects := map[string]bool{}
+	handler, err := New(context.Background(), http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		subjects[req.Header.Get("X-Auth-Internal-Subject")] = true
+		_, _ = rw.Write([]byte(req.Header.Get("X-Auth-User-Id") + " " + req.Header.Get("X-Auth-Organization") + " " + req.Header.Get("X-Auth-Dns-Names")))
+	}), cfg, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, test := range map[string]struct {
+		tls    *tls.ConnectionState
+		remote string
+		header string
+		status int
+	}{
+		"header":         {header: forwarded(client), status: http.StatusOK},
+		"header ipv6":    {remote: "[2001:db8::1]:1234", header: forwarded(client), status: http.StatusOK},
+		"spoofed header": {remote: "203.0.113.7:1234", header: forwarded(client), status: http.StatusUnauthorized},
+		"tls":            {tls: &tls.ConnectionState{PeerCertificates: []*x509.Certificate{client}}, status: http.StatusOK},
+		"untrusted":      {header: forwarded(forged), status: http.StatusUnauthorized},
+		"malformed":      {header: "bm90IGEgY2VydA==", status: http.StatusUnauthorized},
+		"no certificate": {status: http.StatusUnauthorized},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.TLS = test.tls
+		if test.remote != "" {
+			req.RemoteAddr = test.remote
+		}
+		if test.header != "" {
+			req.Header.Set(clientCertHeader, test.header)
+		}
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, req)
+		if rw.Code != test.status {
+			t.Errorf("%s: expected %d, got %d", name, test.status, rw.Code)
+		} else if test.status == http.StatusOK && rw.Body.String() != "build-agent-1 Example agent1.internal.example.com" {
+			t.Errorf("%s: unexpected claims %q", name, rw.Body.String())
+		}
+	}
+	if len(subjects) != 1 || subjects[""] {
+		t.Fatalf("expected the machine to have one internal subject, got %v", subjects)
+	}
+
+	cfg = CreateConfig()
+	cfg.ClientCert = &ClientCertConfig{ForwardedHeader: true}
+	if _, err = New(context.Background(), http.NotFoundHandler(), cfg, "test"); err == nil || !strings.Contains(err.Error(), "requires CAFile") || !strings.Contains(err.Error(), "requires TrustedProxies") {
+		t.Fatalf("expected forwarded certificates to require a CA file and trusted proxies, got %v", err)
+	}
+}
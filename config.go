@@ -1,12 +1,15 @@
 package traefikgothauth
 
 import (
+	"errors"
 	"fmt"
 	"github.com/gorilla/sessions"
 	"github.com/markbates/goth"
 	"github.com/markbates/goth/gothic"
+	"net/http"
 	"net/url"
 	"strings"
+	"sync"
 )
 
 // Config configures the Goth Auth plugin.
@@ -21,6 +24,36 @@ type Config struct {
 	ClaimsPrefix string
 	// LogLevel is the log level (trace, debug, info, warn, error, off).
 	LogLevel string
+	// LogFormat (optional) is the format of the logs: text (default) or json, with one object per line.
+	LogFormat string
+	// Audit (optional) writes the authentication events to a separate stream, and optionally to a webhook.
+	Audit *AuditConfig
+	// RedirectHosts (optional) are the hosts allowed in RedirectURI templates, without port. A leading "*." matches any
+	// subdomain. Requests for other hosts are rejected by the providers with a template.
+	RedirectHosts []string
+	// Routes (optional) restrict the providers accepted for some hosts or paths (the first match applies). Other
+	// requests accept all the providers.
+	Routes []*RouteRule
+	// SSO (optional) shares the logins of a central auth host with other hosts, which redirect there to log in.
+	SSO *SSOConfig
+	// Session (optional) expires idle sessions, and sessions older than a maximum lifetime.
+	Session *SessionConfig
+	// StepUp (optional) requires a recent login for sensitive hosts or paths (the strictest matching rule applies).
+	StepUp []*StepUpRule
+	// PublicRules (optional) are the requests that skip authentication, or make it optional (the first match applies).
+	PublicRules []*PublicRule
+	// TOTP (optional) requires a TOTP code after logging in, enrolling the users on their first login.
+	TOTP *TOTPConfig
+	// ClientCert (optional) authenticates the requests with a TLS client certificate, as an alternative to the providers.
+	ClientCert *ClientCertConfig
+	// DeviceFlow (optional) lets headless clients (CLIs) get a bearer token approved from an authenticated browser.
+	DeviceFlow *DeviceFlowConfig
+	// Identities (optional) links the identities of each user at several providers to a stable subject claim.
+	Identities *IdentitiesConfig
+	// Admin (optional) registers the sessions server-side, so that the admins can list and revoke them.
+	Admin *AdminConfig
+	// APIKeys (optional) lets the authenticated users create personal API keys for scripts and CI jobs.
+	APIKeys *APIKeysConfig
 }
 
 type ProviderConfig struct {
@@ -30,9 +63,15 @@ type ProviderConfig struct {
 	ClientKey string
 	// Secret is the secret for the provider.
 	Secret string
-	// RedirectUri is the full redirect URI for the provider, including the host.
-	RedirectURI string
-	redirectURI *url.URL
+	// RedirectUri is the full redirect URI for the provider, including the host. It may also be a template with the
+	// {scheme} and {host} (without port) of each request, e.g. "https://{host}/__goth/github/", or just a path, for the
+	// hosts allowed by Config.RedirectHosts. Each of them must be registered at the provider.
+	RedirectURI       string
+	redirectURI       *url.URL
+	redirectTemplate  string
+	redirectHosts     []string
+	hostProviders     map[string]goth.Provider
+	hostProvidersLock sync.Mutex
 	// AuthURI (optional) is the URI to authenticate against the provider.
 	AuthURI string
 	authURI *url.URL
@@ -43,6 +82,13 @@ type ProviderConfig struct {
 	Scopes []string
 	// Custom (optional) is the custom configuration for the provider.
 	Custom map[string]interface{}
+	// GraphGroups (optional, azuread and microsoftonline only) publishes the Microsoft Graph groups of the user.
+	GraphGroups *GraphGroupsConfig
+	// HTTPClient (optional) configures the outbound HTTP client used to contact the provider.
+	HTTPClient *HTTPClientConfig
+	httpClient *http.Client
+	info       *ProviderInfo
+	provider   goth.Provider
 }
 
 // CreateConfig creates the default plugin configuration.
@@ -55,6 +101,15 @@ func CreateConfig() *Config {
 }
 
 func (c *Config) setup() ([]*ProviderInfo, error) {
+	switch LogFormat(strings.ToLower(c.LogFormat)) {
+	case "", logFormatText:
+		logFormatCurrent = logFormatText
+	case logFormatJSON:
+		logFormatCurrent = logFormatJSON
+	default:
+		logFormatCurrent = logFormatText
+		loge("Invalid log format", "format", c.LogFormat)
+	}
 	var ok bool
 	logLevelCurrent, ok = logTextLevel[strings.ToUpper(c.LogLevel)]
 	if !ok {
@@ -68,42 +123,170 @@ func (c *Config) setup() ([]*ProviderInfo, error) {
 	gothic.Store = sessions.NewCookieStore([]byte(c.CookieSecret))
 	gothic.Store.(*sessions.CookieStore).Options = c.CookieOptions
 	providersInfo := make([]*ProviderInfo, 0, len(c.Providers))
-	for _, providerConfig := range c.Providers {
-		if providerConfig.RedirectURI == "" {
-			return nil, fmt.Errorf("I will not guess your domain name, so you must specify the redirect URI as configured for your provider %s", providerConfig.Name)
+	var errs []error
+	auditCurrent = nil
+	if c.Audit != nil {
+		if err := c.Audit.setup(); err != nil {
+			errs = append(errs, err)
+		} else {
+			auditCurrent = c.Audit
 		}
-		var err error
-		providerConfig.redirectURI, err = url.Parse(providerConfig.RedirectURI)
-		if err != nil {
-			return nil, fmt.Errorf("failed to parse redirect URI: %w", err)
+	}
+	for i, rule := range c.PublicRules {
+		if err := rule.setup(); err != nil {
+			errs = append(errs, fmt.Errorf("public rule %d: %w", i, err))
+		}
+	}
+	if c.TOTP != nil {
+		if err := c.TOTP.setup(c.CookieSecret); err != nil {
+			errs = append(errs, err)
 		}
-		if providerConfig.redirectURI.Host == "" {
-			return nil, fmt.Errorf("redirect URI must include the host: %s", providerConfig.RedirectURI)
+	}
+	if c.ClientCert != nil {
+		if err := c.ClientCert.setup(); err != nil {
+			errs = append(errs, err)
 		}
-		if providerConfig.AuthURI == "" {
-			providerConfig.AuthURI = "/__goth/" + providerConfig.Name + "/login/"
+	}
+	if c.DeviceFlow != nil {
+		if err := c.DeviceFlow.setup(c.CookieSecret); err != nil {
+			errs = append(errs, err)
 		}
-		providerConfig.authURI, err = url.Parse(providerConfig.AuthURI)
-		if err != nil {
-			return nil, fmt.Errorf("failed to parse default auth URI: %w", err)
+	}
+	if c.APIKeys != nil {
+		if err := c.APIKeys.setup(c.CookieSecret); err != nil {
+			errs = append(errs, err)
 		}
-		if providerConfig.LogoutURI == "" {
-			providerConfig.LogoutURI = "/__goth/" + providerConfig.Name + "/logout/"
+	}
+	if c.Identities != nil {
+		if err := c.Identities.setup(c.CookieSecret, c.Providers); err != nil {
+			errs = append(errs, err)
 		}
-		providerConfig.logoutURI, err = url.Parse(providerConfig.LogoutURI)
-		if err != nil {
-			return nil, fmt.Errorf("failed to parse default logout URI: %w", err)
+	}
+	if c.Admin != nil {
+		if err := c.Admin.setup(c.CookieSecret, c.CookieOptions, c.APIKeys); err != nil {
+			errs = append(errs, err)
 		}
-		providerInfo, ok := getProviderInfo(providerConfig.Name)
-		if !ok {
-			return nil, fmt.Errorf("provider not found: %s", providerConfig.Name)
+	}
+	if c.SSO != nil {
+		if err := c.SSO.setup(c.CookieSecret); err != nil {
+			errs = append(errs, err)
 		}
-		providersInfo = append(providersInfo, providerInfo)
-		provider, err := providerInfo.New(providerConfig.ClientKey, providerConfig.Secret, providerConfig.redirectURI.String(), providerConfig.Custom, providerConfig.Scopes...)
+	}
+	if c.Session != nil {
+		if err := c.Session.setup(c.CookieOptions); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for i, rule := range c.StepUp {
+		if err := rule.setup(); err != nil {
+			errs = append(errs, fmt.Errorf("step-up rule %d: %w", i, err))
+		}
+	}
+	for i, rule := range c.Routes {
+		if err := rule.setup(c); err != nil {
+			errs = append(errs, fmt.Errorf("route %d: %w", i, err))
+		}
+	}
+	for _, providerConfig := range c.Providers {
+		providerConfig.redirectHosts = c.RedirectHosts
+		providerInfo, provider, err := providerConfig.setup()
 		if err != nil {
-			return nil, fmt.Errorf("failed to create provider %s: %w", providerConfig.Name, err)
+			errs = append(errs, fmt.Errorf("provider %s: %w", providerConfig.Name, err))
+			continue
 		}
+		providersInfo = append(providersInfo, providerInfo)
 		goth.UseProviders(provider)
+		templatedProviders.Lock()
+		if providerConfig.redirectTemplate != "" {
+			templatedProviders.byName[providerConfig.Name] = providerConfig
+		} else {
+			delete(templatedProviders.byName, providerConfig.Name)
+		}
+		templatedProviders.Unlock()
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
 	}
 	return providersInfo, nil
 }
+
+// setup validates the provider configuration, reporting every problem at once, and creates the goth provider.
+func (providerConfig *ProviderConfig) setup() (*ProviderInfo, goth.Provider, error) {
+	var errs []error
+	var err error
+	var redirectURI string
+	providerConfig.redirectTemplate, redirectURI = parseRedirectTemplate(providerConfig.RedirectURI)
+	if providerConfig.RedirectURI == "" {
+		errs = append(errs, fmt.Errorf("I will not guess your domain name, so you must specify the redirect URI as configured for your provider %s", providerConfig.Name))
+	} else if providerConfig.redirectURI, err = url.Parse(redirectURI); err != nil {
+		errs = append(errs, fmt.Errorf("failed to parse redirect URI: %w", err))
+	} else if providerConfig.redirectURI.Host == "" {
+		errs = append(errs, fmt.Errorf("redirect URI must include the host: %s", providerConfig.RedirectURI))
+	} else if providerConfig.redirectTemplate != "" && len(providerConfig.redirectHosts) == 0 {
+		errs = append(errs, fmt.Errorf("redirect URI templates require RedirectHosts: %s", providerConfig.RedirectURI))
+	}
+	if providerConfig.AuthURI == "" {
+		providerConfig.AuthURI = "/__goth/" + providerConfig.Name + "/login/"
+	}
+	providerConfig.authURI, err = url.Parse(providerConfig.AuthURI)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("failed to parse default auth URI: %w", err))
+	}
+	if providerConfig.LogoutURI == "" {
+		providerConfig.LogoutURI = "/__goth/" + providerConfig.Name + "/logout/"
+	}
+	providerConfig.logoutURI, err = url.Parse(providerConfig.LogoutURI)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("failed to parse default logout URI: %w", err))
+	}
+	if providerConfig.GraphGroups != nil {
+		if err = providerConfig.GraphGroups.setup(providerConfig.Name); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if providerConfig.httpClient, err = providerConfig.HTTPClient.newHTTPClient(); err != nil {
+		errs = append(errs, fmt.Errorf("invalid HTTP client configuration: %w", err))
+	}
+	if replacement, ok := deprecatedProviders[providerConfig.Name]; ok {
+		logw("Deprecated provider, using its replacement", "provider", providerConfig.Name, "replacement", replacement)
+	}
+	providerInfo, ok := getProviderInfo(providerConfig.Name)
+	if !ok {
+		errs = append(errs, fmt.Errorf("provider not found: %s", providerConfig.Name))
+		return nil, nil, errors.Join(errs...)
+	}
+	custom, err := providerInfo.validateCustom(providerConfig.Custom)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	if len(errs) > 0 {
+		return nil, nil, errors.Join(errs...)
+	}
+	providerConfig.Custom = custom
+	if providerInfo.Name != providerConfig.Name { // Deprecated alias, keep the configured name (and URLs)
+		customized := *providerInfo
+		customized.Name = providerConfig.Name
+		providerInfo = &customized
+	}
+	if providerInfo.Name == "generic-oauth2" { // Each deployment names its own identity provider
+		customized := *providerInfo
+		if displayName, ok := custom["displayName"].(string); ok {
+			customized.DisplayName = displayName
+		}
+		if icon, ok := custom["icon"].(string); ok {
+			customized.Icon = icon
+		}
+		providerInfo = &customized
+	}
+	provider, err := providerInfo.New(providerConfig.httpClient, providerConfig.ClientKey, providerConfig.Secret, providerConfig.redirectURI.String(), custom, providerConfig.Scopes...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create provider: %w", err)
+	}
+	provider.SetName(providerConfig.Name)
+	providerConfig.info = providerInfo
+	providerConfig.provider = provider
+	if !setProviderHTTPClient(provider, providerConfig.httpClient) && providerConfig.HTTPClient != nil {
+		logw("Provider does not support a custom HTTP client, using the default one", "provider", providerConfig.Name)
+	}
+	return providerInfo, provider, nil
+}
@@ -0,0 +1,204 @@
+package traefikgothauth
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// CustomSettingType is the type of value expected for a custom provider setting.
+type CustomSettingType string
+
+const (
+	// CustomString accepts strings (numbers are converted, as YAML may parse IDs as numbers).
+	CustomString CustomSettingType = "string"
+	// CustomInt accepts integers or their string representation.
+	CustomInt CustomSettingType = "int"
+	// CustomBool accepts booleans or their string representation.
+	CustomBool CustomSettingType = "bool"
+	// CustomStringList accepts lists of strings or a comma-separated string.
+	CustomStringList CustomSettingType = "[]string"
+	// CustomStringMap accepts objects whose values are strings.
+	CustomStringMap CustomSettingType = "map[string]string"
+)
+
+// CustomSetting describes a key accepted in ProviderConfig.Custom.
+type CustomSetting struct {
+	Name        string
+	Type        CustomSettingType
+	Required    bool
+	Description string
+}
+
+func (s *CustomSetting) String() string {
+	return fmt.Sprintf("%q (%s): %s", s.Name, s.Type, s.Description)
+}
+
+// validateCustom checks the custom settings of a provider, reporting every problem at once.
+//
+// It returns a normalized copy of the settings, with canonical key names (keys are matched case-insensitively, as
+// some Traefik configuration providers lowercase them) and values converted to the declared types.
+func (p *ProviderInfo) validateCustom(custom map[string]interface{}) (map[string]interface{}, error) {
+	normalized := make(map[string]interface{}, len(custom))
+	var errs []error
+	keys := make([]string, 0, len(custom))
+	for key := range custom {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys) // Stable error messages
+	for _, key := range keys {
+		setting := p.customSetting(key)
+		if setting == nil {
+			errs = append(errs, fmt.Errorf("unknown custom setting %q%s", key, p.customSettingsHint()))
+			continue
+		}
+		value, err := setting.Type.convert(custom[key])
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid custom setting %s: %w", setting, err))
+			continue
+		}
+		normalized[setting.Name] = value
+	}
+	for _, setting := range p.Custom {
+		if _, ok := normalized[setting.Name]; setting.Required && !ok {
+			errs = append(errs, fmt.Errorf("missing required custom setting %s", setting))
+		}
+	}
+	if len(errs) == 0 && p.Validate != nil {
+		if err := p.Validate(normalized); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return normalized, nil
+}
+
+func (p *ProviderInfo) customSetting(key string) *CustomSetting {
+	for _, setting := range p.Custom {
+		if strings.EqualFold(setting.Name, key) {
+			return setting
+		}
+	}
+	return nil
+}
+
+func (p *ProviderInfo) customSettingsHint() string {
+	if len(p.Custom) == 0 {
+		return " (this provider does not accept custom settings)"
+	}
+	names := make([]string, 0, len(p.Custom))
+	for _, setting := range p.Custom {
+		names = append(names, setting.Name)
+	}
+	return " (accepted: " + strings.Join(names, ", ") + ")"
+}
+
+// requireOneOf returns a validation that fails unless all the keys of at least one of the alternatives are set.
+func requireOneOf(alternatives ...[]string) func(custom map[string]interface{}) error {
+	return func(custom map[string]interface{}) error {
+		for _, keys := range alternatives {
+			complete := true
+			for _, key := range keys {
+				if _, ok := custom[key]; !ok {
+					complete = false
+					break
+				}
+			}
+			if complete {
+				return nil
+			}
+		}
+		options := make([]string, 0, len(alternatives))
+		for _, keys := range alternatives {
+			options = append(options, strings.Join(keys, " + "))
+		}
+		return fmt.Errorf("missing custom settings, one of these sets is required: %s", strings.Join(options, " | "))
+	}
+}
+
+func (t CustomSettingType) convert(value interface{}) (interface{}, error) {
+	switch t {
+	case CustomString:
+		switch v := value.(type) {
+		case string:
+			return v, nil
+		case int:
+			return strconv.Itoa(v), nil
+		case int64:
+			return strconv.FormatInt(v, 10), nil
+		case uint64:
+			return strconv.FormatUint(v, 10), nil
+		case float64:
+			return strconv.FormatFloat(v, 'f', -1, 64), nil
+		}
+	case CustomInt:
+		switch v := value.(type) {
+		case int:
+			return v, nil
+		case int64:
+			return int(v), nil
+		case float64:
+			if v == float64(int(v)) {
+				return int(v), nil
+			}
+		case string:
+			i, err := strconv.Atoi(v)
+			if err == nil {
+				return i, nil
+			}
+		}
+	case CustomBool:
+		switch v := value.(type) {
+		case bool:
+			return v, nil
+		case string:
+			b, err := strconv.ParseBool(v)
+			if err == nil {
+				return b, nil
+			}
+		}
+	case CustomStringList:
+		switch v := value.(type) {
+		case []string:
+			return v, nil
+		case string:
+			list := strings.Split(v, ",")
+			for i := range list {
+				list[i] = strings.TrimSpace(list[i])
+			}
+			return list, nil
+		case []interface{}:
+			list := make([]string, 0, len(v))
+			for _, item := range v {
+				str, ok := item.(string)
+				if !ok {
+					return nil, fmt.Errorf("expected a list of strings, found item %v (%T)", item, item)
+				}
+				list = append(list, str)
+			}
+			return list, nil
+		}
+	case CustomStringMap:
+		switch v := value.(type) {
+		case map[string]string:
+			return v, nil
+		case map[string]interface{}:
+			m := make(map[string]string, len(v))
+			for key, item := range v {
+				str, ok := item.(string)
+				if !ok {
+					return nil, fmt.Errorf("expected an object of strings, found %s=%v (%T)", key, item, item)
+				}
+				m[key] = str
+			}
+			return m, nil
+		}
+	default:
+		return nil, fmt.Errorf("unsupported setting type %s", t)
+	}
+	return nil, fmt.Errorf("expected %s, found %v (%T)", t, value, value)
+}
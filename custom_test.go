@@ -0,0 +1,61 @@
+package traefikgothauth
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateCustom(t *testing.T) {
+	okta, _ := getProviderInfo("okta")
+	_, err := okta.validateCustom(map[string]interface{}{"orgurl": 42, "domain": "example.com"})
+	if err == nil || !strings.Contains(err.Error(), `unknown custom setting "domain"`) {
+		t.Fatalf("expected the unknown key to be reported, got: %v", err)
+	}
+
+	_, err = okta.validateCustom(nil)
+	if err == nil || !strings.Contains(err.Error(), `missing required custom setting "orgURL"`) {
+		t.Fatalf("expected the missing key to be reported, got: %v", err)
+	}
+
+	azure, _ := getProviderInfo("azuread")
+	custom, err := azure.validateCustom(map[string]interface{}{"Resources": []interface{}{"a", "b"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resources, ok := custom["resources"].([]string); !ok || len(resources) != 2 {
+		t.Fatalf("expected the resources to be converted, got: %#v", custom)
+	}
+
+	oidc, _ := getProviderInfo("openid-connect")
+	_, err = oidc.validateCustom(map[string]interface{}{"authURL": "https://example.com", "skipUserInfoRequest": "maybe"})
+	if err == nil || !strings.Contains(err.Error(), "skipUserInfoRequest") {
+		t.Fatalf("expected the invalid bool to be reported, got: %v", err)
+	}
+
+	for value, expected := range map[interface{}]string{float64(1000002): "1000002", 1.5: "1.5", 42: "42", int64(7): "7"} {
+		if converted, err := CustomString.convert(value); err != nil || converted != expected {
+			t.Errorf("expected %v to be converted to %q, got %q (%v)", value, expected, converted, err)
+		}
+	}
+}
+
+func TestConfigSetupReportsAllProblems(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.Providers = []*ProviderConfig{
+		{Name: "okta"},
+		{Name: "wecom", RedirectURI: "https://example.com/__goth/wecom/", Custom: map[string]interface{}{"agentID": 1000002}},
+		{Name: "unknown", RedirectURI: "https://example.com/__goth/unknown/"},
+	}
+	_, err := cfg.setup()
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	for _, expected := range []string{"provider okta: I will not guess", `missing required custom setting "orgURL"`, "provider not found: unknown"} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected %q in error: %v", expected, err)
+		}
+	}
+	if strings.Contains(err.Error(), "wecom") {
+		t.Errorf("did not expect an error for wecom: %v", err)
+	}
+}
@@ -0,0 +1,324 @@
+package traefikgothauth
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/markbates/goth"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	devicePath        = "/__goth/device/"
+	deviceCodePath    = "/__goth/device/code"
+	deviceTokenPath   = "/__goth/device/token"
+	deviceGrantType   = "urn:ietf:params:oauth:grant-type:device_code"
+	deviceTokenPrefix = "gothdev_"
+	// deviceUserCodeAlphabet avoids vowels (no words) and ambiguous characters.
+	deviceUserCodeAlphabet = "BCDFGHJKLMNPQRSTVWXZ"
+	// deviceMaxPendingAuthorizations limits the memory used by the codes requested by unauthenticated clients.
+	deviceMaxPendingAuthorizations = 1000
+)
+
+// DeviceFlowConfig enables the OAuth 2.0 device authorization flow (RFC 8628) for headless clients: a CLI gets a
+// code, the user approves it in a browser authenticated by any provider, and the CLI receives a bearer token that is
+// accepted instead of the session cookie.
+//
+// The CLI requests a code with POST /__goth/device/code, the user approves it at /__goth/device/ and the CLI polls
+// POST /__goth/device/token with grant_type=urn:ietf:params:oauth:grant-type:device_code and the device_code.
+type DeviceFlowConfig struct {
+	// TokenTTL (optional) is the lifetime of the bearer tokens, e.g. "720h" (default). They can not be revoked
+	// individually: revoke all the sessions of their user in the Admin page, or change the CookieSecret to revoke all
+	// of them.
+	TokenTTL string
+	// CodeTTL (optional) is the time given to the user to approve a code, e.g. "10m" (default).
+	CodeTTL string
+	// Interval (optional) is the minimum number of seconds between polls of the token endpoint. Defaults to 5.
+	Interval   int
+	tokenTTL   time.Duration
+	codeTTL    time.Duration
+	tokenKey   []byte
+	approveKey []byte
+	limiter    *loginRateLimiter
+}
+
+// deviceGrant is the identity granted to a device, the value of its bearer token.
+type deviceGrant struct {
+	Provider string
+	Claims   map[string]interface{}
+	// Issued is when the token was issued, to reject it if the sessions of the user are revoked later.
+	Issued time.Time
+}
+
+// deviceAuthorization is a pending authorization request.
+type deviceAuthorization struct {
+	userCode string
+	expires  time.Time
+	lastPoll time.Time
+	grant    *deviceGrant
+	denied   bool
+}
+
+// deviceAuthorizations are the pending requests by device code, shared by all the plugin instances of this process.
+var deviceAuthorizations = struct {
+	sync.Mutex
+	byDeviceCode map[string]*deviceAuthorization
+}{byDeviceCode: map[string]*deviceAuthorization{}}
+
+func (c *DeviceFlowConfig) setup(cookieSecret string) error {
+	var errs []error
+	var err error
+	if c.tokenTTL, err = parseDurationDefault(c.TokenTTL, 30*24*time.Hour); err != nil {
+		errs = append(errs, fmt.Errorf("deviceFlow: failed to parse TokenTTL: %w", err))
+	}
+	if c.codeTTL, err = parseDurationDefault(c.CodeTTL, 10*time.Minute); err != nil {
+		errs = append(errs, fmt.Errorf("deviceFlow: failed to parse CodeTTL: %w", err))
+	}
+	if c.Interval <= 0 {
+		c.Interval = 5
+	}
+	c.tokenKey = signingKey(cookieSecret, "device-token")
+	c.approveKey = signingKey(cookieSecret, "device-approve")
+	c.limiter = newLoginRateLimiter(10, 15*time.Minute)
+	return errors.Join(errs...)
+}
+
+// serveEndpoints serves the endpoints used by the CLI, returning true if it handled the request.
+func (c *DeviceFlowConfig) serveEndpoints(rw http.ResponseWriter, req *http.Request) bool {
+	switch req.URL.Path {
+	case deviceCodePath:
+		if req.Method != http.MethodPost {
+			http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+			return true
+		}
+		c.serveCode(rw, req)
+		return true
+	case deviceTokenPath:
+		if req.Method != http.MethodPost {
+			http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+			return true
+		}
+		c.serveToken(rw, req)
+		return true
+	}
+	return false
+}
+
+func (c *DeviceFlowConfig) serveCode(rw http.ResponseWriter, req *http.Request) {
+	// Issued codes count as failed attempts, so that a client can not fill the pending authorizations
+	limiterKey := "ip:" + clientIP(req)
+	if !c.limiter.allowed(limiterKey) {
+		logw("Too many device codes requested", "request", requestID(req), "remote", req.RemoteAddr)
+		serveJSON(rw, http.StatusTooManyRequests, map[string]string{"error": "slow_down"})
+		return
+	}
+	c.limiter.fail(limiterKey)
+	deviceCode, userCode := randomString(32), newDeviceUserCode()
+	deviceAuthorizations.Lock()
+	now := time.Now()
+	if len(deviceAuthorizations.byDeviceCode) >= deviceMaxPendingAuthorizations {
+		for code, authorization := range deviceAuthorizations.byDeviceCode {
+			if now.After(authorization.expires) {
+				delete(deviceAuthorizations.byDeviceCode, code)
+			}
+		}
+	}
+	full := len(deviceAuthorizations.byDeviceCode) >= deviceMaxPendingAuthorizations
+	if !full {
+		deviceAuthorizations.byDeviceCode[deviceCode] = &deviceAuthorization{userCode: userCode, expires: now.Add(c.codeTTL)}
+	}
+	deviceAuthorizations.Unlock()
+	if full {
+		logw("Too many pending device authorizations", "request", requestID(req), "remote", req.RemoteAddr)
+		serveJSON(rw, http.StatusServiceUnavailable, map[string]string{"error": "temporarily_unavailable"})
+		return
+	}
+	verificationURI := requestBaseURL(req) + devicePath
+	logd("Issued device code", "request", requestID(req), "userCode", userCode, "remote", req.RemoteAddr)
+	serveJSON(rw, http.StatusOK, map[string]interface{}{
+		"device_code":               deviceCode,
+		"user_code":                 userCode,
+		"verification_uri":          verificationURI,
+		"verification_uri_complete": verificationURI + "?" + url.Values{"user_code": {userCode}}.Encode(),
+		"expires_in":                int(c.codeTTL.Seconds()),
+		"interval":                  c.Interval,
+	})
+}
+
+func (c *DeviceFlowConfig) serveToken(rw http.ResponseWriter, req *http.Request) {
+	if req.FormValue("grant_type") != deviceGrantType {
+		serveJSON(rw, http.StatusBadRequest, map[string]string{"error": "unsupported_grant_type"})
+		return
+	}
+	deviceAuthorizations.Lock()
+	defer deviceAuthorizations.Unlock()
+	deviceCode := req.FormValue("device_code")
+	authorization, ok := deviceAuthorizations.byDeviceCode[deviceCode]
+	now := time.Now()
+	switch {
+	case !ok || now.After(authorization.expires):
+		delete(deviceAuthorizations.byDeviceCode, deviceCode)
+		serveJSON(rw, http.StatusBadRequest, map[string]string{"error": "expired_token"})
+	case authorization.denied:
+		delete(deviceAuthorizations.byDeviceCode, deviceCode)
+		serveJSON(rw, http.StatusBadRequest, map[string]string{"error": "access_denied"})
+	case authorization.grant != nil:
+		delete(deviceAuthorizations.byDeviceCode, deviceCode)
+		authorization.grant.Issued = now.UTC()
+		token, err := signToken(c.tokenKey, "device-token", c.tokenTTL, authorization.grant)
+		if err != nil {
+			loge("Failed to sign device token", "request", requestID(req), "error", err)
+			serveJSON(rw, http.StatusInternalServerError, map[string]string{"error": "server_error"})
+			return
+		}
+		logi("Issued device token", "request", requestID(req), "provider", authorization.grant.Provider, "user", authorization.grant.Claims["user-id"])
+		serveJSON(rw, http.StatusOK, map[string]interface{}{
+			"access_token": deviceTokenPrefix + token,
+			"token_type":   "Bearer",
+			"expires_in":   int(c.tokenTTL.Seconds()),
+		})
+	case now.Sub(authorization.lastPoll) < time.Duration(c.Interval)*time.Second:
+		authorization.lastPoll = now
+		serveJSON(rw, http.StatusBadRequest, map[string]string{"error": "slow_down"})
+	default:
+		authorization.lastPoll = now
+		serveJSON(rw, http.StatusBadRequest, map[string]string{"error": "authorization_pending"})
+	}
+}
+
+// authenticateBearer returns the identity of the device token of the request. Other bearer tokens are ignored, as
+// they may be meant for the next handler.
+func (c *DeviceFlowConfig) authenticateBearer(req *http.Request) (*deviceGrant, error) {
+	token, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer "+deviceTokenPrefix)
+	if !ok {
+		return nil, nil
+	}
+	grant := &deviceGrant{}
+	if err := verifyToken(c.tokenKey, "device-token", token, grant); err != nil {
+		return nil, err
+	}
+	return grant, nil
+}
+
+// serveVerification serves the page where the authenticated user approves a device, returning true if it handled
+// the request.
+func (c *DeviceFlowConfig) serveVerification(rw http.ResponseWriter, req *http.Request, providerName string, auth *goth.User) bool {
+	if req.URL.Path != devicePath {
+		return false
+	}
+	page := &devicePage{Title: "Connect a device", UserCode: req.FormValue("user_code"), User: auth.Email}
+	if page.User == "" {
+		page.User = auth.Name
+	}
+	status := http.StatusOK
+	if req.Method == http.MethodPost {
+		var expected string
+		limiterKey := "user:" + providerName + ":" + auth.UserID
+		switch {
+		case verifyToken(c.approveKey, "device-approve", req.PostForm.Get("csrf"), &expected) != nil || expected != providerName+":"+auth.UserID:
+			page.Error, status = "Your session expired, please try again", http.StatusBadRequest
+		case !c.limiter.allowed(limiterKey):
+			page.Error, status = "Too many failed attempts, please try again later", http.StatusTooManyRequests
+		default:
+			approve := req.PostForm.Get("action") == "approve"
+			grant := &deviceGrant{Provider: providerName, Claims: auth.RawData}
+			if !c.decide(page.UserCode, approve, grant) {
+				c.limiter.fail(limiterKey)
+				logw("Invalid device user code", "request", requestID(req), "provider", providerName, "user", auth.UserID, "remote", req.RemoteAddr)
+				page.Error, status = "This code is invalid or expired", http.StatusBadRequest
+				break
+			}
+			logi("Device authorization decided", "request", requestID(req), "provider", providerName, "user", auth.UserID, "approved", approve)
+			page.Message = "The device was denied access, you can close this page."
+			if approve {
+				page.Message = "The device is now connected, you can close this page."
+			}
+			servePage(rw, http.StatusOK, deviceHtml, page)
+			return true
+		}
+	}
+	csrf, err := signToken(c.approveKey, "device-approve", c.codeTTL, providerName+":"+auth.UserID)
+	if err != nil {
+		loge("Failed to sign device approval", "request", requestID(req), "error", err)
+		http.Error(rw, "Failed to serve the page", http.StatusInternalServerError)
+		return true
+	}
+	page.CSRF = csrf
+	servePage(rw, status, deviceHtml, page)
+	return true
+}
+
+// decide approves or denies the pending authorization with the given user code.
+func (c *DeviceFlowConfig) decide(userCode string, approve bool, grant *deviceGrant) bool {
+	userCode = normalizeDeviceUserCode(userCode)
+	deviceAuthorizations.Lock()
+	defer deviceAuthorizations.Unlock()
+	for _, authorization := range deviceAuthorizations.byDeviceCode {
+		if normalizeDeviceUserCode(authorization.userCode) != userCode || time.Now().After(authorization.expires) ||
+			authorization.grant != nil || authorization.denied {
+			continue
+		}
+		if approve {
+			authorization.grant = grant
+		} else {
+			authorization.denied = true
+		}
+		return true
+	}
+	return false
+}
+
+// newDeviceUserCode returns a code that is easy to type, e.g. "BDFG-HJKL".
+func newDeviceUserCode() string {
+	b := make([]byte, 8)
+	for i := range b {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(deviceUserCodeAlphabet))))
+		if err != nil {
+			panic("source of randomness unavailable: " + err.Error())
+		}
+		b[i] = deviceUserCodeAlphabet[n.Int64()]
+	}
+	return string(b[:4]) + "-" + string(b[4:])
+}
+
+func normalizeDeviceUserCode(code string) string {
+	return strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
+
+// requestBaseURL returns the scheme and host of the request, as seen by the client.
+func requestBaseURL(req *http.Request) string {
+	return requestScheme(req) + "://" + req.Host
+}
+
+// requestScheme returns the scheme of the request, as seen by the client.
+func requestScheme(req *http.Request) string {
+	scheme := "http"
+	if req.TLS != nil {
+		scheme = "https"
+	}
+	if forwarded := req.Header.Get("X-Forwarded-Proto"); forwarded == "http" || forwarded == "https" {
+		scheme = forwarded
+	}
+	return scheme
+}
+
+// serveJSON writes a JSON response that is never cached.
+func serveJSON(rw http.ResponseWriter, status int, value interface{}) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.WriteHeader(status)
+	_ = json.NewEncoder(rw).Encode(value)
+}
+
+// devicePage is the data of deviceHtml.
+type devicePage struct {
+	Title, Error, Message, User, UserCode, CSRF string
+}
+
+var deviceHtml = newPageTemplate("deviceTemplate", `{{if .Error}}<div class="login-box-error">{{.Error}}</div>{{end}} {{if .Message}}<div class="login-box-message">{{.Message}}</div>{{else}}<form class="login-box-form" method="post" action="`+devicePath+`"> <div class="login-box-message">Allow a device to access as <b>{{.User}}</b></div> <input type="hidden" name="csrf" value="{{.CSRF}}"> <label>Code shown on the device <input name="user_code" type="text" value="{{.UserCode}}" autocomplete="off" autocapitalize="characters" required autofocus></label> <button class="btn" type="submit" name="action" value="approve">Allow</button> <button class="btn" type="submit" name="action" value="deny">Deny</button> </form>{{end}}`)
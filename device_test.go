@@ -0,0 +1,115 @@
+package traefikgothauth
+
+import (
+	"context"
+	"encoding/json"
+	"golang.org/x/crypto/bcrypt"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"testing"
+)
+
+func TestDeviceFlow(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var handler http.Handler
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		handler.ServeHTTP(rw, req)
+	}))
+	defer server.Close()
+	cfg := CreateConfig()
+	cfg.CookieSecret = "secret-for-testing-only"
+	cfg.DeviceFlow = &DeviceFlowConfig{}
+	cfg.Providers = []*ProviderConfig{{
+		Name:        "local",
+		RedirectURI: server.URL + "/__goth/local/",
+		Custom:      map[string]interface{}{"users": map[string]interface{}{"alice": string(hash)}},
+	}}
+	handler, err = New(context.Background(), http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_, _ = rw.Write([]byte("hello " + req.Header.Get("X-Auth-User-Id")))
+	}), cfg, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	read := func(res *http.Response, err error) (*http.Response, string) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(res.Body)
+		_ = res.Body.Close()
+		return res, string(body)
+	}
+	poll := func(deviceCode string) map[string]interface{} {
+		_, body := read(http.PostForm(server.URL+deviceTokenPath, url.Values{"grant_type": {deviceGrantType}, "device_code": {deviceCode}}))
+		response := map[string]interface{}{}
+		if err := json.Unmarshal([]byte(body), &response); err != nil {
+			t.Fatal(err)
+		}
+		return response
+	}
+
+	// The CLI gets a code
+	_, body := read(http.PostForm(server.URL+deviceCodePath, nil))
+	code := map[string]interface{}{}
+	if err = json.Unmarshal([]byte(body), &code); err != nil {
+		t.Fatal(err)
+	}
+	deviceCode, _ := code["device_code"].(string)
+	if response := poll(deviceCode); response["error"] != "authorization_pending" {
+		t.Fatalf("expected the authorization to be pending, got %v", response)
+	}
+
+	// The user logs in and approves it
+	jar, _ := cookiejar.New(nil)
+	browser := &http.Client{Jar: jar}
+	res, _ := read(browser.Get(code["verification_uri_complete"].(string)))
+	res, body = read(browser.PostForm(res.Request.URL.String(), url.Values{
+		"state": {res.Request.URL.Query().Get("state")}, "username": {"alice"}, "password": {"hunter2"},
+	}))
+	csrf := regexp.MustCompile(`name="csrf" value="([^"]+)"`).FindStringSubmatch(body)
+	if res.Request.URL.Path != devicePath || csrf == nil {
+		t.Fatalf("expected the approval page, got %d at %s: %s", res.StatusCode, res.Request.URL, body)
+	}
+	approve := url.Values{"csrf": {csrf[1]}, "user_code": {code["user_code"].(string)}, "action": {"approve"}}
+	if res, _ = read(browser.PostForm(server.URL+devicePath, url.Values{"user_code": approve["user_code"], "action": {"approve"}})); res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected the approval without CSRF token to be rejected, got %d", res.StatusCode)
+	}
+	if res, _ = read(browser.PostForm(server.URL+devicePath, approve)); res.StatusCode != http.StatusOK {
+		t.Fatalf("expected the device to be approved, got %d", res.StatusCode)
+	}
+
+	// The CLI gets a token and uses it
+	response := poll(deviceCode)
+	token, _ := response["access_token"].(string)
+	if token == "" {
+		t.Fatalf("expected a token, got %v", response)
+	}
+	if response = poll(deviceCode); response["error"] != "expired_token" {
+		t.Fatalf("expected the device code to be single-use, got %v", response)
+	}
+	req, _ := http.NewRequest(http.MethodGet, server.URL+"/api", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	if res, body = read(http.DefaultClient.Do(req)); body != "hello alice" {
+		t.Fatalf("expected the token to be accepted, got %d: %s", res.StatusCode, body)
+	}
+	req.Header.Set("Authorization", "Bearer "+token+"x")
+	if res, _ = read(http.DefaultClient.Do(req)); res.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected the tampered token to be rejected, got %d", res.StatusCode)
+	}
+
+	// Clients can not request codes without limit
+	status := http.StatusOK
+	for i := 0; i < 100 && status == http.StatusOK; i++ {
+		res, _ = read(http.PostForm(server.URL+deviceCodePath, nil))
+		status = res.StatusCode
+	}
+	if status != http.StatusTooManyRequests {
+		t.Fatalf("expected the codes of a client to be rate limited, got %d", status)
+	}
+}
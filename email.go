@@ -0,0 +1,269 @@
+package traefikgothauth
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/markbates/goth"
+	"mime"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// emailProvider logs users in with single-use links sent to their email address (magic links).
+type emailProvider struct {
+	*formProvider
+	linkKey        []byte
+	linkTTL        time.Duration
+	subject        string
+	allowedEmails  map[string]bool
+	allowedDomains map[string]bool
+	smtp           *smtpConfig
+	sending        chan struct{}
+}
+
+// emailMaxPendingSends limits the emails being sent at once, dropping the links requested during a burst.
+const emailMaxPendingSends = 10
+
+var _ loginPageProvider = &emailProvider{}
+
+// emailLink is the value of the signed token of a login link.
+type emailLink struct {
+	ID, Email, State string
+}
+
+func newEmailProvider(client *http.Client, secret, callback string, custom map[string]interface{}) (*emailProvider, error) {
+	form, err := newFormProvider("email", "Email login", secret, callback, custom)
+	if err != nil {
+		return nil, err
+	}
+	p := &emailProvider{
+		formProvider:   form,
+		linkKey:        signingKey(secret, "email-link"),
+		allowedEmails:  map[string]bool{},
+		allowedDomains: map[string]bool{},
+		sending:        make(chan struct{}, emailMaxPendingSends),
+	}
+	linkTTL, _ := custom["linkTTL"].(string)
+	if p.linkTTL, err = parseDurationDefault(linkTTL, 15*time.Minute); err != nil {
+		return nil, fmt.Errorf("failed to parse linkTTL: %w", err)
+	}
+	if p.subject, _ = custom["subject"].(string); p.subject == "" {
+		p.subject = "Your login link"
+	}
+	allowedEmails, _ := custom["allowedEmails"].([]string)
+	for _, email := range allowedEmails {
+		p.allowedEmails[strings.ToLower(email)] = true
+	}
+	allowedDomains, _ := custom["allowedDomains"].([]string)
+	for _, domain := range allowedDomains {
+		p.allowedDomains[strings.ToLower(strings.TrimPrefix(domain, "@"))] = true
+	}
+	if p.smtp, err = newSMTPConfig(client, custom); err != nil {
+		return nil, err
+	}
+	form.fields = []loginFormField{{Name: "username", Label: "Email", Type: "email", Autocomplete: "email"}}
+	form.submit = "Send login link"
+	form.verify = p.sendLink
+	return p, nil
+}
+
+// linkPath is the path of the login links.
+func (p *emailProvider) linkPath() string {
+	return "/__goth/" + p.providerName + "/link/"
+}
+
+// allowed returns whether the (lowercase) address may log in.
+func (p *emailProvider) allowed(email string) bool {
+	_, domain, _ := strings.Cut(email, "@")
+	return p.allowedEmails[email] || p.allowedDomains[domain]
+}
+
+// sendLink emails a login link to the submitted address. The login continues when the link is opened.
+//
+// The email is sent in the background, so that allowed and forbidden addresses get the same answer in the same time.
+func (p *emailProvider) sendLink(req *http.Request, form url.Values) (*goth.User, error) {
+	address, err := mail.ParseAddress(form.Get("username"))
+	if err != nil || address.Name != "" {
+		return nil, fmt.Errorf("invalid email address %q", form.Get("username"))
+	}
+	email := strings.ToLower(address.Address)
+	// The same answer is given for addresses that are not allowed, so that they can not be discovered
+	sent := errLoginPending("If this address is allowed to log in, a login link was sent to it. It expires in " + p.linkTTL.String() + ".")
+	// Sent links count as failed attempts, so that nobody can flood an inbox
+	p.limiter.fail("ip:"+clientIP(req), "user:"+strings.ToLower(form.Get("username")))
+	if !p.allowed(email) {
+		logw("Login link requested for an address that is not allowed", "request", requestID(req), "provider", p.providerName, "email", email, "remote", req.RemoteAddr)
+		return nil, sent
+	}
+	token, err := signToken(p.linkKey, p.providerName+"-link", p.linkTTL, &emailLink{ID: randomString(16), Email: email, State: form.Get("state")})
+	if err != nil {
+		return nil, err
+	}
+	link, err := url.Parse(p.callbackURL)
+	if err != nil {
+		return nil, err
+	}
+	link.Path, link.RawQuery = p.linkPath(), url.Values{"token": {token}}.Encode()
+	body := "Open this link to log in:\n\n" + link.String() + "\n\nIt expires in " + p.linkTTL.String() +
+		" and only works in the browser where the login was started.\nIf you did not request it, you can ignore this email.\n"
+	request := requestID(req)
+	select {
+	case p.sending <- struct{}{}:
+		go func() {
+			defer func() { <-p.sending }()
+			if err := p.smtp.send(email, p.subject, body); err != nil {
+				loge("Failed to send login link", "request", request, "provider", p.providerName, "email", email, "error", err)
+				return
+			}
+			logi("Sent login link", "request", request, "provider", p.providerName, "email", email)
+		}()
+	default:
+		logw("Too many login links being sent, dropping one", "request", requestID(req), "provider", p.providerName, "email", email)
+	}
+	return nil, sent
+}
+
+// ServeLoginPage serves the login form and the login links.
+func (p *emailProvider) ServeLoginPage(rw http.ResponseWriter, req *http.Request) bool {
+	if req.URL.Path != p.linkPath() {
+		return p.formProvider.ServeLoginPage(rw, req)
+	}
+	page := &emailLinkPage{Title: p.title, Token: req.FormValue("token")}
+	link := &emailLink{}
+	if err := verifyToken(p.linkKey, p.providerName+"-link", page.Token, link); err != nil {
+		logw("Invalid login link", "request", requestID(req), "provider", p.providerName, "remote", req.RemoteAddr, "error", err)
+		page.Error = "This login link is invalid or expired"
+		servePage(rw, http.StatusBadRequest, emailLinkHtml, page)
+		return true
+	}
+	page.Email = link.Email
+	// Opening the link only shows a button: email scanners that follow links must not consume it
+	if req.Method != http.MethodPost {
+		servePage(rw, http.StatusOK, emailLinkHtml, page)
+		return true
+	}
+	if !consumeToken(p.providerName+"-link:"+link.ID, time.Now().Add(p.linkTTL)) {
+		logw("Login link reused", "request", requestID(req), "provider", p.providerName, "email", link.Email, "remote", req.RemoteAddr)
+		page.Error = "This login link was already used"
+		servePage(rw, http.StatusBadRequest, emailLinkHtml, page)
+		return true
+	}
+	callbackURL, err := p.callbackWithCode(&goth.User{UserID: link.Email, Email: link.Email, Name: link.Email}, link.State)
+	if err != nil {
+		loge("Failed to sign login code", "request", requestID(req), "provider", p.providerName, "error", err)
+		http.Error(rw, "Failed to log in", http.StatusInternalServerError)
+		return true
+	}
+	http.Redirect(rw, req, callbackURL, http.StatusSeeOther)
+	return true
+}
+
+// emailLinkPage is the data of emailLinkHtml.
+type emailLinkPage struct {
+	Title, Error, Email, Token string
+}
+
+var emailLinkHtml = newPageTemplate("emailLinkTemplate", `{{if .Error}}<div class="login-box-error">{{.Error}}</div>{{else}}<form class="login-box-form" method="post"> <input type="hidden" name="token" value="{{.Token}}"> <div class="login-box-message">Log in as <b>{{.Email}}</b></div> <button class="btn" type="submit" autofocus>Continue</button> </form>{{end}}`)
+
+// smtpConfig is the SMTP server that sends the emails.
+type smtpConfig struct {
+	address, host      string
+	username, password string
+	from               *mail.Address
+	security           string
+	tlsConfig          *tls.Config
+	timeout            time.Duration
+}
+
+func newSMTPConfig(client *http.Client, custom map[string]interface{}) (*smtpConfig, error) {
+	c := &smtpConfig{}
+	c.address, _ = custom["smtpAddress"].(string)
+	var err error
+	if c.host, _, err = net.SplitHostPort(c.address); err != nil {
+		return nil, fmt.Errorf("smtpAddress must be host:port: %w", err)
+	}
+	c.username, _ = custom["smtpUsername"].(string)
+	c.password, _ = custom["smtpPassword"].(string)
+	if c.security, _ = custom["smtpSecurity"].(string); c.security == "" {
+		c.security = "starttls"
+	}
+	if c.security != "starttls" && c.security != "tls" && c.security != "none" {
+		return nil, fmt.Errorf("smtpSecurity must be starttls, tls or none, got %q", c.security)
+	}
+	from, _ := custom["from"].(string)
+	if c.from, err = mail.ParseAddress(from); err != nil {
+		return nil, fmt.Errorf("invalid from address: %w", err)
+	}
+	c.tlsConfig, c.timeout = clientTLSSettings(client)
+	c.tlsConfig.ServerName = c.host
+	return c, nil
+}
+
+// send sends a plain text email.
+func (c *smtpConfig) send(to, subject, body string) error {
+	dialer := &net.Dialer{Timeout: c.timeout}
+	var conn net.Conn
+	var err error
+	if c.security == "tls" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", c.address, c.tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", c.address)
+	}
+	if err != nil {
+		return err
+	}
+	if err = conn.SetDeadline(time.Now().Add(c.timeout)); err != nil {
+		_ = conn.Close()
+		return err
+	}
+	client, err := smtp.NewClient(conn, c.host)
+	if err != nil {
+		_ = conn.Close()
+		return err
+	}
+	defer func() { _ = client.Close() }()
+	if c.security == "starttls" {
+		if ok, _ := client.Extension("STARTTLS"); !ok {
+			return errors.New("the SMTP server does not support STARTTLS")
+		}
+		if err = client.StartTLS(c.tlsConfig); err != nil {
+			return err
+		}
+	}
+	if c.username != "" {
+		if err = client.Auth(smtp.PlainAuth("", c.username, c.password, c.host)); err != nil {
+			return err
+		}
+	}
+	if err = client.Mail(c.from.Address); err != nil {
+		return err
+	}
+	if err = client.Rcpt(to); err != nil {
+		return err
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	message := "From: " + c.from.String() + "\r\n" +
+		"To: " + to + "\r\n" +
+		"Subject: " + mime.QEncoding.Encode("utf-8", subject) + "\r\n" +
+		"Date: " + time.Now().Format(time.RFC1123Z) + "\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"Content-Transfer-Encoding: 8bit\r\n\r\n" +
+		strings.ReplaceAll(body, "\n", "\r\n")
+	if _, err = w.Write([]byte(message)); err != nil {
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
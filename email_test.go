@@ -0,0 +1,144 @@
+package traefikgothauth
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startSMTPTestServer accepts every email, sending their content to the returned channel.
+func startSMTPTestServer(t *testing.T) (string, chan string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+	emails := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer func() { _ = conn.Close() }()
+				r := bufio.NewReader(conn)
+				reply := func(line string) { _, _ = conn.Write([]byte(line + "\r\n")) }
+				reply("220 localhost ESMTP test")
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					switch command := strings.ToUpper(strings.Fields(line + " x")[0]); command {
+					case "EHLO", "HELO", "MAIL", "RCPT", "RSET", "NOOP":
+						reply("250 OK")
+					case "DATA":
+						reply("354 Go ahead")
+						var data strings.Builder
+						for {
+							line, err = r.ReadString('\n')
+							if err != nil || line == ".\r\n" {
+								break
+							}
+							data.WriteString(line)
+						}
+						emails <- data.String()
+						reply("250 Queued")
+					case "QUIT":
+						reply("221 Bye")
+						return
+					default:
+						reply("502 Not implemented")
+					}
+				}
+			}()
+		}
+	}()
+	return listener.Addr().String(), emails
+}
+
+func TestEmailLogin(t *testing.T) {
+	smtpAddress, emails := startSMTPTestServer(t)
+	var handler http.Handler
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		handler.ServeHTTP(rw, req)
+	}))
+	defer server.Close()
+	cfg := CreateConfig()
+	cfg.CookieSecret = "secret-for-testing-only"
+	cfg.Providers = []*ProviderConfig{{
+		Name:        "email",
+		RedirectURI: server.URL + "/__goth/email/",
+		Custom: map[string]interface{}{
+			"smtpAddress":    smtpAddress,
+			"smtpSecurity":   "none",
+			"from":           "Login <login@example.com>",
+			"allowedDomains": []interface{}{"example.com"},
+		},
+	}}
+	var err error
+	handler, err = New(context.Background(), http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_, _ = rw.Write([]byte("hello " + req.Header.Get("X-Auth-Email")))
+	}), cfg, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jar, _ := cookiejar.New(nil)
+	client := &http.Client{Jar: jar}
+	read := func(res *http.Response, err error) (*http.Response, string) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(res.Body)
+		_ = res.Body.Close()
+		return res, string(body)
+	}
+	res, _ := read(client.Get(server.URL + "/private"))
+	formURL, state := res.Request.URL.String(), res.Request.URL.Query().Get("state")
+	requestLink := func(email string, wait time.Duration) string {
+		res, body := read(client.PostForm(formURL, url.Values{"state": {state}, "username": {email}}))
+		if res.StatusCode != http.StatusOK || !strings.Contains(body, "If this address is allowed") {
+			t.Fatalf("expected the link to be sent, got %d: %s", res.StatusCode, body)
+		}
+		select {
+		case email := <-emails:
+			return email
+		case <-time.After(wait):
+			return ""
+		}
+	}
+
+	if email := requestLink("mallory@example.org", 100*time.Millisecond); email != "" {
+		t.Fatalf("expected no email for a forbidden address, got %s", email)
+	}
+	email := requestLink("Alice@Example.com", 5*time.Second)
+	if !strings.Contains(email, "To: alice@example.com\r\n") {
+		t.Fatalf("unexpected email: %s", email)
+	}
+	link := regexp.MustCompile(`http://\S+`).FindString(email)
+
+	// Opening the link does not log in yet (email scanners), the confirmation does
+	res, body := read(client.Get(link))
+	if res.StatusCode != http.StatusOK || !strings.Contains(body, "alice@example.com") {
+		t.Fatalf("expected the confirmation page, got %d: %s", res.StatusCode, body)
+	}
+	token := regexp.MustCompile(`name="token" value="([^"]+)"`).FindStringSubmatch(body)[1]
+	res, body = read(client.PostForm(link, url.Values{"token": {token}}))
+	if body != "hello alice@example.com" || res.Request.URL.Path != "/private" {
+		t.Fatalf("expected to reach the original page, got %d at %s: %s", res.StatusCode, res.Request.URL, body)
+	}
+	if res, _ = read(client.PostForm(link, url.Values{"token": {token}})); res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected the link to be single-use, got %d", res.StatusCode)
+	}
+}
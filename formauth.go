@@ -0,0 +1,366 @@
+package traefikgothauth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/markbates/goth"
+	"github.com/markbates/goth/gothic"
+	"golang.org/x/oauth2"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const formCodeTTL = time.Minute
+
+// loginPageProvider is implemented by the providers that serve their own login pages.
+type loginPageProvider interface {
+	goth.Provider
+	// ServeLoginPage handles the request if it targets one of the login pages of the provider, returning false
+	// otherwise.
+	ServeLoginPage(rw http.ResponseWriter, req *http.Request) bool
+}
+
+// authenticatedPageProvider is implemented by the providers that serve pages to the users already authenticated by
+// any provider (e.g. to register a passkey).
+type authenticatedPageProvider interface {
+	// ServeAuthenticatedPage handles the request if it targets one of these pages, returning false otherwise.
+	ServeAuthenticatedPage(rw http.ResponseWriter, req *http.Request, providerName string, user *goth.User) bool
+}
+
+// errLoginPending is returned by formProvider.verify when the login continues out of band (e.g. by email).
+type errLoginPending string
+
+func (e errLoginPending) Error() string {
+	return string(e)
+}
+
+// formProvider is a goth.Provider whose login form is served by the plugin itself, for identities that are not
+// managed by an OAuth2 server (local users, LDAP...).
+//
+// The flow mimics OAuth2, so that the rest of the plugin handles it like any other provider: BeginAuth points to the
+// login form, which redirects to the callback with a short-lived signed code once the user has been verified.
+type formProvider struct {
+	providerName string
+	title        string
+	callbackURL  string
+	codeKey      []byte
+	fields       []loginFormField
+	submit       string
+	// verify checks the submitted form and returns the authenticated user.
+	verify func(req *http.Request, form url.Values) (*goth.User, error)
+	// render serves the login form, defaults to loginFormHtml.
+	render  func(rw http.ResponseWriter, status int, page *loginFormPage)
+	limiter *loginRateLimiter
+}
+
+var _ loginPageProvider = &formProvider{}
+
+func newFormProvider(name, title, secret, callback string, custom map[string]interface{}) (*formProvider, error) {
+	maxAttempts, ok := custom["maxAttempts"].(int)
+	if !ok {
+		maxAttempts = 5
+	}
+	attemptsWindow, _ := custom["attemptsWindow"].(string)
+	window, err := parseDurationDefault(attemptsWindow, 15*time.Minute)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse attemptsWindow: %w", err)
+	}
+	return &formProvider{
+		providerName: name,
+		title:        title,
+		callbackURL:  callback,
+		codeKey:      signingKey(secret, name+"-code"),
+		submit:       "Log in",
+		render: func(rw http.ResponseWriter, status int, page *loginFormPage) {
+			servePage(rw, status, loginFormHtml, page)
+		},
+		limiter: newLoginRateLimiter(maxAttempts, window),
+	}, nil
+}
+
+// formProviderCustomSettings are the custom settings accepted by every formProvider.
+var formProviderCustomSettings = []*CustomSetting{
+	{Name: "maxAttempts", Type: CustomInt, Description: "failed logins allowed per user (4 times more per client IP) before blocking them (default 5)"},
+	{Name: "attemptsWindow", Type: CustomString, Description: "duration during which failed logins are counted, e.g. 15m (default)"},
+}
+
+// formPath is the path of the login form.
+func (p *formProvider) formPath() string {
+	return "/__goth/" + p.providerName + "/form/"
+}
+
+// form returns the formProvider itself, also when it is embedded by another provider.
+func (p *formProvider) form() *formProvider {
+	return p
+}
+
+// Name is the name used to retrieve this provider later.
+func (p *formProvider) Name() string {
+	return p.providerName
+}
+
+// SetName is to update the name of the provider (needed in case of multiple providers of 1 type).
+func (p *formProvider) SetName(name string) {
+	p.providerName = name
+}
+
+// Debug is a no-op.
+func (p *formProvider) Debug(bool) {}
+
+// BeginAuth points to the login form.
+func (p *formProvider) BeginAuth(state string) (goth.Session, error) {
+	return &formSession{AuthURL: p.formPath() + "?" + url.Values{"state": {state}}.Encode()}, nil
+}
+
+// UnmarshalSession will unmarshal a JSON string into a session.
+func (p *formProvider) UnmarshalSession(data string) (goth.Session, error) {
+	s := &formSession{}
+	err := json.NewDecoder(strings.NewReader(data)).Decode(s)
+	return s, err
+}
+
+// FetchUser returns the user verified by the login form.
+func (p *formProvider) FetchUser(session goth.Session) (goth.User, error) {
+	sess := session.(*formSession)
+	if sess.User == nil {
+		return goth.User{}, fmt.Errorf("%s has not authenticated the user yet", p.providerName)
+	}
+	user := *sess.User
+	user.Provider = p.Name()
+	return user, nil
+}
+
+// RefreshTokenAvailable refresh token is provided by auth provider or not.
+func (p *formProvider) RefreshTokenAvailable() bool {
+	return false
+}
+
+// RefreshToken is not supported.
+func (p *formProvider) RefreshToken(string) (*oauth2.Token, error) {
+	return nil, errors.New("refresh token is not provided by " + p.providerName)
+}
+
+// ServeLoginPage serves the login form and verifies the submitted credentials.
+func (p *formProvider) ServeLoginPage(rw http.ResponseWriter, req *http.Request) bool {
+	if req.URL.Path != p.formPath() {
+		return false
+	}
+	page := &loginFormPage{Title: p.title, Fields: p.fields, Submit: p.submit, State: req.FormValue("state")}
+	// The state is only known by the browser that started the login, so it also protects the form against CSRF
+	if expected := p.sessionState(req); expected == "" || page.State != expected {
+		page.Error, page.Message = "Your login session expired", "Please go back and try again."
+		p.render(rw, http.StatusBadRequest, page)
+		return true
+	}
+	if req.Method != http.MethodPost {
+		p.render(rw, http.StatusOK, page)
+		return true
+	}
+
+	limiterKeys := []string{"ip:" + clientIP(req)}
+	if username := req.PostForm.Get("username"); username != "" {
+		limiterKeys = append(limiterKeys, "user:"+strings.ToLower(username))
+	}
+	if !p.limiter.allowed(limiterKeys...) {
+		logw("Too many failed logins", "request", requestID(req), "provider", p.providerName, "remote", req.RemoteAddr, "keys", limiterKeys)
+		audit(req, auditLoginFailure, p.providerName, req.PostForm.Get("username"), "too many failed logins")
+		page.Error = "Too many failed attempts, please try again later"
+		p.render(rw, http.StatusTooManyRequests, page)
+		return true
+	}
+	user, err := p.verify(req, req.PostForm)
+	var pending errLoginPending
+	if errors.As(err, &pending) {
+		page.Message = pending.Error()
+		p.render(rw, http.StatusOK, page)
+		return true
+	}
+	if err != nil {
+		p.limiter.fail(limiterKeys...)
+		logw("Failed login", "request", requestID(req), "provider", p.providerName, "remote", req.RemoteAddr, "error", err)
+		audit(req, auditLoginFailure, p.providerName, req.PostForm.Get("username"), err.Error())
+		page.Error = "Invalid credentials"
+		p.render(rw, http.StatusUnauthorized, page)
+		return true
+	}
+	callbackURL, err := p.callbackWithCode(user, page.State)
+	if err != nil {
+		loge("Failed to sign login code", "request", requestID(req), "provider", p.providerName, "error", err)
+		http.Error(rw, "Failed to log in", http.StatusInternalServerError)
+		return true
+	}
+	http.Redirect(rw, req, callbackURL, http.StatusSeeOther)
+	return true
+}
+
+// formCode is the value of the signed code sent to the callback.
+type formCode struct {
+	User  *goth.User
+	State string
+}
+
+// callbackWithCode returns the callback URL including the code that authenticates the user.
+func (p *formProvider) callbackWithCode(user *goth.User, state string) (string, error) {
+	code, err := signToken(p.codeKey, p.providerName, formCodeTTL, &formCode{User: user, State: state})
+	if err != nil {
+		return "", err
+	}
+	callbackURL, err := url.Parse(p.callbackURL)
+	if err != nil {
+		return "", err
+	}
+	query := callbackURL.Query()
+	query.Set("code", code)
+	query.Set("state", state)
+	callbackURL.RawQuery = query.Encode()
+	return callbackURL.String(), nil
+}
+
+// sessionState returns the state of the login started by this browser, if any.
+func (p *formProvider) sessionState(req *http.Request) string {
+	value, err := gothic.GetFromSession(p.providerName, req)
+	if err != nil {
+		return ""
+	}
+	sess, err := p.UnmarshalSession(value)
+	if err != nil {
+		return ""
+	}
+	authURL, err := url.Parse(sess.(*formSession).AuthURL)
+	if err != nil {
+		return ""
+	}
+	return authURL.Query().Get("state")
+}
+
+// formSession stores data during the auth process with a formProvider.
+type formSession struct {
+	AuthURL string
+	User    *goth.User
+}
+
+var _ goth.Session = &formSession{}
+
+// GetAuthURL will return the URL set by calling the `BeginAuth` function on the provider.
+func (s *formSession) GetAuthURL() (string, error) {
+	if s.AuthURL == "" {
+		return "", errors.New(goth.NoAuthUrlErrorMessage)
+	}
+	return s.AuthURL, nil
+}
+
+// Authorize verifies the code sent by the login form.
+func (s *formSession) Authorize(provider goth.Provider, params goth.Params) (string, error) {
+	p := provider.(interface{ form() *formProvider }).form()
+	if params.Get("code") == "" {
+		return "", errors.New("missing code")
+	}
+	code := &formCode{}
+	if err := verifyToken(p.codeKey, p.providerName, params.Get("code"), code); err != nil {
+		return "", err
+	}
+	if code.User == nil || code.State != params.Get("state") {
+		return "", errors.New("code issued for a different login")
+	}
+	s.User = code.User
+	return "", nil
+}
+
+// Marshal the session into a string.
+func (s *formSession) Marshal() string {
+	b, _ := json.Marshal(s)
+	return string(b)
+}
+
+// clientIP returns the IP address of the client (Traefik already resolves trusted forwarded headers).
+func clientIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// loginRateLimiterMaxKeys limits the memory used by the failures of attacker-chosen keys (e.g. usernames).
+const loginRateLimiterMaxKeys = 10000
+
+// loginRateLimiter blocks the keys (users, IPs) with too many recent failed logins.
+type loginRateLimiter struct {
+	mu          sync.Mutex
+	maxAttempts int
+	window      time.Duration
+	failures    map[string][]time.Time
+	lastSweep   time.Time
+}
+
+func newLoginRateLimiter(maxAttempts int, window time.Duration) *loginRateLimiter {
+	return &loginRateLimiter{maxAttempts: maxAttempts, window: window, failures: map[string][]time.Time{}, lastSweep: time.Now()}
+}
+
+// allowed returns whether all the keys may attempt a new login. While the limiter is full, keys that are not tracked
+// yet are not allowed, so that flooding it with failures can not be used to avoid the limits.
+func (l *loginRateLimiter) allowed(keys ...string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	for _, key := range keys {
+		limit := l.maxAttempts
+		if strings.HasPrefix(key, "ip:") {
+			limit *= 4 // Many users may share the same IP
+		}
+		times, tracked := l.failures[key]
+		if len(l.prune(key, times, now)) >= limit || (!tracked && len(l.failures) >= loginRateLimiterMaxKeys) {
+			return false
+		}
+	}
+	return true
+}
+
+// fail records a failed login for all the keys.
+func (l *loginRateLimiter) fail(keys ...string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if len(l.failures) >= loginRateLimiterMaxKeys || now.Sub(l.lastSweep) > l.window {
+		l.sweep(now)
+	}
+	for _, key := range keys {
+		times, tracked := l.failures[key]
+		if !tracked && len(l.failures) >= loginRateLimiterMaxKeys {
+			logd("Too many failed logins to track, ignoring a key", "key", key)
+			continue
+		}
+		l.failures[key] = append(l.prune(key, times, now), now)
+	}
+}
+
+// prune removes the expired failures of a key, returning the remaining ones.
+func (l *loginRateLimiter) prune(key string, times []time.Time, now time.Time) []time.Time {
+	oldest := now.Add(-l.window)
+	i := 0
+	for i < len(times) && times[i].Before(oldest) {
+		i++
+	}
+	if i == 0 {
+		return times
+	}
+	if i == len(times) {
+		delete(l.failures, key)
+		return nil
+	}
+	l.failures[key] = times[i:]
+	return times[i:]
+}
+
+// sweep removes the expired failures of all the keys.
+func (l *loginRateLimiter) sweep(now time.Time) {
+	for key, times := range l.failures {
+		l.prune(key, times, now)
+	}
+	l.lastSweep = now
+}
@@ -0,0 +1,229 @@
+package traefikgothauth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/markbates/goth"
+	"golang.org/x/oauth2"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// genericOAuth2Provider is a goth.Provider for any OAuth2 server with a JSON userinfo endpoint.
+//
+// Everything is configured from ProviderConfig.Custom, so that new identity providers do not require code changes.
+type genericOAuth2Provider struct {
+	providerName string
+	config       *oauth2.Config
+	userInfoURL  string
+	// fields maps goth.User fields to (dot-separated) paths in the userinfo JSON response.
+	fields     genericOAuth2Fields
+	HTTPClient *http.Client
+}
+
+type genericOAuth2Fields struct {
+	UserID, Email, Name, FirstName, LastName, NickName, AvatarURL, Description, Location string
+}
+
+var _ goth.Provider = &genericOAuth2Provider{}
+
+// newGenericOAuth2Provider creates the provider from its custom configuration.
+func newGenericOAuth2Provider(clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (*genericOAuth2Provider, error) {
+	str := func(key, def string) string {
+		if value, ok := custom[key].(string); ok && value != "" {
+			return value
+		}
+		return def
+	}
+	p := &genericOAuth2Provider{
+		providerName: "generic-oauth2",
+		userInfoURL:  str("userInfoURL", ""),
+		fields: genericOAuth2Fields{
+			UserID:      str("userIDField", "id"),
+			Email:       str("emailField", "email"),
+			Name:        str("nameField", "name"),
+			FirstName:   str("firstNameField", "given_name"),
+			LastName:    str("lastNameField", "family_name"),
+			NickName:    str("nickNameField", "login"),
+			AvatarURL:   str("avatarURLField", "avatar_url"),
+			Description: str("descriptionField", "bio"),
+			Location:    str("locationField", "location"),
+		},
+	}
+	authURL, tokenURL := str("authURL", ""), str("tokenURL", "")
+	if authURL == "" || tokenURL == "" || p.userInfoURL == "" {
+		return nil, errors.New("generic-oauth2 requires the authURL, tokenURL and userInfoURL custom settings")
+	}
+	authStyle := oauth2.AuthStyleAutoDetect
+	switch str("authStyle", "") {
+	case "":
+	case "header":
+		authStyle = oauth2.AuthStyleInHeader
+	case "params":
+		authStyle = oauth2.AuthStyleInParams
+	default:
+		return nil, fmt.Errorf("invalid authStyle %q (expected header or params)", custom["authStyle"])
+	}
+	p.config = &oauth2.Config{
+		ClientID:     clientKey,
+		ClientSecret: secret,
+		RedirectURL:  callback,
+		Endpoint:     oauth2.Endpoint{AuthURL: authURL, TokenURL: tokenURL, AuthStyle: authStyle},
+		Scopes:       scopes,
+	}
+	return p, nil
+}
+
+// Name is the name used to retrieve this provider later.
+func (p *genericOAuth2Provider) Name() string {
+	return p.providerName
+}
+
+// SetName is to update the name of the provider (needed in case of multiple providers of 1 type).
+func (p *genericOAuth2Provider) SetName(name string) {
+	p.providerName = name
+}
+
+// Client is the HTTP client to be used in all fetch operations.
+func (p *genericOAuth2Provider) Client() *http.Client {
+	return goth.HTTPClientWithFallBack(p.HTTPClient)
+}
+
+// Debug is a no-op.
+func (p *genericOAuth2Provider) Debug(bool) {}
+
+// BeginAuth asks the server for an authentication end-point.
+func (p *genericOAuth2Provider) BeginAuth(state string) (goth.Session, error) {
+	return &genericOAuth2Session{AuthURL: p.config.AuthCodeURL(state)}, nil
+}
+
+// UnmarshalSession will unmarshal a JSON string into a session.
+func (p *genericOAuth2Provider) UnmarshalSession(data string) (goth.Session, error) {
+	s := &genericOAuth2Session{}
+	err := json.NewDecoder(strings.NewReader(data)).Decode(s)
+	return s, err
+}
+
+// FetchUser will go to the userinfo endpoint and map the configured fields of the response.
+func (p *genericOAuth2Provider) FetchUser(session goth.Session) (goth.User, error) {
+	sess := session.(*genericOAuth2Session)
+	user := goth.User{
+		AccessToken:  sess.AccessToken,
+		RefreshToken: sess.RefreshToken,
+		ExpiresAt:    sess.ExpiresAt,
+		Provider:     p.Name(),
+	}
+	if user.AccessToken == "" {
+		return user, fmt.Errorf("%s cannot get user information without accessToken", p.providerName)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, p.userInfoURL, nil)
+	if err != nil {
+		return user, err
+	}
+	req.Header.Set("Authorization", "Bearer "+sess.AccessToken)
+	req.Header.Set("Accept", "application/json")
+	res, err := p.Client().Do(req)
+	if err != nil {
+		return user, err
+	}
+	defer func() { _ = res.Body.Close() }()
+	if res.StatusCode != http.StatusOK {
+		return user, fmt.Errorf("%s responded with a %d trying to fetch user information", p.providerName, res.StatusCode)
+	}
+
+	decoder := json.NewDecoder(res.Body)
+	decoder.UseNumber() // Keep big numeric IDs intact
+	if err = decoder.Decode(&user.RawData); err != nil {
+		return user, fmt.Errorf("failed to decode user information: %w", err)
+	}
+	user.UserID = jsonPathString(user.RawData, p.fields.UserID)
+	user.Email = jsonPathString(user.RawData, p.fields.Email)
+	user.Name = jsonPathString(user.RawData, p.fields.Name)
+	user.FirstName = jsonPathString(user.RawData, p.fields.FirstName)
+	user.LastName = jsonPathString(user.RawData, p.fields.LastName)
+	user.NickName = jsonPathString(user.RawData, p.fields.NickName)
+	user.AvatarURL = jsonPathString(user.RawData, p.fields.AvatarURL)
+	user.Description = jsonPathString(user.RawData, p.fields.Description)
+	user.Location = jsonPathString(user.RawData, p.fields.Location)
+	if user.UserID == "" {
+		return user, fmt.Errorf("%s did not return a user ID at %q", p.providerName, p.fields.UserID)
+	}
+	return user, nil
+}
+
+// RefreshTokenAvailable refresh token is provided by auth provider or not.
+func (p *genericOAuth2Provider) RefreshTokenAvailable() bool {
+	return true
+}
+
+// RefreshToken get new access token based on the refresh token.
+func (p *genericOAuth2Provider) RefreshToken(refreshToken string) (*oauth2.Token, error) {
+	token := &oauth2.Token{RefreshToken: refreshToken}
+	ts := p.config.TokenSource(goth.ContextForClient(p.Client()), token)
+	return ts.Token()
+}
+
+// genericOAuth2Session stores data during the auth process with the generic OAuth2 server.
+type genericOAuth2Session struct {
+	AuthURL      string
+	AccessToken  string
+	RefreshToken string
+	ExpiresAt    time.Time
+}
+
+var _ goth.Session = &genericOAuth2Session{}
+
+// GetAuthURL will return the URL set by calling the `BeginAuth` function on the provider.
+func (s *genericOAuth2Session) GetAuthURL() (string, error) {
+	if s.AuthURL == "" {
+		return "", errors.New(goth.NoAuthUrlErrorMessage)
+	}
+	return s.AuthURL, nil
+}
+
+// Authorize the session with the server and return the access token to be stored for future use.
+func (s *genericOAuth2Session) Authorize(provider goth.Provider, params goth.Params) (string, error) {
+	p := provider.(*genericOAuth2Provider)
+	token, err := p.config.Exchange(goth.ContextForClient(p.Client()), params.Get("code"))
+	if err != nil {
+		return "", err
+	}
+	if !token.Valid() {
+		return "", errors.New("invalid token received from provider")
+	}
+	s.AccessToken = token.AccessToken
+	s.RefreshToken = token.RefreshToken
+	s.ExpiresAt = token.Expiry
+	return token.AccessToken, nil
+}
+
+// Marshal the session into a string.
+func (s *genericOAuth2Session) Marshal() string {
+	b, _ := json.Marshal(s)
+	return string(b)
+}
+
+// jsonPathString follows a dot-separated path of object keys and returns the value found as a string.
+func jsonPathString(data map[string]interface{}, path string) string {
+	var current interface{} = data
+	for _, key := range strings.Split(path, ".") {
+		obj, ok := current.(map[string]interface{})
+		if !ok {
+			return ""
+		}
+		current = obj[key]
+	}
+	switch value := current.(type) {
+	case nil:
+		return ""
+	case string:
+		return value
+	case json.Number:
+		return value.String()
+	default:
+		return fmt.Sprint(value)
+	}
+}
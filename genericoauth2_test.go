@@ -0,0 +1,42 @@
+package traefikgothauth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGenericOAuth2FetchUser(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") != "Bearer token" {
+			rw.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_, _ = rw.Write([]byte(`{"data":{"uid":12345678901234567890,"mail":"user@example.com"},"display":"User"}`))
+	}))
+	defer server.Close()
+
+	provider, err := newGenericOAuth2Provider("key", "secret", "http://localhost/callback", map[string]interface{}{
+		"authURL":     server.URL + "/auth",
+		"tokenURL":    server.URL + "/token",
+		"userInfoURL": server.URL,
+		"userIDField": "data.uid",
+		"emailField":  "data.mail",
+		"nameField":   "display",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user, err := provider.FetchUser(&genericOAuth2Session{AccessToken: "token"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.UserID != "12345678901234567890" || user.Email != "user@example.com" || user.Name != "User" {
+		t.Fatalf("unexpected user: %+v", user)
+	}
+
+	if _, err = provider.FetchUser(&genericOAuth2Session{AccessToken: "wrong"}); err == nil {
+		t.Fatal("expected an error with an invalid access token")
+	}
+}
@@ -5,6 +5,9 @@ go 1.22
 require (
 	github.com/gorilla/sessions v1.3.0
 	github.com/markbates/goth v1.80.0
+	golang.org/x/crypto v0.31.0
+	golang.org/x/oauth2 v0.22.0
+	rsc.io/qr v0.2.0
 )
 
 require (
@@ -13,5 +16,4 @@ require (
 	github.com/gorilla/securecookie v1.1.2 // indirect
 	github.com/markbates/going v1.0.3 // indirect
 	github.com/mrjones/oauth v0.0.0-20190623134757-126b35219450 // indirect
-	golang.org/x/oauth2 v0.22.0 // indirect
 )
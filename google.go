@@ -0,0 +1,120 @@
+package traefikgothauth
+
+import (
+	"fmt"
+	"github.com/markbates/goth"
+	"github.com/markbates/goth/providers/openidConnect"
+	"net/url"
+	"strings"
+)
+
+const (
+	googleAuthURL     = "https://accounts.google.com/o/oauth2/v2/auth"
+	googleTokenURL    = "https://oauth2.googleapis.com/token"
+	googleIssuer      = "https://accounts.google.com"
+	googleUserInfoURL = "https://openidconnect.googleapis.com/v1/userinfo"
+)
+
+// googleProvider is a goth.Provider for Google, based on its OpenID Connect endpoints.
+//
+// It adds Google-specific authentication parameters and verifies the hosted domain (Google Workspace) of the user.
+type googleProvider struct {
+	*openidConnect.Provider
+	// hostedDomains restricts the accounts that can log in to these Google Workspace domains (if not empty).
+	hostedDomains []string
+	authParams    url.Values
+}
+
+var _ goth.Provider = &googleProvider{}
+
+// newGoogleProvider creates the provider from its custom configuration.
+func newGoogleProvider(clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (*googleProvider, error) {
+	if len(scopes) == 0 {
+		scopes = []string{"email", "profile"}
+	}
+	oidc, err := openidConnect.NewCustomisedURL(clientKey, secret, callback, googleAuthURL, googleTokenURL, googleIssuer, googleUserInfoURL, "", scopes...)
+	if err != nil {
+		return nil, err
+	}
+	oidc.SetName("google")
+	p := &googleProvider{Provider: oidc, authParams: url.Values{}}
+	p.hostedDomains, _ = custom["hostedDomains"].([]string)
+	if len(p.hostedDomains) == 1 {
+		p.authParams.Set("hd", p.hostedDomains[0])
+	} else if len(p.hostedDomains) > 1 {
+		p.authParams.Set("hd", "*") // Only hints that a Workspace account should be used
+	}
+	if prompt, ok := custom["prompt"].(string); ok {
+		p.authParams.Set("prompt", prompt)
+	}
+	if offlineAccess, _ := custom["offlineAccess"].(bool); offlineAccess {
+		p.authParams.Set("access_type", "offline")
+		if p.authParams.Get("prompt") == "" {
+			// Google only returns a refresh token the first time the user consents
+			p.authParams.Set("prompt", "consent")
+		}
+	}
+	return p, nil
+}
+
+// BeginAuth asks Google for an authentication end-point, adding the configured parameters.
+func (p *googleProvider) BeginAuth(state string) (goth.Session, error) {
+	sess, err := p.Provider.BeginAuth(state)
+	if err != nil {
+		return nil, err
+	}
+	oidcSession := sess.(*openidConnect.Session)
+	authURL, err := url.Parse(oidcSession.AuthURL)
+	if err != nil {
+		return nil, err
+	}
+	query := authURL.Query()
+	for key, values := range p.authParams {
+		query[key] = values
+	}
+	authURL.RawQuery = query.Encode()
+	oidcSession.AuthURL = authURL.String()
+	return &googleSession{Session: oidcSession}, nil
+}
+
+// UnmarshalSession will unmarshal a JSON string into a session.
+func (p *googleProvider) UnmarshalSession(data string) (goth.Session, error) {
+	sess, err := p.Provider.UnmarshalSession(data)
+	if err != nil {
+		return nil, err
+	}
+	return &googleSession{Session: sess.(*openidConnect.Session)}, nil
+}
+
+// FetchUser reads the user from the ID token and userinfo endpoint, and verifies its hosted domain.
+func (p *googleProvider) FetchUser(session goth.Session) (goth.User, error) {
+	user, err := p.Provider.FetchUser(session.(*googleSession).Session)
+	if err != nil {
+		return user, err
+	}
+	if len(p.hostedDomains) > 0 {
+		// The hd parameter is only a hint that the user can change, so the claim must always be verified
+		hd, _ := user.RawData["hd"].(string)
+		allowed := false
+		for _, domain := range p.hostedDomains {
+			if hd != "" && strings.EqualFold(hd, domain) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return goth.User{}, fmt.Errorf("%s account is not part of an allowed hosted domain (hd=%q)", p.Name(), hd)
+		}
+	}
+	return user, nil
+}
+
+// googleSession wraps the OpenID Connect session, as it only accepts its own provider type when authorizing.
+type googleSession struct {
+	*openidConnect.Session
+}
+
+// Authorize the session with Google and return the access token to be stored for future use.
+func (s *googleSession) Authorize(provider goth.Provider, params goth.Params) (string, error) {
+	return s.Session.Authorize(provider.(*googleProvider).Provider, params)
+}
@@ -0,0 +1,104 @@
+package traefikgothauth
+
+import (
+	"encoding/json"
+	"github.com/markbates/goth"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestGoogleAuthURL(t *testing.T) {
+	p, err := newGoogleProvider("key", "secret", "https://example.com/__goth/google/", map[string]interface{}{
+		"hostedDomains": []string{"example.com"},
+		"offlineAccess": true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	session, err := p.BeginAuth("state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	authURL, _ := session.GetAuthURL()
+	parsed, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := parsed.Query()
+	if parsed.Host != "accounts.google.com" || query.Get("hd") != "example.com" || query.Get("access_type") != "offline" ||
+		query.Get("prompt") != "consent" || query.Get("state") != "state" {
+		t.Fatalf("expected the Google parameters, got %s", authURL)
+	}
+
+	p, err = newGoogleProvider("key", "secret", "https://example.com/__goth/google/", map[string]interface{}{
+		"hostedDomains": []string{"example.com", "example.org"},
+		"prompt":        "select_account",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	session, _ = p.BeginAuth("state")
+	authURL, _ = session.GetAuthURL()
+	if parsed, _ = url.Parse(authURL); parsed.Query().Get("hd") != "*" || parsed.Query().Get("prompt") != "select_account" || parsed.Query().Has("access_type") {
+		t.Fatalf("expected any hosted domain and the configured prompt, got %s", authURL)
+	}
+}
+
+func TestGoogleHostedDomains(t *testing.T) {
+	// Google answers with the hosted domain of each code
+	google := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Content-Type", "application/json")
+		switch req.URL.Path {
+		case "/token":
+			hd := req.PostFormValue("code")
+			claims := map[string]interface{}{
+				"iss": googleIssuer, "aud": "key", "sub": "123", "email": "alice@" + hd, "exp": time.Now().Add(time.Hour).Unix(),
+			}
+			if hd != "" {
+				claims["hd"] = hd
+			}
+			_ = json.NewEncoder(rw).Encode(map[string]interface{}{
+				"access_token": "token-" + hd, "token_type": "bearer", "expires_in": 3600, "id_token": newTestJWT(t, claims),
+			})
+		case "/v1/userinfo":
+			_, _ = rw.Write([]byte(`{"sub":"123"}`))
+		default:
+			rw.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer google.Close()
+	target, _ := url.Parse(google.URL)
+	p, err := newGoogleProvider("key", "secret", "https://example.com/__goth/google/", map[string]interface{}{
+		"hostedDomains": []string{"example.com", "Example.ORG"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.HTTPClient = &http.Client{Transport: &rewriteTransport{target: target}}
+	login := func(hd string) (goth.User, error) {
+		session, err := p.BeginAuth("state")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = session.Authorize(p, url.Values{"code": {hd}}); err != nil {
+			t.Fatal(err)
+		}
+		return p.FetchUser(session)
+	}
+
+	if user, err := login("example.com"); err != nil || user.UserID != "123" {
+		t.Fatalf("expected an allowed domain to log in, got %+v, %v", user, err)
+	}
+	if _, err := login("example.org"); err != nil {
+		t.Fatalf("expected the domains to match case-insensitively, got %v", err)
+	}
+	if _, err := login("evil.com"); err == nil {
+		t.Fatal("expected another domain to be rejected")
+	}
+	if _, err := login(""); err == nil {
+		t.Fatal("expected a personal account without hosted domain to be rejected")
+	}
+}
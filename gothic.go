@@ -11,12 +11,12 @@ import (
 // HACK: gothic logouts automatically during each login, so we copy the code without the logout.
 
 var CompleteUserAuthNoLogout = func(res http.ResponseWriter, req *http.Request) (goth.User, error) {
-	providerName, err := gothic.GetProviderName(req)
+	providerName, err := currentProviderName(req)
 	if err != nil {
 		return goth.User{}, err
 	}
 
-	provider, err := goth.GetProvider(providerName)
+	provider, err := gothProvider(req, providerName)
 	if err != nil {
 		return goth.User{}, err
 	}
@@ -65,6 +65,35 @@ var CompleteUserAuthNoLogout = func(res http.ResponseWriter, req *http.Request)
 	return gu, err
 }
 
+// getAuthURL is gothic.GetAuthURL, with the provider for the host of the request.
+func getAuthURL(res http.ResponseWriter, req *http.Request) (string, error) {
+	providerName, err := currentProviderName(req)
+	if err != nil {
+		return "", err
+	}
+
+	provider, err := gothProvider(req, providerName)
+	if err != nil {
+		return "", err
+	}
+	sess, err := provider.BeginAuth(gothic.SetState(req))
+	if err != nil {
+		return "", err
+	}
+
+	authURL, err := sess.GetAuthURL()
+	if err != nil {
+		return "", err
+	}
+
+	err = gothic.StoreInSession(providerName, sess.Marshal(), req, res)
+	if err != nil {
+		return "", err
+	}
+
+	return authURL, err
+}
+
 func validateState(req *http.Request, sess goth.Session) error {
 	rawAuthURL, err := sess.GetAuthURL()
 	if err != nil {
@@ -84,3 +113,12 @@ func validateState(req *http.Request, sess goth.Session) error {
 	}
 	return nil
 }
+
+// currentProviderName returns the provider being tried by ServeHTTP. gothic.GetProviderName prefers the "provider"
+// query parameter, which is the choice of the user in the selection screen and stays in the URL after the login.
+func currentProviderName(req *http.Request) (string, error) {
+	if providerName := req.URL.Query().Get(":provider"); providerName != "" {
+		return providerName, nil
+	}
+	return gothic.GetProviderName(req)
+}
@@ -0,0 +1,231 @@
+package traefikgothauth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/markbates/goth"
+	"github.com/markbates/goth/gothic"
+	"github.com/markbates/goth/providers/azuread"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	graphMemberOfURL  = "https://graph.microsoft.com/v1.0/me/memberOf/microsoft.graph.group?$select=id,displayName&$top=999"
+	graphResource     = "https://graph.microsoft.com"
+	azureADTokenURL   = "https://login.microsoftonline.com/%s/oauth2/token"
+	graphMaxPages     = 100 // Hard limit to avoid looping forever on a misbehaving server
+	graphDefaultClaim = "groups"
+)
+
+// GraphGroupsConfig configures the Microsoft Graph group enrichment (azuread and microsoftonline only).
+//
+// The application needs the GroupMember.Read.All (or Directory.Read.All) delegated permission.
+type GraphGroupsConfig struct {
+	// Claim (optional) is the name of the claim that will contain the comma-separated groups. Defaults to "groups".
+	Claim string
+	// Names (optional) maps group object IDs to the names to publish instead of the IDs.
+	Names map[string]string
+	// UseDisplayNames (optional) publishes the Microsoft Graph display name for groups not listed in Names.
+	UseDisplayNames bool
+	// OnlyMapped (optional) drops all groups that are not listed in Names.
+	OnlyMapped bool
+	// CacheTTL (optional) is how long the groups of a user are cached (e.g. "5m"). Defaults to 5 minutes.
+	CacheTTL string
+	cacheTTL time.Duration
+}
+
+func (c *GraphGroupsConfig) setup(providerName string) error {
+	if providerName != "azuread" && providerName != "microsoftonline" {
+		return fmt.Errorf("graph groups are only supported by the azuread and microsoftonline providers, not %s", providerName)
+	}
+	if c.Claim == "" {
+		c.Claim = graphDefaultClaim
+	}
+	var err error
+	if c.cacheTTL, err = parseDurationDefault(c.CacheTTL, 5*time.Minute); err != nil {
+		return fmt.Errorf("failed to parse graph groups cache TTL: %w", err)
+	}
+	return nil
+}
+
+// graphGroup is a group as returned by Microsoft Graph.
+type graphGroup struct {
+	ID          string `json:"id"`
+	DisplayName string `json:"displayName"`
+}
+
+type graphGroupsCacheEntry struct {
+	groups  []graphGroup
+	expires time.Time
+}
+
+// graphGroupsCacheSweepInterval is how often the expired groups are removed from the cache, when adding new ones.
+const graphGroupsCacheSweepInterval = time.Minute
+
+// graphGroupsCache caches the groups of each session, indexed by a hash of its access token.
+var graphGroupsCache = struct {
+	sync.Mutex
+	entries   map[string]*graphGroupsCacheEntry
+	lastSweep time.Time
+}{entries: map[string]*graphGroupsCacheEntry{}}
+
+// enrichGraphGroups adds the Microsoft Graph groups of the user as a claim.
+func enrichGraphGroups(req *http.Request, providerConfig *ProviderConfig, auth *goth.User) error {
+	cfg := providerConfig.GraphGroups
+	if auth.AccessToken == "" {
+		return errors.New("no access token available")
+	}
+	cacheKeyBytes := sha256.Sum256([]byte(providerConfig.Name + "|" + auth.AccessToken))
+	cacheKey := hex.EncodeToString(cacheKeyBytes[:])
+
+	graphGroupsCache.Lock()
+	now := time.Now()
+	entry, ok := graphGroupsCache.entries[cacheKey]
+	graphGroupsCache.Unlock()
+
+	if !ok || now.After(entry.expires) {
+		token, err := graphAccessToken(req, providerConfig, auth)
+		if err != nil {
+			return fmt.Errorf("failed to get a Microsoft Graph access token: %w", err)
+		}
+		groups, err := fetchGraphGroups(req, providerConfig.httpClient, token)
+		if err != nil {
+			return err
+		}
+		entry = &graphGroupsCacheEntry{groups: groups, expires: now.Add(cfg.cacheTTL)}
+		graphGroupsCache.Lock()
+		if now.Sub(graphGroupsCache.lastSweep) > graphGroupsCacheSweepInterval {
+			for key, other := range graphGroupsCache.entries {
+				if now.After(other.expires) {
+					delete(graphGroupsCache.entries, key)
+				}
+			}
+			graphGroupsCache.lastSweep = now
+		}
+		graphGroupsCache.entries[cacheKey] = entry
+		graphGroupsCache.Unlock()
+	}
+
+	names := make([]string, 0, len(entry.groups))
+	for _, group := range entry.groups {
+		if name, ok := cfg.Names[group.ID]; ok {
+			names = append(names, name)
+		} else if cfg.OnlyMapped {
+			continue
+		} else if cfg.UseDisplayNames && group.DisplayName != "" {
+			names = append(names, group.DisplayName)
+		} else {
+			names = append(names, group.ID)
+		}
+	}
+	if auth.RawData == nil {
+		auth.RawData = make(map[string]interface{})
+	}
+	auth.RawData[cfg.Claim] = strings.Join(names, ",")
+	return nil
+}
+
+// graphAccessToken returns an access token valid for Microsoft Graph.
+//
+// The microsoftonline provider already requests a Microsoft Graph token (v2 endpoint). The azuread provider uses the
+// v1 endpoint, whose tokens are only valid for the Azure AD Graph, so the refresh token is redeemed for the Microsoft
+// Graph resource, at the token endpoint of the tenant of the app (so that single-tenant apps work too).
+func graphAccessToken(req *http.Request, providerConfig *ProviderConfig, auth *goth.User) (string, error) {
+	if providerConfig.Name != "azuread" {
+		return auth.AccessToken, nil
+	}
+	value, err := gothic.GetFromSession(providerConfig.Name, req)
+	if err != nil {
+		return "", err
+	}
+	provider, err := gothProvider(req, providerConfig.Name)
+	if err != nil {
+		return "", err
+	}
+	sess, err := provider.UnmarshalSession(value)
+	if err != nil {
+		return "", err
+	}
+	azureSession, ok := sess.(*azuread.Session)
+	if !ok || azureSession.RefreshToken == "" {
+		return "", errors.New("no refresh token available")
+	}
+	form := url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {azureSession.RefreshToken},
+		"client_id":     {providerConfig.ClientKey},
+		"client_secret": {providerConfig.Secret},
+		"resource":      {graphResource},
+	}
+	tenant, _ := providerConfig.Custom["tenant"].(string)
+	if tenant == "" {
+		tenant = "common"
+	}
+	tokenURL := fmt.Sprintf(azureADTokenURL, url.PathEscape(tenant))
+	tokenReq, err := http.NewRequestWithContext(req.Context(), http.MethodPost, tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	tokenReq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	res, err := providerConfig.httpClient.Do(tokenReq)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = res.Body.Close() }()
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token endpoint responded with %d", res.StatusCode)
+	}
+	var tokenRes struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err = json.NewDecoder(res.Body).Decode(&tokenRes); err != nil {
+		return "", err
+	}
+	if tokenRes.AccessToken == "" {
+		return "", errors.New("token endpoint did not return an access token")
+	}
+	return tokenRes.AccessToken, nil
+}
+
+// fetchGraphGroups lists all the groups the user is a direct member of, following the pagination links.
+func fetchGraphGroups(req *http.Request, client *http.Client, token string) ([]graphGroup, error) {
+	groups := make([]graphGroup, 0)
+	nextURL := graphMemberOfURL
+	for page := 0; nextURL != ""; page++ {
+		if page >= graphMaxPages {
+			return nil, fmt.Errorf("too many pages of groups (more than %d)", graphMaxPages)
+		}
+		graphReq, err := http.NewRequestWithContext(req.Context(), http.MethodGet, nextURL, nil)
+		if err != nil {
+			return nil, err
+		}
+		graphReq.Header.Set("Authorization", "Bearer "+token)
+		res, err := client.Do(graphReq)
+		if err != nil {
+			return nil, err
+		}
+		var pageRes struct {
+			Value    []graphGroup `json:"value"`
+			NextLink string       `json:"@odata.nextLink"`
+		}
+		if res.StatusCode != http.StatusOK {
+			_ = res.Body.Close()
+			return nil, fmt.Errorf("microsoft graph responded with %d trying to list groups", res.StatusCode)
+		}
+		err = json.NewDecoder(res.Body).Decode(&pageRes)
+		_ = res.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode microsoft graph groups: %w", err)
+		}
+		groups = append(groups, pageRes.Value...)
+		nextURL = pageRes.NextLink
+	}
+	return groups, nil
+}
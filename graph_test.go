@@ -0,0 +1,126 @@
+package traefikgothauth
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/markbates/goth"
+	"github.com/markbates/goth/gothic"
+	"github.com/markbates/goth/providers/azuread"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// rewriteTransport sends every request to the test server, whatever its host.
+type rewriteTransport struct {
+	target *url.URL
+}
+
+func (t *rewriteTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.URL.Scheme, req.URL.Host = t.target.Scheme, t.target.Host
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestGraphGroups(t *testing.T) {
+	graph := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Content-Type", "application/json")
+		switch req.URL.Path {
+		case "/contoso.onmicrosoft.com/oauth2/token":
+			if req.PostFormValue("refresh_token") != "refresh" || req.PostFormValue("resource") != graphResource {
+				rw.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			_, _ = rw.Write([]byte(`{"access_token":"graph-token"}`))
+		case "/v1.0/me/memberOf/microsoft.graph.group":
+			if req.Header.Get("Authorization") != "Bearer graph-token" {
+				rw.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			if req.URL.Query().Get("page") == "" {
+				_ = json.NewEncoder(rw).Encode(map[string]interface{}{
+					"value":           []graphGroup{{ID: "1", DisplayName: "Admins"}, {ID: "2", DisplayName: "Developers"}},
+					"@odata.nextLink": "https://graph.microsoft.com/v1.0/me/memberOf/microsoft.graph.group?page=2",
+				})
+			} else {
+				_ = json.NewEncoder(rw).Encode(map[string]interface{}{"value": []graphGroup{{ID: "3"}}})
+			}
+		default:
+			rw.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer graph.Close()
+	target, _ := url.Parse(graph.URL)
+
+	cfg := CreateConfig()
+	cfg.CookieSecret = "secret-for-testing-only"
+	cfg.Providers = []*ProviderConfig{{
+		Name:        "azuread",
+		ClientKey:   "key",
+		Secret:      "secret",
+		RedirectURI: "https://app.example.com/__goth/azuread/",
+		Custom:      map[string]interface{}{"tenant": "contoso.onmicrosoft.com"},
+		GraphGroups: &GraphGroupsConfig{Names: map[string]string{"1": "admin"}},
+	}}
+	if _, err := New(context.Background(), http.NotFoundHandler(), cfg, "test"); err != nil {
+		t.Fatal(err)
+	}
+	providerConfig := cfg.Providers[0]
+	providerConfig.httpClient = &http.Client{Transport: &rewriteTransport{target: target}}
+
+	// The refresh token of the session is redeemed at the tenant for a Microsoft Graph token
+	rw := httptest.NewRecorder()
+	session := &azuread.Session{AccessToken: "aad-token", RefreshToken: "refresh"}
+	if err := gothic.StoreInSession("azuread", session.Marshal(), httptest.NewRequest(http.MethodGet, "/", nil), rw); err != nil {
+		t.Fatal(err)
+	}
+	newRequest := func() *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		for _, cookie := range rw.Result().Cookies() {
+			req.AddCookie(cookie)
+		}
+		return req
+	}
+	enrich := func(cfg *GraphGroupsConfig, accessToken string) string {
+		providerConfig.GraphGroups = cfg
+		if err := cfg.setup(providerConfig.Name); err != nil {
+			t.Fatal(err)
+		}
+		auth := &goth.User{AccessToken: accessToken}
+		if err := enrichGraphGroups(newRequest(), providerConfig, auth); err != nil {
+			t.Fatal(err)
+		}
+		return auth.RawData[cfg.Claim].(string)
+	}
+
+	// All the pages are read, and the groups are mapped to their names
+	if groups := enrich(&GraphGroupsConfig{Names: map[string]string{"1": "admin"}}, "token-1"); groups != "admin,2,3" {
+		t.Fatalf("expected the mapped names and the IDs of every page, got %s", groups)
+	}
+	if groups := enrich(&GraphGroupsConfig{Names: map[string]string{"1": "admin"}, UseDisplayNames: true}, "token-2"); groups != "admin,Developers,3" {
+		t.Fatalf("expected the display names of the unmapped groups, got %s", groups)
+	}
+	if groups := enrich(&GraphGroupsConfig{Names: map[string]string{"1": "admin"}, OnlyMapped: true, Claim: "roles"}, "token-3"); groups != "admin" {
+		t.Fatalf("expected only the mapped groups, got %s", groups)
+	}
+
+	// Expired groups are fetched again, and the other expired ones are removed when the cache is swept
+	graphGroupsCache.Lock()
+	for _, entry := range graphGroupsCache.entries {
+		entry.groups, entry.expires = []graphGroup{{ID: "9"}}, time.Now().Add(-time.Second)
+	}
+	graphGroupsCache.entries["stale"] = &graphGroupsCacheEntry{expires: time.Now().Add(-time.Second)}
+	graphGroupsCache.lastSweep = time.Time{}
+	graphGroupsCache.Unlock()
+	if groups := enrich(&GraphGroupsConfig{Names: map[string]string{"1": "admin"}}, "token-1"); groups != "admin,2,3" {
+		t.Fatalf("expected the expired groups to be fetched again, got %s", groups)
+	}
+	graphGroupsCache.Lock()
+	_, stale := graphGroupsCache.entries["stale"]
+	graphGroupsCache.Unlock()
+	if stale {
+		t.Fatal("expected the expired groups to be swept")
+	}
+}
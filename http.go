@@ -7,33 +7,212 @@ import (
 	"github.com/markbates/goth"
 	"github.com/markbates/goth/gothic"
 	"net/http"
+	"net/url"
 	"regexp"
 	"strings"
+	"sync"
 	"time"
 )
 
 func (o *Plugin) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if req.Header.Get(requestIDHeader) == "" {
+		req.Header.Set(requestIDHeader, randomString(12))
+	}
 	if logtEnabled() {
 		session, _ := gothic.Store.Get(req, gothic.SessionName)
 		sessionKeys := make([]string, 0, len(session.Values))
 		for key := range session.Values {
 			sessionKeys = append(sessionKeys, fmt.Sprint(key))
 		}
-		logt("Request", "method", req.Method, "url", req.URL.String(), "remote", req.RemoteAddr, "sessionKeys", sessionKeys)
+		logt("Request", "request", requestID(req), "method", req.Method, "url", req.URL.String(), "remote", req.RemoteAddr, "sessionKeys", sessionKeys)
+	}
+	// Public requests skip authentication, or only use it if available.
+	publicRule := o.config.publicRule(req)
+	if publicRule != nil && !publicRule.Optional {
+		logd("Public request", "request", requestID(req), "method", req.Method, "path", req.URL.Path)
+		o.config.stripClaims(req)
+		o.next.ServeHTTP(rw, req)
+		return
+	}
+	// Some routes only accept some providers.
+	route := o.config.route(req)
+	if o.config.SSO != nil {
+		route = o.config.SSO.authorizeRoute(req, route)
+	}
+	// Machines that present a client certificate are authenticated without any redirect.
+	if o.config.ClientCert != nil {
+		auth, err := o.config.ClientCert.authenticate(req)
+		if err != nil {
+			logw("Invalid client certificate", "request", requestID(req), "remote", req.RemoteAddr, "error", err)
+			audit(req, auditLoginFailure, clientCertProviderName, "", err.Error())
+		}
+		if auth != nil && !route.allows(clientCertProviderName) {
+			logd("Client certificates are not accepted for this route", "request", requestID(req), "user", auth.UserID, "path", req.URL.Path)
+			auth = nil
+		}
+		if auth != nil {
+			fillRawData(auth)
+			if !o.resolveSubject(rw, req, clientCertProviderName, auth) {
+				return
+			}
+			o.publishClaims(req, clientCertProviderName, auth)
+			o.next.ServeHTTP(rw, req)
+			return
+		}
+		if o.config.ClientCert.Required && publicRule == nil {
+			audit(req, auditDenied, clientCertProviderName, "", "client certificate required")
+			http.Error(rw, "A valid client certificate is required", http.StatusUnauthorized)
+			return
+		}
+	}
+	// Headless clients get and use bearer tokens with the device authorization flow.
+	if o.config.DeviceFlow != nil {
+		if o.config.DeviceFlow.serveEndpoints(rw, req) {
+			return
+		}
+		grant, err := o.config.DeviceFlow.authenticateBearer(req)
+		if err != nil {
+			logd("Invalid device token", "request", requestID(req), "remote", req.RemoteAddr, "error", err)
+			audit(req, auditLoginFailure, "", "", "invalid device token: "+err.Error())
+			rw.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			http.Error(rw, "Invalid or expired token", http.StatusUnauthorized)
+			return
+		}
+		var userID string
+		if grant != nil {
+			userID, _ = grant.Claims["user-id"].(string)
+		}
+		if grant != nil && o.config.Admin != nil {
+			revoked, err := o.config.Admin.registry.revokedSince(grant.Provider, userID, grant.Issued)
+			if err != nil {
+				loge("Failed to read the sessions", "request", requestID(req), "error", err)
+				http.Error(rw, "Failed to check the token", http.StatusInternalServerError)
+				return
+			}
+			if revoked {
+				logd("Revoked device token", "request", requestID(req), "provider", grant.Provider, "user", userID)
+				audit(req, auditLoginFailure, grant.Provider, userID, "revoked device token")
+				rw.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+				http.Error(rw, "Invalid or expired token", http.StatusUnauthorized)
+				return
+			}
+		}
+		if grant != nil && !route.allows(grant.Provider) {
+			logd("Device token not accepted for this route", "request", requestID(req), "provider", grant.Provider, "path", req.URL.Path)
+			audit(req, auditDenied, grant.Provider, userID, "device token not accepted for this route")
+			http.Error(rw, "Forbidden", http.StatusForbidden)
+			return
+		}
+		if grant != nil {
+			// The subject may have changed since the device was approved, e.g. after unlinking the identity.
+			if !o.resolveSubject(rw, req, grant.Provider, &goth.User{UserID: userID, RawData: grant.Claims}) {
+				return
+			}
+			o.publishClaims(req, grant.Provider, &goth.User{RawData: grant.Claims})
+			o.next.ServeHTTP(rw, req)
+			return
+		}
+	}
+	// Scripts and CI jobs present the personal API keys of their users.
+	if o.config.APIKeys != nil {
+		auth, err := o.config.APIKeys.authenticate(req)
+		if err != nil {
+			logd("Invalid API key", "request", requestID(req), "remote", req.RemoteAddr, "error", err)
+			audit(req, auditLoginFailure, "", "", "invalid API key: "+err.Error())
+			rw.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			http.Error(rw, "Invalid or expired API key", http.StatusUnauthorized)
+			return
+		}
+		if auth != nil && !route.allows(auth.Provider) {
+			logd("API key not accepted for this route", "request", requestID(req), "provider", auth.Provider, "path", req.URL.Path)
+			audit(req, auditDenied, auth.Provider, auth.UserID, "API key not accepted for this route")
+			http.Error(rw, "Forbidden", http.StatusForbidden)
+			return
+		}
+		if auth != nil {
+			if !o.resolveSubject(rw, req, auth.Provider, auth) {
+				return
+			}
+			o.publishClaims(req, auth.Provider, auth)
+			o.next.ServeHTTP(rw, req)
+			return
+		}
+	}
+	// Hosts other than the central auth host get their logins from it.
+	if o.config.SSO != nil && !o.config.SSO.isAuthHost(req) {
+		o.serveSSOHost(rw, req, route, publicRule)
+		return
 	}
+	// Serve the login pages of the providers implemented by the plugin itself, even with a session of another provider.
 	for _, providerConfig := range o.config.Providers {
+		provider, err := providerConfig.providerForHost(req)
+		if err != nil { // Other providers (or public rules) may still serve this host
+			logd("Provider not available for this host", "request", requestID(req), "provider", providerConfig.Name, "host", req.Host, "error", err)
+			continue
+		}
+		if loginPages, ok := provider.(loginPageProvider); ok && loginPages.ServeLoginPage(rw, req) {
+			return
+		}
+	}
+	callbackProvider := o.config.callbackProvider(req)
+	// denied is the first session rejected by the route, audited if no other session is accepted.
+	var denied *goth.User
+	for _, providerConfig := range o.config.Providers {
+		// Callbacks are only for their provider, even with a session of another provider (e.g. to link an account).
+		if callbackProvider != nil && callbackProvider != providerConfig {
+			continue
+		}
+
+		// Handle form_post callbacks (e.g. Apple): they are cross-site POST requests, so the browser does not send the
+		// session cookie (SameSite=Lax). Turn them into a top-level GET navigation, which does include the cookie. Only
+		// the state and code go in the URL, the other fields (e.g. the name of the user) are kept in a cookie, so that
+		// they never reach the access logs or the Referer headers.
+		if req.Method == http.MethodPost && req.URL.Path == providerConfig.redirectURI.Path {
+			if err := req.ParseForm(); err == nil && req.PostForm.Get("state") != "" {
+				logd("Redirecting form_post callback", "request", requestID(req), "provider", providerConfig.Name)
+				if user := req.PostForm.Get("user"); user != "" {
+					session, _ := gothic.Store.New(req, formPostSessionName)
+					session.Values["user"] = user
+					session.Options.MaxAge = int(formPostTTL.Seconds())
+					if err = session.Save(req, rw); err != nil {
+						logw("Could not save the form_post callback", "request", requestID(req), "provider", providerConfig.Name, "error", err)
+					}
+				}
+				callbackURL := *req.URL
+				callbackURL.RawQuery = url.Values{"state": {req.PostForm.Get("state")}, "code": {req.PostForm.Get("code")}}.Encode()
+				http.Redirect(rw, req, callbackURL.RequestURI(), http.StatusSeeOther)
+				return
+			}
+		}
+
 		// Avoid yaegi context collision bug: different types with the same value collide when inserted in the context.
 		// This breaks mux.Vars, provider.Name and other context values.
 		tmpQuery := req.URL.Query()
 		tmpQuery.Set(":provider", providerConfig.Name)
+		if req.URL.Path == providerConfig.redirectURI.Path {
+			if session, err := gothic.Store.Get(req, formPostSessionName); err == nil && session.Values["user"] != nil {
+				tmpQuery.Set("user", fmt.Sprint(session.Values["user"]))
+				session.Options.MaxAge = -1
+				if err = session.Save(req, rw); err != nil {
+					logw("Could not delete the form_post callback", "request", requestID(req), "provider", providerConfig.Name, "error", err)
+				}
+			}
+		}
 		req.URL.RawQuery = tmpQuery.Encode()
 
 		// Handle logout requests.
 		if req.URL.Path == providerConfig.logoutURI.Path {
-			logd("Logging out", "provider", providerConfig.Name)
+			logd("Logging out", "request", requestID(req), "provider", providerConfig.Name)
+			audit(req, auditLogout, providerConfig.Name, authUserID(req, providerConfig.Name), "")
+			if o.config.Admin != nil {
+				o.config.Admin.registry.end(req, providerConfig.Name)
+				if err := o.config.Admin.endImpersonation(rw, req, "logout"); err != nil {
+					logw("Could not end the impersonation", "request", requestID(req), "error", err)
+				}
+			}
 			err := gothic.Logout(rw, req)
 			if err != nil {
-				loge("Failed to logout", "provider", providerConfig.Name, "error", err)
+				loge("Failed to logout", "request", requestID(req), "provider", providerConfig.Name, "error", err)
 				http.Error(rw, "Failed to logout", http.StatusInternalServerError)
 				return
 			}
@@ -42,31 +221,34 @@ func (o *Plugin) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 		}
 
 		// Handle callback/redirect_uri requests, and normal requests that are already authenticated.
-		logd("Completing authentication", "provider", providerConfig.Name)
+		logd("Completing authentication", "request", requestID(req), "provider", providerConfig.Name)
 		auth, err := CompleteUserAuthNoLogout(rw, req)
 		if err != nil {
 			if req.URL.Path == providerConfig.redirectURI.Path {
-				loge("Failed to authenticate", "provider", providerConfig.Name, "error", err)
+				loge("Failed to authenticate", "request", requestID(req), "provider", providerConfig.Name, "error", err)
+				audit(req, auditLoginFailure, providerConfig.Name, "", err.Error())
 				http.Error(rw, "Failed to authenticate", http.StatusInternalServerError)
 				return
 			} else {
-				logd("Not authenticated", "provider", providerConfig.Name, "error", err)
+				logd("Not authenticated", "request", requestID(req), "provider", providerConfig.Name, "error", err)
 				// Handle login requests that specify the providerConfig.
 				// NOTE: Handling them here avoids possible infinite loop when redirecting to the login url
 				if req.URL.Path == providerConfig.authURI.Path {
-					o.runBeginAuthHandler(rw, req, providerConfig)
+					o.runBeginAuthHandler(rw, req, providerConfig, 0)
 					return
 				}
 				continue
 			}
 		}
 		if req.URL.Path == providerConfig.redirectURI.Path {
+			loginTime, verified := providerAuthTime(providerConfig.provider, &auth)
 			auth.IDToken = strings.Repeat("*", len(auth.IDToken))
 			auth.AccessToken = strings.Repeat("*", len(auth.AccessToken))
 			auth.AccessTokenSecret = strings.Repeat("*", len(auth.AccessTokenSecret))
 			auth.RefreshToken = strings.Repeat("*", len(auth.RefreshToken))
 			// Redirect to initial URL after login success!
 			redirectPath := "/" // Default if it cannot be recovered
+			var stepUpMaxAge time.Duration
 			redirectSession, err := gothic.Store.Get(req, gothic.SessionName+"_redirect")
 			if err == nil {
 				redirectPathTmp, ok := redirectSession.Values["path"].(string)
@@ -75,48 +257,183 @@ func (o *Plugin) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 				} else {
 					err = errors.New("could not get the path value from the redirect session cookie")
 				}
+				if seconds, ok := redirectSession.Values["maxAge"].(int64); ok {
+					stepUpMaxAge = time.Duration(seconds) * time.Second
+				}
 			}
 			if err != nil {
-				logw("Could not recover the redirect path", "error", err.Error())
+				logw("Could not recover the redirect path", "request", requestID(req), "error", err.Error())
 			}
-			logi("User just logged in", "provider", providerConfig.Name, "user", fmt.Sprintf("%+v", auth), "redirect", redirectPath)
+			// Providers may ignore max_age, so a recent login must be proven by them.
+			if stepUpMaxAge > 0 && (!verified || time.Since(loginTime) > stepUpMaxAge+authTimeLeeway) {
+				reason := "login not recent enough"
+				if !verified {
+					reason = "the provider did not report the login time"
+				}
+				logw("Recent login not proven", "request", requestID(req), "provider", providerConfig.Name, "user", auth.UserID, "loginTime", loginTime, "verified", verified)
+				audit(req, auditLoginFailure, providerConfig.Name, auth.UserID, reason)
+				http.Error(rw, "A recent login is required, and "+reason, http.StatusForbidden)
+				return
+			}
+			if o.config.Admin != nil {
+				fillRawData(&auth)
+				if err = o.config.Admin.registry.register(req, providerConfig.Name, providerConfig.Name, &auth); err != nil {
+					loge("Failed to register the session", "request", requestID(req), "provider", providerConfig.Name, "error", err)
+					http.Error(rw, "Failed to save the session", http.StatusInternalServerError)
+					return
+				}
+			}
+			if o.config.Identities != nil {
+				o.config.Identities.completeLink(rw, req, providerConfig.Name, &auth)
+			}
+			if err = recordAuthTime(rw, req, providerConfig.Name, auth.UserID, loginTime, verified); err != nil {
+				logw("Could not record the login time", "request", requestID(req), "provider", providerConfig.Name, "error", err)
+			}
+			logi("User just logged in", "request", requestID(req), "provider", providerConfig.Name, "user", auth.UserID, "redirect", redirectPath)
+			audit(req, auditLogin, providerConfig.Name, auth.UserID, "")
 			http.Redirect(rw, req, redirectPath, http.StatusTemporaryRedirect)
 			return
 		}
 
+		// Sessions of other providers are ignored here, the user may need to log in again.
+		if !route.allows(providerConfig.Name) {
+			logd("Provider not accepted for this route", "request", requestID(req), "provider", providerConfig.Name, "path", req.URL.Path)
+			if denied == nil {
+				denied = &goth.User{Provider: providerConfig.Name, UserID: auth.UserID}
+			}
+			continue
+		}
+
+		// Revoked sessions require a new login.
+		if o.config.Admin != nil && !o.config.Admin.registry.active(req, providerConfig.Name, auth.UserID) {
+			o.runBeginAuthHandler(rw, req, providerConfig, 0)
+			return
+		}
+
+		// Idle and old sessions require a new login.
+		if o.config.Session != nil && o.config.Session.expired(rw, req, providerConfig.Name, auth.UserID) {
+			o.runBeginAuthHandler(rw, req, providerConfig, 0)
+			return
+		}
+
+		// Sensitive paths require a recent login.
+		if maxAge := o.config.maxAuthAge(req); maxAge > 0 {
+			if loginTime, ok := verifiedAuthTime(req, providerConfig.Name, auth.UserID); !ok || time.Since(loginTime) > maxAge {
+				logi("Recent login required", "request", requestID(req), "provider", providerConfig.Name, "user", auth.UserID, "path", req.URL.Path, "maxAge", maxAge)
+				o.runBeginAuthHandler(rw, req, providerConfig, maxAge)
+				return
+			}
+		}
+
+		// The second factor is required before serving anything else to the user.
+		if o.config.TOTP != nil && o.config.TOTP.serveChallenge(rw, req, providerConfig, &auth) {
+			return
+		}
+
 		// We are authenticated with this provider, publish claims and finish!
+		if providerConfig.GraphGroups != nil {
+			if err = enrichGraphGroups(req, providerConfig, &auth); err != nil {
+				logw("Could not enrich the user with Microsoft Graph groups", "request", requestID(req), "provider", providerConfig.Name, "error", err)
+				// Never let the client provide the groups itself.
+				req.Header.Del(o.config.ClaimsPrefix + invalidHeader.ReplaceAllString(providerConfig.GraphGroups.Claim, "-"))
+			}
+		}
 		fillRawData(&auth)
-		logt("Publishing claims for next http handler", "provider", providerConfig.Name, "claims", fmt.Sprintf("%+v", auth.RawData))
-		for key, value := range auth.RawData {
-			headerKey := o.config.ClaimsPrefix + invalidHeader.ReplaceAllString(key, "-")
-			valueStr := fmt.Sprintf("%v", value)
-			// Detect and log attempts to overwrite headers (client tries to overwrite the header with a different value).
-			if prevValueStr := req.Header.Get(headerKey); prevValueStr != "" {
-				logw("Client tried to overwrite header (ignoring it)", "provider", providerConfig.Name, "header", headerKey, "old", prevValueStr, "new", valueStr)
+		if !o.resolveSubject(rw, req, providerConfig.Name, &auth) {
+			return
+		}
+		if o.config.SSO != nil && o.config.SSO.serveAuthorize(rw, req, providerConfig.Name, &auth) {
+			return
+		}
+		if o.config.DeviceFlow != nil && o.config.DeviceFlow.serveVerification(rw, req, providerConfig.Name, &auth) {
+			return
+		}
+		if o.config.APIKeys != nil && o.config.APIKeys.serveManagement(rw, req, providerConfig.Name, &auth) {
+			return
+		}
+		if o.config.Admin != nil && o.config.Admin.serveAdmin(rw, req, providerConfig.Name, &auth) {
+			return
+		}
+		if o.config.Identities != nil && o.serveLinking(rw, req, providerConfig.Name, &auth) {
+			return
+		}
+		for _, otherConfig := range o.config.Providers {
+			otherProvider, _ := otherConfig.providerForHost(req)
+			if pages, ok := otherProvider.(authenticatedPageProvider); ok && pages.ServeAuthenticatedPage(rw, req, providerConfig.Name, &auth) {
+				return
 			}
-			// Always set the header, even if it is already set.
-			req.Header.Set(headerKey, valueStr)
 		}
+		// Admins may see the apps as another user.
+		if o.config.Admin != nil {
+			req.Header.Del(o.config.ClaimsPrefix + "Impersonator")
+			req.Header.Del(o.config.ClaimsPrefix + "Impersonation-Stop")
+			if current := o.config.Admin.impersonated(req, providerConfig.Name, &auth); current != nil {
+				// The impersonated user must also be accepted by the route.
+				if !route.allows(current.Provider) {
+					logd("Impersonated provider not accepted for this route", "request", requestID(req), "admin", current.Admin, "provider", current.Provider, "path", req.URL.Path)
+					auditAdmin(req, auditDenied, current.Provider, current.UserID, current.Admin, "provider not accepted for this route")
+					http.Error(rw, "Forbidden", http.StatusForbidden)
+					return
+				}
+				stopURL, err := o.config.Admin.stopImpersonationURL(current.Admin)
+				if err != nil {
+					loge("Failed to sign the impersonation stop link", "request", requestID(req), "error", err)
+					http.Error(rw, "Failed to serve the page", http.StatusInternalServerError)
+					return
+				}
+				claims := make(map[string]interface{}, len(current.Claims)+2)
+				for claim, value := range current.Claims {
+					claims[claim] = value
+				}
+				claims["impersonator"] = current.Admin
+				claims["impersonation-stop"] = stopURL
+				logd("Impersonating", "request", requestID(req), "admin", current.Admin, "provider", current.Provider, "user", current.UserID, "path", req.URL.Path)
+				o.publishClaims(req, current.Provider, &goth.User{RawData: claims})
+				o.next.ServeHTTP(rw, req)
+				return
+			}
+		}
+		o.publishClaims(req, providerConfig.Name, &auth)
 
 		// Authentication completed, run the next handler.
 		o.next.ServeHTTP(rw, req)
 		return
 	}
 
-	// We could not authenticate with any provider, select one to start the authentication.
+	if denied != nil {
+		audit(req, auditDenied, denied.Provider, denied.UserID, "provider not accepted for this route")
+	}
+
+	// We could not authenticate with any provider, let optional requests pass anonymously.
+	if publicRule != nil {
+		logd("Anonymous request", "request", requestID(req), "method", req.Method, "path", req.URL.Path)
+		o.config.stripClaims(req)
+		o.next.ServeHTTP(rw, req)
+		return
+	}
+
+	// Select a provider to start the authentication.
+	allowedProviders := make([]*ProviderConfig, 0, len(o.config.Providers))
+	allowedProvidersInfo := make([]*ProviderInfo, 0, len(o.providersInfo))
+	for i, providerConfig := range o.config.Providers {
+		if route.allows(providerConfig.Name) {
+			allowedProviders = append(allowedProviders, providerConfig)
+			allowedProvidersInfo = append(allowedProvidersInfo, o.providersInfo[i])
+		}
+	}
 	var autoBeginAuthFor *ProviderConfig
-	if len(o.config.Providers) == 1 {
-		autoBeginAuthFor = o.config.Providers[0]
+	if len(allowedProviders) == 1 {
+		autoBeginAuthFor = allowedProviders[0]
 	} else if req.URL.Query().Has("provider") {
 		search := req.URL.Query().Get("provider")
-		for _, provider := range o.config.Providers {
+		for _, provider := range allowedProviders {
 			if search == provider.Name {
 				autoBeginAuthFor = provider
 				break
 			}
 		}
 		if autoBeginAuthFor == nil {
-			loge("Provider not found", "provider", search)
+			loge("Provider not found", "request", requestID(req), "provider", search)
 			http.Error(rw, "Invalid provider", http.StatusBadRequest)
 			return
 		}
@@ -125,36 +442,88 @@ func (o *Plugin) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	//o.providersInfo = allProviders
 	if autoBeginAuthFor != nil {
 		// Log in with the selected provider without an intermediate page
-		o.runBeginAuthHandler(rw, req, autoBeginAuthFor)
+		o.runBeginAuthHandler(rw, req, autoBeginAuthFor, 0)
 	} else {
 		// Show a page for the user to choose the provider
-		if loginChooseProviderHtmlCache == nil {
-			tmp := &bytes.Buffer{}
-			err := loginChooseProviderHtml.Execute(tmp, o.providersInfo)
-			if err != nil {
-				http.Error(rw, err.Error(), http.StatusInternalServerError)
-			}
-			loginChooseProviderHtmlCache = bytes.NewReader(tmp.Bytes())
-			loginChooseProviderHtmlCacheTime = time.Now()
+		page, err := loginChooseProviderPage(allowedProvidersInfo)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
 		}
-		http.ServeContent(rw, req, "login-choose-provider.html", loginChooseProviderHtmlCacheTime, loginChooseProviderHtmlCache)
+		http.ServeContent(rw, req, "login-choose-provider.html", page.modTime, bytes.NewReader(page.content))
 	}
 }
 
-func (o *Plugin) runBeginAuthHandler(rw http.ResponseWriter, req *http.Request, providerConfig *ProviderConfig) {
-	logd("Authenticating", "provider", providerConfig.Name)
+// publishClaims sets the claims of the authenticated user as headers of the request, for the next handler.
+func (o *Plugin) publishClaims(req *http.Request, providerName string, auth *goth.User) {
+	logt("Publishing claims for next http handler", "request", requestID(req), "provider", providerName, "claims", fmt.Sprintf("%+v", auth.RawData))
+	for key, value := range auth.RawData {
+		headerKey := o.config.ClaimsPrefix + invalidHeader.ReplaceAllString(key, "-")
+		valueStr := fmt.Sprintf("%v", value)
+		// Detect and log attempts to overwrite headers (client tries to overwrite the header with a different value).
+		if prevValueStr := req.Header.Get(headerKey); prevValueStr != "" {
+			logw("Client tried to overwrite header (ignoring it)", "request", requestID(req), "provider", providerName, "header", headerKey, "old", prevValueStr, "new", valueStr)
+		}
+		// Always set the header, even if it is already set.
+		req.Header.Set(headerKey, valueStr)
+	}
+}
+
+// runBeginAuthHandler redirects to the provider, asking it to re-authenticate the user if maxAge is not 0.
+func (o *Plugin) runBeginAuthHandler(rw http.ResponseWriter, req *http.Request, providerConfig *ProviderConfig, maxAge time.Duration) {
+	logd("Authenticating", "request", requestID(req), "provider", providerConfig.Name)
 	tmpQuery := req.URL.Query()
 	tmpQuery.Set(":provider", providerConfig.Name)
 	req.URL.RawQuery = tmpQuery.Encode()
 	redirectSession, err := o.redirectStore.New(req, gothic.SessionName+"_redirect")
 	if err == nil {
 		redirectSession.Values["path"] = req.RequestURI
+		if maxAge > 0 {
+			redirectSession.Values["maxAge"] = int64(maxAge.Seconds())
+		}
 		err = redirectSession.Save(req, rw)
 	}
 	if err != nil {
-		logw("Could not save redirect path", "error", err.Error())
+		logw("Could not save redirect path", "request", requestID(req), "error", err.Error())
+	}
+	authURL, err := getAuthURL(rw, req)
+	if err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		_, _ = fmt.Fprintln(rw, err)
+		return
 	}
-	gothic.BeginAuthHandler(rw, req)
+	if maxAge > 0 {
+		prompt := "login"
+		if providerConfig.info != nil && providerConfig.info.NoLoginPrompt {
+			prompt = ""
+		}
+		authURL = stepUpAuthURL(authURL, maxAge, prompt)
+	}
+	http.Redirect(rw, req, authURL, http.StatusTemporaryRedirect)
+}
+
+const (
+	// formPostSessionName is the cookie that keeps the fields of a form_post callback that are not sent in the URL.
+	formPostSessionName = "_gothic_form_post"
+	formPostTTL         = 5 * time.Minute
+)
+
+// requestIDHeader identifies each request in the logs, and is also sent to the next handler. Requests that already
+// have one (e.g. from another proxy) keep it.
+const requestIDHeader = "X-Request-Id"
+
+func requestID(req *http.Request) string {
+	return req.Header.Get(requestIDHeader)
+}
+
+// callbackProvider returns the provider whose callback is the path of the request, if any.
+func (c *Config) callbackProvider(req *http.Request) *ProviderConfig {
+	for _, providerConfig := range c.Providers {
+		if req.URL.Path == providerConfig.redirectURI.Path {
+			return providerConfig
+		}
+	}
+	return nil
 }
 
 func fillRawData(auth *goth.User) {
@@ -184,5 +553,34 @@ func fillRawData(auth *goth.User) {
 
 var invalidHeader = regexp.MustCompile("[^a-zA-Z0-9-]+") // Also removing _ from headers
 
-var loginChooseProviderHtmlCache *bytes.Reader
-var loginChooseProviderHtmlCacheTime time.Time
+// loginChooseProviderHtmlCache are the rendered chooser pages, by the names of their providers.
+var loginChooseProviderHtmlCache = struct {
+	sync.Mutex
+	byProviders map[string]*renderedPage
+}{byProviders: map[string]*renderedPage{}}
+
+type renderedPage struct {
+	content []byte
+	modTime time.Time
+}
+
+// loginChooseProviderPage renders (once) the chooser page that lists the given providers.
+func loginChooseProviderPage(providersInfo []*ProviderInfo) (*renderedPage, error) {
+	names := make([]string, 0, len(providersInfo))
+	for _, providerInfo := range providersInfo {
+		names = append(names, providerInfo.Name)
+	}
+	key := strings.Join(names, ",")
+	loginChooseProviderHtmlCache.Lock()
+	defer loginChooseProviderHtmlCache.Unlock()
+	if page, ok := loginChooseProviderHtmlCache.byProviders[key]; ok {
+		return page, nil
+	}
+	tmp := &bytes.Buffer{}
+	if err := loginChooseProviderHtml.Execute(tmp, providersInfo); err != nil {
+		return nil, err
+	}
+	page := &renderedPage{content: tmp.Bytes(), modTime: time.Now()}
+	loginChooseProviderHtmlCache.byProviders[key] = page
+	return page, nil
+}
@@ -0,0 +1,194 @@
+package traefikgothauth
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"github.com/markbates/goth"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"time"
+)
+
+// HTTPClientConfig configures the outbound HTTP client used to contact a provider (token, userinfo, discovery...).
+type HTTPClientConfig struct {
+	// CAFile (optional) is a PEM bundle of additional certificate authorities to trust (e.g. an internal CA).
+	CAFile string
+	// CertFile (optional) is the PEM client certificate for mutual TLS. Requires KeyFile.
+	CertFile string
+	// KeyFile (optional) is the PEM private key of the client certificate for mutual TLS. Requires CertFile.
+	KeyFile string
+	// Proxy (optional) is the URL of the HTTP proxy. Defaults to the HTTP_PROXY, HTTPS_PROXY and NO_PROXY variables.
+	Proxy string
+	// Timeout (optional) is the maximum duration of each request, including retries (e.g. "10s"). Defaults to 30s.
+	Timeout string
+	// Retries (optional) is the number of times a request is retried after a network error or a 429/5xx response. Only
+	// idempotent requests (e.g. userinfo or discovery) are retried: token requests are not, as codes are single-use.
+	Retries int
+	// RetryBackoff (optional) is the wait before the first retry, doubled after each retry. Defaults to 500ms.
+	RetryBackoff string
+}
+
+const defaultHTTPClientTimeout = 30 * time.Second
+
+// newHTTPClient builds the outbound HTTP client. A nil configuration still sets a timeout, so that an unreachable
+// provider can not hang requests indefinitely.
+func (c *HTTPClientConfig) newHTTPClient() (*http.Client, error) {
+	if c == nil {
+		c = &HTTPClientConfig{}
+	}
+	var errs []error
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	if c.CAFile != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		pem, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to read CA file: %w", err))
+		} else if !pool.AppendCertsFromPEM(pem) {
+			errs = append(errs, fmt.Errorf("no certificates found in CA file %s", c.CAFile))
+		}
+		transport.TLSClientConfig.RootCAs = pool
+	}
+	if c.CertFile != "" || c.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to load client certificate: %w", err))
+		}
+		transport.TLSClientConfig.Certificates = []tls.Certificate{cert}
+	}
+	if c.Proxy != "" {
+		proxyURL, err := url.Parse(c.Proxy)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to parse proxy URL: %w", err))
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+	timeout, err := parseDurationDefault(c.Timeout, defaultHTTPClientTimeout)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("failed to parse timeout: %w", err))
+	}
+	transport.DialContext = (&net.Dialer{Timeout: timeout, KeepAlive: 30 * time.Second}).DialContext
+	transport.TLSHandshakeTimeout = timeout
+	transport.ResponseHeaderTimeout = timeout
+	backoff, err := parseDurationDefault(c.RetryBackoff, 500*time.Millisecond)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("failed to parse retry backoff: %w", err))
+	}
+	if c.Retries < 0 {
+		errs = append(errs, fmt.Errorf("retries must not be negative: %d", c.Retries))
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	client := &http.Client{Timeout: timeout, Transport: transport}
+	if c.Retries > 0 {
+		client.Transport = &retryTransport{next: transport, retries: c.Retries, backoff: backoff}
+	}
+	return client, nil
+}
+
+// clientTLSSettings returns the TLS settings (CA, client certificate) and timeout of the outbound HTTP client, for the
+// providers that connect with other protocols (LDAP, SMTP...).
+func clientTLSSettings(client *http.Client) (*tls.Config, time.Duration) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	transport := client.Transport
+	if retry, ok := transport.(*retryTransport); ok {
+		transport = retry.next
+	}
+	if httpTransport, ok := transport.(*http.Transport); ok && httpTransport.TLSClientConfig != nil {
+		tlsConfig = httpTransport.TLSClientConfig.Clone()
+	}
+	timeout := client.Timeout
+	if timeout <= 0 {
+		timeout = defaultHTTPClientTimeout
+	}
+	return tlsConfig, timeout
+}
+
+// parseDurationDefault parses a duration such as "5m", returning def for an empty string.
+func parseDurationDefault(value string, def time.Duration) (time.Duration, error) {
+	if value == "" {
+		return def, nil
+	}
+	return time.ParseDuration(value)
+}
+
+// retryTransport retries idempotent requests that failed because of network errors or retryable status codes.
+type retryTransport struct {
+	next    http.RoundTripper
+	retries int
+	backoff time.Duration
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !isIdempotent(req.Method) {
+		return t.next.RoundTrip(req)
+	}
+	wait := t.backoff
+	for attempt := 0; ; attempt++ {
+		attemptReq := req
+		if attempt > 0 && req.Body != nil && req.Body != http.NoBody {
+			if req.GetBody == nil {
+				return nil, errors.New("can not retry a request without GetBody")
+			}
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			attemptReq = req.Clone(req.Context())
+			attemptReq.Body = body
+		}
+		res, err := t.next.RoundTrip(attemptReq)
+		retryable := err != nil || res.StatusCode == http.StatusTooManyRequests || res.StatusCode >= 500
+		if !retryable || attempt >= t.retries || req.Context().Err() != nil {
+			return res, err
+		}
+		if err != nil {
+			logd("Retrying outbound request", "url", req.URL.Redacted(), "attempt", attempt+1, "error", err)
+		} else {
+			logd("Retrying outbound request", "url", req.URL.Redacted(), "attempt", attempt+1, "status", res.StatusCode)
+			_, _ = io.Copy(io.Discard, res.Body)
+			_ = res.Body.Close()
+		}
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(wait):
+		}
+		wait *= 2
+	}
+}
+
+// isIdempotent returns true for the methods that can be safely repeated (RFC 9110, section 9.2.2).
+func isIdempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// setProviderHTTPClient makes a goth provider use the given client, as most of them expose it as a struct field.
+func setProviderHTTPClient(provider goth.Provider, client *http.Client) bool {
+	value := reflect.ValueOf(provider)
+	if value.Kind() != reflect.Ptr || value.Elem().Kind() != reflect.Struct {
+		return false
+	}
+	for _, fieldName := range []string{"HTTPClient", "Client"} {
+		field := value.Elem().FieldByName(fieldName)
+		if field.IsValid() && field.CanSet() && field.Type() == reflect.TypeOf(client) {
+			field.Set(reflect.ValueOf(client))
+			return true
+		}
+	}
+	return false
+}
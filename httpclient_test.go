@@ -0,0 +1,56 @@
+package traefikgothauth
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHTTPClientRetries(t *testing.T) {
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		attempts++
+		body, _ := io.ReadAll(req.Body)
+		if string(body) != "code=1" {
+			t.Errorf("unexpected body on attempt %d: %q", attempts, body)
+		}
+		if attempts < 3 {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = rw.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	client, err := (&HTTPClientConfig{Retries: 2, RetryBackoff: "1ms", Timeout: "5s"}).newHTTPClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest(http.MethodPut, server.URL, strings.NewReader("code=1"))
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = res.Body.Close()
+	if res.StatusCode != http.StatusOK || attempts != 3 {
+		t.Fatalf("expected success after 3 attempts, got %d after %d", res.StatusCode, attempts)
+	}
+
+	// Token requests are not idempotent: the code would be redeemed twice
+	attempts = 0
+	res, err = client.Post(server.URL, "application/x-www-form-urlencoded", strings.NewReader("code=1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = res.Body.Close()
+	if res.StatusCode != http.StatusServiceUnavailable || attempts != 1 {
+		t.Fatalf("expected POST requests not to be retried, got %d after %d attempts", res.StatusCode, attempts)
+	}
+
+	if _, err = (&HTTPClientConfig{CAFile: "/nonexistent.pem", Timeout: "soon"}).newHTTPClient(); err == nil ||
+		!strings.Contains(err.Error(), "CA file") || !strings.Contains(err.Error(), "timeout") {
+		t.Fatalf("expected all configuration problems to be reported, got: %v", err)
+	}
+}
@@ -0,0 +1,339 @@
+package traefikgothauth
+
+import (
+	"errors"
+	"fmt"
+	"github.com/markbates/goth"
+	"github.com/markbates/goth/gothic"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	identitiesPath = "/__goth/link/"
+	// linkSessionName is the cookie that remembers the subject to link while the user logs in with another provider.
+	linkSessionName = "_gothic_link"
+	linkTTL         = 10 * time.Minute
+)
+
+// IdentitiesConfig links the identities of the users at several providers to one stable subject, published as the
+// internal-subject claim (not to be confused with the subject claim of the client certificates). Identities are linked automatically by verified email, or by the users themselves at /__goth/link/.
+type IdentitiesConfig struct {
+	// StoreFile is the JSON file where the subjects and their identities are kept. It must be writable and persistent.
+	StoreFile string
+	// EmailProviders (optional) are the providers that verify the emails of their users, so that identities with the
+	// same email are linked automatically. Users with an email_verified claim set to false are never linked by email.
+	EmailProviders []string
+	store          *fileStore
+	csrfKey        []byte
+}
+
+// subject is a user, with all their linked identities ("provider:userID").
+type subject struct {
+	ID         string
+	Identities []string
+	// Emails are the verified emails of the identities, so that they are forgotten when the identity is unlinked.
+	Emails  map[string]string
+	Created time.Time
+}
+
+// identitiesData is the content of the store file.
+type identitiesData struct {
+	Subjects []*subject
+}
+
+func (c *IdentitiesConfig) setup(cookieSecret string, providers []*ProviderConfig) error {
+	var errs []error
+	if c.StoreFile == "" {
+		errs = append(errs, errors.New("identities: StoreFile is required"))
+	}
+	for _, name := range c.EmailProviders {
+		found := false
+		for _, providerConfig := range providers {
+			found = found || providerConfig.Name == name
+		}
+		if !found {
+			errs = append(errs, fmt.Errorf("identities: unknown email provider %s", name))
+		}
+	}
+	c.store = newFileStore(c.StoreFile)
+	c.csrfKey = signingKey(cookieSecret, "identities")
+	return errors.Join(errs...)
+}
+
+// verifiedEmail returns the email of the user if the provider verified it, or "".
+func (c *IdentitiesConfig) verifiedEmail(providerName string, auth *goth.User) string {
+	if auth.Email == "" || fmt.Sprint(auth.RawData["email_verified"]) == "false" {
+		return ""
+	}
+	for _, name := range c.EmailProviders {
+		if name == providerName {
+			return strings.ToLower(auth.Email)
+		}
+	}
+	return ""
+}
+
+// resolve sets the internal-subject claim of the user, linking their identity to a subject on their first login.
+func (c *IdentitiesConfig) resolve(providerName string, auth *goth.User) error {
+	identity := providerName + ":" + auth.UserID
+	email := c.verifiedEmail(providerName, auth)
+	snapshot, err := c.store.snapshot(func() interface{} { return &identitiesData{} })
+	if err != nil {
+		return err
+	}
+	if found := snapshot.(*identitiesData).find(identity); found != nil && (email == "" || found.Emails[identity] == email) {
+		auth.RawData["internal-subject"] = found.ID
+		return nil
+	}
+	data := &identitiesData{}
+	var resolved *subject
+	err = c.store.update(data, func() error {
+		resolved = data.find(identity)
+		if resolved == nil && email != "" {
+			for _, other := range data.Subjects {
+				if other.hasEmail(email) {
+					resolved = other
+					logi("Identity linked by email", "subject", other.ID, "identity", identity, "email", email)
+					break
+				}
+			}
+		}
+		if resolved == nil {
+			resolved = &subject{ID: randomString(16), Created: time.Now().UTC().Truncate(time.Second)}
+			data.Subjects = append(data.Subjects, resolved)
+			logi("New subject", "subject", resolved.ID, "identity", identity)
+		}
+		if !contains(resolved.Identities, identity) {
+			resolved.Identities = append(resolved.Identities, identity)
+		}
+		if email != "" {
+			if resolved.Emails == nil {
+				resolved.Emails = map[string]string{}
+			}
+			resolved.Emails[identity] = email
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	auth.RawData["internal-subject"] = resolved.ID
+	return nil
+}
+
+// hasEmail returns true if any identity of the subject has the verified email.
+func (s *subject) hasEmail(email string) bool {
+	for _, other := range s.Emails {
+		if other == email {
+			return true
+		}
+	}
+	return false
+}
+
+// find returns the subject of the identity, if any.
+func (data *identitiesData) find(identity string) *subject {
+	for _, other := range data.Subjects {
+		if contains(other.Identities, identity) {
+			return other
+		}
+	}
+	return nil
+}
+
+// link moves the identity to the subject, deleting its previous subject if it has no identities left.
+func (c *IdentitiesConfig) link(subjectID, identity string) error {
+	data := &identitiesData{}
+	return c.store.update(data, func() error {
+		var target *subject
+		for _, other := range data.Subjects {
+			if other.ID == subjectID {
+				target = other
+			}
+		}
+		if target == nil {
+			return errors.New("subject not found")
+		}
+		email := ""
+		if previous := data.find(identity); previous != nil {
+			email = previous.Emails[identity]
+		}
+		c.unlinkFrom(data, identity)
+		target.Identities = append(target.Identities, identity)
+		if email != "" {
+			if target.Emails == nil {
+				target.Emails = map[string]string{}
+			}
+			target.Emails[identity] = email
+		}
+		return nil
+	})
+}
+
+// unlinkFrom removes the identity and its email from its subject, deleting the subject if it has no identities left.
+func (c *IdentitiesConfig) unlinkFrom(data *identitiesData, identity string) {
+	kept := data.Subjects[:0]
+	for _, other := range data.Subjects {
+		identities := other.Identities[:0]
+		for _, otherIdentity := range other.Identities {
+			if otherIdentity != identity {
+				identities = append(identities, otherIdentity)
+			}
+		}
+		other.Identities = identities
+		delete(other.Emails, identity)
+		if len(other.Identities) > 0 {
+			kept = append(kept, other)
+		}
+	}
+	data.Subjects = kept
+}
+
+// completeLink links the identity that just logged in to the subject that asked for it, if any.
+func (c *IdentitiesConfig) completeLink(rw http.ResponseWriter, req *http.Request, providerName string, auth *goth.User) {
+	session, _ := gothic.Store.Get(req, linkSessionName)
+	value, _ := session.Values["subject"].(string)
+	if value == "" {
+		return
+	}
+	session.Options.MaxAge = -1
+	if err := session.Save(req, rw); err != nil {
+		logw("Could not delete the link session", "request", requestID(req), "error", err)
+	}
+	subjectID, expires, _ := strings.Cut(value, "\x00")
+	if unix, err := strconv.ParseInt(expires, 10, 64); err != nil || time.Now().Unix() > unix {
+		logw("Account link expired", "request", requestID(req), "provider", providerName, "user", auth.UserID)
+		return
+	}
+	identity := providerName + ":" + auth.UserID
+	if err := c.link(subjectID, identity); err != nil {
+		loge("Failed to link the account", "request", requestID(req), "subject", subjectID, "identity", identity, "error", err)
+		return
+	}
+	logi("Identity linked", "request", requestID(req), "subject", subjectID, "identity", identity)
+}
+
+func contains(values []string, value string) bool {
+	for _, other := range values {
+		if other == value {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveSubject resolves the subject of the user if the identities are enabled, returning false after answering with
+// an error.
+func (o *Plugin) resolveSubject(rw http.ResponseWriter, req *http.Request, providerName string, auth *goth.User) bool {
+	if o.config.Identities == nil {
+		return true
+	}
+	if err := o.config.Identities.resolve(providerName, auth); err != nil {
+		loge("Failed to resolve the subject", "request", requestID(req), "provider", providerName, "user", auth.UserID, "error", err)
+		http.Error(rw, "Failed to read the user", http.StatusInternalServerError)
+		return false
+	}
+	return true
+}
+
+// serveLinking serves the page where the authenticated user links other accounts to their subject, returning true if
+// it handled the request.
+func (o *Plugin) serveLinking(rw http.ResponseWriter, req *http.Request, providerName string, auth *goth.User) bool {
+	if req.URL.Path != identitiesPath {
+		return false
+	}
+	c := o.config.Identities
+	subjectID, _ := auth.RawData["internal-subject"].(string)
+	if subjectID == "" {
+		http.Error(rw, "Failed to read the linked accounts", http.StatusInternalServerError)
+		return true
+	}
+	identity := providerName + ":" + auth.UserID
+	page := &identitiesPage{Title: "Linked accounts", Current: identity}
+	status := http.StatusOK
+	if req.Method == http.MethodPost {
+		var expected string
+		_ = req.ParseForm()
+		if err := verifyToken(c.csrfKey, "identities", req.PostForm.Get("csrf"), &expected); err != nil || expected != subjectID {
+			page.Error, status = "Your session expired, please try again", http.StatusBadRequest
+		} else {
+			switch req.PostForm.Get("action") {
+			case "link":
+				for _, providerConfig := range o.config.Providers {
+					if providerConfig.Name == req.PostForm.Get("provider") {
+						session, _ := gothic.Store.Get(req, linkSessionName)
+						session.Values["subject"] = subjectID + "\x00" + strconv.FormatInt(time.Now().Add(linkTTL).Unix(), 10)
+						if err := session.Save(req, rw); err != nil {
+							loge("Failed to save the link session", "request", requestID(req), "error", err)
+							http.Error(rw, "Failed to link the account", http.StatusInternalServerError)
+							return true
+						}
+						logd("Linking account", "request", requestID(req), "subject", subjectID, "provider", providerConfig.Name)
+						o.runBeginAuthHandler(rw, req, providerConfig, 0)
+						return true
+					}
+				}
+				page.Error, status = "Invalid provider", http.StatusBadRequest
+			case "unlink":
+				unlinked := req.PostForm.Get("identity")
+				data := &identitiesData{}
+				err := c.store.update(data, func() error {
+					if found := data.find(unlinked); found == nil || found.ID != subjectID || unlinked == identity {
+						return errors.New("not linked")
+					}
+					c.unlinkFrom(data, unlinked)
+					return nil
+				})
+				if err != nil {
+					page.Error, status = "You can only unlink the other accounts linked to yours", http.StatusBadRequest
+				} else {
+					logi("Identity unlinked", "request", requestID(req), "subject", subjectID, "identity", unlinked)
+					page.Message = "The account was unlinked."
+				}
+			default:
+				page.Error, status = "Invalid action", http.StatusBadRequest
+			}
+		}
+	}
+	data := &identitiesData{}
+	if err := c.store.read(data); err != nil {
+		loge("Failed to read the identities", "request", requestID(req), "error", err)
+		http.Error(rw, "Failed to read the linked accounts", http.StatusInternalServerError)
+		return true
+	}
+	for _, other := range data.Subjects {
+		if other.ID == subjectID {
+			page.Identities = other.Identities
+		}
+	}
+	for i, providerConfig := range o.config.Providers {
+		linked := false
+		for _, linkedIdentity := range page.Identities {
+			linked = linked || strings.HasPrefix(linkedIdentity, providerConfig.Name+":")
+		}
+		if !linked {
+			page.Providers = append(page.Providers, o.providersInfo[i])
+		}
+	}
+	csrf, err := signToken(c.csrfKey, "identities", time.Hour, subjectID)
+	if err != nil {
+		loge("Failed to sign linking form", "request", requestID(req), "error", err)
+		http.Error(rw, "Failed to serve the page", http.StatusInternalServerError)
+		return true
+	}
+	page.CSRF = csrf
+	servePage(rw, status, identitiesHtml, page)
+	return true
+}
+
+// identitiesPage is the data of identitiesHtml.
+type identitiesPage struct {
+	Title, Error, Message, Current, CSRF string
+	Identities                           []string
+	Providers                            []*ProviderInfo
+}
+
+var identitiesHtml = newPageTemplate("identitiesTemplate", `{{if .Error}}<div class="login-box-error">{{.Error}}</div>{{end}} {{if .Message}}<div class="login-box-message">{{.Message}}</div>{{end}} <table class="login-box-table">{{range .Identities}}<tr><td>{{.}}</td><td>{{if eq . $.Current}}Current{{else}}<form method="post" action="`+identitiesPath+`"><input type="hidden" name="csrf" value="{{$.CSRF}}"><input type="hidden" name="identity" value="{{.}}"><button class="btn" type="submit" name="action" value="unlink">Unlink</button></form>{{end}}</td></tr>{{end}}</table> {{if .Providers}}<form class="login-box-buttons" method="post" action="`+identitiesPath+`"><input type="hidden" name="csrf" value="{{.CSRF}}"><input type="hidden" name="action" value="link">{{range .Providers}}<button class="btn" type="submit" name="provider" value="{{.Name}}">Link {{.DisplayName}}</button>{{end}}</form>{{end}}`)
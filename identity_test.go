@@ -0,0 +1,144 @@
+package traefikgothauth
+
+import (
+	"context"
+	"github.com/markbates/goth"
+	"golang.org/x/crypto/bcrypt"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestIdentitiesLinking(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/auth":
+			callback, _ := url.Parse(req.URL.Query().Get("redirect_uri"))
+			callback.RawQuery = url.Values{"code": {"code"}, "state": {req.URL.Query().Get("state")}}.Encode()
+			http.Redirect(rw, req, callback.String(), http.StatusFound)
+		case "/token":
+			rw.Header().Set("Content-Type", "application/json")
+			_, _ = rw.Write([]byte(`{"access_token":"token","token_type":"bearer"}`))
+		default:
+			_, _ = rw.Write([]byte(`{"id":"gh-1","email":"alice@example.com"}`))
+		}
+	}))
+	defer idp.Close()
+	var handler http.Handler
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		handler.ServeHTTP(rw, req)
+	}))
+	defer server.Close()
+	cfg := CreateConfig()
+	cfg.CookieSecret = "secret-for-testing-only"
+	cfg.Identities = &IdentitiesConfig{StoreFile: filepath.Join(t.TempDir(), "identities.json")}
+	cfg.Providers = []*ProviderConfig{{
+		Name:        "local",
+		RedirectURI: server.URL + "/__goth/local/",
+		Custom:      map[string]interface{}{"users": map[string]interface{}{"alice": string(hash)}},
+	}, {
+		Name:        "generic-oauth2",
+		ClientKey:   "key",
+		Secret:      "secret",
+		RedirectURI: server.URL + "/__goth/generic-oauth2/",
+		Custom:      map[string]interface{}{"authURL": idp.URL + "/auth", "tokenURL": idp.URL + "/token", "userInfoURL": idp.URL + "/userinfo"},
+	}}
+	handler, err = New(context.Background(), http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_, _ = rw.Write([]byte(req.Header.Get("X-Auth-Provider") + " " + req.Header.Get("X-Auth-Internal-Subject")))
+	}), cfg, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	read := func(res *http.Response, err error) (*http.Response, string) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(res.Body)
+		_ = res.Body.Close()
+		return res, string(body)
+	}
+
+	// The first login creates a subject
+	jar, _ := cookiejar.New(nil)
+	browser := &http.Client{Jar: jar}
+	res, _ := read(browser.Get(server.URL + "/?provider=local"))
+	_, body := read(browser.PostForm(res.Request.URL.String(), url.Values{
+		"state": {res.Request.URL.Query().Get("state")}, "username": {"alice"}, "password": {"hunter2"},
+	}))
+	provider, subjectID, _ := strings.Cut(body, " ")
+	if provider != "local" || subjectID == "" {
+		t.Fatalf("expected a subject for the first login, got %s", body)
+	}
+
+	// The user links another account while logged in
+	_, page := read(browser.Get(server.URL + identitiesPath))
+	csrf := regexp.MustCompile(`name="csrf" value="([^"]+)"`).FindStringSubmatch(page)
+	if csrf == nil || !strings.Contains(page, "local:alice") || !strings.Contains(page, `value="generic-oauth2"`) {
+		t.Fatalf("expected the linking page: %s", page)
+	}
+	res, page = read(browser.PostForm(server.URL+identitiesPath, url.Values{"csrf": {csrf[1]}, "action": {"link"}, "provider": {"generic-oauth2"}}))
+	if res.Request.URL.Path != identitiesPath || !strings.Contains(page, "generic-oauth2:gh-1") {
+		t.Fatalf("expected the account to be linked, got %d at %s: %s", res.StatusCode, res.Request.URL, page)
+	}
+
+	// Logging in with the linked account gives the same subject
+	jar, _ = cookiejar.New(nil)
+	other := &http.Client{Jar: jar}
+	if _, body = read(other.Get(server.URL + "/?provider=generic-oauth2")); body != "generic-oauth2 "+subjectID {
+		t.Fatalf("expected the subject of the linked account, got %s", body)
+	}
+}
+
+func TestIdentitiesEmail(t *testing.T) {
+	c := &IdentitiesConfig{StoreFile: filepath.Join(t.TempDir(), "identities.json"), EmailProviders: []string{"google", "github"}}
+	if err := c.setup("secret", []*ProviderConfig{{Name: "google"}, {Name: "github"}, {Name: "local"}}); err != nil {
+		t.Fatal(err)
+	}
+	resolve := func(provider, userID, email string, rawData map[string]interface{}) string {
+		user := &goth.User{UserID: userID, Email: email, RawData: rawData}
+		if user.RawData == nil {
+			user.RawData = map[string]interface{}{}
+		}
+		if err := c.resolve(provider, user); err != nil {
+			t.Fatal(err)
+		}
+		return user.RawData["internal-subject"].(string)
+	}
+	google := resolve("google", "1", "Alice@example.com", nil)
+	if resolve("google", "1", "alice@example.com", nil) != google {
+		t.Fatal("expected the same identity to keep its subject")
+	}
+	if resolve("github", "2", "alice@example.com", nil) != google {
+		t.Fatal("expected identities with the same verified email to be linked")
+	}
+	if resolve("github", "3", "alice@example.com", map[string]interface{}{"email_verified": false}) == google {
+		t.Fatal("expected unverified emails not to be linked")
+	}
+	if resolve("local", "alice", "alice@example.com", nil) == google {
+		t.Fatal("expected emails of other providers not to be linked")
+	}
+
+	// Unlinked identities take their email with them
+	local := resolve("local", "bob", "", nil)
+	resolve("google", "5", "bob@example.com", nil)
+	if err := c.link(local, "google:5"); err != nil || resolve("google", "5", "bob@example.com", nil) != local {
+		t.Fatalf("expected the identity to be linked, got %v", err)
+	}
+	data := &identitiesData{}
+	if err := c.store.update(data, func() error { c.unlinkFrom(data, "google:5"); return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if resolve("google", "5", "bob@example.com", nil) == local {
+		t.Fatal("expected the unlinked identity not to be linked again by its email")
+	}
+}
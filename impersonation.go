@@ -0,0 +1,146 @@
+package traefikgothauth
+
+import (
+	"encoding/json"
+	"github.com/markbates/goth"
+	"github.com/markbates/goth/gothic"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// impersonationSessionName is the cookie that holds the impersonation of the admin, if any.
+const impersonationSessionName = "_gothic_impersonation"
+
+// impersonation is an admin seeing the apps as another user.
+type impersonation struct {
+	Admin    string
+	Provider string
+	UserID   string
+	User     string
+	Claims   map[string]interface{}
+	Started  time.Time
+	Expires  time.Time
+}
+
+// impersonating returns the current impersonation of the admin, if any. Impersonations started by other admins (e.g.
+// before logging in again with another account) are ignored.
+func (c *AdminConfig) impersonating(req *http.Request, admin string) *impersonation {
+	session, _ := gothic.Store.Get(req, impersonationSessionName)
+	value, _ := session.Values["impersonation"].(string)
+	if value == "" {
+		return nil
+	}
+	current := &impersonation{}
+	if err := json.Unmarshal([]byte(value), current); err != nil {
+		logw("Invalid impersonation session", "request", requestID(req), "error", err)
+		return nil
+	}
+	if current.Admin != admin || time.Now().After(current.Expires) {
+		return nil
+	}
+	return current
+}
+
+// impersonated returns the impersonation of the authenticated user, if they are still an admin.
+func (c *AdminConfig) impersonated(req *http.Request, providerName string, auth *goth.User) *impersonation {
+	if !c.Impersonation {
+		return nil
+	}
+	current := c.impersonating(req, providerName+":"+auth.UserID)
+	if current == nil || !c.isAdmin(providerName, auth) {
+		return nil
+	}
+	return current
+}
+
+// startImpersonation impersonates the user of a registered session, returning the message or the error to show to
+// the admin.
+func (c *AdminConfig) startImpersonation(rw http.ResponseWriter, req *http.Request, admin string, page *adminPage) (string, string) {
+	if !c.Impersonation {
+		return "", "Impersonation is disabled"
+	}
+	data := &sessionsData{}
+	if err := c.registry.store.read(data); err != nil {
+		loge("Failed to read the sessions", "request", requestID(req), "error", err)
+		return "", "Failed to read the sessions"
+	}
+	var target *registeredSession
+	for _, registered := range data.Sessions {
+		if registered.ID == req.PostForm.Get("id") {
+			target = registered
+		}
+	}
+	if target == nil {
+		return "", "Session not found"
+	}
+	if target.Provider+":"+target.UserID == admin {
+		return "", "You cannot impersonate yourself"
+	}
+	now := time.Now().UTC()
+	started := &impersonation{
+		Admin:    admin,
+		Provider: target.Provider,
+		UserID:   target.UserID,
+		User:     target.User,
+		Claims:   target.Claims,
+		Started:  now,
+		Expires:  now.Add(c.impersonationTTL),
+	}
+	value, err := json.Marshal(started)
+	if err == nil {
+		session, _ := gothic.Store.Get(req, impersonationSessionName)
+		session.Values["impersonation"] = string(value)
+		err = session.Save(req, rw)
+	}
+	if err != nil {
+		loge("Failed to save the impersonation", "request", requestID(req), "error", err)
+		return "", "Failed to start the impersonation"
+	}
+	logi("Impersonation started", "request", requestID(req), "admin", admin, "provider", target.Provider, "user", target.UserID, "remote", req.RemoteAddr, "expires", started.Expires)
+	auditAdmin(req, auditImpersonationStart, target.Provider, target.UserID, admin, "until "+started.Expires.Format(time.RFC3339))
+	page.Impersonating = started
+	return "You now see the apps as " + target.User + ", until you stop impersonating them.", ""
+}
+
+// stopImpersonation ends the impersonation of the admin, returning the message or the error to show to them.
+func (c *AdminConfig) stopImpersonation(rw http.ResponseWriter, req *http.Request, admin string, page *adminPage) (string, string) {
+	current := c.impersonating(req, admin)
+	if current == nil {
+		return "", "You are not impersonating anyone"
+	}
+	if err := c.endImpersonation(rw, req, "stopped"); err != nil {
+		loge("Failed to end the impersonation", "request", requestID(req), "error", err)
+		return "", "Failed to stop the impersonation"
+	}
+	page.Impersonating = nil
+	return "You stopped impersonating " + current.User + ".", ""
+}
+
+// stopImpersonationURL returns a link that stops the impersonation of the admin, for the banners of the apps. It
+// carries its own CSRF token, valid for as long as an impersonation.
+func (c *AdminConfig) stopImpersonationURL(admin string) (string, error) {
+	csrf, err := signToken(c.csrfKey, "stop-impersonation", c.impersonationTTL, admin)
+	if err != nil {
+		return "", err
+	}
+	return adminPath + "?" + url.Values{"action": {"stop-impersonation"}, "csrf": {csrf}}.Encode(), nil
+}
+
+// endImpersonation deletes the impersonation cookie, if any.
+func (c *AdminConfig) endImpersonation(rw http.ResponseWriter, req *http.Request, reason string) error {
+	session, _ := gothic.Store.Get(req, impersonationSessionName)
+	value, _ := session.Values["impersonation"].(string)
+	if value == "" {
+		return nil
+	}
+	ended := &impersonation{}
+	_ = json.Unmarshal([]byte(value), ended)
+	session.Options.MaxAge = -1
+	if err := session.Save(req, rw); err != nil {
+		return err
+	}
+	logi("Impersonation stopped", "request", requestID(req), "admin", ended.Admin, "provider", ended.Provider, "user", ended.UserID, "remote", req.RemoteAddr, "reason", reason)
+	auditAdmin(req, auditImpersonationStop, ended.Provider, ended.UserID, ended.Admin, reason)
+	return nil
+}
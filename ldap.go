@@ -0,0 +1,385 @@
+package traefikgothauth
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/markbates/goth"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	ldapDefaultUserFilter = "(|(uid={username})(sAMAccountName={username}))"
+
+	ldapResultSuccess            = 0
+	ldapResultInvalidCredentials = 49
+
+	ldapTagBindRequest       = berClassApplication | berConstructed | 0
+	ldapTagBindResponse      = berClassApplication | berConstructed | 1
+	ldapTagUnbindRequest     = berClassApplication | 2
+	ldapTagSearchRequest     = berClassApplication | berConstructed | 3
+	ldapTagSearchEntry       = berClassApplication | berConstructed | 4
+	ldapTagSearchDone        = berClassApplication | berConstructed | 5
+	ldapTagSearchReference   = berClassApplication | berConstructed | 19
+	ldapTagExtendedRequest   = berClassApplication | berConstructed | 23
+	ldapTagExtendedResponse  = berClassApplication | berConstructed | 24
+	ldapStartTLSOID          = "1.3.6.1.4.1.1466.20037"
+	ldapSearchScopeSubtree   = 2
+	ldapDerefAliasesNever    = 0
+	ldapSearchSizeLimitUsers = 2 // Only needs to know whether the filter matches exactly one user
+)
+
+// ldapDefaultAttributes maps the claims to the LDAP attributes read from the user entry.
+var ldapDefaultAttributes = map[string]string{
+	"email":      "mail",
+	"name":       "displayName",
+	"first-name": "givenName",
+	"last-name":  "sn",
+	"groups":     "memberOf",
+}
+
+// ldapConfig is the configuration of the LDAP provider.
+type ldapConfig struct {
+	url          *url.URL
+	startTLS     bool
+	bindDN       string
+	bindPassword string
+	baseDN       string
+	userFilter   string
+	attributes   map[string]string
+	tlsConfig    *tls.Config
+	timeout      time.Duration
+}
+
+// newLDAPProvider creates a provider that looks up the user with a search and verifies the password by binding as
+// them (search-and-bind), e.g. against Active Directory or OpenLDAP.
+func newLDAPProvider(client *http.Client, secret, callback string, custom map[string]interface{}) (*formProvider, error) {
+	p, err := newFormProvider("ldap", "Login", secret, callback, custom)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &ldapConfig{attributes: map[string]string{}}
+	rawURL, _ := custom["url"].(string)
+	if cfg.url, err = url.Parse(rawURL); err != nil {
+		return nil, fmt.Errorf("failed to parse url: %w", err)
+	}
+	if cfg.url.Scheme != "ldap" && cfg.url.Scheme != "ldaps" {
+		return nil, fmt.Errorf("url must start with ldap:// or ldaps://, got %q", rawURL)
+	}
+	cfg.startTLS, _ = custom["startTLS"].(bool)
+	if cfg.startTLS && cfg.url.Scheme == "ldaps" {
+		return nil, errors.New("startTLS can not be used with ldaps://")
+	}
+	cfg.bindDN, _ = custom["bindDN"].(string)
+	cfg.bindPassword, _ = custom["bindPassword"].(string)
+	cfg.baseDN, _ = custom["baseDN"].(string)
+	if cfg.userFilter, _ = custom["userFilter"].(string); cfg.userFilter == "" {
+		cfg.userFilter = ldapDefaultUserFilter
+	}
+	if !strings.Contains(cfg.userFilter, "{username}") {
+		return nil, errors.New("userFilter must contain {username}")
+	}
+	if _, err = parseLDAPFilter(strings.ReplaceAll(cfg.userFilter, "{username}", "test")); err != nil {
+		return nil, fmt.Errorf("invalid userFilter: %w", err)
+	}
+	for claim, attribute := range ldapDefaultAttributes {
+		cfg.attributes[claim] = attribute
+	}
+	attributes, _ := custom["attributes"].(map[string]string)
+	for claim, attribute := range attributes {
+		cfg.attributes[claim] = attribute // An empty attribute disables a default claim
+	}
+	cfg.tlsConfig, cfg.timeout = clientTLSSettings(client)
+	cfg.tlsConfig.ServerName = cfg.url.Hostname()
+
+	p.fields = []loginFormField{
+		{Name: "username", Label: "Username", Type: "text", Autocomplete: "username"},
+		{Name: "password", Label: "Password", Type: "password", Autocomplete: "current-password"},
+	}
+	p.verify = func(req *http.Request, form url.Values) (*goth.User, error) {
+		return cfg.authenticate(form.Get("username"), form.Get("password"))
+	}
+	return p, nil
+}
+
+// authenticate finds the entry of the user and binds as them to verify the password.
+func (cfg *ldapConfig) authenticate(username, password string) (*goth.User, error) {
+	if username == "" || password == "" {
+		// An empty password would be an unauthenticated bind, which many servers accept for any DN
+		return nil, errors.New("empty username or password")
+	}
+	conn, err := cfg.dial()
+	if err != nil {
+		loge("Failed to connect to the LDAP server", "url", cfg.url.Redacted(), "error", err)
+		return nil, err
+	}
+	defer conn.close()
+	if cfg.bindDN != "" {
+		if err = conn.bind(cfg.bindDN, cfg.bindPassword); err != nil {
+			loge("Failed to bind with the service account", "url", cfg.url.Redacted(), "bindDN", cfg.bindDN, "error", err)
+			return nil, err
+		}
+	}
+	filter, err := parseLDAPFilter(strings.ReplaceAll(cfg.userFilter, "{username}", escapeLDAPFilterValue(username)))
+	if err != nil {
+		return nil, err
+	}
+	var attributes []string
+	for _, attribute := range cfg.attributes {
+		if attribute != "" {
+			attributes = append(attributes, attribute)
+		}
+	}
+	entries, err := conn.search(cfg.baseDN, filter, attributes)
+	if err != nil {
+		loge("Failed to search for the user", "url", cfg.url.Redacted(), "baseDN", cfg.baseDN, "error", err)
+		return nil, err
+	}
+	if len(entries) != 1 {
+		return nil, fmt.Errorf("found %d entries for user %q", len(entries), username)
+	}
+	entry := entries[0]
+	if err = conn.bind(entry.dn, password); err != nil {
+		return nil, fmt.Errorf("failed to bind as %q: %w", entry.dn, err)
+	}
+	return cfg.user(username, entry), nil
+}
+
+// user maps the attributes of the entry to the claims.
+func (cfg *ldapConfig) user(username string, entry *ldapEntry) *goth.User {
+	rawData := map[string]interface{}{"dn": entry.dn}
+	for claim, attribute := range cfg.attributes {
+		values := entry.attributes[strings.ToLower(attribute)]
+		if attribute == "" || len(values) == 0 {
+			continue
+		}
+		if claim == "groups" {
+			values = ldapGroupNames(values)
+		}
+		rawData[claim] = strings.Join(values, ",")
+	}
+	claim := func(name string) string {
+		value, _ := rawData[name].(string)
+		return value
+	}
+	user := &goth.User{
+		RawData:   rawData,
+		UserID:    claim("user-id"),
+		Email:     claim("email"),
+		Name:      claim("name"),
+		FirstName: claim("first-name"),
+		LastName:  claim("last-name"),
+		NickName:  claim("nick-name"),
+	}
+	if user.UserID == "" {
+		user.UserID = username
+	}
+	if user.NickName == "" {
+		user.NickName = username
+	}
+	return user
+}
+
+// ldapGroupNames converts group DNs (from memberOf) to their common names, e.g. "cn=admins,ou=groups,dc=example" to
+// "admins". Values that are not DNs are kept as is.
+func ldapGroupNames(dns []string) []string {
+	names := make([]string, 0, len(dns))
+	for _, dn := range dns {
+		rdn, _, _ := strings.Cut(dn, ",")
+		attribute, value, ok := strings.Cut(rdn, "=")
+		if ok && strings.EqualFold(strings.TrimSpace(attribute), "cn") {
+			names = append(names, strings.TrimSpace(value))
+		} else {
+			names = append(names, dn)
+		}
+	}
+	return names
+}
+
+// ldapEntry is a search result.
+type ldapEntry struct {
+	dn string
+	// attributes are indexed by lowercase name, as they are case-insensitive.
+	attributes map[string][]string
+}
+
+// ldapConn is a minimal LDAPv3 client connection, processing one request at a time.
+type ldapConn struct {
+	conn      net.Conn
+	r         *bufio.Reader
+	messageID int64
+	timeout   time.Duration
+}
+
+func (cfg *ldapConfig) dial() (*ldapConn, error) {
+	host := cfg.url.Host
+	if cfg.url.Port() == "" {
+		if cfg.url.Scheme == "ldaps" {
+			host = net.JoinHostPort(cfg.url.Hostname(), "636")
+		} else {
+			host = net.JoinHostPort(cfg.url.Hostname(), "389")
+		}
+	}
+	dialer := &net.Dialer{Timeout: cfg.timeout}
+	var conn net.Conn
+	var err error
+	if cfg.url.Scheme == "ldaps" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", host, cfg.tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", host)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c := &ldapConn{conn: conn, r: bufio.NewReader(conn), timeout: cfg.timeout}
+	if cfg.startTLS {
+		if err = c.startTLS(cfg.tlsConfig); err != nil {
+			_ = conn.Close()
+			return nil, fmt.Errorf("failed to start TLS: %w", err)
+		}
+	}
+	return c, nil
+}
+
+// send writes a request and returns its message ID.
+func (c *ldapConn) send(op *berPacket) (int64, error) {
+	c.messageID++
+	if err := c.conn.SetDeadline(time.Now().Add(c.timeout)); err != nil {
+		return 0, err
+	}
+	_, err := c.conn.Write(berConstruct(berTagSequence, berInt(berTagInteger, c.messageID), op).encode())
+	return c.messageID, err
+}
+
+// receive reads the next response to the given message, returning its protocol operation.
+func (c *ldapConn) receive(messageID int64) (*berPacket, error) {
+	for {
+		packet, err := readBERPacket(c.r)
+		if err != nil {
+			return nil, err
+		}
+		if packet.child(0).int() == messageID {
+			return packet.child(1), nil
+		}
+		if packet.child(0).int() == 0 { // Unsolicited notification, e.g. the server is disconnecting
+			return nil, ldapResultError(packet.child(1))
+		}
+	}
+}
+
+// ldapResultError returns the error described by an LDAPResult, or nil on success.
+func ldapResultError(result *berPacket) error {
+	code := result.child(0).int()
+	if code == ldapResultSuccess {
+		return nil
+	}
+	if code == ldapResultInvalidCredentials {
+		return errors.New("invalid credentials")
+	}
+	if message := result.child(2).string(); message != "" {
+		return fmt.Errorf("ldap error %d: %s", code, message)
+	}
+	return fmt.Errorf("ldap error %d", code)
+}
+
+func (c *ldapConn) startTLS(tlsConfig *tls.Config) error {
+	messageID, err := c.send(berConstruct(ldapTagExtendedRequest, berString(berClassContext|0, ldapStartTLSOID)))
+	if err != nil {
+		return err
+	}
+	response, err := c.receive(messageID)
+	if err != nil {
+		return err
+	}
+	if response.tag != ldapTagExtendedResponse {
+		return fmt.Errorf("unexpected response 0x%x", response.tag)
+	}
+	if err = ldapResultError(response); err != nil {
+		return err
+	}
+	tlsConn := tls.Client(c.conn, tlsConfig)
+	if err = tlsConn.SetDeadline(time.Now().Add(c.timeout)); err != nil {
+		return err
+	}
+	if err = tlsConn.Handshake(); err != nil {
+		return err
+	}
+	c.conn, c.r = tlsConn, bufio.NewReader(tlsConn)
+	return nil
+}
+
+// bind authenticates the connection with a simple bind.
+func (c *ldapConn) bind(dn, password string) error {
+	messageID, err := c.send(berConstruct(ldapTagBindRequest,
+		berInt(berTagInteger, 3), berString(berTagOctetString, dn), berString(berClassContext|0, password)))
+	if err != nil {
+		return err
+	}
+	response, err := c.receive(messageID)
+	if err != nil {
+		return err
+	}
+	if response.tag != ldapTagBindResponse {
+		return fmt.Errorf("unexpected response 0x%x", response.tag)
+	}
+	return ldapResultError(response)
+}
+
+// search returns the entries below baseDN that match the filter.
+func (c *ldapConn) search(baseDN string, filter *berPacket, attributes []string) ([]*ldapEntry, error) {
+	attributeList := berConstruct(berTagSequence)
+	for _, attribute := range attributes {
+		attributeList.children = append(attributeList.children, berString(berTagOctetString, attribute))
+	}
+	messageID, err := c.send(berConstruct(ldapTagSearchRequest,
+		berString(berTagOctetString, baseDN),
+		berInt(berTagEnumerated, ldapSearchScopeSubtree),
+		berInt(berTagEnumerated, ldapDerefAliasesNever),
+		berInt(berTagInteger, ldapSearchSizeLimitUsers),
+		berInt(berTagInteger, int64(c.timeout/time.Second)),
+		berBool(false),
+		filter,
+		attributeList))
+	if err != nil {
+		return nil, err
+	}
+	var entries []*ldapEntry
+	for {
+		response, err := c.receive(messageID)
+		if err != nil {
+			return nil, err
+		}
+		switch response.tag {
+		case ldapTagSearchEntry:
+			entry := &ldapEntry{dn: response.child(0).string(), attributes: map[string][]string{}}
+			for _, attribute := range response.child(1).children {
+				name := strings.ToLower(attribute.child(0).string())
+				for _, value := range attribute.child(1).children {
+					entry.attributes[name] = append(entry.attributes[name], value.string())
+				}
+			}
+			entries = append(entries, entry)
+		case ldapTagSearchReference:
+			// Referrals to other servers are not followed
+		case ldapTagSearchDone:
+			const sizeLimitExceeded = 4
+			if response.child(0).int() == sizeLimitExceeded {
+				return entries, nil // More than one user matched, reported by the caller
+			}
+			return entries, ldapResultError(response)
+		default:
+			return nil, fmt.Errorf("unexpected response 0x%x", response.tag)
+		}
+	}
+}
+
+// close unbinds and closes the connection.
+func (c *ldapConn) close() {
+	_, _ = c.send(berPrimitive(ldapTagUnbindRequest, nil))
+	_ = c.conn.Close()
+}
@@ -0,0 +1,173 @@
+package traefikgothauth
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// ldapTestEntry is an entry of the in-process LDAP stand-in.
+type ldapTestEntry struct {
+	dn, password string
+	attributes   map[string][]string
+}
+
+// startLDAPTestServer serves binds and searches over the given entries, evaluating the filters like a real server.
+func startLDAPTestServer(t *testing.T, entries []*ldapTestEntry) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+	respond := func(conn net.Conn, messageID int64, op *berPacket) {
+		_, _ = conn.Write(berConstruct(berTagSequence, berInt(berTagInteger, messageID), op).encode())
+	}
+	result := func(tag byte, code int64) *berPacket {
+		return berConstruct(tag&^berConstructed, berInt(berTagEnumerated, code), berString(berTagOctetString, ""), berString(berTagOctetString, ""))
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer func() { _ = conn.Close() }()
+				r := bufio.NewReader(conn)
+				for {
+					packet, err := readBERPacket(r)
+					if err != nil {
+						return
+					}
+					messageID, op := packet.child(0).int(), packet.child(1)
+					switch op.tag {
+					case ldapTagBindRequest:
+						code := int64(ldapResultInvalidCredentials)
+						for _, entry := range entries {
+							if entry.dn == op.child(1).string() && entry.password == op.child(2).string() {
+								code = ldapResultSuccess
+							}
+						}
+						respond(conn, messageID, result(ldapTagBindResponse, code))
+					case ldapTagSearchRequest:
+						for _, entry := range entries {
+							if !strings.HasSuffix(entry.dn, op.child(0).string()) || !ldapTestMatch(op.child(6), entry) {
+								continue
+							}
+							attributes := berConstruct(berTagSequence)
+							for _, requested := range op.child(7).children {
+								values := berConstruct(berTagSet)
+								for _, value := range entry.attributes[requested.string()] {
+									values.children = append(values.children, berString(berTagOctetString, value))
+								}
+								attributes.children = append(attributes.children, berConstruct(berTagSequence, berString(berTagOctetString, requested.string()), values))
+							}
+							respond(conn, messageID, berConstruct(ldapTagSearchEntry, berString(berTagOctetString, entry.dn), attributes))
+						}
+						respond(conn, messageID, result(ldapTagSearchDone, ldapResultSuccess))
+					case ldapTagUnbindRequest:
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return "ldap://" + listener.Addr().String()
+}
+
+// ldapTestMatch evaluates the and/or/equality filters used by the tests.
+func ldapTestMatch(filter *berPacket, entry *ldapTestEntry) bool {
+	switch filter.tag {
+	case berClassContext | berConstructed | 0:
+		for _, child := range filter.children {
+			if !ldapTestMatch(child, entry) {
+				return false
+			}
+		}
+		return true
+	case berClassContext | berConstructed | 1:
+		for _, child := range filter.children {
+			if ldapTestMatch(child, entry) {
+				return true
+			}
+		}
+		return false
+	case berClassContext | berConstructed | 3:
+		for _, value := range entry.attributes[filter.child(0).string()] {
+			if value == filter.child(1).string() {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func TestLDAPLogin(t *testing.T) {
+	serverURL := startLDAPTestServer(t, []*ldapTestEntry{
+		{dn: "cn=service,dc=example,dc=com", password: "service-password"},
+		{dn: "cn=Alice,ou=people,dc=example,dc=com", password: "hunter2", attributes: map[string][]string{
+			"sAMAccountName": {"alice"},
+			"mail":           {"alice@example.com"},
+			"displayName":    {"Alice Liddell"},
+			"memberOf":       {"CN=Admins,OU=Groups,DC=example,DC=com", "CN=Developers,OU=Groups,DC=example,DC=com"},
+		}},
+		{dn: "cn=Bob,ou=people,dc=example,dc=com", password: "", attributes: map[string][]string{"uid": {"bob"}}},
+	})
+	p, err := newLDAPProvider(http.DefaultClient, "", "http://localhost/callback", map[string]interface{}{
+		"url":          serverURL,
+		"bindDN":       "cn=service,dc=example,dc=com",
+		"bindPassword": "service-password",
+		"baseDN":       "dc=example,dc=com",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	login := func(username, password string) error {
+		_, err := p.verify(nil, url.Values{"username": {username}, "password": {password}})
+		return err
+	}
+
+	user, err := p.verify(nil, url.Values{"username": {"alice"}, "password": {"hunter2"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.UserID != "alice" || user.Email != "alice@example.com" || user.Name != "Alice Liddell" ||
+		user.RawData["groups"] != "Admins,Developers" || user.RawData["dn"] != "cn=Alice,ou=people,dc=example,dc=com" {
+		t.Fatalf("unexpected user: %+v", user)
+	}
+	if err = login("alice", "wrong"); err == nil {
+		t.Fatal("expected the wrong password to be rejected")
+	}
+	if err = login("mallory", "hunter2"); err == nil {
+		t.Fatal("expected the unknown user to be rejected")
+	}
+	if err = login("bob", ""); err == nil {
+		t.Fatal("expected the empty password to be rejected before binding")
+	}
+	if err = login("*", "hunter2"); err == nil {
+		t.Fatal("expected the filter characters of the username to be escaped")
+	}
+}
+
+func TestLDAPFilter(t *testing.T) {
+	filter, err := parseLDAPFilter("(&(objectClass=person)(|(uid=a\\2ab)(!(cn=x*y*)))(mail=*))")
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := readBERPacket(bufio.NewReader(strings.NewReader(string(filter.encode()))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded.children) != 3 || decoded.child(1).child(0).child(1).string() != "a*b" ||
+		decoded.child(1).child(1).child(0).tag != berClassContext|berConstructed|4 || decoded.child(2).string() != "mail" {
+		t.Fatalf("unexpected filter encoding: %x", filter.encode())
+	}
+	for _, invalid := range []string{"", "uid=a", "(uid=a", "(uid=a)x", "(uid=\\zz)"} {
+		if _, err = parseLDAPFilter(invalid); err == nil {
+			t.Errorf("expected %q to be rejected", invalid)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package traefikgothauth
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/markbates/goth"
+	"golang.org/x/crypto/bcrypt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// newLocalProvider creates a provider that verifies usernames and passwords against bcrypt hashes, from an htpasswd
+// file and/or inline in the configuration.
+func newLocalProvider(secret, callback string, custom map[string]interface{}) (*formProvider, error) {
+	p, err := newFormProvider("local", "Login", secret, callback, custom)
+	if err != nil {
+		return nil, err
+	}
+	users := &localUsers{}
+	users.inline, _ = custom["users"].(map[string]string)
+	for username, hash := range users.inline {
+		if !isBcryptHash(hash) {
+			return nil, fmt.Errorf("the password of user %s is not a bcrypt hash", username)
+		}
+	}
+	users.file, _ = custom["htpasswdFile"].(string)
+	if users.file != "" {
+		if _, err = users.load(); err != nil {
+			return nil, err
+		}
+	}
+	// Compared when the user does not exist, so that response times do not reveal which users exist
+	dummyHash, err := bcrypt.GenerateFromPassword([]byte(randomString(16)), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, err
+	}
+	p.fields = []loginFormField{
+		{Name: "username", Label: "Username", Type: "text", Autocomplete: "username"},
+		{Name: "password", Label: "Password", Type: "password", Autocomplete: "current-password"},
+	}
+	p.verify = func(req *http.Request, form url.Values) (*goth.User, error) {
+		username, password := form.Get("username"), form.Get("password")
+		hash, ok, err := users.lookup(username)
+		if err != nil {
+			loge("Failed to read the htpasswd file", "provider", p.providerName, "error", err)
+		}
+		if !ok {
+			_ = bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+			return nil, fmt.Errorf("unknown user %q", username)
+		}
+		if err = bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)); err != nil {
+			return nil, fmt.Errorf("wrong password for user %q", username)
+		}
+		return &goth.User{UserID: username, NickName: username, Name: username}, nil
+	}
+	return p, nil
+}
+
+func isBcryptHash(hash string) bool {
+	return strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$") || strings.HasPrefix(hash, "$2y$")
+}
+
+// localUsers are the users of the local provider, reloading the htpasswd file when it changes.
+type localUsers struct {
+	inline map[string]string
+
+	mu          sync.Mutex
+	file        string
+	fileModTime time.Time
+	fileUsers   map[string]string
+}
+
+// lookup returns the bcrypt hash of the password of a user. The inline users take precedence over the file.
+func (u *localUsers) lookup(username string) (string, bool, error) {
+	if hash, ok := u.inline[username]; ok {
+		return hash, true, nil
+	}
+	if u.file == "" {
+		return "", false, nil
+	}
+	fileUsers, err := u.load()
+	hash, ok := fileUsers[username]
+	return hash, ok, err
+}
+
+// load returns the users of the htpasswd file, reading it again only if it was modified. On errors, the last
+// successfully read users are kept.
+func (u *localUsers) load() (map[string]string, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	info, err := os.Stat(u.file)
+	if err != nil {
+		return u.fileUsers, err
+	}
+	if u.fileUsers != nil && info.ModTime().Equal(u.fileModTime) {
+		return u.fileUsers, nil
+	}
+	f, err := os.Open(u.file)
+	if err != nil {
+		return u.fileUsers, err
+	}
+	defer func() { _ = f.Close() }()
+	users := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		username, hash, ok := strings.Cut(line, ":")
+		if !ok {
+			return u.fileUsers, fmt.Errorf("%s:%d: expected user:hash", u.file, lineNumber)
+		}
+		if !isBcryptHash(hash) {
+			logw("Ignoring user without a bcrypt password hash (use htpasswd -B)", "file", u.file, "line", lineNumber, "username", username)
+			continue
+		}
+		users[username] = hash
+	}
+	if err = scanner.Err(); err != nil {
+		return u.fileUsers, err
+	}
+	if len(users) == 0 {
+		return u.fileUsers, errors.New("no users found in " + u.file)
+	}
+	logd("Loaded htpasswd file", "file", u.file, "users", len(users))
+	u.fileUsers, u.fileModTime = users, info.ModTime()
+	return users, nil
+}
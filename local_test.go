@@ -0,0 +1,113 @@
+package traefikgothauth
+
+import (
+	"context"
+	"golang.org/x/crypto/bcrypt"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLocalLogin(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var handler http.Handler
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		handler.ServeHTTP(rw, req)
+	}))
+	defer server.Close()
+
+	cfg := CreateConfig()
+	cfg.CookieSecret = "secret-for-testing-only"
+	cfg.Providers = []*ProviderConfig{{
+		Name:        "local",
+		RedirectURI: server.URL + "/__goth/local/",
+		Custom:      map[string]interface{}{"users": map[string]interface{}{"alice": string(hash)}, "maxAttempts": 2},
+	}}
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_, _ = rw.Write([]byte("hello " + req.Header.Get("X-Auth-User-Id")))
+	})
+	handler, err = New(context.Background(), next, cfg, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jar, _ := cookiejar.New(nil)
+	client := &http.Client{Jar: jar}
+	res, err := client.Get(server.URL + "/private")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = res.Body.Close()
+	if res.Request.URL.Path != "/__goth/local/form/" || res.StatusCode != http.StatusOK {
+		t.Fatalf("expected the login form, got %d at %s", res.StatusCode, res.Request.URL)
+	}
+	formURL := res.Request.URL.String()
+	state := res.Request.URL.Query().Get("state")
+
+	login := func(password string) (*http.Response, string) {
+		res, err := client.PostForm(formURL, url.Values{"state": {state}, "username": {"alice"}, "password": {password}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(res.Body)
+		_ = res.Body.Close()
+		return res, string(body)
+	}
+
+	if res, _ = login("wrong"); res.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected a failed login, got %d", res.StatusCode)
+	}
+	res, body := login("hunter2")
+	if res.StatusCode != http.StatusOK || body != "hello alice" || res.Request.URL.Path != "/private" {
+		t.Fatalf("expected to reach the original page, got %d at %s: %s", res.StatusCode, res.Request.URL, body)
+	}
+
+	// A different browser can not submit the form (CSRF)
+	res, err = http.PostForm(formURL, url.Values{"state": {state}, "username": {"alice"}, "password": {"hunter2"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected the form to be rejected without the session, got %d", res.StatusCode)
+	}
+
+	// Blocked after too many failures
+	if res, _ = login("wrong"); res.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected a failed login, got %d", res.StatusCode)
+	}
+	if res, body = login("hunter2"); res.StatusCode != http.StatusTooManyRequests || !strings.Contains(body, "Too many") {
+		t.Fatalf("expected the user to be blocked, got %d", res.StatusCode)
+	}
+}
+
+func TestLoginRateLimiterBounded(t *testing.T) {
+	l := newLoginRateLimiter(2, time.Minute)
+	l.fail("ip:192.0.2.1", "user:alice")
+	l.fail("user:alice")
+	if l.allowed("user:alice") || !l.allowed("user:bob") {
+		t.Fatal("expected only alice to be blocked")
+	}
+	for i := len(l.failures); i < loginRateLimiterMaxKeys+10; i++ {
+		l.fail("user:" + strconv.Itoa(i))
+	}
+	if len(l.failures) != loginRateLimiterMaxKeys || l.allowed("user:carol") {
+		t.Fatalf("expected the limiter to stop growing and to block new keys, got %d keys", len(l.failures))
+	}
+	for key := range l.failures {
+		l.failures[key] = []time.Time{time.Now().Add(-time.Hour)}
+	}
+	l.fail("user:carol")
+	if len(l.failures) != 1 || !l.allowed("user:alice", "user:dave") {
+		t.Fatalf("expected the expired failures to be removed, got %d keys", len(l.failures))
+	}
+}
@@ -1,15 +1,17 @@
 package traefikgothauth
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 )
 
 // Traefik is limited to os.Stdout logging and does noy have the log/slog package for now.
 
-const appName = "traefik-oidc"
+const appName = "traefikgothauth"
 
 // LogLevel is the log level.
 type LogLevel int
@@ -42,6 +44,18 @@ var logTextLevel = func() map[string]LogLevel {
 	return m
 }()
 
+// LogFormat is the format of the log lines.
+type LogFormat string
+
+const (
+	// logFormatText is "[traefikgothauth] [LEVEL] time | msg key=value...", quoting the values when needed.
+	logFormatText LogFormat = "text"
+	// logFormatJSON is one JSON object per line, see logJSONLine.
+	logFormatJSON LogFormat = "json"
+)
+
+var logFormatCurrent = logFormatText
+
 func keyValueToString(prefixIfNotEmpty string, keyValue []interface{}) string {
 	if len(keyValue) == 0 {
 		return ""
@@ -51,7 +65,7 @@ func keyValueToString(prefixIfNotEmpty string, keyValue []interface{}) string {
 	}
 	for i := 0; i < len(keyValue); i += 2 {
 		if i < len(keyValue)-1 {
-			prefixIfNotEmpty += fmt.Sprintf("%+v=%+v ", keyValue[i], keyValue[i+1])
+			prefixIfNotEmpty += fmt.Sprintf("%+v=%s ", keyValue[i], quoteLogValue(fmt.Sprintf("%+v", keyValue[i+1])))
 		} else {
 			prefixIfNotEmpty += fmt.Sprintf("%+v ", keyValue[i])
 		}
@@ -59,9 +73,86 @@ func keyValueToString(prefixIfNotEmpty string, keyValue []interface{}) string {
 	return prefixIfNotEmpty
 }
 
+// quoteLogValue quotes the values that would be ambiguous in a text line.
+func quoteLogValue(value string) string {
+	if value == "" || strings.ContainsAny(value, " =\"\\") || strconv.Quote(value) != `"`+value+`"` {
+		return strconv.Quote(value)
+	}
+	return value
+}
+
 const timeLayout = time.DateTime + " -0700"
 
+// logJSONLine is the stable schema of the JSON logs. The well-known keys of the key-value pairs are promoted to their
+// own fields, and the rest are kept in Fields. RequestID is set by every log of a request (the X-Request-Id header),
+// and User is always the user ID at the provider (usernames and emails are logged as other fields).
+type logJSONLine struct {
+	Timestamp string                 `json:"timestamp"`
+	Level     string                 `json:"level"`
+	App       string                 `json:"app"`
+	Message   string                 `json:"message"`
+	Provider  string                 `json:"provider,omitempty"`
+	RequestID string                 `json:"requestId,omitempty"`
+	User      string                 `json:"user,omitempty"`
+	Fields    map[string]interface{} `json:"fields,omitempty"`
+}
+
+func logFormatJSONLine(level LogLevel, msg string, keyValue []interface{}) string {
+	line := &logJSONLine{
+		Timestamp: time.Now().Format(time.RFC3339Nano),
+		Level:     strings.ToLower(strings.TrimSpace(logLevelText[level])),
+		App:       appName,
+		Message:   msg,
+	}
+	for i := 0; i < len(keyValue); i += 2 {
+		key := fmt.Sprintf("%+v", keyValue[i])
+		if i == len(keyValue)-1 {
+			line.Fields = setLogField(line.Fields, "invalid-key-value-pairs", key)
+			break
+		}
+		value := keyValue[i+1]
+		switch key {
+		case "provider":
+			line.Provider = fmt.Sprintf("%+v", value)
+		case "request":
+			line.RequestID = fmt.Sprintf("%+v", value)
+		case "user":
+			line.User = fmt.Sprintf("%+v", value)
+		default:
+			line.Fields = setLogField(line.Fields, key, value)
+		}
+	}
+	b, err := json.Marshal(line)
+	if err != nil { // Values that cannot be encoded are logged as text
+		for key, value := range line.Fields {
+			line.Fields[key] = fmt.Sprintf("%+v", value)
+		}
+		b, _ = json.Marshal(line)
+	}
+	return string(b) + "\n"
+}
+
+func setLogField(fields map[string]interface{}, key string, value interface{}) map[string]interface{} {
+	if fields == nil {
+		fields = make(map[string]interface{})
+	}
+	switch v := value.(type) {
+	case error:
+		value = v.Error()
+	case time.Time: // Encoded as RFC 3339
+	case time.Duration:
+		value = v.String()
+	case fmt.Stringer:
+		value = v.String()
+	}
+	fields[key] = value
+	return fields
+}
+
 func logFormat(level LogLevel, msg string, keyValue []interface{}) string {
+	if logFormatCurrent == logFormatJSON {
+		return logFormatJSONLine(level, msg, keyValue)
+	}
 	return "[" + appName + "] [" + logLevelText[level] + "] " + time.Now().Format(timeLayout) + " | " + msg + keyValueToString(" ", keyValue) + "\n"
 }
 
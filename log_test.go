@@ -0,0 +1,31 @@
+package traefikgothauth
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestLogFormat(t *testing.T) {
+	defer func() { logFormatCurrent = logFormatText }()
+
+	logFormatCurrent = logFormatText
+	line := logFormat(logLevelInfo, "User just logged in", []interface{}{"provider", "github", "user", "Jane Doe", "note", `a "b"`, "empty", ""})
+	if !strings.HasPrefix(line, "[traefikgothauth] [INFO ] ") || !strings.HasSuffix(line, ` | User just logged in provider=github user="Jane Doe" note="a \"b\"" empty="" `+"\n") {
+		t.Fatalf("unexpected text line: %q", line)
+	}
+
+	logFormatCurrent = logFormatJSON
+	line = logFormat(logLevelWarn, "Failed", []interface{}{"provider", "github", "request", "abc", "user", "jane", "error", errors.New("boom"), "count", 2, "odd"})
+	parsed := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(line), &parsed); err != nil || !strings.HasSuffix(line, "}\n") {
+		t.Fatalf("expected a JSON line, got %q: %v", line, err)
+	}
+	fields, _ := parsed["fields"].(map[string]interface{})
+	if parsed["level"] != "warn" || parsed["app"] != "traefikgothauth" || parsed["message"] != "Failed" || parsed["timestamp"] == "" ||
+		parsed["provider"] != "github" || parsed["requestId"] != "abc" || parsed["user"] != "jane" ||
+		fields["error"] != "boom" || fields["count"] != 2.0 || fields["invalid-key-value-pairs"] != "odd" {
+		t.Fatalf("unexpected JSON line: %s", line)
+	}
+}
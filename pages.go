@@ -0,0 +1,43 @@
+package traefikgothauth
+
+import (
+	"bytes"
+	"html/template"
+	"net/http"
+)
+
+// pageStyle is the style of login-choose-provider.html, extended for forms, shared by all other pages of the plugin.
+const pageStyle = `<style>html,body{margin:0;padding:0;font-family:-apple-system,BlinkMacSystemFont,Segoe UI,Roboto,Helvetica Neue,Arial,sans-serif;font-size:16px}.login-box{border-radius:20px;min-width:300px;max-width:-moz-fit-content;max-width:fit-content;margin-top:5vh;margin-left:auto;margin-right:auto;padding:20px;box-shadow:0 0 10px #0000001a}.login-box-title{text-align:center;margin-bottom:20px;font-size:24px;font-weight:700}.login-box-buttons{flex-flow:wrap;justify-content:center;align-items:center;display:flex}.btn{color:#000;background-color:#f0f0f0;border-radius:5px;margin:10px;padding:10px 20px;text-decoration:none;transition:background-color .3s;display:inline-block}.btn:hover{background-color:#e0e0e0}.btn img{vertical-align:text-top;width:20px;margin-right:5px}.login-box-form{flex-direction:column;display:flex}.login-box-form label{flex-direction:column;margin:5px 10px;display:flex}.login-box-form input,.login-box-form select{font:inherit;border:1px solid #ccc;border-radius:5px;margin-top:5px;padding:8px}.login-box-form .btn,button.btn{font:inherit;cursor:pointer;border:none}.login-box-error{color:#c00;text-align:center;margin:10px}.login-box-message{text-align:center;margin:10px}.login-box-table{border-collapse:collapse;margin:10px}.login-box-table td,.login-box-table th{text-align:left;border-bottom:1px solid #ccc;padding:5px 10px}@media (prefers-color-scheme:dark){body{color:#f0f0f0;background-color:#121212}.login-box{color:#f0f0f0;background-color:#1e1e1e}.btn{color:#f0f0f0;background-color:#333}.btn:hover{background-color:#444}.login-box-form input,.login-box-form select{color:#f0f0f0;background-color:#121212;border-color:#444}.login-box-error{color:#f66}}@media (width>=1200px){.login-box{max-width:1200px}}</style>`
+
+// newPageTemplate wraps the body of a page with the common layout. The data must have a Title field.
+func newPageTemplate(name, body string) *template.Template {
+	return template.Must(template.New(name).Parse(`<!DOCTYPE html><html lang="en"><head><title>{{.Title}}</title><meta charset="utf-8"><meta name="viewport" content="width=device-width, initial-scale=1.0"></head><body> <div class="login-box"> <div class="login-box-title">{{.Title}}</div> ` + body + ` </div> ` + pageStyle + ` </body></html>`))
+}
+
+// servePage renders a page template, never caching it as it may contain user data.
+func servePage(rw http.ResponseWriter, status int, tmpl *template.Template, data interface{}) {
+	buf := &bytes.Buffer{}
+	if err := tmpl.Execute(buf, data); err != nil {
+		loge("Failed to render page", "template", tmpl.Name(), "error", err)
+		http.Error(rw, "Failed to render page", http.StatusInternalServerError)
+		return
+	}
+	rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.Header().Set("X-Frame-Options", "DENY")
+	rw.WriteHeader(status)
+	_, _ = rw.Write(buf.Bytes())
+}
+
+// loginFormField is an input of a login form.
+type loginFormField struct {
+	Name, Label, Type, Autocomplete string
+}
+
+// loginFormPage is the data of loginFormHtml.
+type loginFormPage struct {
+	Title, Error, Message, State, Submit string
+	Fields                               []loginFormField
+}
+
+var loginFormHtml = newPageTemplate("loginFormTemplate", `{{if .Error}}<div class="login-box-error">{{.Error}}</div>{{end}} {{if .Message}}<div class="login-box-message">{{.Message}}</div>{{else}}<form class="login-box-form" method="post"> <input type="hidden" name="state" value="{{.State}}"> {{range $i,$field:=.Fields}}<label>{{$field.Label}} <input name="{{$field.Name}}" type="{{$field.Type}}" autocomplete="{{$field.Autocomplete}}" required{{if eq $i 0}} autofocus{{end}}></label> {{end}}<button class="btn" type="submit">{{.Submit}}</button> </form>{{end}}`)
@@ -1,6 +1,7 @@
 package traefikgothauth
 
 import (
+	"encoding/json"
 	"fmt"
 	"github.com/markbates/goth"
 	"github.com/markbates/goth/providers/amazon"
@@ -20,7 +21,6 @@ import (
 	"github.com/markbates/goth/providers/gitea"
 	"github.com/markbates/goth/providers/github"
 	"github.com/markbates/goth/providers/gitlab"
-	"github.com/markbates/goth/providers/gplus"
 	"github.com/markbates/goth/providers/heroku"
 	"github.com/markbates/goth/providers/instagram"
 	"github.com/markbates/goth/providers/intercom"
@@ -60,6 +60,7 @@ import (
 	"github.com/markbates/goth/providers/yammer"
 	"github.com/markbates/goth/providers/yandex"
 	"github.com/markbates/goth/providers/zoom"
+	"net/http"
 )
 
 // NewProvider creates a New provider based on the given Name and parameters.
@@ -68,10 +69,22 @@ func NewProvider(name, clientclientKey, secret, callback string, custom map[stri
 	if !ok {
 		return nil, fmt.Errorf("provider %s not found", name)
 	}
-	return p.New(clientclientKey, secret, callback, custom, scopes...)
+	custom, err := p.validateCustom(custom)
+	if err != nil {
+		return nil, err
+	}
+	provider, err := p.New(http.DefaultClient, clientclientKey, secret, callback, custom, scopes...)
+	if err != nil {
+		return nil, err
+	}
+	setProviderHTTPClient(provider, http.DefaultClient)
+	return provider, nil
 }
 
 func getProviderInfo(name string) (*ProviderInfo, bool) {
+	if replacement, ok := deprecatedProviders[name]; ok {
+		name = replacement
+	}
 	for _, p := range allProviders {
 		if p.Name == name {
 			return p, true
@@ -80,10 +93,27 @@ func getProviderInfo(name string) (*ProviderInfo, bool) {
 	return nil, false
 }
 
+// pluginIcon is the icon of the providers implemented by the plugin itself.
+const pluginIcon = "https://raw.githubusercontent.com/Yeicor/traefikgothauth/master/.github/icon.png"
+
+// deprecatedProviders maps the names of removed providers to their replacements.
+var deprecatedProviders = map[string]string{
+	"gplus": "google", // The Google+ API was shut down
+}
+
 // ProviderInfo contains static metadata for a provider.
 type ProviderInfo struct {
 	Name, DisplayName, Icon string
-	New                     func(clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error)
+	// Custom lists the accepted ProviderConfig.Custom settings.
+	Custom []*CustomSetting
+	// NoLoginPrompt (optional) only sends max_age to re-authenticate users at step-up, for the providers that reject
+	// prompt=login (e.g. Google).
+	NoLoginPrompt bool
+	// Validate (optional) checks constraints between custom settings, once each of them is valid.
+	Validate func(custom map[string]interface{}) error
+	// New creates the provider, with custom settings already validated and converted to the declared types.
+	// The client is the outbound HTTP client, which is also set on the returned provider if it supports it.
+	New func(client *http.Client, clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error)
 }
 
 // allProviders is a list of static metadata for all supported providers.
@@ -94,35 +124,46 @@ var allProviders = []*ProviderInfo{
 		Name:        "amazon",
 		DisplayName: "Amazon",
 		Icon:        "https://icons.duckduckgo.com/ip3/amazon.com.ico",
-		New: func(clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
+		New: func(client *http.Client, clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
 			return amazon.New(clientKey, secret, callback, scopes...), nil
 		},
 	},
-	//{ // Incompatible with yaegi (for now...)
-	//	Name:        "apple",
-	//	DisplayName: "Apple",
-	//	Icon:        "https://icons.duckduckgo.com/ip3/apple.com.ico",
-	//	New: func(clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
-	//		client, ok := custom["client"].(*http.Client)
-	//		if !ok {
-	//			client = http.DefaultClient
-	//		}
-	//		return apple.New(clientKey, secret, callback, client, scopes...), nil
-	//	},
-	//},
+	{
+		Name:        "apple",
+		DisplayName: "Apple",
+		Icon:        "https://icons.duckduckgo.com/ip3/apple.com.ico",
+		Custom: []*CustomSetting{
+			{Name: "teamID", Type: CustomString, Required: true, Description: "Apple developer team ID"},
+			{Name: "keyID", Type: CustomString, Required: true, Description: "ID of the Sign in with Apple private key"},
+			{Name: "privateKeyFile", Type: CustomString, Description: "path to the .p8 private key file"},
+			{Name: "privateKey", Type: CustomString, Description: "contents of the .p8 private key (alternative to privateKeyFile)"},
+		},
+		Validate: requireOneOf([]string{"privateKeyFile"}, []string{"privateKey"}),
+		New: func(client *http.Client, clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
+			return newAppleProvider(clientKey, callback, custom, scopes...)
+		},
+	},
 	{
 		Name:        "auth0",
 		DisplayName: "Auth0",
 		Icon:        "https://icons.duckduckgo.com/ip3/auth0.com.ico",
-		New: func(clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
-			return auth0.New(clientKey, secret, callback, custom["domain"].(string), scopes...), nil
+		Custom: []*CustomSetting{
+			{Name: "domain", Type: CustomString, Required: true, Description: "Auth0 tenant domain, e.g. example.eu.auth0.com"},
+		},
+		New: func(client *http.Client, clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
+			domain, _ := custom["domain"].(string)
+			return auth0.New(clientKey, secret, callback, domain, scopes...), nil
 		},
 	},
 	{
 		Name:        "azuread",
 		DisplayName: "Azure AD",
 		Icon:        "https://icons.duckduckgo.com/ip3/azure.com.ico",
-		New: func(clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
+		Custom: []*CustomSetting{
+			{Name: "resources", Type: CustomStringList, Description: "additional resources to request access to"},
+			{Name: "tenant", Type: CustomString, Description: "directory (tenant) ID or domain of single-tenant apps, used to get Microsoft Graph tokens (defaults to common)"},
+		},
+		New: func(client *http.Client, clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
 			resources, ok := custom["resources"].([]string)
 			if !ok {
 				resources = []string{}
@@ -134,7 +175,7 @@ var allProviders = []*ProviderInfo{
 		Name:        "battlenet",
 		DisplayName: "Battle.net",
 		Icon:        "https://icons.duckduckgo.com/ip3/battle.net.ico",
-		New: func(clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
+		New: func(client *http.Client, clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
 			return battlenet.New(clientKey, secret, callback, scopes...), nil
 		},
 	},
@@ -142,7 +183,7 @@ var allProviders = []*ProviderInfo{
 		Name:        "bitbucket",
 		DisplayName: "Bitbucket",
 		Icon:        "https://icons.duckduckgo.com/ip3/bitbucket.org.ico",
-		New: func(clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
+		New: func(client *http.Client, clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
 			return bitbucket.New(clientKey, secret, callback, scopes...), nil
 		},
 	},
@@ -150,7 +191,7 @@ var allProviders = []*ProviderInfo{
 		Name:        "box",
 		DisplayName: "Box",
 		Icon:        "https://icons.duckduckgo.com/ip3/box.com.ico",
-		New: func(clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
+		New: func(client *http.Client, clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
 			return box.New(clientKey, secret, callback, scopes...), nil
 		},
 	},
@@ -158,7 +199,7 @@ var allProviders = []*ProviderInfo{
 		Name:        "dailymotion",
 		DisplayName: "Dailymotion",
 		Icon:        "https://icons.duckduckgo.com/ip3/dailymotion.com.ico",
-		New: func(clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
+		New: func(client *http.Client, clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
 			return dailymotion.New(clientKey, secret, callback, scopes...), nil
 		},
 	},
@@ -166,7 +207,7 @@ var allProviders = []*ProviderInfo{
 		Name:        "deezer",
 		DisplayName: "Deezer",
 		Icon:        "https://icons.duckduckgo.com/ip3/deezer.com.ico",
-		New: func(clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
+		New: func(client *http.Client, clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
 			return deezer.New(clientKey, secret, callback, scopes...), nil
 		},
 	},
@@ -174,7 +215,7 @@ var allProviders = []*ProviderInfo{
 		Name:        "digitalocean",
 		DisplayName: "DigitalOcean",
 		Icon:        "https://icons.duckduckgo.com/ip3/digitalocean.com.ico",
-		New: func(clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
+		New: func(client *http.Client, clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
 			return digitalocean.New(clientKey, secret, callback, scopes...), nil
 		},
 	},
@@ -182,7 +223,7 @@ var allProviders = []*ProviderInfo{
 		Name:        "discord",
 		DisplayName: "Discord",
 		Icon:        "https://icons.duckduckgo.com/ip3/discord.com.ico",
-		New: func(clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
+		New: func(client *http.Client, clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
 			return discord.New(clientKey, secret, callback, scopes...), nil
 		},
 	},
@@ -190,15 +231,35 @@ var allProviders = []*ProviderInfo{
 		Name:        "dropbox",
 		DisplayName: "Dropbox",
 		Icon:        "https://icons.duckduckgo.com/ip3/dropbox.com.ico",
-		New: func(clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
+		New: func(client *http.Client, clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
 			return dropbox.New(clientKey, secret, callback, scopes...), nil
 		},
 	},
+	{
+		Name:        "email",
+		DisplayName: "Email",
+		Icon:        pluginIcon,
+		Custom: append([]*CustomSetting{
+			{Name: "smtpAddress", Type: CustomString, Required: true, Description: "host:port of the SMTP server, e.g. smtp.example.com:587"},
+			{Name: "smtpSecurity", Type: CustomString, Description: "starttls (default), tls (implicit, usually port 465) or none"},
+			{Name: "smtpUsername", Type: CustomString, Description: "username to authenticate with the SMTP server"},
+			{Name: "smtpPassword", Type: CustomString, Description: "password to authenticate with the SMTP server"},
+			{Name: "from", Type: CustomString, Required: true, Description: "sender of the emails, e.g. Login <login@example.com>"},
+			{Name: "subject", Type: CustomString, Description: "subject of the emails (default: Your login link)"},
+			{Name: "allowedEmails", Type: CustomStringList, Description: "addresses that may log in"},
+			{Name: "allowedDomains", Type: CustomStringList, Description: "domains whose addresses may log in, e.g. example.com"},
+			{Name: "linkTTL", Type: CustomString, Description: "validity of the login links, e.g. 15m (default)"},
+		}, formProviderCustomSettings...),
+		Validate: requireOneOf([]string{"allowedEmails"}, []string{"allowedDomains"}),
+		New: func(client *http.Client, clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
+			return newEmailProvider(client, secret, callback, custom)
+		},
+	},
 	{
 		Name:        "eveonline",
 		DisplayName: "EVE Online",
 		Icon:        "https://icons.duckduckgo.com/ip3/eveonline.com.ico",
-		New: func(clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
+		New: func(client *http.Client, clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
 			return eveonline.New(clientKey, secret, callback, scopes...), nil
 		},
 	},
@@ -206,7 +267,7 @@ var allProviders = []*ProviderInfo{
 		Name:        "facebook",
 		DisplayName: "Facebook",
 		Icon:        "https://icons.duckduckgo.com/ip3/facebook.com.ico",
-		New: func(clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
+		New: func(client *http.Client, clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
 			return facebook.New(clientKey, secret, callback, scopes...), nil
 		},
 	},
@@ -214,15 +275,40 @@ var allProviders = []*ProviderInfo{
 		Name:        "fitbit",
 		DisplayName: "Fitbit",
 		Icon:        "https://icons.duckduckgo.com/ip3/fitbit.com.ico",
-		New: func(clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
+		New: func(client *http.Client, clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
 			return fitbit.New(clientKey, secret, callback, scopes...), nil
 		},
 	},
+	{
+		Name:        "generic-oauth2",
+		DisplayName: "OAuth2",
+		Icon:        "https://icons.duckduckgo.com/ip3/oauth.net.ico",
+		Custom: []*CustomSetting{
+			{Name: "authURL", Type: CustomString, Required: true, Description: "authorization endpoint URL"},
+			{Name: "tokenURL", Type: CustomString, Required: true, Description: "token endpoint URL"},
+			{Name: "userInfoURL", Type: CustomString, Required: true, Description: "JSON userinfo endpoint URL"},
+			{Name: "authStyle", Type: CustomString, Description: "how client credentials are sent to the token endpoint: header or params (auto-detected by default)"},
+			{Name: "userIDField", Type: CustomString, Description: "dot-separated path to the user ID in the userinfo response (default id)"},
+			{Name: "emailField", Type: CustomString, Description: "dot-separated path to the email (default email)"},
+			{Name: "nameField", Type: CustomString, Description: "dot-separated path to the full name (default name)"},
+			{Name: "firstNameField", Type: CustomString, Description: "dot-separated path to the first name (default given_name)"},
+			{Name: "lastNameField", Type: CustomString, Description: "dot-separated path to the last name (default family_name)"},
+			{Name: "nickNameField", Type: CustomString, Description: "dot-separated path to the nickname (default login)"},
+			{Name: "avatarURLField", Type: CustomString, Description: "dot-separated path to the avatar URL (default avatar_url)"},
+			{Name: "descriptionField", Type: CustomString, Description: "dot-separated path to the description (default bio)"},
+			{Name: "locationField", Type: CustomString, Description: "dot-separated path to the location (default location)"},
+			{Name: "displayName", Type: CustomString, Description: "name shown in the provider selection page"},
+			{Name: "icon", Type: CustomString, Description: "icon URL shown in the provider selection page"},
+		},
+		New: func(client *http.Client, clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
+			return newGenericOAuth2Provider(clientKey, secret, callback, custom, scopes...)
+		},
+	},
 	{
 		Name:        "gitea",
 		DisplayName: "Gitea",
 		Icon:        "https://icons.duckduckgo.com/ip3/gitea.com.ico",
-		New: func(clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
+		New: func(client *http.Client, clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
 			return gitea.New(clientKey, secret, callback, scopes...), nil
 		},
 	},
@@ -230,7 +316,7 @@ var allProviders = []*ProviderInfo{
 		Name:        "github",
 		DisplayName: "GitHub",
 		Icon:        "https://icons.duckduckgo.com/ip3/github.com.ico",
-		New: func(clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
+		New: func(client *http.Client, clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
 			return github.New(clientKey, secret, callback, scopes...), nil
 		},
 	},
@@ -238,35 +324,29 @@ var allProviders = []*ProviderInfo{
 		Name:        "gitlab",
 		DisplayName: "GitLab",
 		Icon:        "https://icons.duckduckgo.com/ip3/gitlab.com.ico",
-		New: func(clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
+		New: func(client *http.Client, clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
 			return gitlab.New(clientKey, secret, callback, scopes...), nil
 		},
 	},
-	//{ // Incompatible with yaegi (for now...)
-	//	Name:        "google",
-	//	DisplayName: "Google",
-	//	Icon:        "https://icons.duckduckgo.com/ip3/google.com.ico",
-	//	New: func(clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
-	//		scopes, ok := custom["scopes"].([]string)
-	//		if !ok {
-	//			scopes = []string{}
-	//		}
-	//		return google.New(clientKey, secret, callback, scopes...), nil
-	//	},
-	//},
 	{
-		Name:        "gplus",
-		DisplayName: "Google Plus",
-		Icon:        "https://icons.duckduckgo.com/ip3/google.com.ico",
-		New: func(clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
-			return gplus.New(clientKey, secret, callback, scopes...), nil
+		Name:          "google",
+		DisplayName:   "Google",
+		Icon:          "https://icons.duckduckgo.com/ip3/google.com.ico",
+		NoLoginPrompt: true, // Only none, consent and select_account are supported
+		Custom: []*CustomSetting{
+			{Name: "hostedDomains", Type: CustomStringList, Description: "only allow accounts of these Google Workspace domains (verified server-side)"},
+			{Name: "prompt", Type: CustomString, Description: "prompt parameter, e.g. select_account or consent"},
+			{Name: "offlineAccess", Type: CustomBool, Description: "request a refresh token (access_type=offline)"},
+		},
+		New: func(client *http.Client, clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
+			return newGoogleProvider(clientKey, secret, callback, custom, scopes...)
 		},
 	},
 	{
 		Name:        "heroku",
 		DisplayName: "Heroku",
 		Icon:        "https://icons.duckduckgo.com/ip3/heroku.com.ico",
-		New: func(clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
+		New: func(client *http.Client, clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
 			return heroku.New(clientKey, secret, callback, scopes...), nil
 		},
 	},
@@ -274,7 +354,7 @@ var allProviders = []*ProviderInfo{
 		Name:        "instagram",
 		DisplayName: "Instagram",
 		Icon:        "https://icons.duckduckgo.com/ip3/instagram.com.ico",
-		New: func(clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
+		New: func(client *http.Client, clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
 			return instagram.New(clientKey, secret, callback, scopes...), nil
 		},
 	},
@@ -282,7 +362,7 @@ var allProviders = []*ProviderInfo{
 		Name:        "intercom",
 		DisplayName: "Intercom",
 		Icon:        "https://icons.duckduckgo.com/ip3/intercom.com.ico",
-		New: func(clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
+		New: func(client *http.Client, clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
 			return intercom.New(clientKey, secret, callback, scopes...), nil
 		},
 	},
@@ -290,7 +370,7 @@ var allProviders = []*ProviderInfo{
 		Name:        "kakao",
 		DisplayName: "Kakao",
 		Icon:        "https://icons.duckduckgo.com/ip3/kakao.com.ico",
-		New: func(clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
+		New: func(client *http.Client, clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
 			return kakao.New(clientKey, secret, callback, scopes...), nil
 		},
 	},
@@ -298,15 +378,32 @@ var allProviders = []*ProviderInfo{
 		Name:        "lastfm",
 		DisplayName: "Last.fm",
 		Icon:        "https://icons.duckduckgo.com/ip3/last.fm.ico",
-		New: func(clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
+		New: func(client *http.Client, clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
 			return lastfm.New(clientKey, secret, callback), nil
 		},
 	},
+	{
+		Name:        "ldap",
+		DisplayName: "LDAP",
+		Icon:        pluginIcon,
+		Custom: append([]*CustomSetting{
+			{Name: "url", Type: CustomString, Required: true, Description: "URL of the server, e.g. ldaps://ldap.example.com or ldap://dc.example.com:389"},
+			{Name: "startTLS", Type: CustomBool, Description: "upgrade the ldap:// connection with StartTLS"},
+			{Name: "bindDN", Type: CustomString, Description: "DN of the service account that searches for users (anonymous search if empty)"},
+			{Name: "bindPassword", Type: CustomString, Description: "password of the service account"},
+			{Name: "baseDN", Type: CustomString, Required: true, Description: "DN below which users are searched, e.g. dc=example,dc=com"},
+			{Name: "userFilter", Type: CustomString, Description: "filter that finds the user, where {username} is replaced by the escaped username (default " + ldapDefaultUserFilter + ")"},
+			{Name: "attributes", Type: CustomStringMap, Description: "claims and the attributes they are read from, overriding the defaults (email: mail, name: displayName, first-name: givenName, last-name: sn, groups: memberOf)"},
+		}, formProviderCustomSettings...),
+		New: func(client *http.Client, clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
+			return newLDAPProvider(client, secret, callback, custom)
+		},
+	},
 	{
 		Name:        "line",
 		DisplayName: "Line",
 		Icon:        "https://icons.duckduckgo.com/ip3/line.me.ico",
-		New: func(clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
+		New: func(client *http.Client, clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
 			return line.New(clientKey, secret, callback, scopes...), nil
 		},
 	},
@@ -314,15 +411,28 @@ var allProviders = []*ProviderInfo{
 		Name:        "linkedin",
 		DisplayName: "LinkedIn",
 		Icon:        "https://icons.duckduckgo.com/ip3/linkedin.com.ico",
-		New: func(clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
+		New: func(client *http.Client, clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
 			return linkedin.New(clientKey, secret, callback, scopes...), nil
 		},
 	},
+	{
+		Name:        "local",
+		DisplayName: "Username and password",
+		Icon:        pluginIcon,
+		Custom: append([]*CustomSetting{
+			{Name: "users", Type: CustomStringMap, Description: "users and their bcrypt password hashes"},
+			{Name: "htpasswdFile", Type: CustomString, Description: "path to an htpasswd file with bcrypt password hashes (htpasswd -B), reloaded on changes"},
+		}, formProviderCustomSettings...),
+		Validate: requireOneOf([]string{"users"}, []string{"htpasswdFile"}),
+		New: func(client *http.Client, clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
+			return newLocalProvider(secret, callback, custom)
+		},
+	},
 	{
 		Name:        "mastodon",
 		DisplayName: "Mastodon",
 		Icon:        "https://icons.duckduckgo.com/ip3/mastodon.social.ico",
-		New: func(clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
+		New: func(client *http.Client, clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
 			return mastodon.New(clientKey, secret, callback, scopes...), nil
 		},
 	},
@@ -330,7 +440,7 @@ var allProviders = []*ProviderInfo{
 		Name:        "meetup",
 		DisplayName: "Meetup",
 		Icon:        "https://icons.duckduckgo.com/ip3/meetup.com.ico",
-		New: func(clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
+		New: func(client *http.Client, clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
 			return meetup.New(clientKey, secret, callback, scopes...), nil
 		},
 	},
@@ -338,7 +448,7 @@ var allProviders = []*ProviderInfo{
 		Name:        "microsoftonline",
 		DisplayName: "Microsoft Online",
 		Icon:        "https://icons.duckduckgo.com/ip3/www.microsoft.com.ico",
-		New: func(clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
+		New: func(client *http.Client, clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
 			return microsoftonline.New(clientKey, secret, callback, scopes...), nil
 		},
 	},
@@ -346,7 +456,7 @@ var allProviders = []*ProviderInfo{
 		Name:        "naver",
 		DisplayName: "Naver",
 		Icon:        "https://icons.duckduckgo.com/ip3/naver.com.ico",
-		New: func(clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
+		New: func(client *http.Client, clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
 			return naver.New(clientKey, secret, callback), nil
 		},
 	},
@@ -354,11 +464,21 @@ var allProviders = []*ProviderInfo{
 		Name:        "nextcloud",
 		DisplayName: "Nextcloud",
 		Icon:        "https://icons.duckduckgo.com/ip3/nextcloud.com.ico",
-		New: func(clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
+		Custom: []*CustomSetting{
+			{Name: "nextcloudURL", Type: CustomString, Description: "base URL of the Nextcloud instance (alternative to the individual URLs)"},
+			{Name: "authURL", Type: CustomString, Description: "authorization endpoint URL"},
+			{Name: "tokenURL", Type: CustomString, Description: "token endpoint URL"},
+			{Name: "profileURL", Type: CustomString, Description: "user profile endpoint URL"},
+		},
+		Validate: requireOneOf([]string{"nextcloudURL"}, []string{"authURL", "tokenURL", "profileURL"}),
+		New: func(client *http.Client, clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
 			if nextcloudURL, ok := custom["nextcloudURL"].(string); ok {
 				return nextcloud.NewCustomisedDNS(clientKey, secret, callback, nextcloudURL, scopes...), nil
 			} else {
-				return nextcloud.NewCustomisedURL(clientKey, secret, callback, custom["authURL"].(string), custom["tokenURL"].(string), custom["profileURL"].(string), scopes...), nil
+				authURL, _ := custom["authURL"].(string)
+				tokenURL, _ := custom["tokenURL"].(string)
+				profileURL, _ := custom["profileURL"].(string)
+				return nextcloud.NewCustomisedURL(clientKey, secret, callback, authURL, tokenURL, profileURL, scopes...), nil
 			}
 		},
 	},
@@ -366,15 +486,19 @@ var allProviders = []*ProviderInfo{
 		Name:        "okta",
 		DisplayName: "Okta",
 		Icon:        "https://icons.duckduckgo.com/ip3/okta.com.ico",
-		New: func(clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
-			return okta.New(clientKey, secret, custom["orgURL"].(string), callback), nil
+		Custom: []*CustomSetting{
+			{Name: "orgURL", Type: CustomString, Required: true, Description: "Okta organization URL, e.g. https://example.okta.com"},
+		},
+		New: func(client *http.Client, clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
+			orgURL, _ := custom["orgURL"].(string)
+			return okta.New(clientKey, secret, orgURL, callback), nil
 		},
 	},
 	{
 		Name:        "onedrive",
 		DisplayName: "OneDrive",
 		Icon:        "https://icons.duckduckgo.com/ip3/onedrive.com.ico",
-		New: func(clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
+		New: func(client *http.Client, clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
 			return onedrive.New(clientKey, secret, callback, scopes...), nil
 		},
 	},
@@ -382,15 +506,35 @@ var allProviders = []*ProviderInfo{
 		Name:        "openid-connect",
 		DisplayName: "OpenID Connect",
 		Icon:        "https://icons.duckduckgo.com/ip3/openid.net.ico",
-		New: func(clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
+		Custom: []*CustomSetting{
+			{Name: "openIDAutoDiscoveryURL", Type: CustomString, Description: "discovery document URL, e.g. https://example.com/.well-known/openid-configuration (alternative to the individual URLs)"},
+			{Name: "authURL", Type: CustomString, Description: "authorization endpoint URL"},
+			{Name: "tokenURL", Type: CustomString, Description: "token endpoint URL"},
+			{Name: "issuerURL", Type: CustomString, Description: "issuer identifier"},
+			{Name: "userInfoURL", Type: CustomString, Description: "userinfo endpoint URL"},
+			{Name: "endSessionEndpointURL", Type: CustomString, Description: "end session endpoint URL"},
+			{Name: "skipUserInfoRequest", Type: CustomBool, Description: "only use the claims of the ID token"},
+		},
+		Validate: requireOneOf([]string{"openIDAutoDiscoveryURL"}, []string{"authURL", "tokenURL", "issuerURL", "userInfoURL"}),
+		New: func(client *http.Client, clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
 			var (
 				c   *openidConnect.Provider
 				err error
 			)
 			if autoDiscoveryURL, ok := custom["openIDAutoDiscoveryURL"].(string); ok {
-				c, err = openidConnect.New(clientKey, secret, callback, autoDiscoveryURL, scopes...)
+				// Discover the endpoints ourselves, as openidConnect.New would not use the configured client
+				var discovered *openidConnect.OpenIDConfig
+				if discovered, err = discoverOpenIDConfig(client, autoDiscoveryURL); err != nil {
+					return nil, err
+				}
+				c, err = openidConnect.NewCustomisedURL(clientKey, secret, callback, discovered.AuthEndpoint, discovered.TokenEndpoint, discovered.Issuer, discovered.UserInfoEndpoint, discovered.EndSessionEndpoint, scopes...)
 			} else {
-				c, err = openidConnect.NewCustomisedURL(clientKey, secret, callback, custom["authURL"].(string), custom["tokenURL"].(string), custom["issuerURL"].(string), custom["userInfoURL"].(string), custom["endSessionEndpointURL"].(string), scopes...)
+				authURL, _ := custom["authURL"].(string)
+				tokenURL, _ := custom["tokenURL"].(string)
+				issuerURL, _ := custom["issuerURL"].(string)
+				userInfoURL, _ := custom["userInfoURL"].(string)
+				endSessionEndpointURL, _ := custom["endSessionEndpointURL"].(string)
+				c, err = openidConnect.NewCustomisedURL(clientKey, secret, callback, authURL, tokenURL, issuerURL, userInfoURL, endSessionEndpointURL, scopes...)
 			}
 			if err != nil {
 				return nil, err
@@ -405,7 +549,7 @@ var allProviders = []*ProviderInfo{
 		Name:        "patreon",
 		DisplayName: "Patreon",
 		Icon:        "https://icons.duckduckgo.com/ip3/patreon.com.ico",
-		New: func(clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
+		New: func(client *http.Client, clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
 			return patreon.New(clientKey, secret, callback, scopes...), nil
 		},
 	},
@@ -413,7 +557,7 @@ var allProviders = []*ProviderInfo{
 		Name:        "paypal",
 		DisplayName: "PayPal",
 		Icon:        "https://icons.duckduckgo.com/ip3/paypal.com.ico",
-		New: func(clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
+		New: func(client *http.Client, clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
 			return paypal.New(clientKey, secret, callback, scopes...), nil
 		},
 	},
@@ -421,7 +565,7 @@ var allProviders = []*ProviderInfo{
 		Name:        "salesforce",
 		DisplayName: "Salesforce",
 		Icon:        "https://icons.duckduckgo.com/ip3/salesforce.com.ico",
-		New: func(clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
+		New: func(client *http.Client, clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
 			return salesforce.New(clientKey, secret, callback, scopes...), nil
 		},
 	},
@@ -429,7 +573,7 @@ var allProviders = []*ProviderInfo{
 		Name:        "seatalk",
 		DisplayName: "SeaTalk",
 		Icon:        "https://icons.duckduckgo.com/ip3/seatalk.com.ico",
-		New: func(clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
+		New: func(client *http.Client, clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
 			return seatalk.New(clientKey, secret, callback, scopes...), nil
 		},
 	},
@@ -437,7 +581,7 @@ var allProviders = []*ProviderInfo{
 		Name:        "shopify",
 		DisplayName: "Shopify",
 		Icon:        "https://icons.duckduckgo.com/ip3/shopify.com.ico",
-		New: func(clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
+		New: func(client *http.Client, clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
 			return shopify.New(clientKey, secret, callback, scopes...), nil
 		},
 	},
@@ -445,7 +589,7 @@ var allProviders = []*ProviderInfo{
 		Name:        "slack",
 		DisplayName: "Slack",
 		Icon:        "https://icons.duckduckgo.com/ip3/slack.com.ico",
-		New: func(clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
+		New: func(client *http.Client, clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
 			return slack.New(clientKey, secret, callback, scopes...), nil
 		},
 	},
@@ -453,7 +597,7 @@ var allProviders = []*ProviderInfo{
 		Name:        "soundcloud",
 		DisplayName: "SoundCloud",
 		Icon:        "https://icons.duckduckgo.com/ip3/soundcloud.com.ico",
-		New: func(clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
+		New: func(client *http.Client, clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
 			return soundcloud.New(clientKey, secret, callback, scopes...), nil
 		},
 	},
@@ -461,7 +605,7 @@ var allProviders = []*ProviderInfo{
 		Name:        "spotify",
 		DisplayName: "Spotify",
 		Icon:        "https://icons.duckduckgo.com/ip3/spotify.com.ico",
-		New: func(clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
+		New: func(client *http.Client, clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
 			return spotify.New(clientKey, secret, callback, scopes...), nil
 		},
 	},
@@ -469,7 +613,7 @@ var allProviders = []*ProviderInfo{
 		Name:        "steam",
 		DisplayName: "Steam",
 		Icon:        "https://icons.duckduckgo.com/ip3/steamcommunity.com.ico",
-		New: func(clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
+		New: func(client *http.Client, clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
 			return steam.New(clientKey, callback), nil
 		},
 	},
@@ -477,7 +621,7 @@ var allProviders = []*ProviderInfo{
 		Name:        "strava",
 		DisplayName: "Strava",
 		Icon:        "https://icons.duckduckgo.com/ip3/strava.com.ico",
-		New: func(clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
+		New: func(client *http.Client, clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
 			return strava.New(clientKey, secret, callback, scopes...), nil
 		},
 	},
@@ -485,7 +629,7 @@ var allProviders = []*ProviderInfo{
 		Name:        "stripe",
 		DisplayName: "Stripe",
 		Icon:        "https://icons.duckduckgo.com/ip3/stripe.com.ico",
-		New: func(clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
+		New: func(client *http.Client, clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
 			return stripe.New(clientKey, secret, callback, scopes...), nil
 		},
 	},
@@ -493,7 +637,7 @@ var allProviders = []*ProviderInfo{
 		Name:        "tiktok",
 		DisplayName: "TikTok",
 		Icon:        "https://icons.duckduckgo.com/ip3/tiktok.com.ico",
-		New: func(clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
+		New: func(client *http.Client, clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
 			return tiktok.New(clientKey, secret, callback, scopes...), nil
 		},
 	},
@@ -501,7 +645,7 @@ var allProviders = []*ProviderInfo{
 		Name:        "twitch",
 		DisplayName: "Twitch",
 		Icon:        "https://icons.duckduckgo.com/ip3/twitch.tv.ico",
-		New: func(clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
+		New: func(client *http.Client, clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
 			return twitch.New(clientKey, secret, callback, scopes...), nil
 		},
 	},
@@ -509,7 +653,7 @@ var allProviders = []*ProviderInfo{
 		Name:        "twitter",
 		DisplayName: "Twitter (v1)",
 		Icon:        "https://icons.duckduckgo.com/ip3/twitter.com.ico",
-		New: func(clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
+		New: func(client *http.Client, clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
 			return twitter.New(clientKey, secret, callback), nil
 		},
 	},
@@ -517,7 +661,7 @@ var allProviders = []*ProviderInfo{
 		Name:        "twitterv2",
 		DisplayName: "Twitter (v2)",
 		Icon:        "https://icons.duckduckgo.com/ip3/twitter.com.ico",
-		New: func(clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
+		New: func(client *http.Client, clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
 			return twitterv2.New(clientKey, secret, callback), nil
 		},
 	},
@@ -525,7 +669,7 @@ var allProviders = []*ProviderInfo{
 	//	Name:        "typetalk",
 	//	DisplayName: "TypeTalk",
 	//	Icon:   "https://icons.duckduckgo.com/ip3/typetalk.com.ico",
-	//	New: func(clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
+	//	New: func(client *http.Client, clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
 	//		return typetalk.New(clientKey, secret, callback, scopes...), nil
 	//	},
 	//},
@@ -533,7 +677,7 @@ var allProviders = []*ProviderInfo{
 		Name:        "uber",
 		DisplayName: "Uber",
 		Icon:        "https://icons.duckduckgo.com/ip3/uber.com.ico",
-		New: func(clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
+		New: func(client *http.Client, clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
 			return uber.New(clientKey, secret, callback, scopes...), nil
 		},
 	},
@@ -541,23 +685,40 @@ var allProviders = []*ProviderInfo{
 		Name:        "vk",
 		DisplayName: "VK",
 		Icon:        "https://icons.duckduckgo.com/ip3/vk.com.ico",
-		New: func(clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
+		New: func(client *http.Client, clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
 			return vk.New(clientKey, secret, callback, scopes...), nil
 		},
 	},
+	{
+		Name:        "webauthn",
+		DisplayName: "Passkey",
+		Icon:        pluginIcon,
+		Custom: append([]*CustomSetting{
+			{Name: "credentialsFile", Type: CustomString, Required: true, Description: "path of the JSON file that stores the registered passkeys (created if missing)"},
+			{Name: "rpID", Type: CustomString, Description: "relying party ID, a domain that includes all the protected hosts (default: the host of the redirect URI)"},
+			{Name: "invites", Type: CustomStringMap, Description: "one-time invite codes and the usernames they register a passkey for, at /__goth/webauthn/register/?invite=<code>"},
+		}, formProviderCustomSettings...),
+		New: func(client *http.Client, clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
+			return newWebauthnProvider(secret, callback, custom)
+		},
+	},
 	{
 		Name:        "wecom",
 		DisplayName: "WeCom",
 		Icon:        "https://icons.duckduckgo.com/ip3/wework.com.ico",
-		New: func(clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
-			return wecom.New(clientKey, secret, custom["agentID"].(string), callback), nil
+		Custom: []*CustomSetting{
+			{Name: "agentID", Type: CustomString, Required: true, Description: "WeCom application agent ID"},
+		},
+		New: func(client *http.Client, clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
+			agentID, _ := custom["agentID"].(string)
+			return wecom.New(clientKey, secret, agentID, callback), nil
 		},
 	},
 	{
 		Name:        "wepay",
 		DisplayName: "WePay",
 		Icon:        "https://icons.duckduckgo.com/ip3/wepay.com.ico",
-		New: func(clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
+		New: func(client *http.Client, clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
 			return wepay.New(clientKey, secret, callback, scopes...), nil
 		},
 	},
@@ -565,7 +726,7 @@ var allProviders = []*ProviderInfo{
 		Name:        "xero",
 		DisplayName: "Xero",
 		Icon:        "https://icons.duckduckgo.com/ip3/xero.com.ico",
-		New: func(clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
+		New: func(client *http.Client, clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
 			return xero.New(clientKey, secret, callback), nil
 		},
 	},
@@ -573,7 +734,7 @@ var allProviders = []*ProviderInfo{
 		Name:        "yahoo",
 		DisplayName: "Yahoo",
 		Icon:        "https://icons.duckduckgo.com/ip3/yahoo.com.ico",
-		New: func(clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
+		New: func(client *http.Client, clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
 			return yahoo.New(clientKey, secret, callback, scopes...), nil
 		},
 	},
@@ -581,7 +742,7 @@ var allProviders = []*ProviderInfo{
 		Name:        "yammer",
 		DisplayName: "Yammer",
 		Icon:        "https://icons.duckduckgo.com/ip3/yammer.com.ico",
-		New: func(clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
+		New: func(client *http.Client, clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
 			return yammer.New(clientKey, secret, callback, scopes...), nil
 		},
 	},
@@ -589,7 +750,7 @@ var allProviders = []*ProviderInfo{
 		Name:        "yandex",
 		DisplayName: "Yandex",
 		Icon:        "https://icons.duckduckgo.com/ip3/yandex.com.ico",
-		New: func(clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
+		New: func(client *http.Client, clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
 			return yandex.New(clientKey, secret, callback, scopes...), nil
 		},
 	},
@@ -597,8 +758,25 @@ var allProviders = []*ProviderInfo{
 		Name:        "zoom",
 		DisplayName: "Zoom",
 		Icon:        "https://icons.duckduckgo.com/ip3/zoom.us.ico",
-		New: func(clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
+		New: func(client *http.Client, clientKey, secret, callback string, custom map[string]interface{}, scopes ...string) (goth.Provider, error) {
 			return zoom.New(clientKey, secret, callback, scopes...), nil
 		},
 	},
 }
+
+// discoverOpenIDConfig fetches the OpenID Connect discovery document.
+func discoverOpenIDConfig(client *http.Client, autoDiscoveryURL string) (*openidConnect.OpenIDConfig, error) {
+	res, err := goth.HTTPClientWithFallBack(client).Get(autoDiscoveryURL)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = res.Body.Close() }()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return nil, fmt.Errorf("non-success code for discovery URL: %d", res.StatusCode)
+	}
+	discovered := &openidConnect.OpenIDConfig{}
+	if err = json.NewDecoder(res.Body).Decode(discovered); err != nil {
+		return nil, fmt.Errorf("failed to decode discovery document: %w", err)
+	}
+	return discovered, nil
+}
@@ -0,0 +1,141 @@
+package traefikgothauth
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// PublicRule matches the requests that skip authentication (health checks, static assets, webhooks, CORS
+// preflights...). All the configured conditions must match.
+type PublicRule struct {
+	// Paths (optional) are path globs, any of which must match: "*" matches within a path segment and "**" across
+	// segments, e.g. "/static/**" or "/*.ico".
+	Paths []string
+	// PathRegex (optional) is a regular expression that must match the path, e.g. "^/api/v[0-9]+/health$".
+	PathRegex string
+	// Methods (optional) are the HTTP methods, any of which must match, e.g. ["OPTIONS"].
+	Methods []string
+	// Headers (optional) maps header names to regular expressions that their values must match, e.g.
+	// {"X-Hub-Signature-256": "."} to require the header to be present.
+	Headers map[string]string
+	// Optional (optional) still authenticates the requests that have a session, publishing their claims, but lets
+	// anonymous requests pass instead of redirecting them to the login.
+	Optional  bool
+	paths     []*regexp.Regexp
+	pathRegex *regexp.Regexp
+	headers   map[string]*regexp.Regexp
+}
+
+func (r *PublicRule) setup() error {
+	var errs []error
+	if len(r.Paths) == 0 && r.PathRegex == "" && len(r.Methods) == 0 && len(r.Headers) == 0 {
+		errs = append(errs, errors.New("at least one condition is required"))
+	}
+	for _, glob := range r.Paths {
+		r.paths = append(r.paths, globToRegexp(glob))
+	}
+	if r.PathRegex != "" {
+		var err error
+		if r.pathRegex, err = regexp.Compile(r.PathRegex); err != nil {
+			errs = append(errs, fmt.Errorf("invalid PathRegex: %w", err))
+		}
+	}
+	r.headers = make(map[string]*regexp.Regexp, len(r.Headers))
+	for name, value := range r.Headers {
+		valueRegex, err := regexp.Compile(value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid regex for header %s: %w", name, err))
+			continue
+		}
+		r.headers[name] = valueRegex
+	}
+	return errors.Join(errs...)
+}
+
+// matches returns true if the request matches all the conditions of the rule.
+func (r *PublicRule) matches(req *http.Request) bool {
+	if r.pathRegex != nil && !r.pathRegex.MatchString(req.URL.Path) {
+		return false
+	}
+	if len(r.paths) > 0 && !anyMatch(r.paths, req.URL.Path) {
+		return false
+	}
+	if len(r.Methods) > 0 {
+		found := false
+		for _, method := range r.Methods {
+			found = found || strings.EqualFold(method, req.Method)
+		}
+		if !found {
+			return false
+		}
+	}
+	for name, valueRegex := range r.headers {
+		found := false
+		for _, value := range req.Header.Values(name) {
+			found = found || valueRegex.MatchString(value)
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// publicRule returns the first rule that matches the request, if any.
+func (c *Config) publicRule(req *http.Request) *PublicRule {
+	// Never match paths that the next handler may resolve to a different one (e.g. "/static/../admin").
+	if cleanPath := path.Clean("/" + req.URL.Path); cleanPath != req.URL.Path && cleanPath+"/" != req.URL.Path {
+		return nil
+	}
+	for _, rule := range c.PublicRules {
+		if rule.matches(req) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// stripClaims removes the claim headers sent by the client, so that anonymous requests can not impersonate anyone.
+func (c *Config) stripClaims(req *http.Request) {
+	prefix := http.CanonicalHeaderKey(c.ClaimsPrefix)
+	for key := range req.Header {
+		if strings.HasPrefix(http.CanonicalHeaderKey(key), prefix) {
+			logw("Client tried to set a claim header on an anonymous request (removing it)", "request", requestID(req), "header", key)
+			req.Header.Del(key)
+		}
+	}
+}
+
+// globToRegexp converts a path glob to an anchored regular expression.
+func globToRegexp(glob string) *regexp.Regexp {
+	var pattern strings.Builder
+	pattern.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		switch {
+		case strings.HasPrefix(glob[i:], "**"):
+			pattern.WriteString(".*")
+			i++
+		case glob[i] == '*':
+			pattern.WriteString("[^/]*")
+		case glob[i] == '?':
+			pattern.WriteString("[^/]")
+		default:
+			pattern.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		}
+	}
+	pattern.WriteString("$")
+	return regexp.MustCompile(pattern.String())
+}
+
+func anyMatch(regexes []*regexp.Regexp, value string) bool {
+	for _, regex := range regexes {
+		if regex.MatchString(value) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,60 @@
+package traefikgothauth
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPublicRules(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.CookieSecret = "secret-for-testing-only"
+	cfg.PublicRules = []*PublicRule{
+		{Paths: []string{"/health", "/*.ico", "/static/**"}, Methods: []string{"GET", "HEAD"}},
+		{Methods: []string{"OPTIONS"}},
+		{PathRegex: "^/hooks/[a-z]+$", Headers: map[string]string{"X-Hub-Signature-256": "^sha256="}},
+		{Paths: []string{"/blog/**"}, Optional: true},
+	}
+	cfg.Providers = []*ProviderConfig{{
+		Name:        "local",
+		RedirectURI: "http://example.com/__goth/local/",
+		Custom:      map[string]interface{}{"users": map[string]interface{}{}},
+	}}
+	handler, err := New(context.Background(), http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_, _ = rw.Write([]byte("user=" + req.Header.Get("X-Auth-User-Id")))
+	}), cfg, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, test := range map[string]struct {
+		method, path string
+		headers      map[string]string
+		public       bool
+	}{
+		"health":               {method: "GET", path: "/health", public: true},
+		"health post":          {method: "POST", path: "/health"},
+		"favicon":              {method: "GET", path: "/favicon.ico", public: true},
+		"nested ico":           {method: "GET", path: "/private/favicon.ico"},
+		"static":               {method: "HEAD", path: "/static/js/app.js", public: true},
+		"static traversal":     {method: "GET", path: "/static/../admin"},
+		"preflight":            {method: "OPTIONS", path: "/api/users", public: true},
+		"signed webhook":       {method: "POST", path: "/hooks/github", headers: map[string]string{"X-Hub-Signature-256": "sha256=abc"}, public: true},
+		"unsigned webhook":     {method: "POST", path: "/hooks/github"},
+		"optional anonymous":   {method: "GET", path: "/blog/post", public: true},
+		"spoofed claim header": {method: "GET", path: "/blog/post", headers: map[string]string{"X-Auth-User-Id": "admin"}, public: true},
+		"private":              {method: "GET", path: "/admin"},
+	} {
+		req := httptest.NewRequest(test.method, "http://example.com"+test.path, nil)
+		for header, value := range test.headers {
+			req.Header.Set(header, value)
+		}
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, req)
+		if test.public && (rw.Code != http.StatusOK || rw.Body.String() != "user=") {
+			t.Errorf("%s: expected an anonymous request, got %d: %s", name, rw.Code, rw.Body.String())
+		} else if !test.public && rw.Code == http.StatusOK {
+			t.Errorf("%s: expected authentication to be required", name)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package traefikgothauth
+
+import (
+	"fmt"
+	"github.com/markbates/goth"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// maxHostProviders limits the providers created for the hosts of a templated RedirectURI, as each of them may be
+// expensive to create (e.g. OIDC discovery) and wildcard RedirectHosts allow any number of hosts.
+const maxHostProviders = 100
+
+// templatedProviders are the providers with a RedirectURI template, by name. Their goth provider depends on the host
+// of each request, so they are looked up here before the goth registry.
+var templatedProviders = struct {
+	sync.RWMutex
+	byName map[string]*ProviderConfig
+}{byName: map[string]*ProviderConfig{}}
+
+// parseRedirectTemplate detects RedirectURI templates: paths or URLs with the {scheme} and {host} placeholders. It
+// returns the template (or "" for normal URIs) and an example URI to validate it. The {host} has no port, so that
+// clients can not create a provider for each port they send in the Host header.
+func parseRedirectTemplate(redirectURI string) (string, string) {
+	if strings.HasPrefix(redirectURI, "/") {
+		redirectURI = "{scheme}://{host}" + redirectURI
+	}
+	if !strings.Contains(redirectURI, "{scheme}") && !strings.Contains(redirectURI, "{host}") {
+		return "", redirectURI
+	}
+	return redirectURI, strings.NewReplacer("{scheme}", "https", "{host}", "localhost").Replace(redirectURI)
+}
+
+// gothProvider returns the goth provider with the given name that handles the request.
+func gothProvider(req *http.Request, name string) (goth.Provider, error) {
+	templatedProviders.RLock()
+	providerConfig, ok := templatedProviders.byName[name]
+	templatedProviders.RUnlock()
+	if ok {
+		return providerConfig.providerForHost(req)
+	}
+	return goth.GetProvider(name)
+}
+
+// providerForHost returns the goth provider whose callback is on the host of the request, creating it on first use.
+// Hosts that are not allowed are rejected, so that the providers never send codes to an attacker's domain.
+func (providerConfig *ProviderConfig) providerForHost(req *http.Request) (goth.Provider, error) {
+	if providerConfig.redirectTemplate == "" {
+		return providerConfig.provider, nil
+	}
+	host, _ := requestHostAndPath(req)
+	if !matchHostsAndPaths(providerConfig.redirectHosts, nil, host, "/") {
+		return nil, fmt.Errorf("host %s is not allowed by RedirectHosts", req.Host)
+	}
+	callback := strings.NewReplacer("{scheme}", requestScheme(req), "{host}", host).Replace(providerConfig.redirectTemplate)
+	providerConfig.hostProvidersLock.Lock()
+	defer providerConfig.hostProvidersLock.Unlock()
+	if provider, ok := providerConfig.hostProviders[callback]; ok {
+		return provider, nil
+	}
+	if len(providerConfig.hostProviders) >= maxHostProviders {
+		return nil, fmt.Errorf("too many hosts for this provider (%d), not adding %s", maxHostProviders, host)
+	}
+	provider, err := providerConfig.info.New(providerConfig.httpClient, providerConfig.ClientKey, providerConfig.Secret, callback, providerConfig.Custom, providerConfig.Scopes...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create provider for %s: %w", callback, err)
+	}
+	provider.SetName(providerConfig.Name)
+	setProviderHTTPClient(provider, providerConfig.httpClient)
+	// Failed logins are limited across all the hosts
+	if hostForm, ok := provider.(interface{ form() *formProvider }); ok {
+		if baseForm, ok := providerConfig.provider.(interface{ form() *formProvider }); ok {
+			hostForm.form().limiter = baseForm.form().limiter
+		}
+	}
+	if providerConfig.hostProviders == nil {
+		providerConfig.hostProviders = map[string]goth.Provider{}
+	}
+	providerConfig.hostProviders[callback] = provider
+	logd("Created provider for host", "request", requestID(req), "provider", providerConfig.Name, "callback", callback)
+	return provider, nil
+}
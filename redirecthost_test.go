@@ -0,0 +1,81 @@
+package traefikgothauth
+
+import (
+	"context"
+	"golang.org/x/crypto/bcrypt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestRedirectURITemplate(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var handler http.Handler
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		handler.ServeHTTP(rw, req)
+	}))
+	defer server.Close()
+	_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	cfg := CreateConfig()
+	cfg.CookieSecret = "secret-for-testing-only"
+	cfg.RedirectHosts = []string{"*.example.test"}
+	cfg.Providers = []*ProviderConfig{
+		{Name: "local", RedirectURI: "http://{host}:" + port + "/__goth/local/", Custom: map[string]interface{}{"users": map[string]interface{}{"alice": string(hash)}}},
+		{Name: "github", ClientKey: "key", Secret: "secret", RedirectURI: "https://{host}/__goth/github/"},
+	}
+	handler, err = New(context.Background(), http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_, _ = rw.Write([]byte("hello " + req.Header.Get("X-Auth-User-Id") + " at " + req.Host))
+	}), cfg, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The OAuth2 callback follows the host of the request
+	for _, host := range []string{"a.example.test", "b.example.test"} {
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "http://"+host+"/__goth/github/login/", nil))
+		location, _ := url.Parse(rw.Header().Get("Location"))
+		if location == nil || location.Query().Get("redirect_uri") != "https://"+host+"/__goth/github/" {
+			t.Fatalf("%s: expected the callback of the host, got %d to %s", host, rw.Code, rw.Header().Get("Location"))
+		}
+	}
+	for _, hostPort := range []string{"a.example.test:1", "a.example.test:2"} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://"+hostPort+"/__goth/github/login/", nil))
+	}
+	if hostProviders := len(cfg.Providers[1].hostProviders); hostProviders != 2 {
+		t.Fatalf("expected one provider per host whatever the port, got %d", hostProviders)
+	}
+	rw := httptest.NewRecorder()
+	handler.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "http://evil.test/__goth/github/login/", nil))
+	if rw.Code != http.StatusBadRequest {
+		t.Fatalf("expected a host that is not allowed to be rejected, got %d to %s", rw.Code, rw.Header().Get("Location"))
+	}
+
+	// The local login works on any allowed host
+	jar, _ := cookiejar.New(nil)
+	client := &http.Client{Jar: jar, Transport: &http.Transport{DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, network, server.Listener.Addr().String())
+	}}}
+	read := func(res *http.Response, err error) (*http.Response, string) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(res.Body)
+		_ = res.Body.Close()
+		return res, string(body)
+	}
+	res, _ := read(client.Get("http://c.example.test:" + port + "/__goth/local/login/"))
+	res, body := read(client.PostForm(res.Request.URL.String(), url.Values{
+		"state": {res.Request.URL.Query().Get("state")}, "username": {"alice"}, "password": {"hunter2"},
+	}))
+	if body != "hello alice at c.example.test:"+port {
+		t.Fatalf("expected to log in on the host, got %s at %s", body, res.Request.URL)
+	}
+}
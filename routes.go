@@ -0,0 +1,111 @@
+package traefikgothauth
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// RouteRule restricts the providers accepted for some hosts or paths, e.g. /admin only with the corporate provider.
+// A request must match one of the Hosts (if any) and one of the PathPrefixes (if any).
+type RouteRule struct {
+	// Hosts (optional) are the hosts of the rule, without port. A leading "*." matches any subdomain.
+	Hosts []string
+	// PathPrefixes (optional) are the path prefixes of the rule, matched on whole segments ("/admin" matches
+	// "/admin/users" but not "/administrator").
+	PathPrefixes []string
+	// Providers are the names of the providers accepted for the matching requests, including "client-cert" for
+	// ClientCert. The chooser page only lists these.
+	Providers []string
+}
+
+func (r *RouteRule) setup(c *Config) error {
+	var errs []error
+	if len(r.Hosts) == 0 && len(r.PathPrefixes) == 0 {
+		errs = append(errs, errors.New("at least one host or path prefix is required"))
+	}
+	if len(r.Providers) == 0 {
+		errs = append(errs, errors.New("at least one provider is required"))
+	}
+	for _, name := range r.Providers {
+		found := name == clientCertProviderName && c.ClientCert != nil
+		for _, providerConfig := range c.Providers {
+			found = found || providerConfig.Name == name
+		}
+		if !found {
+			errs = append(errs, fmt.Errorf("provider %s is not configured", name))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (r *RouteRule) matches(host, cleanPath string) bool {
+	return matchHostsAndPaths(r.Hosts, r.PathPrefixes, host, cleanPath)
+}
+
+// allows returns true if the provider is accepted by the rule. A nil rule accepts all the providers.
+func (r *RouteRule) allows(providerName string) bool {
+	if r == nil {
+		return true
+	}
+	for _, name := range r.Providers {
+		if name == providerName {
+			return true
+		}
+	}
+	return false
+}
+
+// route returns the first rule that matches the request, or nil if all the providers are accepted.
+func (c *Config) route(req *http.Request) *RouteRule {
+	host, cleanPath := requestHostAndPath(req)
+	for _, rule := range c.Routes {
+		if rule.matches(host, cleanPath) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// requestHostAndPath returns the host (without port) and path of the request to match against rules.
+func requestHostAndPath(req *http.Request) (string, string) {
+	host := strings.ToLower(req.Host)
+	if hostWithoutPort, _, err := net.SplitHostPort(host); err == nil {
+		host = hostWithoutPort
+	}
+	// Match what the next handler will most likely see (e.g. "/public/../admin" is "/admin").
+	return host, path.Clean("/" + req.URL.Path)
+}
+
+// matchHostsAndPaths returns true if the host matches one of the hosts (if any) and the path one of the prefixes (if
+// any). A leading "*." matches any subdomain and prefixes are matched on whole segments.
+func matchHostsAndPaths(hosts, pathPrefixes []string, host, cleanPath string) bool {
+	if len(hosts) > 0 {
+		found := false
+		for _, ruleHost := range hosts {
+			ruleHost = strings.ToLower(ruleHost)
+			if suffix, ok := strings.CutPrefix(ruleHost, "*"); ok {
+				found = found || strings.HasSuffix(host, suffix)
+			} else {
+				found = found || host == ruleHost
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(pathPrefixes) > 0 {
+		found := false
+		for _, prefix := range pathPrefixes {
+			prefix = strings.TrimSuffix(prefix, "/")
+			found = found || prefix == "" || cleanPath == prefix || strings.HasPrefix(cleanPath, prefix+"/")
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
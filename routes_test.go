@@ -0,0 +1,94 @@
+package traefikgothauth
+
+import (
+	"context"
+	"golang.org/x/crypto/bcrypt"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRoutes(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var handler http.Handler
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		handler.ServeHTTP(rw, req)
+	}))
+	defer server.Close()
+	cfg := CreateConfig()
+	cfg.CookieSecret = "secret-for-testing-only"
+	auditFile := filepath.Join(t.TempDir(), "audit.log")
+	cfg.Audit = &AuditConfig{File: auditFile}
+	cfg.Routes = []*RouteRule{
+		{PathPrefixes: []string{"/admin"}, Providers: []string{"github"}},
+		{PathPrefixes: []string{"/community/"}, Providers: []string{"local", "gitlab"}},
+	}
+	cfg.Providers = []*ProviderConfig{
+		{Name: "local", RedirectURI: server.URL + "/__goth/local/", Custom: map[string]interface{}{"users": map[string]interface{}{"alice": string(hash)}}},
+		{Name: "github", ClientKey: "key", Secret: "secret", RedirectURI: server.URL + "/__goth/github/"},
+		{Name: "gitlab", ClientKey: "key", Secret: "secret", RedirectURI: server.URL + "/__goth/gitlab/"},
+	}
+	handler, err = New(context.Background(), http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_, _ = rw.Write([]byte("hello " + req.Header.Get("X-Auth-User-Id")))
+	}), cfg, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { auditCurrent = nil }()
+	jar, _ := cookiejar.New(nil)
+	client := &http.Client{Jar: jar, CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if req.URL.Host != strings.TrimPrefix(server.URL, "http://") {
+			return http.ErrUseLastResponse // Do not contact the real providers
+		}
+		return nil
+	}}
+	get := func(path string) (*http.Response, string) {
+		res, err := client.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(res.Body)
+		_ = res.Body.Close()
+		return res, string(body)
+	}
+
+	// The chooser only lists the providers of the route
+	if _, body := get("/community/forum"); !strings.Contains(body, "/__goth/local/login/") || !strings.Contains(body, "/__goth/gitlab/login/") || strings.Contains(body, "/__goth/github/login/") {
+		t.Fatalf("expected the chooser to list local and gitlab only: %s", body)
+	}
+	if _, body := get("/other"); !strings.Contains(body, "/__goth/github/login/") {
+		t.Fatalf("expected the chooser to list all the providers: %s", body)
+	}
+	// A single provider is used directly, even through path tricks
+	for _, path := range []string{"/admin/users", "/community/../admin"} {
+		if res, _ := get(path); res.StatusCode != http.StatusTemporaryRedirect || !strings.HasPrefix(res.Header.Get("Location"), "https://github.com/") {
+			t.Fatalf("%s: expected a redirect to github, got %d to %s", path, res.StatusCode, res.Header.Get("Location"))
+		}
+	}
+
+	// A local session is accepted for the community, but not for the admin
+	res, _ := get("/__goth/local/login/")
+	res, err = client.PostForm(res.Request.URL.String(), url.Values{"state": {res.Request.URL.Query().Get("state")}, "username": {"alice"}, "password": {"hunter2"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = res.Body.Close()
+	if _, body := get("/community/forum"); body != "hello alice" {
+		t.Fatalf("expected the local session to be accepted, got %s", body)
+	}
+	if res, _ = get("/admin"); res.StatusCode != http.StatusTemporaryRedirect || !strings.HasPrefix(res.Header.Get("Location"), "https://github.com/") {
+		t.Fatalf("expected the local session to be rejected, got %d", res.StatusCode)
+	}
+	if events, _ := os.ReadFile(auditFile); !strings.Contains(string(events), `"event":"denied","provider":"local","user":"alice","admin":"","reason":"provider not accepted for this route"`) {
+		t.Fatalf("expected the rejected session to be audited: %s", events)
+	}
+}
@@ -0,0 +1,127 @@
+package traefikgothauth
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gorilla/sessions"
+	"github.com/markbates/goth/gothic"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// authTimeSessionName is the cookie that records when the user logged in with each provider, and their last activity.
+const authTimeSessionName = "_gothic_auth_time"
+
+// SessionConfig limits the lifetime of the sessions beyond CookieOptions.MaxAge, forcing the users to log in again.
+type SessionConfig struct {
+	// IdleTimeout (optional) expires the sessions without any request for this long, e.g. "30m". Activity renews the
+	// session cookies, so CookieOptions.MaxAge should not be shorter.
+	IdleTimeout string
+	// MaxLifetime (optional) expires the sessions this long after the login, even if they are active, e.g. "12h".
+	MaxLifetime string
+	idleTimeout time.Duration
+	maxLifetime time.Duration
+}
+
+func (c *SessionConfig) setup(cookieOptions *sessions.Options) error {
+	var errs []error
+	var err error
+	if c.idleTimeout, err = parseDurationDefault(c.IdleTimeout, 0); err != nil {
+		errs = append(errs, fmt.Errorf("session: failed to parse IdleTimeout: %w", err))
+	}
+	if c.maxLifetime, err = parseDurationDefault(c.MaxLifetime, 0); err != nil {
+		errs = append(errs, fmt.Errorf("session: failed to parse MaxLifetime: %w", err))
+	}
+	if c.idleTimeout <= 0 && c.maxLifetime <= 0 {
+		errs = append(errs, errors.New("session: IdleTimeout or MaxLifetime is required"))
+	}
+	if cookieOptions.MaxAge > 0 && time.Duration(cookieOptions.MaxAge)*time.Second < c.idleTimeout {
+		logw("CookieOptions.MaxAge is shorter than the session IdleTimeout, idle sessions will expire sooner", "maxAge", cookieOptions.MaxAge, "idleTimeout", c.idleTimeout)
+	}
+	return errors.Join(errs...)
+}
+
+// expired returns true if the session with the provider has been idle or alive for too long. Otherwise, it renews the
+// session cookies as the user is active.
+func (c *SessionConfig) expired(rw http.ResponseWriter, req *http.Request, providerName, userID string) bool {
+	session, _ := gothic.Store.Get(req, authTimeSessionName)
+	loginTime, loginOK := sessionTime(session, providerName, userID)
+	lastActivity, activityOK := sessionTime(session, "activity:"+providerName, userID)
+	now := time.Now()
+	if c.maxLifetime > 0 && (!loginOK || now.Sub(loginTime) > c.maxLifetime) {
+		logi("Session reached its maximum lifetime", "request", requestID(req), "provider", providerName, "user", userID, "login", loginTime)
+		audit(req, auditSessionExpired, providerName, userID, "maximum lifetime")
+		return true
+	}
+	if c.idleTimeout <= 0 {
+		return false
+	}
+	if !activityOK || now.Sub(lastActivity) > c.idleTimeout {
+		logi("Session expired after inactivity", "request", requestID(req), "provider", providerName, "user", userID, "lastActivity", lastActivity)
+		audit(req, auditSessionExpired, providerName, userID, "idle timeout")
+		return true
+	}
+	// Renewing the cookies on every request would be wasteful, a tenth of the timeout is precise enough.
+	if now.Sub(lastActivity) > c.idleTimeout/10 {
+		setSessionTime(session, "activity:"+providerName, userID, now)
+		gothicSession, _ := gothic.Store.Get(req, gothic.SessionName)
+		if err := errors.Join(session.Save(req, rw), gothicSession.Save(req, rw)); err != nil {
+			logw("Could not renew the session", "request", requestID(req), "provider", providerName, "error", err)
+		}
+	}
+	return false
+}
+
+// recordAuthTime remembers when the user logged in with the provider, and that they are active. Only verified login
+// times (see providerAuthTime) satisfy the step-up rules.
+func recordAuthTime(rw http.ResponseWriter, req *http.Request, providerName, userID string, loginTime time.Time, verified bool) error {
+	session, _ := gothic.Store.Get(req, authTimeSessionName)
+	setSessionTime(session, providerName, userID, loginTime)
+	setSessionTime(session, "activity:"+providerName, userID, time.Now())
+	if verified {
+		setSessionTime(session, "verified:"+providerName, userID, loginTime)
+	} else {
+		delete(session.Values, "verified:"+providerName)
+	}
+	return session.Save(req, rw)
+}
+
+// authUserID returns the user that logged in with the provider, if it was recorded.
+func authUserID(req *http.Request, providerName string) string {
+	session, _ := gothic.Store.Get(req, authTimeSessionName)
+	value, _ := session.Values[providerName].(string)
+	userID, _, _ := strings.Cut(value, "\x00")
+	return userID
+}
+
+// authTime returns when the user logged in with the provider, if it was recorded.
+func authTime(req *http.Request, providerName, userID string) (time.Time, bool) {
+	session, _ := gothic.Store.Get(req, authTimeSessionName)
+	return sessionTime(session, providerName, userID)
+}
+
+// verifiedAuthTime returns when the user logged in with the provider, if it was recorded and verified.
+func verifiedAuthTime(req *http.Request, providerName, userID string) (time.Time, bool) {
+	session, _ := gothic.Store.Get(req, authTimeSessionName)
+	return sessionTime(session, "verified:"+providerName, userID)
+}
+
+func setSessionTime(session *sessions.Session, key, userID string, t time.Time) {
+	session.Values[key] = userID + "\x00" + strconv.FormatInt(t.UnixMilli(), 10)
+}
+
+// sessionTime returns the time recorded for the user, ignoring the ones of other users.
+func sessionTime(session *sessions.Session, key, userID string) (time.Time, bool) {
+	value, _ := session.Values[key].(string)
+	recordedUserID, unixMilli, ok := strings.Cut(value, "\x00")
+	if !ok || recordedUserID != userID {
+		return time.Time{}, false
+	}
+	milliseconds, err := strconv.ParseInt(unixMilli, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.UnixMilli(milliseconds), true
+}
@@ -0,0 +1,75 @@
+package traefikgothauth
+
+import (
+	"context"
+	"golang.org/x/crypto/bcrypt"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestSessionLifetime(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var handler http.Handler
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		handler.ServeHTTP(rw, req)
+	}))
+	defer server.Close()
+	cfg := CreateConfig()
+	cfg.CookieSecret = "secret-for-testing-only"
+	cfg.Session = &SessionConfig{IdleTimeout: "500ms", MaxLifetime: "1200ms"}
+	cfg.Providers = []*ProviderConfig{{
+		Name:        "local",
+		RedirectURI: server.URL + "/__goth/local/",
+		Custom:      map[string]interface{}{"users": map[string]interface{}{"alice": string(hash)}},
+	}}
+	handler, err = New(context.Background(), http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_, _ = rw.Write([]byte("hello " + req.Header.Get("X-Auth-User-Id")))
+	}), cfg, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	jar, _ := cookiejar.New(nil)
+	client := &http.Client{Jar: jar}
+	read := func(res *http.Response, err error) (*http.Response, string) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(res.Body)
+		_ = res.Body.Close()
+		return res, string(body)
+	}
+	login := func() {
+		res, _ := read(client.Get(server.URL + "/private"))
+		if res.Request.URL.Path != "/__goth/local/form/" {
+			t.Fatalf("expected the login form, got %s", res.Request.URL)
+		}
+		if _, body := read(client.PostForm(res.Request.URL.String(), url.Values{
+			"state": {res.Request.URL.Query().Get("state")}, "username": {"alice"}, "password": {"hunter2"},
+		})); body != "hello alice" {
+			t.Fatalf("expected to log in, got %s", body)
+		}
+	}
+
+	// Activity keeps the session alive, until its maximum lifetime
+	login()
+	for i := 0; i < 3; i++ {
+		time.Sleep(300 * time.Millisecond)
+		if _, body := read(client.Get(server.URL + "/private")); body != "hello alice" {
+			t.Fatalf("expected the active session to be renewed (%d), got %s", i, body)
+		}
+	}
+	time.Sleep(400 * time.Millisecond)
+	login()
+
+	// Inactivity expires the session
+	time.Sleep(600 * time.Millisecond)
+	login()
+}
@@ -0,0 +1,324 @@
+package traefikgothauth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/markbates/goth"
+	"github.com/markbates/goth/gothic"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ssoAuthorizePath = "/__goth/sso/authorize"
+	ssoCallbackPath  = "/__goth/sso/callback"
+	ssoSessionName   = "_gothic_sso"
+	// ssoNonceSessionName is the cookie that binds the codes to the browser that started the login.
+	ssoNonceSessionName = "_gothic_sso_nonce"
+	ssoNonceTTL         = time.Hour
+)
+
+// SSOConfig shares the logins of a central auth host with other hosts, even in unrelated domains. Only the auth host
+// needs to be registered at the providers (RedirectURI), and its provider sessions are the only real ones.
+//
+// Other hosts redirect to the auth host, which (once the user is logged in) sends back a single-use code that creates
+// a session for the original host. The middleware must be used for the auth host too, with the same configuration.
+//
+// The codes only work in the browser that started the login. They are single-use within each Traefik instance: with
+// several replicas, a code may be redeemed once at each of them during its CodeTTL.
+type SSOConfig struct {
+	// AuthURL is the base URL of the auth host, e.g. "https://auth.example.com".
+	AuthURL string
+	// AllowedHosts are the hosts that may receive the logins, without port. A leading "*." matches any subdomain, e.g.
+	// ["*.example.com", "app.example.org"].
+	AllowedHosts []string
+	// CodeTTL (optional) is the lifetime of the codes sent back to the hosts, e.g. "1m" (default).
+	CodeTTL string
+	authURL *url.URL
+	codeTTL time.Duration
+	codeKey []byte
+}
+
+// ssoGrant is the identity shared with a host.
+type ssoGrant struct {
+	Provider  string
+	UserID    string
+	Claims    map[string]interface{}
+	LoginTime time.Time
+	// Verified is true if the provider proved the LoginTime, so that it satisfies the step-up rules.
+	Verified bool
+}
+
+// ssoCode is the value of the single-use codes sent back to the hosts.
+type ssoCode struct {
+	ID     string
+	Return string
+	// Nonce is the nonce of the browser of the original host, so that nobody else can use the code.
+	Nonce string
+	Grant *ssoGrant
+}
+
+func (c *SSOConfig) setup(cookieSecret string) error {
+	var errs []error
+	var err error
+	if c.authURL, err = url.Parse(c.AuthURL); err != nil || c.authURL.Host == "" || (c.authURL.Scheme != "http" && c.authURL.Scheme != "https") {
+		errs = append(errs, fmt.Errorf("sso: AuthURL must be an absolute http(s) URL: %s", c.AuthURL))
+	}
+	if len(c.AllowedHosts) == 0 {
+		errs = append(errs, errors.New("sso: AllowedHosts is required"))
+	}
+	if cookieSecret == "" {
+		errs = append(errs, errors.New("sso: CookieSecret is required, as it signs the codes for the other hosts"))
+	}
+	if c.codeTTL, err = parseDurationDefault(c.CodeTTL, time.Minute); err != nil {
+		errs = append(errs, fmt.Errorf("sso: failed to parse CodeTTL: %w", err))
+	}
+	c.codeKey = signingKey(cookieSecret, "sso-code")
+	return errors.Join(errs...)
+}
+
+// isAuthHost returns true if the request is for the central auth host.
+func (c *SSOConfig) isAuthHost(req *http.Request) bool {
+	return strings.EqualFold(req.Host, c.authURL.Host)
+}
+
+// authorizeRoute restricts the providers of an authorization request to the ones accepted by the original host.
+func (c *SSOConfig) authorizeRoute(req *http.Request, route *RouteRule) *RouteRule {
+	if req.URL.Path != ssoAuthorizePath || req.URL.Query().Get("providers") == "" {
+		return route
+	}
+	restricted := &RouteRule{}
+	for _, name := range strings.Split(req.URL.Query().Get("providers"), ",") {
+		if route.allows(name) {
+			restricted.Providers = append(restricted.Providers, name)
+		}
+	}
+	return restricted
+}
+
+// authorizeMaxAge returns the maximum age of the login requested by the original host, or 0.
+func (c *SSOConfig) authorizeMaxAge(req *http.Request) time.Duration {
+	if req.URL.Path != ssoAuthorizePath {
+		return 0
+	}
+	seconds, err := strconv.Atoi(req.URL.Query().Get("max_age"))
+	if err != nil || seconds <= 0 {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// serveAuthorize sends the authenticated user back to the original host with a code, returning true if it handled
+// the request.
+func (c *SSOConfig) serveAuthorize(rw http.ResponseWriter, req *http.Request, providerName string, auth *goth.User) bool {
+	if req.URL.Path != ssoAuthorizePath {
+		return false
+	}
+	returnURL, err := url.Parse(req.URL.Query().Get("return"))
+	if err != nil || (returnURL.Scheme != "http" && returnURL.Scheme != "https") || !c.allowedHost(returnURL.Host) {
+		logw("Invalid SSO return URL", "request", requestID(req), "provider", providerName, "return", req.URL.Query().Get("return"), "remote", req.RemoteAddr)
+		http.Error(rw, "Invalid return URL", http.StatusBadRequest)
+		return true
+	}
+	nonce := req.URL.Query().Get("nonce")
+	if nonce == "" {
+		logw("Missing SSO nonce", "request", requestID(req), "provider", providerName, "remote", req.RemoteAddr)
+		http.Error(rw, "Invalid login request", http.StatusBadRequest)
+		return true
+	}
+	loginTime, ok := authTime(req, providerName, auth.UserID)
+	if !ok {
+		loginTime = time.Now()
+	}
+	verifiedTime, verified := verifiedAuthTime(req, providerName, auth.UserID)
+	verified = verified && verifiedTime.Equal(loginTime)
+	code, err := signToken(c.codeKey, "sso-code", c.codeTTL, &ssoCode{
+		ID:     randomString(16),
+		Return: returnURL.String(),
+		Nonce:  nonce,
+		Grant:  &ssoGrant{Provider: providerName, UserID: auth.UserID, Claims: auth.RawData, LoginTime: loginTime, Verified: verified},
+	})
+	if err != nil {
+		loge("Failed to sign SSO code", "request", requestID(req), "error", err)
+		http.Error(rw, "Failed to sign in", http.StatusInternalServerError)
+		return true
+	}
+	callbackURL := url.URL{Scheme: returnURL.Scheme, Host: returnURL.Host, Path: ssoCallbackPath, RawQuery: url.Values{"code": {code}}.Encode()}
+	logd("Sending SSO login", "request", requestID(req), "provider", providerName, "user", auth.UserID, "host", returnURL.Host)
+	http.Redirect(rw, req, callbackURL.String(), http.StatusTemporaryRedirect)
+	return true
+}
+
+func (c *SSOConfig) allowedHost(hostWithPort string) bool {
+	host := strings.ToLower(hostWithPort)
+	if hostWithoutPort, _, err := net.SplitHostPort(host); err == nil {
+		host = hostWithoutPort
+	}
+	return host != "" && matchHostsAndPaths(c.AllowedHosts, nil, host, "/")
+}
+
+// session returns the identity received from the auth host, if any.
+func (c *SSOConfig) session(req *http.Request) *ssoGrant {
+	session, _ := gothic.Store.Get(req, ssoSessionName)
+	value, _ := session.Values["grant"].(string)
+	if value == "" {
+		return nil
+	}
+	grant := &ssoGrant{}
+	if err := json.Unmarshal([]byte(value), grant); err != nil {
+		logw("Invalid SSO session", "request", requestID(req), "error", err)
+		return nil
+	}
+	return grant
+}
+
+// serveCallback creates the session of this host from a code of the auth host, registering it if there is a registry.
+func (c *SSOConfig) serveCallback(rw http.ResponseWriter, req *http.Request, registry *sessionRegistry) {
+	code := &ssoCode{}
+	err := verifyToken(c.codeKey, "sso-code", req.URL.Query().Get("code"), code)
+	var returnURL *url.URL
+	if err == nil {
+		if returnURL, err = url.Parse(code.Return); err == nil && !strings.EqualFold(returnURL.Host, req.Host) {
+			err = errors.New("code issued for another host")
+		}
+	}
+	if nonce := c.nonce(req); err == nil && (nonce == "" || nonce != code.Nonce) {
+		err = errors.New("code issued for another browser")
+	}
+	if err == nil && !consumeToken("sso-code:"+code.ID, time.Now().Add(c.codeTTL)) {
+		err = errors.New("code already used")
+	}
+	if err != nil {
+		logw("Invalid SSO code", "request", requestID(req), "remote", req.RemoteAddr, "error", err)
+		audit(req, auditLoginFailure, "", "", "invalid SSO code: "+err.Error())
+		http.Error(rw, "Invalid or expired login, please try again", http.StatusBadRequest)
+		return
+	}
+	grantJSON, err := json.Marshal(code.Grant)
+	if err == nil && registry != nil {
+		email, _ := code.Grant.Claims["email"].(string)
+		name, _ := code.Grant.Claims["name"].(string)
+		user := &goth.User{UserID: code.Grant.UserID, Email: email, Name: name, RawData: code.Grant.Claims}
+		err = registry.register(req, ssoSessionKey(code.Grant.Provider), code.Grant.Provider, user)
+	}
+	if err == nil {
+		session, _ := gothic.Store.Get(req, ssoSessionName)
+		session.Values["grant"] = string(grantJSON)
+		err = errors.Join(session.Save(req, rw), recordAuthTime(rw, req, ssoSessionKey(code.Grant.Provider), code.Grant.UserID, code.Grant.LoginTime, code.Grant.Verified))
+	}
+	if err != nil {
+		loge("Failed to save the SSO session", "request", requestID(req), "error", err)
+		http.Error(rw, "Failed to save the session", http.StatusInternalServerError)
+		return
+	}
+	logi("User logged in through SSO", "request", requestID(req), "provider", code.Grant.Provider, "user", code.Grant.UserID, "redirect", returnURL.RequestURI())
+	audit(req, auditLogin, code.Grant.Provider, code.Grant.UserID, "sso")
+	http.Redirect(rw, req, returnURL.RequestURI(), http.StatusTemporaryRedirect)
+}
+
+// redirectToAuthHost sends the user to the auth host to log in, asking for the providers of the route and a recent
+// enough login.
+func (c *SSOConfig) redirectToAuthHost(rw http.ResponseWriter, req *http.Request, route *RouteRule, maxAge time.Duration) {
+	nonce := c.nonce(req)
+	if nonce == "" { // Reused while valid, so that logins started in several tabs all work
+		nonce = randomString(16)
+		session, _ := gothic.Store.Get(req, ssoNonceSessionName)
+		session.Values["nonce"] = nonce + "\x00" + strconv.FormatInt(time.Now().Add(ssoNonceTTL).Unix(), 10)
+		if err := session.Save(req, rw); err != nil {
+			loge("Failed to save the SSO nonce", "request", requestID(req), "error", err)
+			http.Error(rw, "Failed to sign in", http.StatusInternalServerError)
+			return
+		}
+	}
+	query := url.Values{"return": {requestBaseURL(req) + req.RequestURI}, "nonce": {nonce}}
+	if route != nil {
+		query.Set("providers", strings.Join(route.Providers, ","))
+	}
+	if maxAge > 0 {
+		query.Set("max_age", strconv.Itoa(int(maxAge.Seconds())))
+	}
+	authorizeURL := c.authURL.ResolveReference(&url.URL{Path: ssoAuthorizePath, RawQuery: query.Encode()})
+	logd("Redirecting to the SSO auth host", "request", requestID(req), "url", authorizeURL.String())
+	http.Redirect(rw, req, authorizeURL.String(), http.StatusTemporaryRedirect)
+}
+
+// nonce returns the unexpired nonce of the browser, or "".
+func (c *SSOConfig) nonce(req *http.Request) string {
+	session, _ := gothic.Store.Get(req, ssoNonceSessionName)
+	value, _ := session.Values["nonce"].(string)
+	nonce, expires, _ := strings.Cut(value, "\x00")
+	if unix, err := strconv.ParseInt(expires, 10, 64); err != nil || time.Now().Unix() > unix {
+		return ""
+	}
+	return nonce
+}
+
+// serveSSOHost authenticates the requests of the hosts other than the auth host.
+func (o *Plugin) serveSSOHost(rw http.ResponseWriter, req *http.Request, route *RouteRule, publicRule *PublicRule) {
+	c := o.config.SSO
+	var registry *sessionRegistry
+	if o.config.Admin != nil {
+		registry = o.config.Admin.registry
+	}
+	if req.URL.Path == ssoCallbackPath {
+		c.serveCallback(rw, req, registry)
+		return
+	}
+	for _, providerConfig := range o.config.Providers {
+		if req.URL.Path == providerConfig.logoutURI.Path {
+			// Log out here and at the auth host, so that the next login is not automatic.
+			if grant := c.session(req); grant != nil {
+				audit(req, auditLogout, grant.Provider, grant.UserID, "sso")
+				if registry != nil {
+					registry.end(req, ssoSessionKey(grant.Provider))
+				}
+			}
+			session, _ := gothic.Store.Get(req, ssoSessionName)
+			session.Options.MaxAge = -1
+			if err := session.Save(req, rw); err != nil {
+				logw("Could not delete the SSO session", "request", requestID(req), "error", err)
+			}
+			http.Redirect(rw, req, c.authURL.ResolveReference(&url.URL{Path: req.URL.Path}).String(), http.StatusTemporaryRedirect)
+			return
+		}
+	}
+	grant := c.session(req)
+	if grant != nil && !route.allows(grant.Provider) {
+		logd("Provider not accepted for this route", "request", requestID(req), "provider", grant.Provider, "path", req.URL.Path)
+		audit(req, auditDenied, grant.Provider, grant.UserID, "provider not accepted for this route")
+		grant = nil
+	}
+	if grant != nil && registry != nil && !registry.active(req, ssoSessionKey(grant.Provider), grant.UserID) {
+		grant = nil
+	}
+	if grant != nil && o.config.Session != nil && o.config.Session.expired(rw, req, ssoSessionKey(grant.Provider), grant.UserID) {
+		grant = nil
+	}
+	maxAge := o.config.maxAuthAge(req)
+	if grant != nil && maxAge > 0 && (!grant.Verified || time.Since(grant.LoginTime) > maxAge) {
+		logi("Recent login required", "request", requestID(req), "provider", grant.Provider, "user", grant.UserID, "path", req.URL.Path, "maxAge", maxAge)
+		grant = nil
+	}
+	if grant != nil {
+		o.publishClaims(req, grant.Provider, &goth.User{RawData: grant.Claims})
+		o.next.ServeHTTP(rw, req)
+		return
+	}
+	if publicRule != nil {
+		logd("Anonymous request", "request", requestID(req), "method", req.Method, "path", req.URL.Path)
+		o.config.stripClaims(req)
+		o.next.ServeHTTP(rw, req)
+		return
+	}
+	c.redirectToAuthHost(rw, req, route, maxAge)
+}
+
+// ssoSessionKey is the key of the login and activity times of the sessions received from the auth host.
+func ssoSessionKey(providerName string) string {
+	return "sso:" + providerName
+}
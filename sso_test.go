@@ -0,0 +1,102 @@
+package traefikgothauth
+
+import (
+	"context"
+	"golang.org/x/crypto/bcrypt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestSSO(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var handler http.Handler
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		handler.ServeHTTP(rw, req)
+	}))
+	defer server.Close()
+	_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	authURL, appURL, otherURL := "http://auth.example.test:"+port, "http://app.example.test:"+port, "http://other.example.test:"+port
+	cfg := CreateConfig()
+	cfg.CookieSecret = "secret-for-testing-only"
+	cfg.SSO = &SSOConfig{AuthURL: authURL, AllowedHosts: []string{"*.example.test"}}
+	cfg.Providers = []*ProviderConfig{{
+		Name:        "local",
+		RedirectURI: authURL + "/__goth/local/",
+		Custom:      map[string]interface{}{"users": map[string]interface{}{"alice": string(hash)}},
+	}}
+	handler, err = New(context.Background(), http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_, _ = rw.Write([]byte("hello " + req.Header.Get("X-Auth-User-Id") + " at " + req.Host))
+	}), cfg, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// All the hosts resolve to the test server
+	jar, _ := cookiejar.New(nil)
+	var callbacks []string
+	client := &http.Client{
+		Jar: jar,
+		Transport: &http.Transport{DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, server.Listener.Addr().String())
+		}},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if req.URL.Path == ssoCallbackPath {
+				callbacks = append(callbacks, req.URL.String())
+			}
+			return nil
+		},
+	}
+	read := func(res *http.Response, err error) (*http.Response, string) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(res.Body)
+		_ = res.Body.Close()
+		return res, string(body)
+	}
+
+	// The first host logs in at the auth host
+	res, _ := read(client.Get(appURL + "/private?x=1"))
+	if !strings.HasPrefix(res.Request.URL.String(), authURL+"/__goth/local/form/") {
+		t.Fatalf("expected the login form of the auth host, got %s", res.Request.URL)
+	}
+	res, body := read(client.PostForm(res.Request.URL.String(), url.Values{
+		"state": {res.Request.URL.Query().Get("state")}, "username": {"alice"}, "password": {"hunter2"},
+	}))
+	if body != "hello alice at app.example.test:"+port || res.Request.URL.String() != appURL+"/private?x=1" {
+		t.Fatalf("expected to return to the first host, got %s at %s", body, res.Request.URL)
+	}
+
+	// The second host reuses the login
+	if res, body = read(client.Get(otherURL + "/")); body != "hello alice at other.example.test:"+port {
+		t.Fatalf("expected the second host to reuse the login, got %s at %s", body, res.Request.URL)
+	}
+
+	// Codes are single-use and only for allowed hosts
+	if res, _ = read(client.Get(callbacks[0])); res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected a replayed code to be rejected, got %d", res.StatusCode)
+	}
+	noRedirects := &http.Client{Jar: jar, Transport: client.Transport, CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	authorize := authURL + ssoAuthorizePath + "?" + url.Values{"return": {appURL + "/"}, "nonce": {"attacker"}}.Encode()
+	res, _ = read(noRedirects.Get(authorize))
+	victimJar, _ := cookiejar.New(nil)
+	victim := &http.Client{Jar: victimJar, Transport: client.Transport}
+	if res, _ = read(victim.Get(res.Header.Get("Location"))); res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected the code of another browser to be rejected, got %d", res.StatusCode)
+	}
+	evil := authURL + ssoAuthorizePath + "?" + url.Values{"return": {"http://evil.test:" + port + "/"}}.Encode()
+	if res, _ = read(client.Get(evil)); res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected a return URL of another domain to be rejected, got %d", res.StatusCode)
+	}
+}
@@ -0,0 +1,120 @@
+package traefikgothauth
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/markbates/goth"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// authTimeLeeway tolerates the clock skew between the providers and the plugin when checking their auth_time.
+const authTimeLeeway = time.Minute
+
+// StepUpRule requires a recent login for sensitive hosts or paths. Older sessions are sent through their provider
+// again, asking it to re-authenticate the user (max_age, and prompt=login for the providers that support it).
+//
+// Providers may ignore these parameters and silently log in a user that still has a session there, so only the logins
+// that prove their time are accepted: the built-in login forms, and the providers that report the auth_time claim
+// (OpenID Connect providers must, when they receive max_age). The users of other providers (e.g. GitHub) are rejected.
+type StepUpRule struct {
+	// Hosts (optional) are the hosts of the rule, without port. A leading "*." matches any subdomain.
+	Hosts []string
+	// PathPrefixes (optional) are the path prefixes of the rule, matched on whole segments.
+	PathPrefixes []string
+	// MaxAge is the maximum time since the login, e.g. "5m".
+	MaxAge string
+	maxAge time.Duration
+}
+
+func (r *StepUpRule) setup() error {
+	var errs []error
+	if len(r.Hosts) == 0 && len(r.PathPrefixes) == 0 {
+		errs = append(errs, errors.New("at least one host or path prefix is required"))
+	}
+	var err error
+	if r.maxAge, err = time.ParseDuration(r.MaxAge); err != nil {
+		errs = append(errs, fmt.Errorf("failed to parse MaxAge: %w", err))
+	} else if r.maxAge <= 0 {
+		errs = append(errs, errors.New("MaxAge must be positive"))
+	}
+	return errors.Join(errs...)
+}
+
+// maxAuthAge returns the strictest MaxAge of the step-up rules that match the request, or 0 if none does.
+func (c *Config) maxAuthAge(req *http.Request) time.Duration {
+	host, cleanPath := requestHostAndPath(req)
+	var maxAge time.Duration
+	for _, rule := range c.StepUp {
+		if matchHostsAndPaths(rule.Hosts, rule.PathPrefixes, host, cleanPath) && (maxAge == 0 || rule.maxAge < maxAge) {
+			maxAge = rule.maxAge
+		}
+	}
+	if c.SSO != nil { // The hosts that use the central auth host may request a recent login too
+		if requested := c.SSO.authorizeMaxAge(req); requested > 0 && (maxAge == 0 || requested < maxAge) {
+			maxAge = requested
+		}
+	}
+	return maxAge
+}
+
+// providerAuthTime returns when the user authenticated at the provider, and whether the provider proved it. The
+// built-in login forms always authenticate the user, the other providers may report it in the auth_time claim of
+// their user information or ID token. Otherwise, the current time is returned, as it is still the start of the session.
+func providerAuthTime(provider goth.Provider, auth *goth.User) (time.Time, bool) {
+	if _, ok := provider.(interface{ form() *formProvider }); ok {
+		return time.Now(), true
+	}
+	if unix, ok := claimUnix(auth.RawData["auth_time"]); ok {
+		return time.Unix(unix, 0), true
+	}
+	if _, payload, ok := strings.Cut(auth.IDToken, "."); ok {
+		payload, _, _ = strings.Cut(payload, ".")
+		claims := map[string]interface{}{}
+		if decoded, err := base64.RawURLEncoding.DecodeString(payload); err == nil && json.Unmarshal(decoded, &claims) == nil {
+			if unix, ok := claimUnix(claims["auth_time"]); ok {
+				return time.Unix(unix, 0), true
+			}
+		}
+	}
+	return time.Now(), false
+}
+
+// claimUnix parses a claim with a Unix time, as decoded from JSON.
+func claimUnix(value interface{}) (int64, bool) {
+	switch value := value.(type) {
+	case float64:
+		return int64(value), value > 0
+	case json.Number:
+		unix, err := value.Int64()
+		return unix, err == nil && unix > 0
+	case string:
+		unix, err := strconv.ParseInt(value, 10, 64)
+		return unix, err == nil && unix > 0
+	}
+	return 0, false
+}
+
+// stepUpAuthURL asks OAuth2/OIDC providers to re-authenticate the user even if they still have a session there. The
+// prompt is only added if not empty and not already configured.
+func stepUpAuthURL(authURL string, maxAge time.Duration, prompt string) string {
+	parsed, err := url.Parse(authURL)
+	if err != nil {
+		return authURL
+	}
+	query := parsed.Query()
+	if !query.Has("response_type") { // Not an OAuth2 authorization request
+		return authURL
+	}
+	if prompt != "" && !query.Has("prompt") {
+		query.Set("prompt", prompt)
+	}
+	query.Set("max_age", strconv.Itoa(int(maxAge.Seconds())))
+	parsed.RawQuery = query.Encode()
+	return parsed.String()
+}
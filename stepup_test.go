@@ -0,0 +1,160 @@
+package traefikgothauth
+
+import (
+	"context"
+	"golang.org/x/crypto/bcrypt"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestStepUp(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var handler http.Handler
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		handler.ServeHTTP(rw, req)
+	}))
+	defer server.Close()
+	cfg := CreateConfig()
+	cfg.CookieSecret = "secret-for-testing-only"
+	cfg.StepUp = []*StepUpRule{{PathPrefixes: []string{"/admin"}, MaxAge: "1s"}}
+	cfg.Providers = []*ProviderConfig{{
+		Name:        "local",
+		RedirectURI: server.URL + "/__goth/local/",
+		Custom:      map[string]interface{}{"users": map[string]interface{}{"alice": string(hash)}},
+	}}
+	handler, err = New(context.Background(), http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_, _ = rw.Write([]byte("hello " + req.Header.Get("X-Auth-User-Id")))
+	}), cfg, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	jar, _ := cookiejar.New(nil)
+	client := &http.Client{Jar: jar}
+	read := func(res *http.Response, err error) (*http.Response, string) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(res.Body)
+		_ = res.Body.Close()
+		return res, string(body)
+	}
+	login := func(res *http.Response) (*http.Response, string) {
+		return read(client.PostForm(res.Request.URL.String(), url.Values{
+			"state": {res.Request.URL.Query().Get("state")}, "username": {"alice"}, "password": {"hunter2"},
+		}))
+	}
+
+	res, _ := read(client.Get(server.URL + "/admin/delete"))
+	if res, body := login(res); body != "hello alice" || res.Request.URL.Path != "/admin/delete" {
+		t.Fatalf("expected a fresh login to be accepted, got %s at %s", body, res.Request.URL)
+	}
+	time.Sleep(1100 * time.Millisecond)
+	if _, body := read(client.Get(server.URL + "/dashboard")); body != "hello alice" {
+		t.Fatalf("expected the old session to be accepted for other paths, got %s", body)
+	}
+	res, body := read(client.Get(server.URL + "/admin/delete"))
+	if res.Request.URL.Path != "/__goth/local/form/" {
+		t.Fatalf("expected the old session to log in again, got %s at %s", body, res.Request.URL)
+	}
+	if res, body = login(res); body != "hello alice" || res.Request.URL.Path != "/admin/delete" {
+		t.Fatalf("expected to return to the original request, got %s at %s", body, res.Request.URL)
+	}
+}
+
+func TestStepUpAuthTime(t *testing.T) {
+	// The provider ignores max_age and prompt, and reports the time of its own login
+	var reportedAuthTime string
+	idp := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/auth":
+			callback, _ := url.Parse(req.URL.Query().Get("redirect_uri"))
+			callback.RawQuery = url.Values{"code": {"code"}, "state": {req.URL.Query().Get("state")}}.Encode()
+			http.Redirect(rw, req, callback.String(), http.StatusFound)
+		case "/token":
+			rw.Header().Set("Content-Type", "application/json")
+			_, _ = rw.Write([]byte(`{"access_token":"token","token_type":"bearer"}`))
+		default:
+			_, _ = rw.Write([]byte(`{"id":"alice"` + reportedAuthTime + `}`))
+		}
+	}))
+	defer idp.Close()
+	var handler http.Handler
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		handler.ServeHTTP(rw, req)
+	}))
+	defer server.Close()
+	cfg := CreateConfig()
+	cfg.CookieSecret = "secret-for-testing-only"
+	cfg.StepUp = []*StepUpRule{{PathPrefixes: []string{"/admin"}, MaxAge: "5m"}}
+	cfg.Providers = []*ProviderConfig{{
+		Name:        "generic-oauth2",
+		ClientKey:   "key",
+		Secret:      "secret",
+		RedirectURI: server.URL + "/__goth/generic-oauth2/",
+		Custom:      map[string]interface{}{"authURL": idp.URL + "/auth", "tokenURL": idp.URL + "/token", "userInfoURL": idp.URL + "/userinfo"},
+	}}
+	handler, err := New(context.Background(), http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_, _ = rw.Write([]byte("hello " + req.Header.Get("X-Auth-User-Id")))
+	}), cfg, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	jar, _ := cookiejar.New(nil)
+	client := &http.Client{Jar: jar}
+	get := func(path string) (int, string) {
+		res, err := client.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(res.Body)
+		_ = res.Body.Close()
+		return res.StatusCode, string(body)
+	}
+	authTime := func(ago time.Duration) string {
+		return `,"auth_time":` + strconv.FormatInt(time.Now().Add(-ago).Unix(), 10)
+	}
+
+	// Without auth_time, the logins are accepted but never satisfy the step-up rules
+	reportedAuthTime = ""
+	if status, body := get("/dashboard"); body != "hello alice" {
+		t.Fatalf("expected a login without auth_time to be accepted, got %d: %s", status, body)
+	}
+	if status, _ := get("/admin"); status != http.StatusForbidden {
+		t.Fatalf("expected a login without auth_time to be rejected for step-up, got %d", status)
+	}
+
+	// A silent login at the provider is stale
+	reportedAuthTime = authTime(time.Hour)
+	if status, _ := get("/admin"); status != http.StatusForbidden {
+		t.Fatalf("expected a stale auth_time to be rejected, got %d", status)
+	}
+	reportedAuthTime = authTime(time.Minute)
+	if status, body := get("/admin"); body != "hello alice" {
+		t.Fatalf("expected a recent auth_time to be accepted, got %d: %s", status, body)
+	}
+}
+
+func TestStepUpAuthURL(t *testing.T) {
+	for _, test := range []struct{ authURL, prompt, expected string }{
+		{"https://idp.example.com/authorize?client_id=a&response_type=code&state=s", "login", "https://idp.example.com/authorize?client_id=a&max_age=300&prompt=login&response_type=code&state=s"},
+		{"https://idp.example.com/authorize?prompt=consent&response_type=code", "login", "https://idp.example.com/authorize?max_age=300&prompt=consent&response_type=code"},
+		{"https://accounts.google.com/o/oauth2/auth?response_type=code", "", "https://accounts.google.com/o/oauth2/auth?max_age=300&response_type=code"},
+		{"/__goth/local/login/?state=s", "login", "/__goth/local/login/?state=s"},
+	} {
+		if got := stepUpAuthURL(test.authURL, 5*time.Minute, test.prompt); got != test.expected {
+			t.Errorf("%s: expected %s, got %s", test.authURL, test.expected, got)
+		}
+	}
+	if google, _ := getProviderInfo("google"); !google.NoLoginPrompt {
+		t.Error("expected Google not to receive prompt=login")
+	}
+}
@@ -0,0 +1,123 @@
+package traefikgothauth
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// fileStoreStates serializes the access to each file and caches its content, shared by all the plugin instances (one
+// per router) of this process.
+var fileStoreStates = struct {
+	sync.Mutex
+	byPath map[string]*fileStoreState
+}{byPath: map[string]*fileStoreState{}}
+
+// fileStoreState is the lock and the cached content of a file.
+type fileStoreState struct {
+	sync.Mutex
+	// info is the file as it was when cached was decoded.
+	info   os.FileInfo
+	cached interface{}
+}
+
+// fileStore persists small amounts of JSON data (credentials, secrets...) in a file, so that they survive restarts.
+//
+// The file is read again on each access, as it is also shared by the plugin instances and may be edited by hand. The
+// checks done on every request use snapshot instead, which only decodes the file again when it changes.
+type fileStore struct {
+	path  string
+	state *fileStoreState
+}
+
+func newFileStore(path string) *fileStore {
+	path = filepath.Clean(path)
+	fileStoreStates.Lock()
+	defer fileStoreStates.Unlock()
+	state, ok := fileStoreStates.byPath[path]
+	if !ok {
+		state = &fileStoreState{}
+		fileStoreStates.byPath[path] = state
+	}
+	return &fileStore{path: path, state: state}
+}
+
+// snapshot returns the content of the file decoded into a value created by newData, decoding it again only if the
+// file changed since the last call. The value is shared: callers must not modify it.
+func (s *fileStore) snapshot(newData func() interface{}) (interface{}, error) {
+	s.state.Lock()
+	defer s.state.Unlock()
+	info, err := os.Stat(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		s.state.cached, s.state.info = nil, nil
+		return newData(), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	cachedInfo := s.state.info
+	if s.state.cached != nil && os.SameFile(info, cachedInfo) && info.ModTime().Equal(cachedInfo.ModTime()) && info.Size() == cachedInfo.Size() {
+		return s.state.cached, nil
+	}
+	data := newData()
+	if err = s.load(data); err != nil {
+		return nil, err
+	}
+	s.state.cached, s.state.info = data, info
+	return data, nil
+}
+
+// read decodes the file into data, leaving it untouched if the file does not exist yet.
+func (s *fileStore) read(data interface{}) error {
+	s.state.Lock()
+	defer s.state.Unlock()
+	return s.load(data)
+}
+
+// update decodes the file into data, calls fn to modify it, and writes it back if fn succeeds.
+func (s *fileStore) update(data interface{}, fn func() error) error {
+	s.state.Lock()
+	defer s.state.Unlock()
+	if err := s.load(data); err != nil {
+		return err
+	}
+	if err := fn(); err != nil {
+		return err
+	}
+	return s.save(data)
+}
+
+func (s *fileStore) load(data interface{}) error {
+	b, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, data)
+}
+
+// save writes the file atomically, so that a crash never leaves it half-written.
+func (s *fileStore) save(data interface{}) error {
+	b, err := json.MarshalIndent(data, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), "."+filepath.Base(s.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+	if _, err = tmp.Write(b); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	s.state.cached = nil
+	return os.Rename(tmp.Name(), s.path)
+}
@@ -0,0 +1,35 @@
+package traefikgothauth
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileStoreSnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.json")
+	store := newFileStore(path)
+	newData := func() interface{} { return &apiKeysData{} }
+	if data, err := store.snapshot(newData); err != nil || len(data.(*apiKeysData).Keys) != 0 {
+		t.Fatalf("expected no keys before the file exists, got %v, %v", data, err)
+	}
+	data := &apiKeysData{}
+	if err := store.update(data, func() error { data.Keys = append(data.Keys, &apiKey{ID: "a"}); return nil }); err != nil {
+		t.Fatal(err)
+	}
+	first, err := store.snapshot(newData)
+	if err != nil || len(first.(*apiKeysData).Keys) != 1 {
+		t.Fatalf("expected the updated keys, got %v, %v", first, err)
+	}
+	if again, _ := store.snapshot(newData); again != first {
+		t.Fatalf("expected the unchanged file to be cached")
+	}
+
+	// Edits by hand are seen too
+	if err = os.WriteFile(path, []byte(`{"Keys": [{"ID": "a"}, {"ID": "b"}]}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if edited, err := store.snapshot(newData); err != nil || len(edited.(*apiKeysData).Keys) != 2 {
+		t.Fatalf("expected the edited keys, got %v, %v", edited, err)
+	}
+}
@@ -0,0 +1,117 @@
+package traefikgothauth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+// signedToken is the envelope of the tokens signed by the plugin (login codes, links...).
+type signedToken struct {
+	Purpose string
+	Expires int64
+	Value   json.RawMessage
+}
+
+// signToken serializes and signs the value, so that it can be safely sent to the client and back.
+//
+// The purpose is also signed, so that a token issued for one use can not be replayed for another one. Tokens are not
+// encrypted: never put secrets in them.
+func signToken(key []byte, purpose string, ttl time.Duration, value interface{}) (string, error) {
+	valueBytes, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(&signedToken{Purpose: purpose, Expires: time.Now().Add(ttl).Unix(), Value: valueBytes})
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(payload)
+	return base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+// verifyToken checks the signature, purpose and expiration of a token created by signToken and decodes its value.
+func verifyToken(key []byte, purpose, token string, value interface{}) error {
+	payloadB64, macB64, ok := strings.Cut(token, ".")
+	if !ok {
+		return errors.New("malformed token")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(payloadB64)
+	if err != nil {
+		return errors.New("malformed token payload")
+	}
+	gotMAC, err := base64.RawURLEncoding.DecodeString(macB64)
+	if err != nil {
+		return errors.New("malformed token signature")
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(payload)
+	if !hmac.Equal(gotMAC, mac.Sum(nil)) {
+		return errors.New("invalid token signature")
+	}
+	envelope := &signedToken{}
+	if err = json.Unmarshal(payload, envelope); err != nil {
+		return err
+	}
+	if envelope.Purpose != purpose {
+		return errors.New("token issued for a different purpose")
+	}
+	if time.Now().Unix() > envelope.Expires {
+		return errors.New("token expired")
+	}
+	return json.Unmarshal(envelope.Value, value)
+}
+
+// signingKey derives a signing key from a configured secret, or generates a random one (only valid for the lifetime
+// of this process and instance) if it is empty.
+func signingKey(secret, purpose string) []byte {
+	if secret == "" {
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			panic("source of randomness unavailable: " + err.Error())
+		}
+		return key
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+// randomString returns a random URL-safe string with the given number of bytes of entropy.
+func randomString(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic("source of randomness unavailable: " + err.Error())
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// usedTokens remembers the single-use tokens already consumed by this process, until they expire.
+var usedTokens = struct {
+	sync.Mutex
+	expires map[string]time.Time
+}{expires: map[string]time.Time{}}
+
+// consumeToken marks the single-use token with the given ID as used, returning false if it already was.
+func consumeToken(id string, expires time.Time) bool {
+	usedTokens.Lock()
+	defer usedTokens.Unlock()
+	now := time.Now()
+	for usedID, usedExpires := range usedTokens.expires {
+		if now.After(usedExpires) {
+			delete(usedTokens.expires, usedID)
+		}
+	}
+	if _, used := usedTokens.expires[id]; used {
+		return false
+	}
+	usedTokens.expires[id] = expires
+	return true
+}
@@ -0,0 +1,272 @@
+package traefikgothauth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/markbates/goth"
+	"github.com/markbates/goth/gothic"
+	"html/template"
+	"net/http"
+	"net/url"
+	"rsc.io/qr"
+	"strings"
+	"time"
+)
+
+const (
+	totpPath        = "/__goth/totp/"
+	totpSessionName = "_gothic_totp"
+	totpPeriod      = 30
+	totpEnrollTTL   = 10 * time.Minute
+)
+
+// TOTPConfig requires a TOTP code (RFC 6238, e.g. from an authenticator app) after logging in with a provider.
+type TOTPConfig struct {
+	// SecretsFile is the path of the JSON file that stores the TOTP secret of each user (created if missing).
+	SecretsFile string
+	// Issuer (optional) is the name shown by authenticator apps. Defaults to "Traefik".
+	Issuer string
+	// Providers (optional) are the names of the providers that require a TOTP code. Defaults to all of them.
+	Providers []string
+	// MaxAttempts (optional) is the number of wrong codes allowed per user (4 times more per client IP) in 15 minutes.
+	// Defaults to 5.
+	MaxAttempts int
+	store       *fileStore
+	enrollKey   []byte
+	limiter     *loginRateLimiter
+}
+
+// totpUser is the TOTP enrollment of a user.
+type totpUser struct {
+	Secret   string
+	Enrolled time.Time
+	// LastCounter is the time step of the last accepted code, so that each code is only accepted once.
+	LastCounter int64
+}
+
+// totpData is the content of the secrets file, indexed by provider and user ID.
+type totpData struct {
+	Users map[string]*totpUser
+}
+
+// totpEnrollment is the value of the signed token that carries a new secret until the user confirms it.
+type totpEnrollment struct {
+	User, Secret string
+}
+
+func (c *TOTPConfig) setup(cookieSecret string) error {
+	if c.SecretsFile == "" {
+		return errors.New("totp: SecretsFile is required")
+	}
+	if c.Issuer == "" {
+		c.Issuer = "Traefik"
+	}
+	if c.MaxAttempts <= 0 {
+		c.MaxAttempts = 5
+	}
+	c.store = newFileStore(c.SecretsFile)
+	if err := c.store.read(&totpData{}); err != nil {
+		return fmt.Errorf("totp: failed to read the secrets file: %w", err)
+	}
+	c.enrollKey = signingKey(cookieSecret, "totp-enroll")
+	c.limiter = newLoginRateLimiter(c.MaxAttempts, 15*time.Minute)
+	return nil
+}
+
+// required returns whether the users of the provider must enter a TOTP code.
+func (c *TOTPConfig) required(providerName string) bool {
+	if len(c.Providers) == 0 {
+		return true
+	}
+	for _, name := range c.Providers {
+		if name == providerName {
+			return true
+		}
+	}
+	return false
+}
+
+// sessionMarker identifies the current login with the provider, so that a verified code is only valid until the user
+// logs in again.
+func (c *TOTPConfig) sessionMarker(req *http.Request, providerName string) string {
+	value, _ := gothic.GetFromSession(providerName, req)
+	hash := sha256.Sum256([]byte(providerName + "\x00" + value))
+	return hex.EncodeToString(hash[:])
+}
+
+// serveChallenge asks for a TOTP code until the user of this login has entered a valid one, returning true if it
+// handled the request.
+func (c *TOTPConfig) serveChallenge(rw http.ResponseWriter, req *http.Request, providerConfig *ProviderConfig, auth *goth.User) bool {
+	if !c.required(providerConfig.Name) {
+		return false
+	}
+	marker := c.sessionMarker(req, providerConfig.Name)
+	session, _ := gothic.Store.Get(req, totpSessionName)
+	if verified, _ := session.Values["verified"].(string); verified == marker {
+		if req.URL.Path == totpPath {
+			http.Redirect(rw, req, "/", http.StatusSeeOther)
+			return true
+		}
+		return false
+	}
+
+	userKey := providerConfig.Name + ":" + auth.UserID
+	page := &totpPage{Title: "Two-factor authentication", Redirect: localRedirect(req.RequestURI)}
+	if req.URL.Path == totpPath {
+		page.Redirect = localRedirect(req.FormValue("redirect"))
+	}
+	status := http.StatusUnauthorized
+	if req.Method == http.MethodPost && req.URL.Path == totpPath {
+		limiterKeys := []string{"ip:" + clientIP(req), "user:" + userKey}
+		var err error
+		if !c.limiter.allowed(limiterKeys...) {
+			page.Error, status = "Too many failed attempts, please try again later", http.StatusTooManyRequests
+		} else if err = c.verify(userKey, req.PostForm.Get("code"), req.PostForm.Get("enrollment")); err != nil {
+			c.limiter.fail(limiterKeys...)
+			logw("Invalid TOTP code", "request", requestID(req), "provider", providerConfig.Name, "user", auth.UserID, "remote", req.RemoteAddr, "error", err)
+			audit(req, auditLoginFailure, providerConfig.Name, auth.UserID, "invalid TOTP code")
+			page.Error = "Invalid code"
+		} else {
+			session.Values["verified"] = marker
+			if err = session.Save(req, rw); err != nil {
+				loge("Failed to save the TOTP session", "request", requestID(req), "error", err)
+				http.Error(rw, "Failed to save the session", http.StatusInternalServerError)
+				return true
+			}
+			logi("TOTP code verified", "request", requestID(req), "provider", providerConfig.Name, "user", auth.UserID)
+			http.Redirect(rw, req, page.Redirect, http.StatusSeeOther)
+			return true
+		}
+	}
+	if err := c.prepareEnrollment(page, userKey, auth, req.FormValue("enrollment")); err != nil {
+		loge("Failed to prepare the TOTP enrollment", "request", requestID(req), "provider", providerConfig.Name, "user", auth.UserID, "error", err)
+		http.Error(rw, "Failed to prepare the two-factor authentication", http.StatusInternalServerError)
+		return true
+	}
+	servePage(rw, status, totpHtml, page)
+	return true
+}
+
+// verify checks the code against the secret of the user, or the secret being enrolled (stored if valid).
+func (c *TOTPConfig) verify(userKey, code, enrollment string) error {
+	data := &totpData{}
+	return c.store.update(data, func() error {
+		if data.Users == nil {
+			data.Users = map[string]*totpUser{}
+		}
+		user := data.Users[userKey]
+		if user == nil {
+			pending := &totpEnrollment{}
+			if err := verifyToken(c.enrollKey, "totp-enroll", enrollment, pending); err != nil {
+				return fmt.Errorf("invalid enrollment: %w", err)
+			}
+			if pending.User != userKey {
+				return errors.New("enrollment issued for a different user")
+			}
+			user = &totpUser{Secret: pending.Secret, Enrolled: time.Now().UTC()}
+		}
+		counter, err := totpValidate(user.Secret, code, time.Now())
+		if err != nil {
+			return err
+		}
+		if counter <= user.LastCounter {
+			return errors.New("code already used")
+		}
+		user.LastCounter = counter
+		data.Users[userKey] = user
+		return nil
+	})
+}
+
+// prepareEnrollment adds the secret and its QR code to the page if the user has not enrolled yet. The secret of the
+// previous enrollment is kept, so that a mistyped code does not require scanning a new QR code.
+func (c *TOTPConfig) prepareEnrollment(page *totpPage, userKey string, auth *goth.User, previous string) error {
+	data := &totpData{}
+	if err := c.store.read(data); err != nil {
+		return err
+	}
+	if data.Users[userKey] != nil {
+		return nil
+	}
+	pending := &totpEnrollment{}
+	if err := verifyToken(c.enrollKey, "totp-enroll", previous, pending); err != nil || pending.User != userKey {
+		key := make([]byte, 20)
+		if _, err = rand.Read(key); err != nil {
+			return err
+		}
+		pending = &totpEnrollment{User: userKey, Secret: base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(key)}
+	}
+	secret := pending.Secret
+	enrollment, err := signToken(c.enrollKey, "totp-enroll", totpEnrollTTL, pending)
+	if err != nil {
+		return err
+	}
+	account := auth.Email
+	if account == "" {
+		account = auth.UserID
+	}
+	otpauth := (&url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + c.Issuer + ":" + account,
+		RawQuery: url.Values{"secret": {secret}, "issuer": {c.Issuer}}.Encode(),
+	}).String()
+	code, err := qr.Encode(otpauth, qr.M)
+	if err != nil {
+		return err
+	}
+	code.Scale = 4
+	page.Enrollment, page.Secret = enrollment, secret
+	page.QRCode = template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(code.PNG()))
+	return nil
+}
+
+// totpValidate checks a code allowing one time step of clock drift, returning the time step it belongs to.
+func totpValidate(secret, code string, now time.Time) (int64, error) {
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.ToUpper(strings.TrimRight(secret, "=")))
+	if err != nil {
+		return 0, fmt.Errorf("invalid secret: %w", err)
+	}
+	code = strings.ReplaceAll(code, " ", "")
+	current := now.Unix() / totpPeriod
+	for _, counter := range []int64{current, current - 1, current + 1} {
+		if hmac.Equal([]byte(totpCode(key, counter)), []byte(code)) {
+			return counter, nil
+		}
+	}
+	return 0, errors.New("wrong code")
+}
+
+// totpCode computes the code of a time step (RFC 4226 dynamic truncation).
+func totpCode(key []byte, counter int64) string {
+	mac := hmac.New(sha1.New, key)
+	_ = binary.Write(mac, binary.BigEndian, counter)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%06d", value%1000000)
+}
+
+// localRedirect only allows redirecting to paths of the same host.
+func localRedirect(target string) string {
+	if !strings.HasPrefix(target, "/") || strings.HasPrefix(target, "//") || strings.HasPrefix(target, "/\\") {
+		return "/"
+	}
+	return target
+}
+
+// totpPage is the data of totpHtml.
+type totpPage struct {
+	Title, Error, Redirect, Enrollment, Secret string
+	QRCode                                     template.URL
+}
+
+var totpHtml = newPageTemplate("totpTemplate", `{{if .Error}}<div class="login-box-error">{{.Error}}</div>{{end}} <form class="login-box-form" method="post" action="`+totpPath+`"> {{if .Enrollment}}<div class="login-box-message">Scan this QR code with your authenticator app<br><img src="{{.QRCode}}" alt="QR code"><br>or enter the key <code>{{.Secret}}</code></div> <input type="hidden" name="enrollment" value="{{.Enrollment}}"> {{end}}<input type="hidden" name="redirect" value="{{.Redirect}}"> <label>Code <input name="code" type="text" inputmode="numeric" pattern="[0-9 ]*" autocomplete="one-time-code" required autofocus></label> <button class="btn" type="submit">Verify</button> </form>`)
@@ -0,0 +1,93 @@
+package traefikgothauth
+
+import (
+	"context"
+	"encoding/base32"
+	"golang.org/x/crypto/bcrypt"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestTOTPCode(t *testing.T) {
+	// RFC 6238 test vectors (SHA-1), truncated to 6 digits
+	secret := base32.StdEncoding.EncodeToString([]byte("12345678901234567890"))
+	for unix, code := range map[int64]string{59: "287082", 1111111109: "081804", 2000000000: "279037"} {
+		counter, err := totpValidate(secret, code, time.Unix(unix, 0))
+		if err != nil || counter != unix/totpPeriod {
+			t.Errorf("expected %s to be valid at %d: %v", code, unix, err)
+		}
+	}
+	if _, err := totpValidate(secret, "000000", time.Unix(59, 0)); err == nil {
+		t.Error("expected a wrong code to be rejected")
+	}
+}
+
+func TestTOTPEnrollAndVerify(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var handler http.Handler
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		handler.ServeHTTP(rw, req)
+	}))
+	defer server.Close()
+	cfg := CreateConfig()
+	cfg.CookieSecret = "secret-for-testing-only"
+	cfg.TOTP = &TOTPConfig{SecretsFile: filepath.Join(t.TempDir(), "totp.json")}
+	cfg.Providers = []*ProviderConfig{{
+		Name:        "local",
+		RedirectURI: server.URL + "/__goth/local/",
+		Custom:      map[string]interface{}{"users": map[string]interface{}{"alice": string(hash)}},
+	}}
+	handler, err = New(context.Background(), http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_, _ = rw.Write([]byte("hello " + req.Header.Get("X-Auth-User-Id")))
+	}), cfg, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jar, _ := cookiejar.New(nil)
+	client := &http.Client{Jar: jar}
+	read := func(res *http.Response, err error) (*http.Response, string) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(res.Body)
+		_ = res.Body.Close()
+		return res, string(body)
+	}
+	res, _ := read(client.Get(server.URL + "/private"))
+	res, body := read(client.PostForm(res.Request.URL.String(), url.Values{
+		"state": {res.Request.URL.Query().Get("state")}, "username": {"alice"}, "password": {"hunter2"},
+	}))
+	if res.StatusCode != http.StatusUnauthorized || res.Request.URL.Path != "/private" {
+		t.Fatalf("expected the TOTP page, got %d at %s: %s", res.StatusCode, res.Request.URL, body)
+	}
+	enrollment := regexp.MustCompile(`name="enrollment" value="([^"]+)"`).FindStringSubmatch(body)
+	secret := regexp.MustCompile(`<code>([A-Z2-7]+)</code>`).FindStringSubmatch(body)
+	if enrollment == nil || secret == nil || !regexp.MustCompile(`src="data:image/png;base64,`).MatchString(body) {
+		t.Fatalf("expected the enrollment QR code: %s", body)
+	}
+
+	verify := func(code string) (*http.Response, string) {
+		return read(client.PostForm(server.URL+totpPath, url.Values{"code": {code}, "enrollment": {enrollment[1]}, "redirect": {"/private"}}))
+	}
+	if res, _ = verify("000000"); res.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected a wrong code to be rejected, got %d", res.StatusCode)
+	}
+	key, _ := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret[1])
+	if res, body = verify(totpCode(key, time.Now().Unix()/totpPeriod)); body != "hello alice" {
+		t.Fatalf("expected to reach the page after the TOTP code, got %d: %s", res.StatusCode, body)
+	}
+	if res, body = read(client.Get(server.URL + "/other")); body != "hello alice" {
+		t.Fatalf("expected the session to be fully authenticated, got %d: %s", res.StatusCode, body)
+	}
+}
@@ -0,0 +1,401 @@
+package traefikgothauth
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/markbates/goth"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const webauthnChallengeTTL = 5 * time.Minute
+
+// WebAuthn authenticator data flags.
+const (
+	webauthnFlagUserPresent   = 0x01
+	webauthnFlagAttestedData  = 0x40
+	webauthnAuthDataMinLength = 37
+)
+
+// webauthnProvider logs users in with passkeys (WebAuthn discoverable credentials).
+//
+// Passkeys are registered by invited users (one-time invites from the configuration) or by users already
+// authenticated with another provider, for their own identity.
+type webauthnProvider struct {
+	*formProvider
+	store        *fileStore
+	rpID         string
+	challengeKey []byte
+	invites      map[string]string
+}
+
+var _ loginPageProvider = &webauthnProvider{}
+var _ authenticatedPageProvider = &webauthnProvider{}
+
+// webauthnCredential is a registered passkey.
+type webauthnCredential struct {
+	ID       []byte
+	Username string
+	Email    string `json:",omitempty"`
+	Name     string `json:",omitempty"`
+	// PublicKey is the COSE_Key of the credential.
+	PublicKey []byte
+	SignCount uint32
+	Created   time.Time
+}
+
+// webauthnData is the content of the credentials file.
+type webauthnData struct {
+	Credentials []*webauthnCredential
+	// UsedInvites are the SHA-256 hashes of the invites already consumed.
+	UsedInvites []string
+}
+
+func (d *webauthnData) credential(id []byte) *webauthnCredential {
+	for _, credential := range d.Credentials {
+		if bytes.Equal(credential.ID, id) {
+			return credential
+		}
+	}
+	return nil
+}
+
+func (d *webauthnData) inviteUsed(invite string) bool {
+	for _, used := range d.UsedInvites {
+		if used == hashInvite(invite) {
+			return true
+		}
+	}
+	return false
+}
+
+func hashInvite(invite string) string {
+	hash := sha256.Sum256([]byte(invite))
+	return hex.EncodeToString(hash[:])
+}
+
+func newWebauthnProvider(secret, callback string, custom map[string]interface{}) (*webauthnProvider, error) {
+	form, err := newFormProvider("webauthn", "Passkey login", secret, callback, custom)
+	if err != nil {
+		return nil, err
+	}
+	credentialsFile, _ := custom["credentialsFile"].(string)
+	p := &webauthnProvider{
+		formProvider: form,
+		store:        newFileStore(credentialsFile),
+		challengeKey: signingKey(secret, "webauthn-challenge"),
+	}
+	if err = p.store.read(&webauthnData{}); err != nil {
+		return nil, fmt.Errorf("failed to read the credentials file: %w", err)
+	}
+	if p.rpID, _ = custom["rpID"].(string); p.rpID == "" {
+		callbackURL, err := url.Parse(callback)
+		if err != nil {
+			return nil, err
+		}
+		p.rpID = callbackURL.Hostname()
+	}
+	p.invites, _ = custom["invites"].(map[string]string)
+	form.submit = "Sign in with a passkey"
+	form.render = p.renderLogin
+	form.verify = p.verifyAssertion
+	return p, nil
+}
+
+// registerPath is the path of the page that registers new passkeys.
+func (p *webauthnProvider) registerPath() string {
+	return "/__goth/" + p.providerName + "/register/"
+}
+
+// webauthnRegisterChallenge is the value of the registration challenges, which are single-use.
+type webauthnRegisterChallenge struct {
+	Username string
+	Nonce    string
+}
+
+// webauthnPage is the data of the WebAuthn pages.
+type webauthnPage struct {
+	*loginFormPage
+	Challenge, RPID, Username, UserHandle, Invite string
+}
+
+func (p *webauthnProvider) renderLogin(rw http.ResponseWriter, status int, page *loginFormPage) {
+	challenge, err := signToken(p.challengeKey, p.providerName+"-login", webauthnChallengeTTL, page.State)
+	if err != nil {
+		loge("Failed to sign passkey challenge", "provider", p.providerName, "error", err)
+		http.Error(rw, "Failed to log in", http.StatusInternalServerError)
+		return
+	}
+	servePage(rw, status, webauthnLoginHtml, &webauthnPage{loginFormPage: page, Challenge: challenge, RPID: p.rpID})
+}
+
+// ServeLoginPage serves the login form, and the registration page for invited users.
+func (p *webauthnProvider) ServeLoginPage(rw http.ResponseWriter, req *http.Request) bool {
+	if req.URL.Path == p.registerPath() && req.FormValue("invite") != "" {
+		invite := req.FormValue("invite")
+		username, ok := p.invites[invite]
+		data := &webauthnData{}
+		if err := p.store.read(data); err != nil {
+			loge("Failed to read the credentials file", "request", requestID(req), "provider", p.providerName, "error", err)
+			http.Error(rw, "Failed to read the credentials", http.StatusInternalServerError)
+			return true
+		}
+		if !ok || data.inviteUsed(invite) {
+			logw("Invalid passkey invite", "request", requestID(req), "provider", p.providerName, "remote", req.RemoteAddr)
+			page := &loginFormPage{Title: "Register a passkey", Error: "This invite is invalid or was already used"}
+			servePage(rw, http.StatusForbidden, webauthnRegisterHtml, &webauthnPage{loginFormPage: page})
+			return true
+		}
+		p.serveRegister(rw, req, &webauthnCredential{Username: username}, invite)
+		return true
+	}
+	return p.formProvider.ServeLoginPage(rw, req)
+}
+
+// ServeAuthenticatedPage lets the users authenticated by any provider register a passkey for their identity.
+//
+// The passkey belongs to the identity at that provider ("provider:userID"), never to an email or ID that another
+// provider may also claim.
+func (p *webauthnProvider) ServeAuthenticatedPage(rw http.ResponseWriter, req *http.Request, providerName string, user *goth.User) bool {
+	if req.URL.Path != p.registerPath() {
+		return false
+	}
+	owner := &webauthnCredential{Username: providerName + ":" + user.UserID, Email: user.Email, Name: user.Name}
+	p.serveRegister(rw, req, owner, "")
+	return true
+}
+
+// serveRegister serves the registration page for the owner of the new passkey, and registers the submitted one.
+func (p *webauthnProvider) serveRegister(rw http.ResponseWriter, req *http.Request, owner *webauthnCredential, invite string) {
+	userHandle := sha256.Sum256([]byte(owner.Username)) // Not the username itself, as authenticators may expose it
+	page := &webauthnPage{
+		loginFormPage: &loginFormPage{Title: "Register a passkey", Submit: "Register a passkey"},
+		RPID:          p.rpID,
+		Username:      owner.Username,
+		UserHandle:    base64.RawURLEncoding.EncodeToString(userHandle[:]),
+		Invite:        invite,
+	}
+	status := http.StatusOK
+	if req.Method == http.MethodPost {
+		err := p.register(req, owner, invite)
+		if err == nil {
+			logi("Registered passkey", "request", requestID(req), "provider", p.providerName, "username", owner.Username, "invite", invite != "")
+			page.Message = "Your passkey was registered, you can now use it to log in."
+			servePage(rw, http.StatusOK, webauthnRegisterHtml, page)
+			return
+		}
+		logw("Failed to register passkey", "request", requestID(req), "provider", p.providerName, "username", owner.Username, "error", err)
+		page.Error, status = "Could not register the passkey", http.StatusBadRequest
+	}
+	challenge, err := signToken(p.challengeKey, p.providerName+"-register", webauthnChallengeTTL, &webauthnRegisterChallenge{Username: owner.Username, Nonce: randomString(16)})
+	if err != nil {
+		loge("Failed to sign passkey challenge", "request", requestID(req), "provider", p.providerName, "error", err)
+		http.Error(rw, "Failed to register the passkey", http.StatusInternalServerError)
+		return
+	}
+	page.Challenge = challenge
+	servePage(rw, status, webauthnRegisterHtml, page)
+}
+
+// register verifies the response of navigator.credentials.create and stores the new passkey.
+func (p *webauthnProvider) register(req *http.Request, owner *webauthnCredential, invite string) error {
+	if err := req.ParseForm(); err != nil {
+		return err
+	}
+	clientDataJSON, err1 := base64.RawURLEncoding.DecodeString(req.PostForm.Get("clientDataJSON"))
+	attestationObject, err2 := base64.RawURLEncoding.DecodeString(req.PostForm.Get("attestationObject"))
+	if err := errors.Join(err1, err2); err != nil {
+		return fmt.Errorf("malformed passkey response: %w", err)
+	}
+	challenge := &webauthnRegisterChallenge{}
+	if err := p.verifyClientData(clientDataJSON, "webauthn.create", p.providerName+"-register", challenge); err != nil {
+		return err
+	}
+	if challenge.Username != owner.Username {
+		return errors.New("challenge issued for a different user")
+	}
+	// The attestation statement is not verified: any authenticator is accepted
+	attestation, _, err := cborDecode(attestationObject)
+	if err != nil {
+		return err
+	}
+	attestationMap, _ := attestation.(map[interface{}]interface{})
+	rawAuthData, _ := attestationMap["authData"].([]byte)
+	authData, err := p.parseAuthData(rawAuthData)
+	if err != nil {
+		return err
+	}
+	if authData.credentialID == nil {
+		return errors.New("missing attested credential data")
+	}
+	if _, _, err = parseCOSEKey(authData.publicKey); err != nil {
+		return err
+	}
+	if !consumeToken(p.providerName+"-register:"+challenge.Nonce, time.Now().Add(webauthnChallengeTTL)) {
+		return errors.New("challenge already used")
+	}
+	data := &webauthnData{}
+	return p.store.update(data, func() error {
+		if invite != "" {
+			if data.inviteUsed(invite) {
+				return errors.New("invite already used")
+			}
+			data.UsedInvites = append(data.UsedInvites, hashInvite(invite))
+		}
+		if data.credential(authData.credentialID) != nil {
+			return errors.New("passkey already registered")
+		}
+		data.Credentials = append(data.Credentials, &webauthnCredential{
+			ID:        authData.credentialID,
+			Username:  owner.Username,
+			Email:     owner.Email,
+			Name:      owner.Name,
+			PublicKey: authData.publicKey,
+			SignCount: authData.signCount,
+			Created:   time.Now().UTC(),
+		})
+		return nil
+	})
+}
+
+// verifyAssertion verifies the response of navigator.credentials.get, submitted by the login form.
+func (p *webauthnProvider) verifyAssertion(_ *http.Request, form url.Values) (*goth.User, error) {
+	credentialID, err1 := base64.RawURLEncoding.DecodeString(form.Get("credentialId"))
+	clientDataJSON, err2 := base64.RawURLEncoding.DecodeString(form.Get("clientDataJSON"))
+	rawAuthData, err3 := base64.RawURLEncoding.DecodeString(form.Get("authenticatorData"))
+	signature, err4 := base64.RawURLEncoding.DecodeString(form.Get("signature"))
+	if err := errors.Join(err1, err2, err3, err4); err != nil {
+		return nil, fmt.Errorf("malformed passkey response: %w", err)
+	}
+	var state string
+	if err := p.verifyClientData(clientDataJSON, "webauthn.get", p.providerName+"-login", &state); err != nil {
+		return nil, err
+	}
+	if state != form.Get("state") {
+		return nil, errors.New("challenge issued for a different login")
+	}
+	authData, err := p.parseAuthData(rawAuthData)
+	if err != nil {
+		return nil, err
+	}
+	var user *goth.User
+	data := &webauthnData{}
+	err = p.store.update(data, func() error {
+		credential := data.credential(credentialID)
+		if credential == nil {
+			return errors.New("unknown passkey")
+		}
+		alg, key, err := parseCOSEKey(credential.PublicKey)
+		if err != nil {
+			return err
+		}
+		clientDataHash := sha256.Sum256(clientDataJSON)
+		if err = verifyCOSESignature(alg, key, append(rawAuthData[:len(rawAuthData):len(rawAuthData)], clientDataHash[:]...), signature); err != nil {
+			return fmt.Errorf("passkey of %s: %w", credential.Username, err)
+		}
+		// Authenticators that count signatures must always increase the counter, otherwise the passkey was cloned
+		if (authData.signCount != 0 || credential.SignCount != 0) && authData.signCount <= credential.SignCount {
+			return fmt.Errorf("passkey of %s: signature counter did not increase, it may have been cloned", credential.Username)
+		}
+		credential.SignCount = authData.signCount
+		user = &goth.User{UserID: credential.Username, NickName: credential.Username, Name: credential.Name, Email: credential.Email}
+		if user.Name == "" {
+			user.Name = credential.Username
+		}
+		return nil
+	})
+	return user, err
+}
+
+// verifyClientData checks the client data of a WebAuthn response and decodes the value of its challenge.
+func (p *webauthnProvider) verifyClientData(clientDataJSON []byte, typ, purpose string, value interface{}) error {
+	clientData := &struct{ Type, Challenge, Origin string }{}
+	if err := json.Unmarshal(clientDataJSON, clientData); err != nil {
+		return err
+	}
+	if clientData.Type != typ {
+		return fmt.Errorf("unexpected client data type %q", clientData.Type)
+	}
+	origin, err := url.Parse(clientData.Origin)
+	if err != nil {
+		return err
+	}
+	host := origin.Hostname()
+	if host != p.rpID && !strings.HasSuffix(host, "."+p.rpID) {
+		return fmt.Errorf("origin %q does not belong to %s", clientData.Origin, p.rpID)
+	}
+	if origin.Scheme != "https" && !(origin.Scheme == "http" && host == "localhost") {
+		return fmt.Errorf("insecure origin %q", clientData.Origin)
+	}
+	challenge, err := base64.RawURLEncoding.DecodeString(clientData.Challenge)
+	if err != nil {
+		return err
+	}
+	return verifyToken(p.challengeKey, purpose, string(challenge), value)
+}
+
+// webauthnAuthData is the decoded authenticator data.
+type webauthnAuthData struct {
+	flags        byte
+	signCount    uint32
+	credentialID []byte
+	publicKey    []byte
+}
+
+// parseAuthData decodes the authenticator data, checking that it was issued for this relying party with the user
+// present.
+func (p *webauthnProvider) parseAuthData(data []byte) (*webauthnAuthData, error) {
+	if len(data) < webauthnAuthDataMinLength {
+		return nil, errors.New("authenticator data too short")
+	}
+	rpIDHash := sha256.Sum256([]byte(p.rpID))
+	if !bytes.Equal(data[:32], rpIDHash[:]) {
+		return nil, errors.New("authenticator data issued for a different relying party")
+	}
+	authData := &webauthnAuthData{flags: data[32], signCount: binary.BigEndian.Uint32(data[33:37])}
+	if authData.flags&webauthnFlagUserPresent == 0 {
+		return nil, errors.New("user not present")
+	}
+	if authData.flags&webauthnFlagAttestedData != 0 {
+		rest := data[37:]
+		if len(rest) < 18 {
+			return nil, errors.New("attested credential data too short")
+		}
+		idLength := int(binary.BigEndian.Uint16(rest[16:18]))
+		rest = rest[18:]
+		if len(rest) < idLength {
+			return nil, errors.New("attested credential data too short")
+		}
+		authData.credentialID, rest = rest[:idLength], rest[idLength:]
+		_, afterKey, err := cborDecode(rest)
+		if err != nil {
+			return nil, fmt.Errorf("invalid credential public key: %w", err)
+		}
+		authData.publicKey = rest[:len(rest)-len(afterKey)]
+	}
+	return authData, nil
+}
+
+// webauthnScript contains the helpers shared by the WebAuthn pages: f is the form, b encodes bytes as base64url and
+// run submits the form with the result of the given async function, showing errors.
+const webauthnScript = `const f=document.getElementById("webauthn-form"),e=document.getElementById("webauthn-error"),` +
+	`b=x=>btoa(String.fromCharCode(...new Uint8Array(x))).replaceAll("+","-").replaceAll("/","_").replaceAll("=",""),` +
+	`d=s=>Uint8Array.from(atob(s.replaceAll("-","+").replaceAll("_","/")),c=>c.charCodeAt(0)),` +
+	`run=g=>f&&f.addEventListener("submit",async ev=>{ev.preventDefault();try{await g(new TextEncoder().encode(f.dataset.challenge));f.submit()}catch(err){e.textContent=err.message;e.hidden=false}});`
+
+var webauthnLoginHtml = newPageTemplate("webauthnLoginTemplate", `{{if .Error}}<div class="login-box-error">{{.Error}}</div>{{end}} <div class="login-box-error" id="webauthn-error" hidden></div> {{if .Message}}<div class="login-box-message">{{.Message}}</div>{{else}}<form class="login-box-form" id="webauthn-form" method="post" data-challenge="{{.Challenge}}" data-rp-id="{{.RPID}}"> <input type="hidden" name="state" value="{{.State}}"> <input type="hidden" name="credentialId"> <input type="hidden" name="clientDataJSON"> <input type="hidden" name="authenticatorData"> <input type="hidden" name="signature"> <button class="btn" type="submit" autofocus>{{.Submit}}</button> </form>{{end}} <script>`+webauthnScript+
+	`run(async c=>{const r=await navigator.credentials.get({publicKey:{challenge:c,rpId:f.dataset.rpId,userVerification:"preferred"}});`+
+	`f.credentialId.value=b(r.rawId);f.clientDataJSON.value=b(r.response.clientDataJSON);f.authenticatorData.value=b(r.response.authenticatorData);f.signature.value=b(r.response.signature)})</script>`)
+
+var webauthnRegisterHtml = newPageTemplate("webauthnRegisterTemplate", `{{if .Error}}<div class="login-box-error">{{.Error}}</div>{{end}} <div class="login-box-error" id="webauthn-error" hidden></div> {{if .Message}}<div class="login-box-message">{{.Message}}</div>{{else if .Challenge}}<form class="login-box-form" id="webauthn-form" method="post" data-challenge="{{.Challenge}}" data-rp-id="{{.RPID}}" data-username="{{.Username}}" data-user-handle="{{.UserHandle}}"> <div class="login-box-message">New passkey for <b>{{.Username}}</b></div> <input type="hidden" name="invite" value="{{.Invite}}"> <input type="hidden" name="clientDataJSON"> <input type="hidden" name="attestationObject"> <button class="btn" type="submit" autofocus>{{.Submit}}</button> </form>{{end}} <script>`+webauthnScript+
+	`run(async c=>{const u=f.dataset.username,r=await navigator.credentials.create({publicKey:{challenge:c,rp:{id:f.dataset.rpId,name:f.dataset.rpId},user:{id:d(f.dataset.userHandle),name:u,displayName:u},`+
+	`pubKeyCredParams:[{type:"public-key",alg:-7},{type:"public-key",alg:-8},{type:"public-key",alg:-257}],authenticatorSelection:{residentKey:"required",userVerification:"preferred"},attestation:"none"}});`+
+	`f.clientDataJSON.value=b(r.response.clientDataJSON);f.attestationObject.value=b(r.response.attestationObject)})</script>`)
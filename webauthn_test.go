@@ -0,0 +1,207 @@
+package traefikgothauth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"github.com/markbates/goth"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// cborEncodeTest encodes the CBOR values used by authenticators.
+func cborEncodeTest(value interface{}) []byte {
+	head := func(major byte, arg int) []byte {
+		switch {
+		case arg < 24:
+			return []byte{major<<5 | byte(arg)}
+		case arg < 256:
+			return []byte{major<<5 | 24, byte(arg)}
+		}
+		return []byte{major<<5 | 25, byte(arg >> 8), byte(arg)}
+	}
+	switch v := value.(type) {
+	case int:
+		if v < 0 {
+			return head(1, -1-v)
+		}
+		return head(0, v)
+	case string:
+		return append(head(3, len(v)), v...)
+	case []byte:
+		return append(head(2, len(v)), v...)
+	case map[interface{}]interface{}:
+		keys := make([]string, 0, len(v)) // Sorted for deterministic output
+		encoded := map[string][]byte{}
+		for key, item := range v {
+			k := string(cborEncodeTest(key))
+			keys, encoded[k] = append(keys, k), cborEncodeTest(item)
+		}
+		sort.Strings(keys)
+		out := head(5, len(v))
+		for _, k := range keys {
+			out = append(append(out, k...), encoded[k]...)
+		}
+		return out
+	}
+	panic("unsupported type")
+}
+
+// webauthnTestAuthenticator simulates a platform authenticator with a single ES256 passkey.
+type webauthnTestAuthenticator struct {
+	key       *ecdsa.PrivateKey
+	id        []byte
+	rpID      string
+	origin    string
+	signCount uint32
+}
+
+func (a *webauthnTestAuthenticator) authData(flags byte, attested []byte) []byte {
+	rpIDHash := sha256.Sum256([]byte(a.rpID))
+	data := append(rpIDHash[:], flags)
+	data = binary.BigEndian.AppendUint32(data, a.signCount)
+	return append(data, attested...)
+}
+
+func (a *webauthnTestAuthenticator) clientData(typ, challenge string) []byte {
+	b, _ := json.Marshal(map[string]string{"type": typ, "challenge": base64.RawURLEncoding.EncodeToString([]byte(challenge)), "origin": a.origin})
+	return b
+}
+
+func (a *webauthnTestAuthenticator) create(challenge string) url.Values {
+	publicKey := cborEncodeTest(map[interface{}]interface{}{
+		1: 2, 3: coseAlgES256, -1: 1, -2: a.key.X.FillBytes(make([]byte, 32)), -3: a.key.Y.FillBytes(make([]byte, 32)),
+	})
+	attested := append(make([]byte, 16), byte(len(a.id)>>8), byte(len(a.id)))
+	attested = append(append(attested, a.id...), publicKey...)
+	attestation := cborEncodeTest(map[interface{}]interface{}{
+		"fmt": "none", "attStmt": map[interface{}]interface{}{}, "authData": a.authData(webauthnFlagUserPresent|webauthnFlagAttestedData, attested),
+	})
+	return url.Values{
+		"clientDataJSON":    {base64.RawURLEncoding.EncodeToString(a.clientData("webauthn.create", challenge))},
+		"attestationObject": {base64.RawURLEncoding.EncodeToString(attestation)},
+	}
+}
+
+func (a *webauthnTestAuthenticator) get(challenge string) url.Values {
+	a.signCount++
+	authData := a.authData(webauthnFlagUserPresent, nil)
+	clientData := a.clientData("webauthn.get", challenge)
+	clientDataHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(authData, clientDataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		panic(err)
+	}
+	return url.Values{
+		"credentialId":      {base64.RawURLEncoding.EncodeToString(a.id)},
+		"clientDataJSON":    {base64.RawURLEncoding.EncodeToString(clientData)},
+		"authenticatorData": {base64.RawURLEncoding.EncodeToString(authData)},
+		"signature":         {base64.RawURLEncoding.EncodeToString(signature)},
+	}
+}
+
+var webauthnChallengeAttribute = regexp.MustCompile(`data-challenge="([^"]+)"`)
+
+func TestWebauthnRegisterAndLogin(t *testing.T) {
+	p, err := newWebauthnProvider("secret", "https://auth.example.com/__goth/webauthn/", map[string]interface{}{
+		"credentialsFile": filepath.Join(t.TempDir(), "passkeys.json"),
+		"rpID":            "example.com",
+		"invites":         map[string]string{"invite-code": "alice"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authenticator := &webauthnTestAuthenticator{key: key, id: []byte("credential-1"), rpID: "example.com", origin: "https://app.example.com"}
+
+	// Register with the invite
+	registerURL := p.registerPath() + "?invite=invite-code"
+	rw := httptest.NewRecorder()
+	if !p.ServeLoginPage(rw, httptest.NewRequest(http.MethodGet, registerURL, nil)) || rw.Code != http.StatusOK {
+		t.Fatalf("expected the registration page, got %d", rw.Code)
+	}
+	challenge := webauthnChallengeAttribute.FindStringSubmatch(rw.Body.String())[1]
+	form := authenticator.create(challenge)
+	form.Set("invite", "invite-code")
+	req := httptest.NewRequest(http.MethodPost, p.registerPath(), strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rw = httptest.NewRecorder()
+	p.ServeLoginPage(rw, req)
+	if rw.Code != http.StatusOK || !strings.Contains(rw.Body.String(), "registered") {
+		t.Fatalf("expected the passkey to be registered, got %d: %s", rw.Code, rw.Body.String())
+	}
+	rw = httptest.NewRecorder()
+	if p.ServeLoginPage(rw, httptest.NewRequest(http.MethodGet, registerURL, nil)); rw.Code != http.StatusForbidden {
+		t.Fatalf("expected the invite to be single-use, got %d", rw.Code)
+	}
+
+	// Log in
+	loginChallenge, err := signToken(p.challengeKey, "webauthn-login", time.Minute, "state-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	form = authenticator.get(loginChallenge)
+	form.Set("state", "state-1")
+	user, err := p.verify(nil, form)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.UserID != "alice" {
+		t.Fatalf("unexpected user: %+v", user)
+	}
+	if _, err = p.verify(nil, form); err == nil {
+		t.Fatal("expected the replayed assertion to be rejected")
+	}
+	form = authenticator.get(loginChallenge)
+	form.Set("state", "state-2")
+	if _, err = p.verify(nil, form); err == nil {
+		t.Fatal("expected the challenge of another login to be rejected")
+	}
+	authenticator.origin = "https://example.org"
+	form = authenticator.get(loginChallenge)
+	form.Set("state", "state-1")
+	if _, err = p.verify(nil, form); err == nil {
+		t.Fatal("expected the foreign origin to be rejected")
+	}
+
+	// Users authenticated by another provider register passkeys for their identity at that provider, once per challenge
+	bob := &goth.User{UserID: "123", Email: "bob@example.com"}
+	rw = httptest.NewRecorder()
+	if !p.ServeAuthenticatedPage(rw, httptest.NewRequest(http.MethodGet, p.registerPath(), nil), "github", bob) ||
+		!strings.Contains(rw.Body.String(), "github:123") {
+		t.Fatalf("expected the registration page for bob, got %d: %s", rw.Code, rw.Body.String())
+	}
+	challenge = webauthnChallengeAttribute.FindStringSubmatch(rw.Body.String())[1]
+	for i, expected := range []int{http.StatusOK, http.StatusBadRequest} {
+		authenticator = &webauthnTestAuthenticator{key: key, id: []byte("credential-bob-" + strconv.Itoa(i)), rpID: "example.com", origin: "https://app.example.com"}
+		req = httptest.NewRequest(http.MethodPost, p.registerPath(), strings.NewReader(authenticator.create(challenge).Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rw = httptest.NewRecorder()
+		if p.ServeAuthenticatedPage(rw, req, "github", bob); rw.Code != expected {
+			t.Fatalf("expected registration %d to respond %d, got %d: %s", i, expected, rw.Code, rw.Body.String())
+		}
+	}
+	data := &webauthnData{}
+	if err = p.store.read(data); err != nil {
+		t.Fatal(err)
+	}
+	if len(data.Credentials) != 2 || data.Credentials[1].Username != "github:123" || data.Credentials[1].Email != "bob@example.com" {
+		t.Fatalf("expected the passkey of bob to be registered for their identity, got %+v", data.Credentials)
+	}
+}